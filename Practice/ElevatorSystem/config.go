@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// buildingConfig describes the building and its bank of elevators. Floors above
+// ground are numbered 1..numberOfFloors and basements -1..-numberOfBasements;
+// there is no floor 0. Every car has to stop at the fire recall floor, which
+// defaults to floor 1. Generated traffic enters and leaves through the lobby
+// floor, which also defaults to floor 1.
+type buildingConfig struct {
+	NumberOfFloors    int              `json:"numberOfFloors"`
+	NumberOfBasements int              `json:"numberOfBasements"`
+	FireRecallFloor   int              `json:"fireRecallFloor"`
+	LobbyFloor        int              `json:"lobbyFloor"`
+	Elevators         []elevatorConfig `json:"elevators"`
+}
+
+// elevatorConfig describes a single car. An empty servedFloors list means the
+// car stops at every floor; express and service cars list only the floors they
+// stop at.
+type elevatorConfig struct {
+	CapacityInKG      int   `json:"capacityInKG"`
+	CapacityInPax     int   `json:"capacityInPax"`
+	FloorTravelMillis int   `json:"floorTravelMillis"`
+	DoorDwellMillis   int   `json:"doorDwellMillis"`
+	StartingFloor     int   `json:"startingFloor"`
+	ServedFloors      []int `json:"servedFloors"`
+}
+
+func loadBuildingConfig(path string) (buildingConfig, error) {
+	var cfg buildingConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("reading building config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing building config %s: %w", path, err)
+	}
+	if cfg.FireRecallFloor == 0 {
+		cfg.FireRecallFloor = 1
+	}
+	if cfg.LobbyFloor == 0 {
+		cfg.LobbyFloor = 1
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func (d buildingConfig) validate() error {
+	if d.NumberOfFloors < 1 {
+		return errors.New("building needs at least one floor above ground")
+	}
+	if d.NumberOfBasements < 0 {
+		return errors.New("number of basements cannot be negative")
+	}
+	if len(d.Elevators) == 0 {
+		return errors.New("building needs at least one elevator")
+	}
+
+	plan := d.floorPlan()
+	if err := plan.validateFloor(d.FireRecallFloor); err != nil {
+		return fmt.Errorf("fire recall floor: %w", err)
+	}
+	if err := plan.validateFloor(d.LobbyFloor); err != nil {
+		return fmt.Errorf("lobby floor: %w", err)
+	}
+	for i, e := range d.Elevators {
+		elevatorNumber := i + 1
+		if e.CapacityInKG <= 0 || e.CapacityInPax <= 0 {
+			return fmt.Errorf("elevator %d: capacities must be positive", elevatorNumber)
+		}
+		if e.FloorTravelMillis <= 0 {
+			return fmt.Errorf("elevator %d: floorTravelMillis must be positive", elevatorNumber)
+		}
+		if e.DoorDwellMillis <= 0 {
+			return fmt.Errorf("elevator %d: doorDwellMillis must be positive", elevatorNumber)
+		}
+		if err := plan.validateFloor(e.StartingFloor); err != nil {
+			return fmt.Errorf("elevator %d starting floor: %w", elevatorNumber, err)
+		}
+		for _, f := range e.ServedFloors {
+			if err := plan.validateFloor(f); err != nil {
+				return fmt.Errorf("elevator %d served floors: %w", elevatorNumber, err)
+			}
+		}
+		if len(e.ServedFloors) > 0 && !containsFloor(e.ServedFloors, e.StartingFloor) {
+			return fmt.Errorf("elevator %d starts at floor %d which it does not serve", elevatorNumber, e.StartingFloor)
+		}
+		if len(e.ServedFloors) > 0 && !containsFloor(e.ServedFloors, d.FireRecallFloor) {
+			return fmt.Errorf("elevator %d does not stop at fire recall floor %d", elevatorNumber, d.FireRecallFloor)
+		}
+	}
+	return nil
+}
+
+func (d buildingConfig) floorPlan() floorPlan {
+	return floorPlan{lowest: -d.NumberOfBasements, highest: d.NumberOfFloors}
+}
+
+func containsFloor(floors []int, floorNumber int) bool {
+	for _, f := range floors {
+		if f == floorNumber {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+// dispatchStrategy decides which car answers a hall call. Strategies are
+// called with the system lock held and may read the state of every candidate.
+type dispatchStrategy interface {
+	name() string
+	selectElevator(candidates []*elevator, call hallCall, plan floorPlan) *elevator
+}
+
+// firstIdleStrategy sends the first idle car, or the first car when all are
+// busy. It is the behaviour the controller started with and the baseline the
+// other strategies are compared against.
+type firstIdleStrategy struct{}
+
+func (d *firstIdleStrategy) name() string {
+	return "first-idle"
+}
+
+func (d *firstIdleStrategy) selectElevator(candidates []*elevator, call hallCall, plan floorPlan) *elevator {
+	for _, e := range candidates {
+		if !e.hasCalls() {
+			return e
+		}
+	}
+	return candidates[0]
+}
+
+// nearestCarStrategy sends the car that will reach the caller soonest: idle
+// cars and cars already heading towards the floor in the requested direction
+// cost their distance, every other car pays for a full sweep first.
+type nearestCarStrategy struct{}
+
+func (d *nearestCarStrategy) name() string {
+	return "nearest-car"
+}
+
+func (d *nearestCarStrategy) selectElevator(candidates []*elevator, call hallCall, plan floorPlan) *elevator {
+	sweep := plan.distance(plan.lowestFloor(), plan.highest)
+	var best *elevator
+	bestCost := 0
+	for _, e := range candidates {
+		cost := plan.distance(e.currentFloor, call.floorNumber)
+		if e.hasCalls() && !e.isApproaching(call) {
+			cost += 2 * sweep
+		}
+		if best == nil || cost < bestCost {
+			best = e
+			bestCost = cost
+		}
+	}
+	return best
+}
+
+// leastLoadedStrategy spreads calls across the bank by sending the car with
+// the fewest pending calls, breaking ties by distance.
+type leastLoadedStrategy struct{}
+
+func (d *leastLoadedStrategy) name() string {
+	return "least-loaded"
+}
+
+func (d *leastLoadedStrategy) selectElevator(candidates []*elevator, call hallCall, plan floorPlan) *elevator {
+	var best *elevator
+	for _, e := range candidates {
+		if best == nil {
+			best = e
+			continue
+		}
+		load, bestLoad := e.pendingCalls(), best.pendingCalls()
+		if load < bestLoad || (load == bestLoad && plan.distance(e.currentFloor, call.floorNumber) < plan.distance(best.currentFloor, call.floorNumber)) {
+			best = e
+		}
+	}
+	return best
+}
+
+// isApproaching reports whether the car is travelling in the call's direction
+// and has not yet passed the calling floor.
+func (d *elevator) isApproaching(call hallCall) bool {
+	if d.direction != call.direction {
+		return false
+	}
+	if d.direction == "up" {
+		return d.currentFloor <= call.floorNumber
+	}
+	return d.currentFloor >= call.floorNumber
+}
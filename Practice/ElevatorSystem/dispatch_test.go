@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func testCar(elevatorNumber, currentFloor int, direction string, carCalls ...int) *elevator {
+	e := &elevator{
+		elevatorNumber: elevatorNumber,
+		currentFloor:   currentFloor,
+		direction:      direction,
+		carCalls:       make(map[int][]chan error),
+		hallCalls:      make(map[hallCall][]*passenger),
+	}
+	for _, f := range carCalls {
+		e.carCalls[f] = nil
+	}
+	return e
+}
+
+func TestNearestCar(t *testing.T) {
+	plan := floorPlan{lowest: -2, highest: 15}
+	tests := []struct {
+		name string
+		cars []*elevator
+		call hallCall
+		want int
+	}{
+		{"closest idle car", []*elevator{testCar(1, 1, ""), testCar(2, 8, "")}, hallCall{6, "up"}, 2},
+		{"across the missing floor 0", []*elevator{testCar(1, -2, ""), testCar(2, 4, "")}, hallCall{1, "up"}, 1},
+		{"car already on its way", []*elevator{testCar(1, 3, "up", 12), testCar(2, 13, "")}, hallCall{7, "up"}, 1},
+		{"car going the other way", []*elevator{testCar(1, 6, "down", 1), testCar(2, 12, "")}, hallCall{7, "up"}, 2},
+		{"car that passed the floor", []*elevator{testCar(1, 9, "up", 12), testCar(2, 15, "")}, hallCall{7, "up"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (&nearestCarStrategy{}).selectElevator(tt.cars, tt.call, plan); got.elevatorNumber != tt.want {
+				t.Fatalf("got elevator %d, want %d", got.elevatorNumber, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeastLoaded(t *testing.T) {
+	plan := floorPlan{lowest: 1, highest: 15}
+	tests := []struct {
+		name string
+		cars []*elevator
+		call hallCall
+		want int
+	}{
+		{"fewest calls", []*elevator{testCar(1, 5, "up", 6, 7), testCar(2, 15, "down", 1)}, hallCall{5, "up"}, 2},
+		{"tie broken by distance", []*elevator{testCar(1, 1, "up", 9), testCar(2, 10, "down", 2)}, hallCall{8, "down"}, 2},
+		{"idle beats busy", []*elevator{testCar(1, 7, "up", 8), testCar(2, 1, "")}, hallCall{7, "up"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (&leastLoadedStrategy{}).selectElevator(tt.cars, tt.call, plan); got.elevatorNumber != tt.want {
+				t.Fatalf("got elevator %d, want %d", got.elevatorNumber, tt.want)
+			}
+		})
+	}
+}
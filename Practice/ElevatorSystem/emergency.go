@@ -0,0 +1,164 @@
+package main
+
+import "fmt"
+
+// Emergency operation. A fire recall cancels every call and sends each car in
+// normal service to the fire recall floor, where it waits with its doors open.
+// Cars in independent service (the fire-service key switch) are left to the
+// firefighters: they never answer hall calls and only follow their own panel.
+// On power failure every car stops at the next floor it reaches, opens its
+// doors and parks until power is restored.
+
+func (d *elevatorSystemControl) triggerFireRecall() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch d.mode {
+	case "FIRE_RECALL":
+		return nil
+	case "POWER_FAILURE":
+		return fmt.Errorf("%w: cars cannot be recalled without power", errPowerFailure)
+	}
+	d.logf("[EMERGENCY] Fire recall: all cars returning to floor %d\n", d.fireRecallFloor)
+	d.mode = "FIRE_RECALL"
+	for _, e := range d.elevators {
+		if d.isRecalled(e) {
+			e.failCalls(errFireRecall)
+		}
+	}
+	d.cond.Broadcast()
+	return nil
+}
+
+func (d *elevatorSystemControl) cancelFireRecall() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mode != "FIRE_RECALL" {
+		return
+	}
+	d.logf("[EMERGENCY] Fire recall cancelled, returning to normal service\n")
+	d.mode = "NORMAL"
+	d.releaseParkedElevators("RECALLED")
+}
+
+// setIndependentService switches a car in or out of independent service.
+func (d *elevatorSystemControl) setIndependentService(elevatorNumber int, enabled bool) error {
+	mode := "NORMAL"
+	if enabled {
+		mode = "INDEPENDENT"
+	}
+	return d.setServiceMode(elevatorNumber, mode)
+}
+
+// reassignHallCalls moves the passengers waiting for a car that stopped
+// answering hall calls to the cars the dispatch strategy picks instead.
+func (d *elevatorSystemControl) reassignHallCalls(from *elevator) {
+	for call, waiting := range from.hallCalls {
+		delete(from.hallCalls, call)
+		// each passenger needs a car that goes where they are going and can carry them
+		for _, p := range waiting {
+			candidates := d.candidates(call.floorNumber, p.destination, p.weightKG)
+			if len(candidates) == 0 {
+				failPassengers([]*passenger{p}, fmt.Errorf("%w: for %s call at floor %d", errNoElevatorAvailable, call.direction, call.floorNumber))
+				continue
+			}
+			to := d.strategy.selectElevator(candidates, call, d.plan)
+			to.hallCalls[call] = append(to.hallCalls[call], p)
+			d.logf("elevator control system reassigned passenger %d on the %s call at floor %d from elevator %d to elevator %d\n", p.id, call.direction, call.floorNumber, from.elevatorNumber, to.elevatorNumber)
+		}
+	}
+}
+
+func (d *elevatorSystemControl) powerFailure() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mode == "POWER_FAILURE" {
+		return
+	}
+	d.logf("[EMERGENCY] Power failure: parking all cars at the nearest floor\n")
+	d.mode = "POWER_FAILURE"
+	for _, e := range d.elevators {
+		e.failCalls(errPowerFailure)
+	}
+	d.cond.Broadcast()
+}
+
+// restorePower resumes normal service. A fire recall interrupted by the power
+// failure is not resumed and has to be triggered again.
+func (d *elevatorSystemControl) restorePower() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mode != "POWER_FAILURE" {
+		return
+	}
+	d.logf("[EMERGENCY] Power restored, returning to normal service\n")
+	d.mode = "NORMAL"
+	d.releaseParkedElevators("PARKED")
+}
+
+// awaitEmergencyStop blocks until every car affected by the current emergency
+// has reached its parking position with its doors open.
+func (d *elevatorSystemControl) awaitEmergencyStop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for !d.stopped && !d.emergencySettled() {
+		d.cond.Wait()
+	}
+}
+
+func (d *elevatorSystemControl) emergencySettled() bool {
+	for _, e := range d.elevators {
+		if d.mode == "POWER_FAILURE" && e.status != "PARKED" {
+			return false
+		}
+		if d.isRecalled(e) && e.status != "RECALLED" {
+			return false
+		}
+	}
+	return true
+}
+
+// hasWork reports whether the car controller has anything to do.
+func (d *elevatorSystemControl) hasWork(e *elevator) bool {
+	switch {
+	case d.mode == "POWER_FAILURE":
+		return e.status != "PARKED"
+	case d.isRecalled(e):
+		return e.status != "RECALLED"
+	}
+	return e.hasCallsToServe()
+}
+
+func (d *elevatorSystemControl) isRecalled(e *elevator) bool {
+	return d.mode == "FIRE_RECALL" && e.serviceMode != "INDEPENDENT"
+}
+
+// parkElevator is called once the car stands at a floor after a power failure;
+// the car only ever stops between moves, so this is the nearest floor.
+func (d *elevatorSystemControl) parkElevator(e *elevator) {
+	e.door.openDoor()
+	d.evacuatePassengers(e)
+	e.status = "PARKED"
+	e.direction = ""
+	d.logf("Elevator %d parked at floor %d with doors open\n", e.elevatorNumber, e.currentFloor)
+	d.cond.Broadcast()
+}
+
+func (d *elevatorSystemControl) recallElevator(e *elevator) {
+	e.door.openDoor()
+	d.evacuatePassengers(e)
+	e.status = "RECALLED"
+	e.direction = ""
+	d.logf("Elevator %d recalled to floor %d with doors open\n", e.elevatorNumber, e.currentFloor)
+	d.cond.Broadcast()
+}
+
+func (d *elevatorSystemControl) releaseParkedElevators(status string) {
+	for _, e := range d.elevators {
+		if e.status == status {
+			e.door.closeDoor()
+			e.status = "IDLE"
+			d.logf("Closing door of elevator %d\n", e.elevatorNumber)
+		}
+	}
+	d.cond.Broadcast()
+}
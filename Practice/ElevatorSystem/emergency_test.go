@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func stateOf(t *testing.T, b *building, elevatorNumber int) carState {
+	t.Helper()
+	return b.system.carStates()[elevatorNumber-1]
+}
+
+func TestFireRecall(t *testing.T) {
+	b := newTestBuilding(t)
+	panel, _ := b.getFloorPanel(4)
+	// a rider picked up at floor 4 by the local car is on the way up when the alarm goes off
+	insidePanel, err := panel.requestFloor(4, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.system.setIndependentService(2, true)
+
+	if err := b.system.triggerFireRecall(); err != nil {
+		t.Fatal(err)
+	}
+	b.system.awaitEmergencyStop()
+	if car := stateOf(t, b, 1); car.Status != "RECALLED" || car.CurrentFloor != 1 || !car.DoorOpen {
+		t.Fatalf("local car is %s at floor %d, want recalled to floor 1 with doors open", car.Status, car.CurrentFloor)
+	}
+	if j := onlyJourney(t, b); j.status != "EVACUATED" || j.arrivalFloor != 1 {
+		t.Fatalf("got journey %+v, want the rider evacuated at floor 1", j)
+	}
+	if err := insidePanel.goToFloor(6); err == nil {
+		t.Fatal("an evacuated rider's car panel still works")
+	}
+	if _, err := panel.requestFloor(4, 1); !errors.Is(err, errFireRecall) {
+		t.Fatalf("hall call during recall: got %v, want %v", err, errFireRecall)
+	}
+	// the firefighters' car is left alone and follows its own panel
+	if car := stateOf(t, b, 2); car.Status == "RECALLED" {
+		t.Fatal("a car in independent service was recalled")
+	}
+	firefighters := b.system.elevators[1].getInsideControlPanel()
+	if err := firefighters.goToFloor(6); err != nil {
+		t.Fatalf("independent car during recall: %v", err)
+	}
+
+	b.system.cancelFireRecall()
+	if car := stateOf(t, b, 1); car.Status != "IDLE" || car.DoorOpen {
+		t.Fatalf("local car is %s after the recall, want idle with doors closed", car.Status)
+	}
+	if _, err := panel.requestFloor(4, 1); err != nil {
+		t.Fatalf("hall call after the recall: %v", err)
+	}
+}
+
+func TestPowerFailure(t *testing.T) {
+	b := newTestBuilding(t)
+	b.system.powerFailure()
+	b.system.awaitEmergencyStop()
+	for _, car := range b.system.carStates() {
+		if car.Status != "PARKED" || !car.DoorOpen {
+			t.Fatalf("elevator %d is %s, want parked with doors open", car.ElevatorNumber, car.Status)
+		}
+	}
+	panel, _ := b.getFloorPanel(1)
+	if _, err := panel.requestFloor(1, 4); !errors.Is(err, errPowerFailure) {
+		t.Fatalf("hall call without power: got %v, want %v", err, errPowerFailure)
+	}
+	if err := b.system.triggerFireRecall(); !errors.Is(err, errPowerFailure) {
+		t.Fatalf("recall without power: got %v, want %v", err, errPowerFailure)
+	}
+	// power failure wins over fire recall, and a recall is not resumed after it
+	if b.system.state().Mode != "POWER_FAILURE" {
+		t.Fatalf("mode is %s, want POWER_FAILURE", b.system.state().Mode)
+	}
+
+	b.system.restorePower()
+	if mode := b.system.state().Mode; mode != "NORMAL" {
+		t.Fatalf("mode is %s after power came back, want NORMAL", mode)
+	}
+	if _, err := panel.requestFloor(1, 4); err != nil {
+		t.Fatalf("hall call after power came back: %v", err)
+	}
+}
+
+func TestPowerFailureDuringRecall(t *testing.T) {
+	b := newTestBuilding(t)
+	if err := b.system.triggerFireRecall(); err != nil {
+		t.Fatal(err)
+	}
+	b.system.powerFailure()
+	b.system.awaitEmergencyStop()
+	b.system.restorePower()
+	if mode := b.system.state().Mode; mode != "NORMAL" {
+		t.Fatalf("mode is %s, want the recall not to resume", mode)
+	}
+}
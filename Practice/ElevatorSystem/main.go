@@ -5,41 +5,145 @@ Question - https://www.geeksforgeeks.org/system-design/elevator-system-low-level
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
+var (
+	errInvalidFloor          = errors.New("invalid floor")
+	errFloorNotServed        = errors.New("floor not served by elevator")
+	errInvalidElevatorNumber = errors.New("invalid elevator number")
+	errSystemStopped         = errors.New("elevator system stopped")
+	errNoElevatorAvailable   = errors.New("no elevator available")
+	errFireRecall            = errors.New("fire recall in progress")
+	errPowerFailure          = errors.New("power failure")
+	errOutOfService          = errors.New("elevator out of service")
+	errFloorLocked           = errors.New("floor locked")
+	errInvalidWeight         = errors.New("invalid passenger weight")
+)
+
+// floorPlan knows which floor numbers exist in the building. Basements are
+// negative and there is no floor 0, so moving from -1 to 1 is a single floor.
+type floorPlan struct {
+	lowest  int
+	highest int
+}
+
+func (d floorPlan) validateFloor(floorNumber int) error {
+	if floorNumber == 0 || floorNumber < d.lowest || floorNumber > d.highest {
+		return fmt.Errorf("%w: %d (building has floors %d to %d)", errInvalidFloor, floorNumber, d.lowestFloor(), d.highest)
+	}
+	return nil
+}
+
+func (d floorPlan) lowestFloor() int {
+	if d.lowest == 0 {
+		return 1
+	}
+	return d.lowest
+}
+
+func (d floorPlan) distance(from, to int) int {
+	floors := to - from
+	if floors < 0 {
+		floors = -floors
+	}
+	if (from < 0) != (to < 0) {
+		floors-- // skip the missing floor 0
+	}
+	return floors
+}
+
+func (d floorPlan) nextFloor(currentFloor int, direction string) int {
+	next := currentFloor + 1
+	if direction == "down" {
+		next = currentFloor - 1
+	}
+	if next == 0 {
+		if direction == "down" {
+			return -1
+		}
+		return 1
+	}
+	return next
+}
+
 type building struct {
-	numberOfFloors int
-	floors         []floor
+	config    buildingConfig
+	strategy  dispatchStrategy // nearest car when nil
+	timeScale float64          // 1 runs in real time, 60 runs a building minute per second
+	quiet     bool
+	plan      floorPlan
+	system    *elevatorSystemControl
+	floors    []floor
 }
 
 func (d *building) initialise() {
-	fmt.Println("Intializing building with", d.numberOfFloors, "floors")
+	if !d.quiet {
+		fmt.Println("Intializing building with", d.config.NumberOfFloors, "floors and", d.config.NumberOfBasements, "basements")
+	}
+	d.plan = d.config.floorPlan()
 
-	esc := &elevatorSystemControl{numberOfElevator: 3}
-	esc.initialise()
+	strategy := d.strategy
+	if strategy == nil {
+		strategy = &nearestCarStrategy{}
+	}
+	timeScale := d.timeScale
+	if timeScale <= 0 {
+		timeScale = 1
+	}
+	esc := &elevatorSystemControl{
+		numberOfElevator: len(d.config.Elevators),
+		plan:             d.plan,
+		strategy:         strategy,
+		clock:            newSimClock(timeScale),
+		quiet:            d.quiet,
+		mode:             "NORMAL",
+		fireRecallFloor:  d.config.FireRecallFloor,
+		lockedFloors:     make(map[int]bool),
+		events:           newEventLog(200),
+	}
+	esc.initialise(d.config.Elevators)
+	d.system = esc
 
 	var floors []floor
-	for i := 0; i < d.numberOfFloors; i++ {
-		f := floor{
-			floorNumber: i + 1,
+	for f := d.plan.lowestFloor(); f <= d.plan.highest; f++ {
+		if f == 0 {
+			continue
+		}
+		floors = append(floors, floor{
+			floorNumber: f,
 			panel: outsideControlPanel{
-				system: esc,
+				floorNumber: f,
+				system:      esc,
 			},
-		}
-		floors = append(floors, f)
+		})
 	}
 	d.floors = floors
 
 }
 
-func (d *building) getFloorPanel(floorNumber int) outsideControlPanel {
-	if floorNumber > d.numberOfFloors {
-		fmt.Println("Number of floor is more than the actual floor in the building")
+// shutdown stops the car controllers once all rides have finished.
+func (d *building) shutdown() {
+	d.system.shutdown()
+}
+
+func (d *building) getFloorPanel(floorNumber int) (outsideControlPanel, error) {
+	if err := d.plan.validateFloor(floorNumber); err != nil {
+		return outsideControlPanel{}, err
 	}
-	return d.floors[floorNumber-1].panel
+	for _, f := range d.floors {
+		if f.floorNumber == floorNumber {
+			return f.panel, nil
+		}
+	}
+	return outsideControlPanel{}, fmt.Errorf("%w: %d", errInvalidFloor, floorNumber)
 }
 
 type floor struct {
@@ -48,19 +152,70 @@ type floor struct {
 }
 
 type outsideControlPanel struct {
-	display externalDisplay
-	system  *elevatorSystemControl
+	floorNumber int
+	display     externalDisplay
+	system      *elevatorSystemControl
 }
 
-func (d *outsideControlPanel) goDown(currentFloor int) insideControlPanel {
-	fmt.Println("Outside Control Panel of floor:", currentFloor, " is used to go up")
-	return d.system.callElevator(currentFloor, "down")
+func (d *outsideControlPanel) goDown(currentFloor int) (insideControlPanel, error) {
+	if err := d.checkFloor(currentFloor); err != nil {
+		return insideControlPanel{}, err
+	}
+	d.system.logf("Outside Control Panel of floor: %d is used to go down\n", currentFloor)
+	if currentFloor == d.system.plan.lowestFloor() {
+		return insideControlPanel{}, fmt.Errorf("%w: cannot go down from the lowest floor %d", errInvalidFloor, currentFloor)
+	}
+	return d.system.callElevator(currentFloor, 0, defaultPassengerWeightKG, "down")
+}
+
+func (d *outsideControlPanel) goUp(currentFloor int) (insideControlPanel, error) {
+	if err := d.checkFloor(currentFloor); err != nil {
+		return insideControlPanel{}, err
+	}
+	d.system.logf("Outside Control Panel of floor: %d is used to go up\n", currentFloor)
+	if currentFloor == d.system.plan.highest {
+		return insideControlPanel{}, fmt.Errorf("%w: cannot go up from the top floor %d", errInvalidFloor, currentFloor)
+	}
+	return d.system.callElevator(currentFloor, 0, defaultPassengerWeightKG, "up")
+
 }
 
-func (d *outsideControlPanel) goUp(currentFloor int) insideControlPanel {
-	fmt.Println("Outside Control Panel of floor:", currentFloor, " is used to go down")
-	return d.system.callElevator(currentFloor, "up")
+// requestFloor is the destination-dispatch keypad: the passenger enters where
+// they want to go, so only cars stopping at both floors are considered.
+func (d *outsideControlPanel) requestFloor(currentFloor, destinationFloor int) (insideControlPanel, error) {
+	return d.requestFloorWithWeight(currentFloor, destinationFloor, defaultPassengerWeightKG)
+}
+
+// requestFloorWithWeight is requestFloor for a passenger whose weight is known,
+// such as one carrying luggage, so the car load is tracked accurately.
+func (d *outsideControlPanel) requestFloorWithWeight(currentFloor, destinationFloor, weightKG int) (insideControlPanel, error) {
+	if err := d.checkFloor(currentFloor); err != nil {
+		return insideControlPanel{}, err
+	}
+	d.system.logf("Outside Control Panel of floor: %d is used to request floor %d\n", currentFloor, destinationFloor)
+	if err := d.system.plan.validateFloor(destinationFloor); err != nil {
+		return insideControlPanel{}, err
+	}
+	if destinationFloor == currentFloor {
+		return insideControlPanel{}, fmt.Errorf("%w: already at floor %d", errInvalidFloor, currentFloor)
+	}
+	direction := "up"
+	if destinationFloor < currentFloor {
+		direction = "down"
+	}
+	return d.system.callElevator(currentFloor, destinationFloor, weightKG, direction)
+}
 
+// checkFloor rejects calls made from a panel with a floor number other than
+// the one the panel is installed on.
+func (d *outsideControlPanel) checkFloor(currentFloor int) error {
+	if d.system == nil {
+		return errors.New("outside control panel is not connected to an elevator system")
+	}
+	if currentFloor != d.floorNumber {
+		return fmt.Errorf("%w: panel of floor %d used for floor %d", errInvalidFloor, d.floorNumber, currentFloor)
+	}
+	return nil
 }
 
 type externalDisplay struct {
@@ -68,100 +223,517 @@ type externalDisplay struct {
 	movementDirection string
 }
 
+// simClock lets the same controller run in real time for the demo and many
+// times faster for traffic simulations. All durations handed to or returned
+// from the clock are in building time.
+type simClock struct {
+	start time.Time
+	scale float64
+}
+
+func newSimClock(scale float64) *simClock {
+	return &simClock{start: time.Now(), scale: scale}
+}
+
+func (d *simClock) now() time.Duration {
+	return time.Duration(float64(time.Since(d.start)) * d.scale)
+}
+
+func (d *simClock) sleep(duration time.Duration) {
+	time.Sleep(time.Duration(float64(duration) / d.scale))
+}
+
+// hallCall is a request made from a floor panel, answered by whichever car the
+// dispatch strategy assigns it to.
+type hallCall struct {
+	floorNumber int
+	direction   string
+}
+
 type elevatorSystemControl struct {
 	numberOfElevator int
+	plan             floorPlan
+	strategy         dispatchStrategy
+	clock            *simClock
+	quiet            bool
+	mode             string // NORMAL, FIRE_RECALL or POWER_FAILURE
+	fireRecallFloor  int
+	lockedFloors     map[int]bool
+	events           *eventLog
+	passengers       []*passenger // journey log, in call order
+	nextPassengerID  int
 	elevators        []*elevator
 	mu               sync.Mutex
+	cond             *sync.Cond // signalled whenever a call is added or the system stops
+	stopped          bool
+	wg               sync.WaitGroup
 }
 
-func (d *elevatorSystemControl) initialise() {
-	fmt.Println("Intializing elevator control system with", d.numberOfElevator, "elevators")
+func (d *elevatorSystemControl) initialise(configs []elevatorConfig) {
+	d.logf("Intializing elevator control system with %d elevators using %s dispatch\n", d.numberOfElevator, d.strategy.name())
+	d.cond = sync.NewCond(&d.mu)
 	var elevators []*elevator
-	for i := 0; i < d.numberOfElevator; i++ {
+	for i, c := range configs {
+		var servedFloors map[int]bool
+		if len(c.ServedFloors) > 0 {
+			servedFloors = make(map[int]bool)
+			for _, f := range c.ServedFloors {
+				servedFloors[f] = true
+			}
+		}
 		e := elevator{
-			elevatorNumber: i + 1,
-			capacityInKG:   15,
-			cpacityInPax:   8,
+			elevatorNumber:  i + 1,
+			capacityInKG:    c.CapacityInKG,
+			cpacityInPax:    c.CapacityInPax,
+			floorTravelTime: time.Duration(c.FloorTravelMillis) * time.Millisecond,
+			doorDwellTime:   time.Duration(c.DoorDwellMillis) * time.Millisecond,
+			servedFloors:    servedFloors,
 			panel: insideControlPanel{
 				elevatorNumber: i + 1,
 				system:         d,
 			},
 			door:         door{},
 			status:       "IDLE",
-			currentFloor: 15,
+			serviceMode:  "NORMAL",
+			currentFloor: c.StartingFloor,
+			carCalls:     make(map[int][]chan error),
+			hallCalls:    make(map[hallCall][]*passenger),
 		}
 		elevators = append(elevators, &e)
 	}
 	d.elevators = elevators
+
+	for _, e := range d.elevators {
+		d.wg.Add(1)
+		go d.runElevator(e)
+	}
 }
 
-func (d *elevatorSystemControl) callElevator(currentFloor int, direction string) insideControlPanel {
+// shutdown stops every car controller and fails any calls still waiting.
+func (d *elevatorSystemControl) shutdown() {
+	d.mu.Lock()
+	d.stopped = true
+	for _, e := range d.elevators {
+		e.failCalls(errSystemStopped)
+	}
+	d.cond.Broadcast()
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// callElevator registers a passenger's hall call and blocks until the
+// passenger has boarded a car at currentFloor. destinationFloor is 0 for plain
+// up/down buttons; when it is known only cars that stop there are considered.
+// The returned panel belongs to the car and knows who is pressing its buttons.
+func (d *elevatorSystemControl) callElevator(currentFloor, destinationFloor, weightKG int, direction string) (insideControlPanel, error) {
+	if err := d.plan.validateFloor(currentFloor); err != nil {
+		return insideControlPanel{}, err
+	}
+	if weightKG <= 0 {
+		return insideControlPanel{}, fmt.Errorf("%w: %d kg", errInvalidWeight, weightKG)
+	}
+	// a passenger no car can carry would wait forever
+	if largest := d.largestCapacityKG(currentFloor, destinationFloor); largest > 0 && weightKG > largest {
+		return insideControlPanel{}, fmt.Errorf("%w: %d kg is more than the largest elevator for this trip can carry (%d kg)", errInvalidWeight, weightKG, largest)
+	}
 
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	if err := d.checkAcceptingCalls(nil); err != nil {
+		d.mu.Unlock()
+		return insideControlPanel{}, err
+	}
+	if err := d.checkFloorsUnlocked(currentFloor, destinationFloor); err != nil {
+		d.mu.Unlock()
+		return insideControlPanel{}, err
+	}
 
-	// finding which elevator is idle
-	floorsToMove := 0
+	call := hallCall{floorNumber: currentFloor, direction: direction}
+	var assigned *elevator
+	// join a car that is already answering the same call
 	for _, e := range d.elevators {
-		if e.status == "IDLE" {
-
-			ef := e.getCurrentFloor()
-			floorsToMove = ef - currentFloor
-			if ef < currentFloor {
-				floorsToMove = currentFloor - ef
+		if _, ok := e.hallCalls[call]; ok && e.answersHallCalls() && (destinationFloor == 0 || e.serves(destinationFloor)) && e.canCarry(weightKG) {
+			assigned = e
+			break
+		}
+	}
+	if assigned == nil {
+		candidates := d.candidates(currentFloor, destinationFloor, weightKG)
+		if len(candidates) == 0 {
+			d.mu.Unlock()
+			if d.servingElevatorExists(currentFloor, destinationFloor) {
+				return insideControlPanel{}, fmt.Errorf("%w: every elevator stopping at floor %d is in independent service or out of service", errNoElevatorAvailable, currentFloor)
+			}
+			if destinationFloor != 0 {
+				return insideControlPanel{}, fmt.Errorf("%w: no elevator stops at both floor %d and floor %d", errFloorNotServed, currentFloor, destinationFloor)
 			}
-			e.moveToFloor(floorsToMove, direction)
-			e.door.openDoor(e.elevatorNumber)
-			return e.getInsideControlPanel()
+			return insideControlPanel{}, fmt.Errorf("%w: no elevator stops at floor %d", errFloorNotServed, currentFloor)
+		}
+		assigned = d.strategy.selectElevator(candidates, call, d.plan)
+		d.logf("elevator control system assigned elevator %d to %s call at floor %d\n", assigned.elevatorNumber, direction, currentFloor)
+	}
+	p := d.newPassenger(currentFloor, destinationFloor, weightKG)
+	assigned.hallCalls[call] = append(assigned.hallCalls[call], p)
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	if err := <-p.boarded; err != nil {
+		return insideControlPanel{}, err
+	}
+	// a passenger left behind by a full car may have boarded another one
+	d.mu.Lock()
+	panel := d.elevators[p.elevatorNumber-1].getInsideControlPanel()
+	d.mu.Unlock()
+	panel.rider = p
+	return panel, nil
+
+}
+
+// candidates lists the cars that may be dispatched to a hall call for a
+// passenger of weightKG.
+func (d *elevatorSystemControl) candidates(currentFloor, destinationFloor, weightKG int) []*elevator {
+	var candidates []*elevator
+	for _, e := range d.elevators {
+		if e.answersHallCalls() && e.servesTrip(currentFloor, destinationFloor) && e.canCarry(weightKG) {
+			candidates = append(candidates, e)
+		}
+	}
+	return candidates
+}
+
+// largestCapacityKG is the most any car stopping at both floors can carry,
+// whatever its service mode, or 0 when no car stops at both.
+func (d *elevatorSystemControl) largestCapacityKG(currentFloor, destinationFloor int) int {
+	largest := 0
+	for _, e := range d.elevators {
+		if e.servesTrip(currentFloor, destinationFloor) && e.capacityInKG > largest {
+			largest = e.capacityInKG
+		}
+	}
+	return largest
+}
+
+func (d *elevatorSystemControl) servingElevatorExists(currentFloor, destinationFloor int) bool {
+	for _, e := range d.elevators {
+		if e.servesTrip(currentFloor, destinationFloor) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAcceptingCalls reports why a call cannot be registered right now. Car
+// is nil for hall calls; cars in independent service keep answering their
+// own panel during a fire recall.
+func (d *elevatorSystemControl) checkAcceptingCalls(car *elevator) error {
+	switch {
+	case d.stopped:
+		return errSystemStopped
+	case d.mode == "POWER_FAILURE":
+		return errPowerFailure
+	case car != nil && car.serviceMode == "OUT_OF_SERVICE":
+		return fmt.Errorf("%w: elevator %d", errOutOfService, car.elevatorNumber)
+	case d.mode == "FIRE_RECALL" && (car == nil || car.serviceMode != "INDEPENDENT"):
+		return errFireRecall
+	}
+	return nil
+}
+
+// checkFloorsUnlocked rejects calls from or to a floor locked by an operator.
+func (d *elevatorSystemControl) checkFloorsUnlocked(floors ...int) error {
+	for _, f := range floors {
+		if d.lockedFloors[f] {
+			return fmt.Errorf("%w: %d", errFloorLocked, f)
 		}
 	}
-	return insideControlPanel{}
+	return nil
+}
+
+// goToFloor registers a car call and blocks until the car opens its doors at
+// destinationFloor. rider is the passenger pressing the button, or nil for
+// panels used by firefighters and operators.
+func (d *elevatorSystemControl) goToFloor(elevatorNumber, destinationFloor int, rider *passenger) error {
+	if err := d.plan.validateFloor(destinationFloor); err != nil {
+		return err
+	}
+	e, err := d.getElevator(elevatorNumber)
+	if err != nil {
+		return err
+	}
+	if !e.serves(destinationFloor) {
+		return fmt.Errorf("%w: elevator %d does not stop at floor %d", errFloorNotServed, elevatorNumber, destinationFloor)
+	}
 
+	d.mu.Lock()
+	if err := d.checkAcceptingCalls(e); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	if err := d.checkFloorsUnlocked(destinationFloor); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	if rider != nil {
+		if rider.status == "ARRIVED" && rider.arrivalFloor == destinationFloor {
+			// the car got there before the button was pressed
+			d.mu.Unlock()
+			return nil
+		}
+		if rider.status != "RIDING" || rider.elevatorNumber != elevatorNumber {
+			d.mu.Unlock()
+			return fmt.Errorf("passenger %d is not in elevator %d", rider.id, elevatorNumber)
+		}
+		rider.destination = destinationFloor
+		rider.divertedTo = 0
+	}
+	d.logf("elevator control system is moving elevator %d to floor %d\n", elevatorNumber, destinationFloor)
+	arrived := make(chan error, 1)
+	e.carCalls[destinationFloor] = append(e.carCalls[destinationFloor], arrived)
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	return <-arrived
+}
+
+func (d *elevatorSystemControl) getElevator(elevatorNumber int) (*elevator, error) {
+	if elevatorNumber < 1 || elevatorNumber > len(d.elevators) {
+		return nil, fmt.Errorf("%w: %d", errInvalidElevatorNumber, elevatorNumber)
+	}
+	return d.elevators[elevatorNumber-1], nil
 }
 
-func (d *elevatorSystemControl) goToFloor(elevatorNumber, destinationFloor int) {
+// runElevator is the controller of a single car. It keeps travelling in one
+// direction while there are calls ahead, stopping at every floor with a car
+// call or a hall call in its direction of travel, then reverses. Emergencies
+// override the calls: see emergency.go.
+func (d *elevatorSystemControl) runElevator(e *elevator) {
+	defer d.wg.Done()
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	fmt.Println("elevator control system is moving elevator", elevatorNumber, "to floor", destinationFloor)
 
-	e := d.elevators[elevatorNumber-1]
-	getCurrentFloor := e.getCurrentFloor()
-	direction := "up"
-	floorsToMove := destinationFloor - getCurrentFloor
-	if getCurrentFloor > destinationFloor {
-		direction = "down"
-		floorsToMove = getCurrentFloor - destinationFloor
+	for {
+		for !d.stopped && !d.hasWork(e) {
+			if e.status != "PARKED" && e.status != "RECALLED" {
+				e.status = "IDLE"
+			}
+			e.direction = ""
+			d.cond.Wait()
+		}
+		if d.stopped {
+			return
+		}
+
+		if d.mode == "POWER_FAILURE" {
+			d.parkElevator(e)
+			continue
+		}
+		if d.isRecalled(e) {
+			if e.currentFloor == d.fireRecallFloor {
+				d.recallElevator(e)
+				continue
+			}
+			e.direction = "up"
+			if d.fireRecallFloor < e.currentFloor {
+				e.direction = "down"
+			}
+			d.moveOneFloor(e)
+			continue
+		}
+
+		if d.serveCurrentFloor(e) {
+			e.status = "DOORS_OPEN"
+			e.door.openDoor()
+			e.stopsMade++
+			e.busyTime += e.doorDwellTime
+			d.logf("Opening door of elevator %d at floor %d\n", e.elevatorNumber, e.currentFloor)
+			d.mu.Unlock()
+			d.clock.sleep(e.doorDwellTime)
+			d.mu.Lock()
+			e.door.closeDoor()
+			d.logf("Closing door of elevator %d\n", e.elevatorNumber)
+			continue
+		}
+
+		e.direction = e.nextDirection()
+		d.moveOneFloor(e)
+	}
+}
+
+// moveOneFloor moves the car one floor in its current direction. The lock is
+// released while the car travels.
+func (d *elevatorSystemControl) moveOneFloor(e *elevator) {
+	e.status = "MOVING"
+	d.mu.Unlock()
+	d.clock.sleep(e.floorTravelTime) // simulate movement per floor
+	d.mu.Lock()
+	e.currentFloor = d.plan.nextFloor(e.currentFloor, e.direction)
+	e.floorsTravelled++
+	e.busyTime += e.floorTravelTime
+	d.logf("Elevator %d moving %s → floor %d\n", e.elevatorNumber, e.direction, e.currentFloor)
+}
+
+// carStats returns a snapshot of the per-car counters used by run reports.
+func (d *elevatorSystemControl) carStats() []carReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var stats []carReport
+	for _, e := range d.elevators {
+		stats = append(stats, carReport{
+			elevatorNumber:  e.elevatorNumber,
+			floorsTravelled: e.floorsTravelled,
+			stopsMade:       e.stopsMade,
+			busyTime:        e.busyTime,
+		})
 	}
+	return stats
+}
 
-	e.moveToFloor(floorsToMove, direction)
-	e.door.openDoor(elevatorNumber)
-	e.status = "IDLE"
+// logf records an event for the monitoring API and prints it unless the
+// system runs quietly.
+func (d *elevatorSystemControl) logf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	d.events.record(strings.TrimSuffix(message, "\n"))
+	if d.quiet {
+		return
+	}
+	fmt.Print(message)
 }
 
 type elevator struct {
-	elevatorNumber int
-	capacityInKG   int
-	cpacityInPax   int
-	door           door
-	status         string
-	currentFloor   int
-	panel          insideControlPanel
+	elevatorNumber  int
+	capacityInKG    int
+	cpacityInPax    int
+	floorTravelTime time.Duration
+	doorDwellTime   time.Duration
+	servedFloors    map[int]bool // nil means every floor is served
+	door            door
+	status          string // IDLE, MOVING, DOORS_OPEN, RECALLED or PARKED
+	serviceMode     string // NORMAL, INDEPENDENT or OUT_OF_SERVICE
+	direction       string // "up", "down" or "" when idle
+	currentFloor    int
+	panel           insideControlPanel
+
+	// pending calls: car calls hold the callers waiting for the doors to open,
+	// hall calls the passengers waiting to board
+	carCalls  map[int][]chan error
+	hallCalls map[hallCall][]*passenger
+
+	riders []*passenger
+	loadKG int
+
+	floorsTravelled int
+	stopsMade       int
+	busyTime        time.Duration
+}
+
+func (d *elevator) serves(floorNumber int) bool {
+	return d.servedFloors == nil || d.servedFloors[floorNumber]
+}
+
+// servesTrip reports whether the car stops at both floors of a trip;
+// destinationFloor is 0 when it is not known.
+func (d *elevator) servesTrip(currentFloor, destinationFloor int) bool {
+	return d.serves(currentFloor) && (destinationFloor == 0 || d.serves(destinationFloor))
+}
+
+func (d *elevator) answersHallCalls() bool {
+	return d.serviceMode == "NORMAL"
+}
+
+func (d *elevator) hasCalls() bool {
+	return len(d.carCalls) > 0 || len(d.hallCalls) > 0
+}
+
+// hasCallsToServe is hasCalls without the hall calls at the car's own floor
+// that it has no room for; those wait until the car has moved on and come back.
+func (d *elevator) hasCallsToServe() bool {
+	if len(d.carCalls) > 0 {
+		return true
+	}
+	for call, waiting := range d.hallCalls {
+		if call.floorNumber != d.currentFloor || d.hasRoomFor(waiting[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *elevator) pendingCalls() int {
+	return len(d.carCalls) + len(d.hallCalls)
+}
+
+// hasCallsBeyond reports whether any call is strictly above (up) or below
+// (down) the car.
+func (d *elevator) hasCallsBeyond(direction string) bool {
+	ahead := func(floorNumber int) bool {
+		if direction == "up" {
+			return floorNumber > d.currentFloor
+		}
+		return floorNumber < d.currentFloor
+	}
+	for f := range d.carCalls {
+		if ahead(f) {
+			return true
+		}
+	}
+	for c := range d.hallCalls {
+		if ahead(c.floorNumber) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *elevator) nextDirection() string {
+	if d.direction != "" && d.hasCallsBeyond(d.direction) {
+		return d.direction
+	}
+	if d.hasCallsBeyond("up") {
+		return "up"
+	}
+	return "down"
 }
 
-func (d *elevator) moveToFloor(floorsToMove int, directionToMove string) {
-	d.status = "MOVING"
-	for i := 0; i < floorsToMove; i++ {
-		time.Sleep(300 * time.Millisecond) // simulate movement per floor
-		if directionToMove == "down" {
-			d.currentFloor--
-		} else {
-			d.currentFloor++
+// serveCurrentFloor lets passengers out and in at the car's current floor and
+// reports whether the car has to stop here.
+func (d *elevatorSystemControl) serveCurrentFloor(e *elevator) bool {
+	served := d.alightPassengers(e)
+	if waiters, ok := e.carCalls[e.currentFloor]; ok {
+		notifyCallers(waiters, nil)
+		delete(e.carCalls, e.currentFloor)
+		served = true
+	}
+
+	directions := []string{e.direction}
+	if e.direction == "" {
+		directions = []string{"up", "down"}
+	}
+	for _, direction := range directions {
+		if d.boardPassengers(e, hallCall{floorNumber: e.currentFloor, direction: direction}) {
+			e.direction = direction
+			return true
 		}
-		fmt.Printf("Elevator %d moving %s → floor %d\n", d.elevatorNumber, directionToMove, d.currentFloor)
 	}
 
-	// fmt.Println("Moving elevator:", d.elevatorNumber, directionToMove, "by", floorsToMove, "floor.")
+	// nothing left ahead, so pick up passengers heading the other way and turn around
+	if e.direction != "" && !e.hasCallsBeyond(e.direction) {
+		opposite := oppositeDirection(e.direction)
+		if d.boardPassengers(e, hallCall{floorNumber: e.currentFloor, direction: opposite}) {
+			e.direction = opposite
+			return true
+		}
+	}
+	return served
+}
 
+func (d *elevator) failCalls(err error) {
+	for f, waiters := range d.carCalls {
+		notifyCallers(waiters, err)
+		delete(d.carCalls, f)
+	}
+	for c, waiting := range d.hallCalls {
+		failPassengers(waiting, err)
+		delete(d.hallCalls, c)
+	}
 }
 
 func (d *elevator) getCurrentFloor() int {
@@ -172,20 +744,44 @@ func (d *elevator) getInsideControlPanel() insideControlPanel {
 	return d.panel
 }
 
+func notifyCallers(waiters []chan error, err error) {
+	for _, w := range waiters {
+		w <- err
+	}
+}
+
+func oppositeDirection(direction string) string {
+	if direction == "up" {
+		return "down"
+	}
+	return "up"
+}
+
 type insideControlPanel struct {
 	elevatorNumber int
 	display        internalDisplay
 	system         *elevatorSystemControl
+	rider          *passenger // who is using the panel; nil for the car's own panel
 }
 
-func (d *insideControlPanel) goToFloor(destinationFloor int) {
+func (d *insideControlPanel) goToFloor(destinationFloor int) error {
+	if d.system == nil {
+		return errors.New("inside control panel is not connected to an elevator system")
+	}
 	// go to a particular floor
-	d.system.goToFloor(d.elevatorNumber, destinationFloor)
+	return d.system.goToFloor(d.elevatorNumber, destinationFloor, d.rider)
 
 }
 
-func (d *insideControlPanel) closeDoor() {
-	d.system.elevators[d.elevatorNumber-1].door.closeDoor(d.elevatorNumber)
+func (d *insideControlPanel) closeDoor() error {
+	if d.system == nil {
+		return errors.New("inside control panel is not connected to an elevator system")
+	}
+	if _, err := d.system.getElevator(d.elevatorNumber); err != nil {
+		return err
+	}
+	d.system.logf("Door close button pressed in elevator %d\n", d.elevatorNumber)
+	return nil
 }
 
 type internalDisplay struct {
@@ -195,46 +791,198 @@ type internalDisplay struct {
 	capacityInPax     int
 }
 
-type door struct{}
+type door struct {
+	open bool
+}
 
-func (d *door) openDoor(elevatorNumber int) {
-	fmt.Println("Opening door of elevator", elevatorNumber)
+func (d *door) openDoor() {
+	d.open = true
+}
 
+func (d *door) closeDoor() {
+	d.open = false
+}
+
+// ride takes a passenger from currentFloor to destinationFloor using the
+// floor keypad and the car panel.
+func ride(b *building, currentFloor, destinationFloor int) error {
+	panel, err := b.getFloorPanel(currentFloor)
+	if err != nil {
+		return err
+	}
+	insidePanel, err := panel.requestFloor(currentFloor, destinationFloor)
+	if err != nil {
+		return err
+	}
+	return insidePanel.goToFloor(destinationFloor)
 }
 
-func (d *door) closeDoor(elevatorNumber int) {
-	fmt.Println("Closing door of elevator", elevatorNumber)
+// emergencyDemo walks through a fire recall with one car under fire-service
+// control, followed by a power failure in the middle of a ride.
+func emergencyDemo(b *building) {
+	esc := b.system
+	var wg sync.WaitGroup
+
+	if err := esc.setIndependentService(2, true); err != nil {
+		fmt.Println("Could not switch elevator 2 to fire service:", err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ride(b, 12, 3); err != nil {
+			fmt.Println("Ride from floor 12 failed:", err)
+		}
+	}()
+	time.Sleep(time.Second)
+	if err := esc.triggerFireRecall(); err != nil {
+		fmt.Println("Fire recall failed:", err)
+	}
+	esc.awaitEmergencyStop()
+	wg.Wait()
+
+	if err := ride(b, 5, 1); err != nil {
+		fmt.Println("Ride from floor 5 failed:", err)
+	}
+	firefighterPanel := esc.elevators[1].getInsideControlPanel()
+	if err := firefighterPanel.goToFloor(9); err != nil {
+		fmt.Println("Fire-service ride failed:", err)
+	}
+	esc.cancelFireRecall()
+	if err := esc.setIndependentService(2, false); err != nil {
+		fmt.Println("Could not return elevator 2 to normal service:", err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ride(b, 1, 14); err != nil {
+			fmt.Println("Ride from floor 1 failed:", err)
+		}
+	}()
+	time.Sleep(3 * time.Second)
+	esc.powerFailure()
+	esc.awaitEmergencyStop()
+	wg.Wait()
+	esc.restorePower()
 }
 
 func main() {
-	building := &building{numberOfFloors: 15}
+	configPath := flag.String("config", "building.json", "path to the building configuration file")
+	simulate := flag.Bool("simulate", false, "run the traffic patterns against every dispatch strategy and print metrics")
+	minutes := flag.Int("minutes", 10, "simulated minutes of passenger arrivals per run")
+	rate := flag.Float64("rate", 12, "passenger arrivals per simulated minute")
+	scale := flag.Float64("scale", 300, "simulated seconds per real second")
+	seed := flag.Int64("seed", 1, "random seed for the traffic generator")
+	emergency := flag.Bool("emergency", false, "run the fire recall and power failure walkthrough")
+	monitorAddr := flag.String("monitor", "", "serve the monitoring API on this address (e.g. :8080) while lunch traffic runs in real time")
+	journeysPath := flag.String("journeys", "", "write the passenger journey log as CSV to this file (when empty the demo writes it to stdout and -simulate writes none)")
+	flag.Parse()
+
+	cfg, err := loadBuildingConfig(*configPath)
+	if err != nil {
+		fmt.Println("Could not load building:", err)
+		os.Exit(1)
+	}
+
+	journeyOut := os.Stdout
+	if *journeysPath != "" {
+		f, err := os.Create(*journeysPath)
+		if err != nil {
+			fmt.Println("Could not create journey log:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		journeyOut = f
+	}
+	journeyLog := newJourneyLogWriter(journeyOut)
+
+	if *simulate {
+		for _, pattern := range []trafficPattern{upPeakTraffic, downPeakTraffic, lunchTraffic} {
+			for _, strategy := range []dispatchStrategy{&firstIdleStrategy{}, &nearestCarStrategy{}, &leastLoadedStrategy{}} {
+				generator, err := newTrafficGenerator(cfg, pattern, *rate, time.Duration(*minutes)*time.Minute, *seed)
+				if err != nil {
+					fmt.Println("Could not generate traffic:", err)
+					os.Exit(1)
+				}
+				report, journeys := simulateTraffic(cfg, strategy, generator, *scale)
+				report.print()
+				if *journeysPath != "" {
+					if err := journeyLog.write(pattern.name+"/"+strategy.name(), journeys); err != nil {
+						fmt.Println("Could not write journey log:", err)
+					}
+				}
+			}
+		}
+		return
+	}
+
+	building := &building{config: cfg}
 	building.initialise()
+	defer building.shutdown()
+
+	if *emergency {
+		emergencyDemo(building)
+		return
+	}
+
+	if *monitorAddr != "" {
+		generator, err := newTrafficGenerator(cfg, lunchTraffic, *rate, time.Duration(*minutes)*time.Minute, *seed)
+		if err != nil {
+			fmt.Println("Could not generate traffic:", err)
+			os.Exit(1)
+		}
+		go generator.run(building)
+		monitor := &monitorServer{system: building.system}
+		fmt.Println("Monitoring API listening on", *monitorAddr)
+		if err := http.ListenAndServe(*monitorAddr, monitor.handler()); err != nil {
+			fmt.Println("Monitoring API stopped:", err)
+		}
+		return
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		currentFloor := 2
-		panel := building.getFloorPanel(currentFloor)
-		insidePanel := panel.goUp(currentFloor)
-		destinationFloor := 10
-		insidePanel.closeDoor()
-		insidePanel.goToFloor(destinationFloor)
+		if err := ride(building, 2, 10); err != nil {
+			fmt.Println("Ride from floor 2 failed:", err)
+		}
 	}()
 
 	go func() {
 		defer wg.Done()
-		currentFloor := 15
-		panel := building.getFloorPanel(currentFloor)
-		insidePanel := panel.goDown(currentFloor)
-
-		destinationFloor := 1
-		insidePanel.closeDoor()
-		insidePanel.goToFloor(destinationFloor)
+		if err := ride(building, 15, 1); err != nil {
+			fmt.Println("Ride from floor 15 failed:", err)
+		}
 	}()
 
 	wg.Wait()
 	fmt.Println("All elevators have completed movement.")
 
+	// requests for floors that do not exist are rejected instead of panicking
+	if _, err := building.getFloorPanel(20); err != nil {
+		fmt.Println("Floor panel lookup failed:", err)
+	}
+	if err := ride(building, -2, 12); err != nil {
+		fmt.Println("Ride from floor -2 failed:", err)
+	}
+
+	// a crowd at the lobby: whoever does not fit waits for the next car
+	wg.Add(12)
+	for i := 0; i < 12; i++ {
+		destinationFloor := 2 + i%8
+		go func() {
+			defer wg.Done()
+			if err := ride(building, 1, destinationFloor); err != nil {
+				fmt.Println("Ride from the lobby failed:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := journeyLog.write("demo", building.system.journeyLog()); err != nil {
+		fmt.Println("Could not write journey log:", err)
+	}
+
 }
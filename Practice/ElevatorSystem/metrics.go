@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// carReport holds the counters of one car over a run. Floors travelled and
+// stops made together are the energy proxy: every floor costs motor time and
+// every stop costs a deceleration, door cycle and acceleration.
+type carReport struct {
+	elevatorNumber  int
+	floorsTravelled int
+	stopsMade       int
+	busyTime        time.Duration
+	utilisation     float64
+}
+
+type runReport struct {
+	strategy    string
+	pattern     string
+	passengers  int
+	failed      int
+	avgWait     time.Duration
+	p95Wait     time.Duration
+	avgTravel   time.Duration
+	p95Travel   time.Duration
+	elapsed     time.Duration
+	cars        []carReport
+	totalFloors int
+	totalStops  int
+}
+
+func buildRunReport(strategy, pattern string, journeys []journeyRecord, cars []carReport, elapsed time.Duration) runReport {
+	report := runReport{strategy: strategy, pattern: pattern, elapsed: elapsed}
+
+	var waits, travels []time.Duration
+	for _, j := range journeys {
+		if j.status != "ARRIVED" {
+			report.failed++
+			continue
+		}
+		report.passengers++
+		waits = append(waits, j.waitTime())
+		travels = append(travels, j.travelTime())
+	}
+	report.avgWait, report.p95Wait = averageAndP95(waits)
+	report.avgTravel, report.p95Travel = averageAndP95(travels)
+
+	for _, c := range cars {
+		if elapsed > 0 {
+			c.utilisation = float64(c.busyTime) / float64(elapsed)
+		}
+		report.totalFloors += c.floorsTravelled
+		report.totalStops += c.stopsMade
+		report.cars = append(report.cars, c)
+	}
+	return report
+}
+
+func averageAndP95(durations []time.Duration) (time.Duration, time.Duration) {
+	if len(durations) == 0 {
+		return 0, 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	// nearest-rank percentile
+	rank := (95*len(sorted) + 99) / 100
+	return total / time.Duration(len(sorted)), sorted[rank-1]
+}
+
+func (d runReport) print() {
+	fmt.Printf("=== %s traffic, %s dispatch ===\n", d.pattern, d.strategy)
+	fmt.Printf("passengers: %d delivered, %d failed, run length %s\n", d.passengers, d.failed, d.elapsed.Round(time.Second))
+	fmt.Printf("wait time:   avg %s, p95 %s\n", d.avgWait.Round(100*time.Millisecond), d.p95Wait.Round(100*time.Millisecond))
+	fmt.Printf("travel time: avg %s, p95 %s\n", d.avgTravel.Round(100*time.Millisecond), d.p95Travel.Round(100*time.Millisecond))
+	for _, c := range d.cars {
+		fmt.Printf("  elevator %d: utilisation %5.1f%%, floors travelled %d, stops %d\n", c.elevatorNumber, 100*c.utilisation, c.floorsTravelled, c.stopsMade)
+	}
+	fmt.Printf("energy proxy: %d floors travelled, %d stops\n\n", d.totalFloors, d.totalStops)
+}
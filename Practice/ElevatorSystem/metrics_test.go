@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAverageAndP95(t *testing.T) {
+	var oneToTwenty []time.Duration
+	for i := 20; i >= 1; i-- {
+		oneToTwenty = append(oneToTwenty, time.Duration(i)*time.Second)
+	}
+	tests := []struct {
+		name      string
+		durations []time.Duration
+		avg, p95  time.Duration
+	}{
+		{"none", nil, 0, 0},
+		{"one", []time.Duration{7 * time.Second}, 7 * time.Second, 7 * time.Second},
+		{"unsorted", []time.Duration{3 * time.Second, time.Second, 2 * time.Second}, 2 * time.Second, 3 * time.Second},
+		{"twenty", oneToTwenty, 10500 * time.Millisecond, 19 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			avg, p95 := averageAndP95(tt.durations)
+			if avg != tt.avg || p95 != tt.p95 {
+				t.Fatalf("got %s and %s, want %s and %s", avg, p95, tt.avg, tt.p95)
+			}
+		})
+	}
+	if oneToTwenty[0] != 20*time.Second {
+		t.Fatal("averageAndP95 sorted its argument in place")
+	}
+}
+
+func TestRunReportOnlyCountsArrivals(t *testing.T) {
+	journeys := []journeyRecord{
+		{status: "ARRIVED", callTime: 0, boardingTime: 10 * time.Second, arrivalTime: 30 * time.Second},
+		{status: "ARRIVED", callTime: 0, boardingTime: 20 * time.Second, arrivalTime: 30 * time.Second},
+		{status: "DIVERTED", callTime: 0, boardingTime: 5 * time.Second, arrivalTime: 6 * time.Second},
+		{status: "FAILED", failure: "floor locked"},
+	}
+	cars := []carReport{{elevatorNumber: 1, floorsTravelled: 12, stopsMade: 4, busyTime: 30 * time.Second}}
+	report := buildRunReport("nearest-car", "lunch", journeys, cars, time.Minute)
+	if report.passengers != 2 || report.failed != 2 {
+		t.Fatalf("%d delivered and %d failed, want 2 and 2", report.passengers, report.failed)
+	}
+	if report.avgWait != 15*time.Second || report.avgTravel != 15*time.Second {
+		t.Fatalf("average wait %s and travel %s, want 15s each", report.avgWait, report.avgTravel)
+	}
+	if report.cars[0].utilisation != 0.5 || report.totalFloors != 12 || report.totalStops != 4 {
+		t.Fatalf("got car report %+v", report.cars[0])
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type systemEvent struct {
+	Sequence int       `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Message  string    `json:"message"`
+}
+
+// eventLog keeps the most recent events for the monitoring API and fans new
+// ones out to live subscribers. Slow subscribers miss events rather than
+// holding up the elevators.
+type eventLog struct {
+	mu          sync.Mutex
+	capacity    int
+	events      []systemEvent
+	sequence    int
+	subscribers map[chan systemEvent]bool
+}
+
+func newEventLog(capacity int) *eventLog {
+	return &eventLog{capacity: capacity, subscribers: make(map[chan systemEvent]bool)}
+}
+
+func (d *eventLog) record(message string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sequence++
+	event := systemEvent{Sequence: d.sequence, Time: time.Now(), Message: message}
+	d.events = append(d.events, event)
+	if len(d.events) > d.capacity {
+		d.events = d.events[len(d.events)-d.capacity:]
+	}
+	for s := range d.subscribers {
+		select {
+		case s <- event:
+		default:
+		}
+	}
+}
+
+func (d *eventLog) recent(limit int) []systemEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if limit <= 0 || limit > len(d.events) {
+		limit = len(d.events)
+	}
+	return append([]systemEvent{}, d.events[len(d.events)-limit:]...)
+}
+
+func (d *eventLog) subscribe() (chan systemEvent, func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := make(chan systemEvent, 64)
+	d.subscribers[s] = true
+	return s, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.subscribers, s)
+	}
+}
+
+// monitorServer is the HTTP API for the facilities dashboard:
+//
+//	GET  /status                        mode, fire recall floor and locked floors
+//	GET  /cars                          state of every car
+//	GET  /calls                         hall and car calls still waiting
+//	GET  /events?limit=N                most recent events
+//	GET  /events/stream                 live events over a WebSocket, one JSON message each
+//	GET  /passengers                    journey log as CSV
+//	POST /cars/{n}/out-of-service       stop a car answering calls
+//	POST /cars/{n}/return-to-service    put a car back into normal service
+//	POST /floors/{f}/lock               stop all service to a floor
+//	POST /floors/{f}/unlock
+//	POST /recall                        trigger fire recall
+//	POST /recall/cancel
+type monitorServer struct {
+	system *elevatorSystemControl
+}
+
+func (d *monitorServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", d.get(func(r *http.Request) (interface{}, error) { return d.system.state(), nil }))
+	mux.HandleFunc("/cars", d.get(func(r *http.Request) (interface{}, error) { return d.system.carStates(), nil }))
+	mux.HandleFunc("/calls", d.get(func(r *http.Request) (interface{}, error) { return d.system.queuedCalls(), nil }))
+	mux.HandleFunc("/events", d.get(d.recentEvents))
+	mux.HandleFunc("/events/stream", d.streamEvents)
+	mux.HandleFunc("/passengers", d.exportJourneys)
+	mux.HandleFunc("/cars/", d.post(d.carCommand))
+	mux.HandleFunc("/floors/", d.post(d.floorCommand))
+	mux.HandleFunc("/recall", d.post(func(r *http.Request) error { return d.system.triggerFireRecall() }))
+	mux.HandleFunc("/recall/cancel", d.post(func(r *http.Request) error {
+		d.system.cancelFireRecall()
+		return nil
+	}))
+	return mux
+}
+
+func (d *monitorServer) get(query func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+			return
+		}
+		result, err := query(r)
+		if err != nil {
+			writeError(w, statusForError(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func (d *monitorServer) post(command func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+			return
+		}
+		if err := command(r); err != nil {
+			writeError(w, statusForError(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, d.system.state())
+	}
+}
+
+func (d *monitorServer) recentEvents(r *http.Request) (interface{}, error) {
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%w: limit must be a positive number", errBadRequest)
+		}
+		limit = n
+	}
+	return d.system.events.recent(limit), nil
+}
+
+// streamEvents pushes each new event to a WebSocket client as a JSON text
+// message until the client closes the connection.
+func (d *monitorServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		writeError(w, statusForError(err), err)
+		return
+	}
+	defer ws.close()
+	events, unsubscribe := d.system.events.subscribe()
+	defer unsubscribe()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := ws.readFrame()
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsOpPing:
+				ws.writeFrame(wsOpPong, payload)
+			case wsOpClose:
+				ws.writeFrame(wsOpClose, payload)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			if err := ws.writeFrame(wsOpText, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *monitorServer) exportJourneys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	newJourneyLogWriter(w).write("monitor", d.system.journeyLog())
+}
+
+// carCommand handles /cars/{n}/out-of-service and /cars/{n}/return-to-service.
+func (d *monitorServer) carCommand(r *http.Request) error {
+	elevatorNumber, action, err := parseCommandPath(r.URL.Path, "/cars/")
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "out-of-service":
+		return d.system.takeOutOfService(elevatorNumber)
+	case "return-to-service":
+		return d.system.returnToService(elevatorNumber)
+	}
+	return fmt.Errorf("%w: unknown car command %q", errNotFound, action)
+}
+
+// floorCommand handles /floors/{f}/lock and /floors/{f}/unlock.
+func (d *monitorServer) floorCommand(r *http.Request) error {
+	floorNumber, action, err := parseCommandPath(r.URL.Path, "/floors/")
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "lock":
+		return d.system.lockFloor(floorNumber)
+	case "unlock":
+		return d.system.unlockFloor(floorNumber)
+	}
+	return fmt.Errorf("%w: unknown floor command %q", errNotFound, action)
+}
+
+var (
+	errBadRequest = errors.New("bad request")
+	errNotFound   = errors.New("not found")
+)
+
+func parseCommandPath(path, prefix string) (int, string, error) {
+	parts := strings.Split(strings.TrimPrefix(path, prefix), "/")
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("%w: %s", errNotFound, path)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %q is not a number", errBadRequest, parts[0])
+	}
+	return n, parts[1], nil
+}
+
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, errInvalidElevatorNumber):
+		return http.StatusNotFound
+	case errors.Is(err, errBadRequest), errors.Is(err, errInvalidFloor), errors.Is(err, errFloorNotServed):
+		return http.StatusBadRequest
+	case errors.Is(err, errPowerFailure), errors.Is(err, errFireRecall), errors.Is(err, errOutOfService), errors.Is(err, errFloorLocked):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
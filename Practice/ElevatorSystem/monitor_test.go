@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w: 9", errInvalidElevatorNumber), http.StatusNotFound},
+		{errNotFound, http.StatusNotFound},
+		{fmt.Errorf("%w: 99", errInvalidFloor), http.StatusBadRequest},
+		{fmt.Errorf("%w: elevator 3 does not stop at floor 5", errFloorNotServed), http.StatusBadRequest},
+		{errBadRequest, http.StatusBadRequest},
+		{fmt.Errorf("%w: 4", errFloorLocked), http.StatusConflict},
+		{fmt.Errorf("%w: elevator 2", errOutOfService), http.StatusConflict},
+		{errFireRecall, http.StatusConflict},
+		{errPowerFailure, http.StatusConflict},
+		{errors.New("something else"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := statusForError(tt.err); got != tt.want {
+			t.Errorf("statusForError(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Operator commands used by the building's monitoring API.
+
+func (d *elevatorSystemControl) takeOutOfService(elevatorNumber int) error {
+	return d.setServiceMode(elevatorNumber, "OUT_OF_SERVICE")
+}
+
+func (d *elevatorSystemControl) returnToService(elevatorNumber int) error {
+	return d.setServiceMode(elevatorNumber, "NORMAL")
+}
+
+// setServiceMode moves a car between normal, independent and out-of-service
+// operation. A car that stops answering hall calls hands them to another car;
+// a car taken out of service still delivers the passengers already inside.
+func (d *elevatorSystemControl) setServiceMode(elevatorNumber int, mode string) error {
+	e, err := d.getElevator(elevatorNumber)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e.serviceMode == mode {
+		return nil
+	}
+	d.logf("[SERVICE] Elevator %d switched from %s to %s service\n", elevatorNumber, e.serviceMode, mode)
+	e.serviceMode = mode
+	if e.status == "RECALLED" && !d.isRecalled(e) {
+		e.door.closeDoor()
+		e.status = "IDLE"
+	}
+	if d.isRecalled(e) {
+		// back under recall, so whatever its panel asked for no longer applies
+		e.failCalls(errFireRecall)
+	}
+	if !e.answersHallCalls() {
+		d.reassignHallCalls(e)
+	}
+	d.cond.Broadcast()
+	return nil
+}
+
+// lockFloor stops all service to a floor and cancels the calls waiting for it.
+// Riders already on their way there are let out at the nearest floor their
+// car can still stop at. Emergency recall still goes to the fire recall floor
+// when it is locked.
+func (d *elevatorSystemControl) lockFloor(floorNumber int) error {
+	if err := d.plan.validateFloor(floorNumber); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lockedFloors[floorNumber] {
+		return nil
+	}
+	d.logf("[SERVICE] Floor %d locked\n", floorNumber)
+	d.lockedFloors[floorNumber] = true
+	lockedErr := fmt.Errorf("%w: %d", errFloorLocked, floorNumber)
+	for _, e := range d.elevators {
+		if waiters, ok := e.carCalls[floorNumber]; ok {
+			notifyCallers(waiters, lockedErr)
+			delete(e.carCalls, floorNumber)
+		}
+		for call, waiting := range e.hallCalls {
+			if call.floorNumber == floorNumber {
+				failPassengers(waiting, lockedErr)
+				delete(e.hallCalls, call)
+				continue
+			}
+			// destination dispatch passengers still waiting to be taken there
+			var stillGoing, goingThere []*passenger
+			for _, p := range waiting {
+				if p.destination == floorNumber {
+					goingThere = append(goingThere, p)
+				} else {
+					stillGoing = append(stillGoing, p)
+				}
+			}
+			if len(goingThere) == 0 {
+				continue
+			}
+			failPassengers(goingThere, lockedErr)
+			if len(stillGoing) == 0 {
+				delete(e.hallCalls, call)
+			} else {
+				e.hallCalls[call] = stillGoing
+			}
+		}
+		for _, p := range e.riders {
+			if p.destination != floorNumber {
+				continue
+			}
+			p.divertedTo = d.nearestOpenFloor(e, floorNumber)
+			if _, ok := e.carCalls[p.divertedTo]; !ok {
+				e.carCalls[p.divertedTo] = nil
+			}
+			d.logf("Passenger %d in elevator %d diverted to floor %d\n", p.id, e.elevatorNumber, p.divertedTo)
+		}
+	}
+	d.cond.Broadcast()
+	return nil
+}
+
+// nearestOpenFloor picks the floor closest to floorNumber that the car stops
+// at and is not locked, preferring the one nearer the car on a tie. Callers
+// hold d.mu.
+func (d *elevatorSystemControl) nearestOpenFloor(e *elevator, floorNumber int) int {
+	nearest := d.fireRecallFloor
+	found := false
+	for f := d.plan.lowestFloor(); f <= d.plan.highest; f++ {
+		if f == 0 || d.lockedFloors[f] || !e.serves(f) {
+			continue
+		}
+		distance, best := d.plan.distance(f, floorNumber), d.plan.distance(nearest, floorNumber)
+		if !found || distance < best || (distance == best && d.plan.distance(f, e.currentFloor) < d.plan.distance(nearest, e.currentFloor)) {
+			nearest, found = f, true
+		}
+	}
+	return nearest
+}
+
+func (d *elevatorSystemControl) unlockFloor(floorNumber int) error {
+	if err := d.plan.validateFloor(floorNumber); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.lockedFloors[floorNumber] {
+		return nil
+	}
+	d.logf("[SERVICE] Floor %d unlocked\n", floorNumber)
+	delete(d.lockedFloors, floorNumber)
+	return nil
+}
+
+type carState struct {
+	ElevatorNumber  int    `json:"elevatorNumber"`
+	CurrentFloor    int    `json:"currentFloor"`
+	Direction       string `json:"direction"`
+	Status          string `json:"status"`
+	ServiceMode     string `json:"serviceMode"`
+	DoorOpen        bool   `json:"doorOpen"`
+	Passengers      []int  `json:"passengers"`
+	LoadKG          int    `json:"loadKG"`
+	ServedFloors    []int  `json:"servedFloors,omitempty"`
+	FloorsTravelled int    `json:"floorsTravelled"`
+	StopsMade       int    `json:"stopsMade"`
+}
+
+type queuedCall struct {
+	Type           string `json:"type"` // hall or car
+	Floor          int    `json:"floor"`
+	Direction      string `json:"direction,omitempty"`
+	ElevatorNumber int    `json:"elevatorNumber"`
+	Waiting        int    `json:"waiting"`
+}
+
+type systemState struct {
+	Mode            string `json:"mode"`
+	FireRecallFloor int    `json:"fireRecallFloor"`
+	LockedFloors    []int  `json:"lockedFloors"`
+}
+
+func (d *elevatorSystemControl) carStates() []carState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var states []carState
+	for _, e := range d.elevators {
+		var servedFloors []int
+		for f := range e.servedFloors {
+			servedFloors = append(servedFloors, f)
+		}
+		sort.Ints(servedFloors)
+		passengers := []int{}
+		for _, p := range e.riders {
+			passengers = append(passengers, p.id)
+		}
+		states = append(states, carState{
+			ElevatorNumber:  e.elevatorNumber,
+			CurrentFloor:    e.currentFloor,
+			Direction:       e.direction,
+			Status:          e.status,
+			ServiceMode:     e.serviceMode,
+			DoorOpen:        e.door.open,
+			Passengers:      passengers,
+			LoadKG:          e.loadKG,
+			ServedFloors:    servedFloors,
+			FloorsTravelled: e.floorsTravelled,
+			StopsMade:       e.stopsMade,
+		})
+	}
+	return states
+}
+
+func (d *elevatorSystemControl) queuedCalls() []queuedCall {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	calls := []queuedCall{}
+	for _, e := range d.elevators {
+		for call, waiting := range e.hallCalls {
+			calls = append(calls, queuedCall{Type: "hall", Floor: call.floorNumber, Direction: call.direction, ElevatorNumber: e.elevatorNumber, Waiting: len(waiting)})
+		}
+		for f, waiters := range e.carCalls {
+			calls = append(calls, queuedCall{Type: "car", Floor: f, ElevatorNumber: e.elevatorNumber, Waiting: len(waiters)})
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].ElevatorNumber != calls[j].ElevatorNumber {
+			return calls[i].ElevatorNumber < calls[j].ElevatorNumber
+		}
+		if calls[i].Type != calls[j].Type {
+			return calls[i].Type < calls[j].Type
+		}
+		return calls[i].Floor < calls[j].Floor
+	})
+	return calls
+}
+
+func (d *elevatorSystemControl) state() systemState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lockedFloors := []int{}
+	for f := range d.lockedFloors {
+		lockedFloors = append(lockedFloors, f)
+	}
+	sort.Ints(lockedFloors)
+	return systemState{Mode: d.mode, FireRecallFloor: d.fireRecallFloor, LockedFloors: lockedFloors}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLockFloor(t *testing.T) {
+	b := newTestBuilding(t)
+	if err := b.system.lockFloor(4); err != nil {
+		t.Fatal(err)
+	}
+	lobby, _ := b.getFloorPanel(1)
+	if _, err := lobby.requestFloor(1, 4); !errors.Is(err, errFloorLocked) {
+		t.Fatalf("call to a locked floor: got %v, want %v", err, errFloorLocked)
+	}
+	locked, _ := b.getFloorPanel(4)
+	if _, err := locked.requestFloor(4, 1); !errors.Is(err, errFloorLocked) {
+		t.Fatalf("call from a locked floor: got %v, want %v", err, errFloorLocked)
+	}
+	if state := b.system.state(); len(state.LockedFloors) != 1 || state.LockedFloors[0] != 4 {
+		t.Fatalf("locked floors %v, want [4]", state.LockedFloors)
+	}
+
+	b.system.unlockFloor(4)
+	if _, err := lobby.requestFloor(1, 4); err != nil {
+		t.Fatalf("call after unlocking: %v", err)
+	}
+}
+
+func TestLockFloorDivertsRiders(t *testing.T) {
+	tests := []struct {
+		name           string
+		outOfService   int
+		destination    int
+		lock           []int
+		wantArrivalAt  int
+		wantElevatorNo int
+	}{
+		{"local car stops a floor short", 2, 6, []int{6}, 5, 1},
+		{"next floor down locked too", 2, 6, []int{5, 6}, 4, 1},
+		// the express car only stops at the lobby and the top floor
+		{"express car goes back to the lobby", 1, 6, []int{6}, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBuilding(t)
+			b.system.takeOutOfService(tt.outOfService)
+			panel, _ := b.getFloorPanel(1)
+			insidePanel, err := panel.requestFloor(1, tt.destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range tt.lock {
+				b.system.lockFloor(f)
+			}
+			b.system.abandonTrip(insidePanel.rider, insidePanel.goToFloor(tt.destination))
+
+			j := onlyJourney(t, b)
+			if j.status != "DIVERTED" || j.arrivalFloor != tt.wantArrivalAt || j.elevatorNumber != tt.wantElevatorNo {
+				t.Fatalf("got journey %+v, want diverted to floor %d in elevator %d", j, tt.wantArrivalAt, tt.wantElevatorNo)
+			}
+		})
+	}
+}
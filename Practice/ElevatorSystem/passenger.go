@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const defaultPassengerWeightKG = 75
+
+// passenger is one journey through the building, from the hall call to the
+// floor where the passenger left the car. All times are building time since
+// the system started.
+type passenger struct {
+	id             int
+	origin         int
+	destination    int // 0 until chosen on the car panel when the up/down buttons were used
+	weightKG       int
+	status         string // WAITING, RIDING, ARRIVED, DIVERTED, EVACUATED or FAILED
+	divertedTo     int    // where to let the rider out instead when the destination was locked on the way
+	elevatorNumber int
+	arrivalFloor   int
+	callTime       time.Duration
+	boardingTime   time.Duration
+	arrivalTime    time.Duration
+	failure        string
+	boarded        chan error    // receives nil once aboard, or why the hall call failed
+	left           chan struct{} // closed once the passenger is out of the car
+}
+
+// newPassenger registers a passenger in the journey log. Callers hold d.mu.
+func (d *elevatorSystemControl) newPassenger(origin, destination, weightKG int) *passenger {
+	d.nextPassengerID++
+	p := &passenger{
+		id:          d.nextPassengerID,
+		origin:      origin,
+		destination: destination,
+		weightKG:    weightKG,
+		status:      "WAITING",
+		callTime:    d.clock.now(),
+		boarded:     make(chan error, 1),
+		left:        make(chan struct{}),
+	}
+	d.passengers = append(d.passengers, p)
+	return p
+}
+
+func (d *elevator) hasRoomFor(p *passenger) bool {
+	return len(d.riders) < d.cpacityInPax && d.loadKG+p.weightKG <= d.capacityInKG
+}
+
+// canCarry reports whether the car could take a passenger of weightKG once
+// empty.
+func (d *elevator) canCarry(weightKG int) bool {
+	return weightKG <= d.capacityInKG
+}
+
+// boardPassengers lets the passengers waiting on a hall call into the car in
+// the order they called. Whoever does not fit is offered to another car, or
+// keeps waiting for this one to come back. It reports whether anyone boarded.
+func (d *elevatorSystemControl) boardPassengers(e *elevator, call hallCall) bool {
+	waiting, ok := e.hallCalls[call]
+	if !ok || len(waiting) == 0 || !e.hasRoomFor(waiting[0]) {
+		return false
+	}
+	delete(e.hallCalls, call)
+
+	var leftBehind []*passenger
+	for _, p := range waiting {
+		if len(leftBehind) > 0 || !e.hasRoomFor(p) {
+			leftBehind = append(leftBehind, p)
+			continue
+		}
+		p.status = "RIDING"
+		p.elevatorNumber = e.elevatorNumber
+		p.boardingTime = d.clock.now()
+		e.riders = append(e.riders, p)
+		e.loadKG += p.weightKG
+		if p.destination != 0 {
+			// destination dispatch: the car already knows where this passenger is going
+			if _, ok := e.carCalls[p.destination]; !ok {
+				e.carCalls[p.destination] = nil
+			}
+		}
+		p.boarded <- nil
+	}
+
+	for _, p := range leftBehind {
+		candidates := d.candidates(p.origin, p.destination, p.weightKG)
+		var others []*elevator
+		for _, c := range candidates {
+			if c != e {
+				others = append(others, c)
+			}
+		}
+		to := e
+		if len(others) > 0 {
+			to = d.strategy.selectElevator(others, call, d.plan)
+		}
+		to.hallCalls[call] = append(to.hallCalls[call], p)
+		d.logf("Passenger %d left behind by full elevator %d, waiting for elevator %d\n", p.id, e.elevatorNumber, to.elevatorNumber)
+	}
+	return true
+}
+
+// alightPassengers lets out the riders whose destination, or the floor they
+// were diverted to, is the current floor and reports whether anyone left the car.
+func (d *elevatorSystemControl) alightPassengers(e *elevator) bool {
+	alighted := false
+	var staying []*passenger
+	for _, p := range e.riders {
+		if p.destination == e.currentFloor {
+			d.leaveCar(e, p, "ARRIVED")
+			alighted = true
+			continue
+		}
+		if p.divertedTo == e.currentFloor {
+			d.leaveCar(e, p, "DIVERTED")
+			alighted = true
+			continue
+		}
+		staying = append(staying, p)
+	}
+	e.riders = staying
+	return alighted
+}
+
+// evacuatePassengers lets everyone out wherever the car was sent during an
+// emergency.
+func (d *elevatorSystemControl) evacuatePassengers(e *elevator) {
+	for _, p := range e.riders {
+		status := "EVACUATED"
+		if p.destination == e.currentFloor {
+			status = "ARRIVED"
+		}
+		d.leaveCar(e, p, status)
+	}
+	e.riders = nil
+}
+
+func (d *elevatorSystemControl) leaveCar(e *elevator, p *passenger, status string) {
+	p.status = status
+	p.arrivalFloor = e.currentFloor
+	p.arrivalTime = d.clock.now()
+	e.loadKG -= p.weightKG
+	close(p.left)
+}
+
+// abandonTrip handles a rider whose car panel refused their floor. A rider
+// the car will still take there, or already has to let out elsewhere, stays
+// as they are; anyone else is let out at the nearest floor the car can stop
+// at and ends up DIVERTED. It returns once the rider is out of the car.
+func (d *elevatorSystemControl) abandonTrip(p *passenger, err error) {
+	d.mu.Lock()
+	if p.status == "RIDING" {
+		e := d.elevators[p.elevatorNumber-1]
+		_, stillGoing := e.carCalls[p.destination]
+		if p.divertedTo == 0 && !stillGoing {
+			p.failure = err.Error()
+			p.divertedTo = d.nearestOpenFloor(e, e.currentFloor)
+			if _, ok := e.carCalls[p.divertedTo]; !ok {
+				e.carCalls[p.divertedTo] = nil
+			}
+			d.logf("Passenger %d in elevator %d could not go to floor %d (%v), letting them out at floor %d\n", p.id, e.elevatorNumber, p.destination, err, p.divertedTo)
+			d.cond.Broadcast()
+		}
+	}
+	d.mu.Unlock()
+	<-p.left
+}
+
+func failPassengers(waiting []*passenger, err error) {
+	for _, p := range waiting {
+		p.status = "FAILED"
+		p.failure = err.Error()
+		p.boarded <- err
+	}
+}
+
+// journeyRecord is the exported view of a passenger journey.
+type journeyRecord struct {
+	passengerID    int
+	origin         int
+	destination    int
+	arrivalFloor   int
+	elevatorNumber int
+	weightKG       int
+	status         string
+	callTime       time.Duration
+	boardingTime   time.Duration
+	arrivalTime    time.Duration
+	failure        string
+}
+
+func (d journeyRecord) waitTime() time.Duration {
+	return d.boardingTime - d.callTime
+}
+
+func (d journeyRecord) travelTime() time.Duration {
+	return d.arrivalTime - d.boardingTime
+}
+
+// journeyLog returns every passenger seen by the system in call order.
+func (d *elevatorSystemControl) journeyLog() []journeyRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var records []journeyRecord
+	for _, p := range d.passengers {
+		records = append(records, journeyRecord{
+			passengerID:    p.id,
+			origin:         p.origin,
+			destination:    p.destination,
+			arrivalFloor:   p.arrivalFloor,
+			elevatorNumber: p.elevatorNumber,
+			weightKG:       p.weightKG,
+			status:         p.status,
+			callTime:       p.callTime,
+			boardingTime:   p.boardingTime,
+			arrivalTime:    p.arrivalTime,
+			failure:        p.failure,
+		})
+	}
+	return records
+}
+
+// journeyLogWriter exports journey records as CSV, one row per passenger. The
+// run column tells apart the runs written to the same file.
+type journeyLogWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func newJourneyLogWriter(w io.Writer) *journeyLogWriter {
+	return &journeyLogWriter{w: csv.NewWriter(w)}
+}
+
+func (d *journeyLogWriter) write(run string, records []journeyRecord) error {
+	if !d.wroteHeader {
+		d.w.Write([]string{"run", "passenger_id", "origin", "destination", "arrival_floor", "elevator", "weight_kg", "status",
+			"call_time_s", "boarding_time_s", "arrival_time_s", "wait_s", "travel_s", "failure"})
+		d.wroteHeader = true
+	}
+	for _, r := range records {
+		row := []string{run, strconv.Itoa(r.passengerID), strconv.Itoa(r.origin), optionalFloor(r.destination), optionalFloor(r.arrivalFloor),
+			strconv.Itoa(r.elevatorNumber), strconv.Itoa(r.weightKG), r.status, seconds(r.callTime), "", "", "", "", r.failure}
+		if r.status != "WAITING" && r.status != "FAILED" {
+			row[9] = seconds(r.boardingTime)
+			row[11] = seconds(r.waitTime())
+		}
+		if r.status == "ARRIVED" || r.status == "DIVERTED" || r.status == "EVACUATED" {
+			row[10] = seconds(r.arrivalTime)
+			row[12] = seconds(r.travelTime())
+		}
+		d.w.Write(row)
+	}
+	d.w.Flush()
+	return d.w.Error()
+}
+
+func optionalFloor(floorNumber int) string {
+	if floorNumber == 0 {
+		return ""
+	}
+	return strconv.Itoa(floorNumber)
+}
+
+func seconds(duration time.Duration) string {
+	return fmt.Sprintf("%.1f", duration.Seconds())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mostAboard is the largest number of journeys that overlapped between
+// boarding and arrival.
+func mostAboard(journeys []journeyRecord) int {
+	most := 0
+	for _, j := range journeys {
+		aboard := 0
+		for _, other := range journeys {
+			if other.boardingTime <= j.boardingTime && j.boardingTime < other.arrivalTime {
+				aboard++
+			}
+		}
+		if aboard > most {
+			most = aboard
+		}
+	}
+	return most
+}
+
+func TestCapacityLimitedBoarding(t *testing.T) {
+	tests := []struct {
+		name     string
+		pax, kg  int
+		weightKG int
+		want     int
+	}{
+		{"passenger limit", 2, 1000, 70, 2},
+		{"weight limit", 8, 250, 120, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &building{
+				config: buildingConfig{
+					NumberOfFloors:  4,
+					FireRecallFloor: 1,
+					LobbyFloor:      1,
+					// the car starts upstairs so the whole crowd is waiting when it arrives
+					Elevators: []elevatorConfig{{CapacityInKG: tt.kg, CapacityInPax: tt.pax, FloorTravelMillis: 300, DoorDwellMillis: 1000, StartingFloor: 4}},
+				},
+				timeScale: 100,
+				quiet:     true,
+			}
+			b.initialise()
+			defer b.shutdown()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					travel(b, 1, 3, tt.weightKG)
+				}()
+			}
+			wg.Wait()
+
+			journeys := b.system.journeyLog()
+			for _, j := range journeys {
+				if j.status != "ARRIVED" {
+					t.Fatalf("passenger %d is %s: %s", j.passengerID, j.status, j.failure)
+				}
+			}
+			if got := mostAboard(journeys); got != tt.want {
+				t.Fatalf("at most %d aboard at once, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectedWeights(t *testing.T) {
+	b := newTestBuilding(t)
+	panel, _ := b.getFloorPanel(1)
+	for _, weightKG := range []int{0, -5, 681} {
+		if _, err := panel.requestFloorWithWeight(1, 4, weightKG); !errors.Is(err, errInvalidWeight) {
+			t.Errorf("%d kg: got %v, want %v", weightKG, err, errInvalidWeight)
+		}
+	}
+	if len(b.system.journeyLog()) != 0 {
+		t.Fatal("a rejected passenger was added to the journey log")
+	}
+}
+
+func TestJourneyLogCSV(t *testing.T) {
+	var out bytes.Buffer
+	w := newJourneyLogWriter(&out)
+	w.write("run-a", []journeyRecord{
+		{passengerID: 1, origin: 1, destination: 5, arrivalFloor: 5, elevatorNumber: 2, weightKG: 75, status: "ARRIVED",
+			callTime: time.Second, boardingTime: 3 * time.Second, arrivalTime: 10 * time.Second},
+	})
+	w.write("run-b", []journeyRecord{
+		{passengerID: 1, origin: 4, weightKG: 75, status: "FAILED", callTime: 2 * time.Second, failure: "floor locked: 4"},
+	})
+	want := "run,passenger_id,origin,destination,arrival_floor,elevator,weight_kg,status,call_time_s,boarding_time_s,arrival_time_s,wait_s,travel_s,failure\n" +
+		"run-a,1,1,5,5,2,75,ARRIVED,1.0,3.0,10.0,2.0,7.0,\n" +
+		"run-b,1,4,,,0,75,FAILED,2.0,,,,,floor locked: 4\n"
+	if got := out.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+	if strings.Count(out.String(), "passenger_id") != 1 {
+		t.Fatal("header written more than once")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// trafficPattern describes where passengers travel. Trips that neither start
+// nor end at the lobby go between two other floors.
+type trafficPattern struct {
+	name      string
+	fromLobby float64 // share of trips starting at the lobby
+	toLobby   float64 // share of trips ending at the lobby
+}
+
+var (
+	upPeakTraffic   = trafficPattern{name: "up-peak", fromLobby: 0.85, toLobby: 0.05}
+	downPeakTraffic = trafficPattern{name: "down-peak", fromLobby: 0.05, toLobby: 0.85}
+	lunchTraffic    = trafficPattern{name: "lunch", fromLobby: 0.35, toLobby: 0.35}
+)
+
+// trafficGenerator releases passengers into a building with exponentially
+// distributed gaps between arrivals, so arrivalsPerMinute is the average rate.
+type trafficGenerator struct {
+	pattern           trafficPattern
+	lobbyFloor        int
+	arrivalsPerMinute float64
+	duration          time.Duration // building time during which passengers keep arriving
+	seed              int64
+}
+
+// newTrafficGenerator takes the lobby from the building config. Trips between
+// two floors other than the lobby need at least three floors, or no such trip
+// could ever be drawn.
+func newTrafficGenerator(cfg buildingConfig, pattern trafficPattern, arrivalsPerMinute float64, duration time.Duration, seed int64) (*trafficGenerator, error) {
+	if !(arrivalsPerMinute > 0) || math.IsInf(arrivalsPerMinute, 1) {
+		return nil, fmt.Errorf("arrivals per minute must be positive, got %v", arrivalsPerMinute)
+	}
+	if duration < 0 {
+		return nil, fmt.Errorf("traffic duration cannot be negative, got %v", duration)
+	}
+	if cfg.NumberOfFloors+cfg.NumberOfBasements < 3 {
+		return nil, errors.New("generated traffic needs a building with at least three floors")
+	}
+	if err := cfg.floorPlan().validateFloor(cfg.LobbyFloor); err != nil {
+		return nil, fmt.Errorf("lobby floor: %w", err)
+	}
+	return &trafficGenerator{
+		pattern:           pattern,
+		lobbyFloor:        cfg.LobbyFloor,
+		arrivalsPerMinute: arrivalsPerMinute,
+		duration:          duration,
+		seed:              seed,
+	}, nil
+}
+
+// run drives the building through its floor and car panels and returns the
+// journey log once every passenger has arrived or failed.
+func (d *trafficGenerator) run(b *building) []journeyRecord {
+	rng := rand.New(rand.NewSource(d.seed))
+	clock := b.system.clock
+
+	var wg sync.WaitGroup
+	meanGap := float64(time.Minute) / d.arrivalsPerMinute
+	arrival := time.Duration(rng.ExpFloat64() * meanGap)
+	for arrival < d.duration {
+		if wait := arrival - clock.now(); wait > 0 {
+			clock.sleep(wait)
+		}
+		origin, destination := d.nextTrip(rng, b)
+		weightKG := 50 + rng.Intn(60)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			travel(b, origin, destination, weightKG)
+		}()
+
+		arrival += time.Duration(rng.ExpFloat64() * meanGap)
+	}
+	wg.Wait()
+	return b.system.journeyLog()
+}
+
+// travel is one passenger's trip; how it went is kept in the journey log.
+func travel(b *building, origin, destination, weightKG int) {
+	panel, err := b.getFloorPanel(origin)
+	if err != nil {
+		return
+	}
+	insidePanel, err := panel.requestFloorWithWeight(origin, destination, weightKG)
+	if err != nil {
+		return
+	}
+	if err := insidePanel.goToFloor(destination); err != nil {
+		b.system.abandonTrip(insidePanel.rider, err)
+	}
+}
+
+func (d *trafficGenerator) nextTrip(rng *rand.Rand, b *building) (int, int) {
+	roll := rng.Float64()
+	switch {
+	case roll < d.pattern.fromLobby:
+		return d.lobbyFloor, d.randomFloor(rng, b, d.lobbyFloor)
+	case roll < d.pattern.fromLobby+d.pattern.toLobby:
+		return d.randomFloor(rng, b, d.lobbyFloor), d.lobbyFloor
+	default:
+		origin := d.randomFloor(rng, b, d.lobbyFloor)
+		return origin, d.randomFloor(rng, b, d.lobbyFloor, origin)
+	}
+}
+
+func (d *trafficGenerator) randomFloor(rng *rand.Rand, b *building, exclude ...int) int {
+	for {
+		f := b.floors[rng.Intn(len(b.floors))].floorNumber
+		if !containsFloor(exclude, f) {
+			return f
+		}
+	}
+}
+
+// simulateTraffic runs one generator against a fresh building using the given
+// dispatch strategy and reports how the bank performed, along with the
+// journey of every passenger.
+func simulateTraffic(cfg buildingConfig, strategy dispatchStrategy, generator *trafficGenerator, timeScale float64) (runReport, []journeyRecord) {
+	b := &building{config: cfg, strategy: strategy, timeScale: timeScale, quiet: true}
+	b.initialise()
+	journeys := generator.run(b)
+	elapsed := b.system.clock.now()
+	cars := b.system.carStats()
+	b.shutdown()
+	return buildRunReport(strategy.name(), generator.pattern.name, journeys, cars, elapsed), journeys
+}
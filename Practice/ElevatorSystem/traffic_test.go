@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestBuilding starts a six floor building with a local car and an express
+// car that only stops at the lobby and the top floor, running fast enough
+// that a ride takes a few milliseconds.
+func newTestBuilding(t *testing.T) *building {
+	t.Helper()
+	car := func(startingFloor int, servedFloors ...int) elevatorConfig {
+		return elevatorConfig{CapacityInKG: 680, CapacityInPax: 8, FloorTravelMillis: 300, DoorDwellMillis: 1000, StartingFloor: startingFloor, ServedFloors: servedFloors}
+	}
+	b := &building{
+		config: buildingConfig{
+			NumberOfFloors:  6,
+			FireRecallFloor: 1,
+			LobbyFloor:      1,
+			Elevators:       []elevatorConfig{car(1), car(1, 1, 6)},
+		},
+		timeScale: 1000,
+		quiet:     true,
+	}
+	b.initialise()
+	t.Cleanup(b.shutdown)
+	return b
+}
+
+func onlyJourney(t *testing.T, b *building) journeyRecord {
+	t.Helper()
+	journeys := b.system.journeyLog()
+	if len(journeys) != 1 {
+		t.Fatalf("got %d journeys, want 1", len(journeys))
+	}
+	return journeys[0]
+}
+
+func TestTravelDelivers(t *testing.T) {
+	b := newTestBuilding(t)
+	travel(b, 1, 4, 80)
+	if j := onlyJourney(t, b); j.status != "ARRIVED" || j.arrivalFloor != 4 || j.weightKG != 80 {
+		t.Fatalf("got journey %+v", j)
+	}
+}
+
+// TestRefusedFloorIsNotDelivered is a rider who took the express car with the
+// up button and then pressed a floor it skips.
+func TestRefusedFloorIsNotDelivered(t *testing.T) {
+	b := newTestBuilding(t)
+	b.system.takeOutOfService(1)
+	panel, _ := b.getFloorPanel(1)
+	insidePanel, err := panel.goUp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = insidePanel.goToFloor(4)
+	if !errors.Is(err, errFloorNotServed) {
+		t.Fatalf("got %v, want %v", err, errFloorNotServed)
+	}
+	b.system.abandonTrip(insidePanel.rider, err)
+
+	j := onlyJourney(t, b)
+	if j.status != "DIVERTED" || j.arrivalFloor != 1 || j.failure == "" {
+		t.Fatalf("got journey %+v, want the rider let out at the lobby", j)
+	}
+	if report := buildRunReport("nearest-car", "test", b.system.journeyLog(), nil, time.Minute); report.passengers != 0 || report.failed != 1 {
+		t.Fatalf("%d delivered and %d failed, want 0 and 1", report.passengers, report.failed)
+	}
+}
+
+// TestAbandonedTripWaitsForTheRider locks the rider's floor after they board,
+// so the car panel refuses it and the rider is let out on the way instead.
+func TestAbandonedTripWaitsForTheRider(t *testing.T) {
+	b := newTestBuilding(t)
+	b.system.takeOutOfService(2)
+	panel, _ := b.getFloorPanel(1)
+	insidePanel, err := panel.requestFloor(1, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.system.lockFloor(6)
+	err = insidePanel.goToFloor(6)
+	if !errors.Is(err, errFloorLocked) {
+		t.Fatalf("got %v, want %v", err, errFloorLocked)
+	}
+	b.system.abandonTrip(insidePanel.rider, err)
+
+	if j := onlyJourney(t, b); j.status != "DIVERTED" || j.arrivalFloor != 5 {
+		t.Fatalf("got journey %+v, want the rider let out at floor 5", j)
+	}
+}
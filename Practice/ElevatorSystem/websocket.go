@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The monitor only pushes events, so this is just enough of RFC 6455 for a
+// server: the opening handshake, unmasked frames out, and masked control
+// frames in so clients can ping and close.
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	// wsMaxPayload bounds what a client may send; the dashboard only sends
+	// control frames.
+	wsMaxPayload = 4096
+)
+
+// wsGUID is the fixed key suffix from RFC 6455 section 1.3.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errWebSocketFrame = errors.New("bad websocket frame")
+
+type webSocket struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex // one frame written at a time
+}
+
+// upgradeWebSocket answers the opening handshake and takes the connection over
+// from the HTTP server. Nothing has been written when it fails before hijacking.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocket, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("%w: use GET", errBadRequest)
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("%w: expected a websocket upgrade", errBadRequest)
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("%w: websocket version must be 13", errBadRequest)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, fmt.Errorf("%w: bad Sec-WebSocket-Key", errBadRequest)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &webSocket{conn: conn, rw: rw}, nil
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeFrame sends a single unfragmented frame. Servers never mask.
+func (d *webSocket) writeFrame(opcode byte, payload []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	d.rw.Write(header)
+	d.rw.Write(payload)
+	return d.rw.Flush()
+}
+
+// readFrame reads the next frame from the client, which must be masked.
+// Fragmented messages are returned a frame at a time.
+func (d *webSocket) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(d.rw, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("%w: client frames must be masked", errWebSocketFrame)
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(d.rw, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(d.rw, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > wsMaxPayload {
+		return 0, nil, fmt.Errorf("%w: %d byte payload", errWebSocketFrame, length)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(d.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(d.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+func (d *webSocket) close() error {
+	return d.conn.Close()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// clientFrame encodes a frame the way a browser sends it; masked is false
+// only to check that the server refuses it.
+func clientFrame(opcode byte, payload []byte, masked bool) []byte {
+	frame := []byte{0x80 | opcode}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame decodes an unmasked frame from the server.
+func readServerFrame(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		return 0, nil, errors.New("server frames must be final and unmasked")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		io.ReadFull(r, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		io.ReadFull(r, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+func pipeWebSocket(t *testing.T) (*webSocket, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return &webSocket{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}, client
+}
+
+func TestWebSocketServerFrames(t *testing.T) {
+	// payload lengths either side of the 7, 16 and 64 bit length encodings
+	for _, n := range []int{0, 5, 125, 126, 300, 0xFFFF, 0x10000} {
+		ws, client := pipeWebSocket(t)
+		payload := bytes.Repeat([]byte("x"), n)
+		written := make(chan error, 1)
+		go func() { written <- ws.writeFrame(wsOpText, payload) }()
+		opcode, got, err := readServerFrame(client)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if opcode != wsOpText || !bytes.Equal(got, payload) {
+			t.Fatalf("%d bytes: got opcode %x and %d bytes", n, opcode, len(got))
+		}
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWebSocketClientFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		opcode  byte
+		payload []byte
+		masked  bool
+		want    error
+	}{
+		{"ping", wsOpPing, []byte("are you there"), true, nil},
+		{"close", wsOpClose, nil, true, nil},
+		{"16 bit length", wsOpText, bytes.Repeat([]byte("y"), 126), true, nil},
+		{"largest allowed", wsOpText, bytes.Repeat([]byte("z"), wsMaxPayload), true, nil},
+		{"unmasked", wsOpText, []byte("hello"), false, errWebSocketFrame},
+		{"too large", wsOpText, bytes.Repeat([]byte("z"), wsMaxPayload+1), true, errWebSocketFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, client := pipeWebSocket(t)
+			go client.Write(clientFrame(tt.opcode, tt.payload, tt.masked))
+			opcode, payload, err := ws.readFrame()
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && (opcode != tt.opcode || !bytes.Equal(payload, tt.payload)) {
+				t.Fatalf("got opcode %x and %q", opcode, payload)
+			}
+		})
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	b := newTestBuilding(t)
+	server := httptest.NewServer((&monitorServer{system: b.system}).handler())
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL + "/events/stream"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain GET got %v, want 400", err)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the sample handshake from RFC 6455 section 1.3
+	conn.Write([]byte("GET /events/stream HTTP/1.1\r\nHost: monitor\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got %s with accept key %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	conn.Write(clientFrame(wsOpPing, []byte("hi"), true))
+	if opcode, payload, err := readServerFrame(r); err != nil || opcode != wsOpPong || string(payload) != "hi" {
+		t.Fatalf("ping got opcode %x %q and %v", opcode, payload, err)
+	}
+	b.system.lockFloor(3)
+	opcode, payload, err := readServerFrame(r)
+	if err != nil || opcode != wsOpText {
+		t.Fatalf("got opcode %x and %v", opcode, err)
+	}
+	var event systemEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.Message != "[SERVICE] Floor 3 locked" {
+		t.Fatalf("got event %+v and %v", event, err)
+	}
+	conn.Write(clientFrame(wsOpClose, nil, true))
+	if opcode, _, err := readServerFrame(r); err != nil || opcode != wsOpClose {
+		t.Fatalf("close got opcode %x and %v", opcode, err)
+	}
+}
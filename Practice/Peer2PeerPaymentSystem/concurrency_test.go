@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// nullChannel accepts every message and sends none, so the tests are not
+// slowed down by outbox files.
+type nullChannel struct{}
+
+func (nullChannel) getName() string {
+	return channelEmail
+}
+
+func (nullChannel) send(to user, notificationId, subject, body string) error {
+	return nil
+}
+
+// newTestPayments opens an INR wallet for users 1 to users and seeds each one
+// with startingBalance.
+func newTestPayments(t *testing.T, users int, startingBalance money) *paymentTransaction {
+	t.Helper()
+	userManager := newUserManager()
+	walletManager := newWalletManager()
+	for userId := 1; userId <= users; userId++ {
+		if err := userManager.addUser(userId, "user"+strconv.Itoa(userId), fmt.Sprintf("user%d@example.com", userId)); err != nil {
+			t.Fatal(err)
+		}
+		walletManager.openWallet(userId, "INR")
+		if _, err := walletManager.addMoney(userId, instrumentCard, startingBalance, "seed-"+strconv.Itoa(userId)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &paymentTransaction{
+		userManager:       userManager,
+		instrumentManager: newInstrumentManager(userManager),
+		walletManager:     walletManager,
+		store:             newTransactionStore(),
+		disputes:          newDisputeStore(),
+		gateways:          newGatewayRouter(),
+		notifier:          newNotificationService(userManager, nullChannel{}),
+	}
+}
+
+func TestRacingSignupsClaimAnEmailOnce(t *testing.T) {
+	userManager := newUserManager()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	registered := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			email := "Same@Example.com"
+			if i%2 == 0 {
+				email = "same@example.com"
+			}
+			if userManager.addUser(100+i, "racer", email) == nil {
+				mu.Lock()
+				registered++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if registered != 1 {
+		t.Fatalf("%d users registered the same email", registered)
+	}
+}
+
+func TestRetriedIdempotencyKeyPaysOnce(t *testing.T) {
+	payments := newTestPayments(t, 2, majorUnits(1000, "INR"))
+	var wg sync.WaitGroup
+	var paid sync.Map
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payment := *payments
+			payment.amount = majorUnits(10, "INR")
+			if record, err := payment.doTransaction("retried", 1, 2, payFromWallet); err == nil {
+				paid.Store(record.transactionId, true)
+			}
+		}()
+	}
+	wg.Wait()
+	count := 0
+	paid.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Fatalf("one idempotency key made %d payments", count)
+	}
+}
+
+// TestParallelTransfersConserveMoney has every user pay every other user at
+// random from many goroutines, races refunds of the same payments, and checks
+// the wallets still hold exactly what they were seeded with. Run it with
+// -race to have the race detector watch as well.
+func TestParallelTransfersConserveMoney(t *testing.T) {
+	const (
+		users           = 4
+		workersPerUser  = 8
+		paymentsPerWork = 40
+	)
+	startingBalance := majorUnits(1000, "INR")
+	payments := newTestPayments(t, users, startingBalance)
+
+	var wg sync.WaitGroup
+	for sender := 1; sender <= users; sender++ {
+		for worker := 0; worker < workersPerUser; worker++ {
+			wg.Add(1)
+			go func(sender, worker int) {
+				defer wg.Done()
+				random := rand.New(rand.NewSource(int64(sender*1000 + worker)))
+				for i := 0; i < paymentsPerWork; i++ {
+					receiver := 1 + random.Intn(users)
+					if receiver == sender {
+						receiver = sender%users + 1
+					}
+					payment := *payments
+					payment.amount = newMoney(100+random.Intn(2400), "INR")
+					payment.doTransaction(fmt.Sprintf("w%d-%d", worker, i), sender, receiver, payFromWallet)
+				}
+			}(sender, worker)
+		}
+	}
+	wg.Wait()
+
+	// racing refunds of the same payment give the money back once
+	var captured []transferRecord
+	for userId := 1; userId <= users; userId++ {
+		for _, r := range payments.store.historyForUser(userId) {
+			if r.fromUserId == userId && r.status == statusCaptured && len(captured) < 10 {
+				captured = append(captured, r)
+			}
+		}
+	}
+	if len(captured) == 0 {
+		t.Fatal("no payment was captured")
+	}
+	for _, r := range captured {
+		var mu sync.Mutex
+		refunds := 0
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := payments.refund(r.transactionId, r.amount, "race"); err == nil {
+					mu.Lock()
+					refunds++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if refunds > 1 {
+			t.Errorf("%s was refunded %d times", r.transactionId, refunds)
+		}
+	}
+
+	checkMoneyConserved(t, payments, users, startingBalance)
+}
+
+// checkMoneyConserved checks the wallets still hold exactly what they were
+// seeded with between them, and that every wallet agrees with the payments
+// made to and from it.
+func checkMoneyConserved(t *testing.T, payments *paymentTransaction, users int, startingBalance money) {
+	t.Helper()
+	expected := make(map[int]int)
+	seen := make(map[string]bool)
+	counts := make(map[string]int)
+	for userId := 1; userId <= users; userId++ {
+		expected[userId] += startingBalance.minor
+		for _, r := range payments.store.historyForUser(userId) {
+			if seen[r.transactionId] {
+				continue
+			}
+			seen[r.transactionId] = true
+			counts[r.status]++
+			switch r.status {
+			case statusCaptured, statusPartiallyRefunded, statusRefunded:
+				kept := r.amount.minor - r.refunded.minor
+				expected[r.fromUserId] -= kept
+				expected[r.toUserId] += kept
+			case statusFailed:
+			default:
+				t.Errorf("%s was left %s", r.transactionId, r.status)
+			}
+		}
+	}
+	for userId := 1; userId <= users; userId++ {
+		balance, err := payments.walletManager.getBalance(userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.minor < 0 {
+			t.Errorf("userId %d is overdrawn: %s", userId, balance)
+		}
+		if balance.minor != expected[userId] {
+			t.Errorf("userId %d has %s, payments add up to %s", userId, balance, newMoney(expected[userId], balance.currency))
+		}
+	}
+	total := payments.walletManager.totalWalletBalance("INR")
+	if want := startingBalance.minor * users; total.minor != want {
+		t.Errorf("wallets hold %s, started with %s", total, newMoney(want, "INR"))
+	}
+	for _, problem := range payments.walletManager.audit() {
+		t.Error(problem)
+	}
+	t.Logf("%d payments: %d captured, %d refunded, %d failed; wallets hold %s", len(seen), counts[statusCaptured], counts[statusRefunded], counts[statusFailed], total)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var (
+	errNoRate         = errors.New("no exchange rate")
+	errNoFXProvider   = errors.New("no FX provider configured for cross-currency payments")
+	errQuoteNotFound  = errors.New("FX quote not found")
+	errQuoteExpired   = errors.New("FX quote has expired")
+	errQuoteUsed      = errors.New("FX quote has already been used")
+	errQuoteMismatch  = errors.New("FX quote does not match the payment")
+	errQuoteNotOwned  = errors.New("FX quote was locked for another user")
+	errInvalidFXInput = errors.New("invalid FX quote request")
+)
+
+// rateScale is the fixed-point scale rates are quoted in: a rate of 83.25 is
+// 83250000.
+const rateScale = 1000000
+
+// fxRateProvider gives the mid-market rate to convert one unit of from into
+// to, scaled by rateScale.
+type fxRateProvider interface {
+	getRate(from, to string) (int64, error)
+}
+
+// staticRateProvider is a fixed rate table standing in for a live feed. A
+// missing direction is derived from the inverse rate.
+type staticRateProvider struct {
+	rates map[string]int64 // "USD/INR" to scaled rate
+}
+
+func newStaticRateProvider(rates map[string]int64) *staticRateProvider {
+	return &staticRateProvider{rates: rates}
+}
+
+func (d *staticRateProvider) getRate(from, to string) (int64, error) {
+	if from == to {
+		return rateScale, nil
+	}
+	if rate, ok := d.rates[from+"/"+to]; ok {
+		return rate, nil
+	}
+	if inverse, ok := d.rates[to+"/"+from]; ok && inverse > 0 {
+		return (rateScale*rateScale + inverse/2) / inverse, nil
+	}
+	return 0, fmt.Errorf("%w: %s to %s", errNoRate, from, to)
+}
+
+// convert turns an amount into another currency at a scaled rate, rounding
+// half up to the nearest minor unit of the target currency.
+func convert(amount money, to string, rate int64) money {
+	numerator := new(big.Int).Mul(big.NewInt(int64(amount.minor)), big.NewInt(rate))
+	numerator.Mul(numerator, big.NewInt(int64(pow10(currencyExponents[to]))))
+	denominator := big.NewInt(int64(rateScale) * int64(pow10(currencyExponents[amount.currency])))
+	numerator.Add(numerator, new(big.Int).Quo(denominator, big.NewInt(2)))
+	return money{minor: int(new(big.Int).Quo(numerator, denominator).Int64()), currency: to}
+}
+
+// fxQuote locks a rate for a short time so the sender knows exactly what the
+// receiver gets and what it costs before paying.
+type fxQuote struct {
+	quoteId   string
+	userId    int   // the sender the rate was locked for
+	send      money // what the sender pays, before the fee
+	receive   money // what the receiver is credited
+	fee       money // charged to the sender on top, in the sender's currency
+	rate      int64
+	expiresAt time.Time
+	usedBy    string // the payment that spent the quote, empty while unspent
+}
+
+func (d fxQuote) printDetail() {
+	fmt.Println("[FXQuote] quoteId:", d.quoteId, "send:", d.send, "receive:", d.receive, "fee:", d.fee, "rate:", formatRate(d.rate), "valid until:", d.expiresAt.Format(time.RFC3339))
+}
+
+func formatRate(rate int64) string {
+	return fmt.Sprintf("%d.%06d", rate/rateScale, rate%rateScale)
+}
+
+// fxService quotes cross-currency payments. The fee is feeBasisPoints of the
+// amount sent, rounded up, and never less than minimumFee minor units.
+type fxService struct {
+	mu             sync.Mutex // guards quotes and lastId
+	provider       fxRateProvider
+	lockFor        time.Duration
+	feeBasisPoints int
+	minimumFee     int
+	quotes         map[string]*fxQuote
+	lastId         int
+}
+
+func newFXService(provider fxRateProvider, lockFor time.Duration, feeBasisPoints, minimumFee int) *fxService {
+	return &fxService{
+		provider:       provider,
+		lockFor:        lockFor,
+		feeBasisPoints: feeBasisPoints,
+		minimumFee:     minimumFee,
+		quotes:         make(map[string]*fxQuote),
+	}
+}
+
+func (d *fxService) quote(userId int, send money, toCurrency string) (fxQuote, error) {
+	if send.minor <= 0 || validCurrency(send.currency) != nil || validCurrency(toCurrency) != nil {
+		return fxQuote{}, fmt.Errorf("%w: %s to %s", errInvalidFXInput, send, toCurrency)
+	}
+	rate, err := d.provider.getRate(send.currency, toCurrency)
+	if err != nil {
+		return fxQuote{}, err
+	}
+	fee := (send.minor*d.feeBasisPoints + 9999) / 10000
+	if fee < d.minimumFee {
+		fee = d.minimumFee
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastId++
+	q := &fxQuote{
+		quoteId:   fmt.Sprintf("FXQ%06d", d.lastId),
+		userId:    userId,
+		send:      send,
+		receive:   convert(send, toCurrency, rate),
+		fee:       newMoney(fee, send.currency),
+		rate:      rate,
+		expiresAt: time.Now().Add(d.lockFor),
+	}
+	d.quotes[q.quoteId] = q
+	return *q, nil
+}
+
+func (d *fxService) getQuote(quoteId string) (fxQuote, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q, ok := d.quotes[quoteId]
+	if !ok {
+		return fxQuote{}, fmt.Errorf("%w: %s", errQuoteNotFound, quoteId)
+	}
+	return *q, nil
+}
+
+// use spends a quote on a payment. Each quote pays for one payment, and only
+// while its rate is still locked.
+func (d *fxService) use(quoteId, transactionId string, now time.Time) (fxQuote, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q, ok := d.quotes[quoteId]
+	if !ok {
+		return fxQuote{}, fmt.Errorf("%w: %s", errQuoteNotFound, quoteId)
+	}
+	if q.usedBy != "" {
+		return *q, fmt.Errorf("%w: %s by %s", errQuoteUsed, quoteId, q.usedBy)
+	}
+	if now.After(q.expiresAt) {
+		return *q, fmt.Errorf("%w: %s at %s", errQuoteExpired, quoteId, q.expiresAt.Format(time.RFC3339))
+	}
+	q.usedBy = transactionId
+	return *q, nil
+}
+
+// release gives back a quote spent on a payment that then failed, so the
+// sender can pay with it again while the rate is still locked.
+func (d *fxService) release(quoteId, transactionId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if q, ok := d.quotes[quoteId]; ok && q.usedBy == transactionId {
+		q.usedBy = ""
+	}
+}
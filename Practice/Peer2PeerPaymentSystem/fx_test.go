@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newFXTestPayments has users 1 and 2 with INR 1000 each, and user 3 holding
+// dollars.
+func newFXTestPayments(t *testing.T) *paymentTransaction {
+	t.Helper()
+	payments := newTestPayments(t, 2, majorUnits(1000, "INR"))
+	if err := payments.userManager.addUser(3, "user3", "user3@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	payments.walletManager.openWallet(3, "USD")
+	payments.fx = newFXService(newStaticRateProvider(map[string]int64{"USD/INR": 83250000}), time.Minute, 50, 0)
+	return payments
+}
+
+func TestQuotePaysOnlyForItsSender(t *testing.T) {
+	payments := newFXTestPayments(t)
+	quote, err := payments.fx.quote(1, majorUnits(100, "INR"), "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := *payments
+	payment.amount, payment.quoteId = quote.send, quote.quoteId
+	if _, err := payment.doTransaction("someone-elses-rate", 2, 3, payFromWallet); !errors.Is(err, errQuoteNotOwned) {
+		t.Fatalf("got %v, want %v", err, errQuoteNotOwned)
+	}
+	if _, err := payment.doTransaction("own-rate", 1, 3, payFromWallet); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailedPaymentGivesTheQuoteBack(t *testing.T) {
+	payments := newFXTestPayments(t)
+	quote, err := payments.fx.quote(1, majorUnits(2000, "INR"), "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := *payments
+	payment.amount, payment.quoteId = quote.send, quote.quoteId
+	if _, err := payment.doTransaction("short", 1, 3, payFromWallet); !errors.Is(err, errInsufficientFunds) {
+		t.Fatalf("got %v, want %v", err, errInsufficientFunds)
+	}
+	if _, err := payments.walletManager.addMoney(1, instrumentCard, majorUnits(2000, "INR"), "top-up"); err != nil {
+		t.Fatal(err)
+	}
+	record, err := payment.doTransaction("topped-up", 1, 3, payFromWallet)
+	if err != nil {
+		t.Fatalf("the quote did not survive the failed payment: %v", err)
+	}
+	if record.credited != quote.receive {
+		t.Fatalf("credited %s, quote promised %s", record.credited, quote.receive)
+	}
+	if _, err := payment.doTransaction("again", 1, 3, payFromWallet); !errors.Is(err, errQuoteUsed) {
+		t.Fatalf("got %v, want %v", err, errQuoteUsed)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errGatewayDeclined        = errors.New("payment declined by gateway")
+	errGatewayTimeout         = errors.New("payment gateway timed out")
+	errNoGatewayForInstrument = errors.New("no gateway registered for instrument type")
+	errAuthorisationNotFound  = errors.New("authorisation not found")
+	errCaptureExceedsAuth     = errors.New("capture exceeds the authorised amount")
+	errRefundExceedsCapture   = errors.New("refund exceeds the captured amount")
+	errInvalidGatewayAmount   = errors.New("gateway amount must be positive and in the authorised currency")
+)
+
+// processor is a payment gateway. authorise reserves money on the customer's
+// instrument and returns the gateway's authorisation id, capture takes some
+// or all of an authorisation and refund gives captured money back.
+type processor interface {
+	getName() string
+	authorise(amount money, reference string) (string, error)
+	capture(authorisationId string, amount money) error
+	refund(authorisationId string, amount money) error
+}
+
+// gatewayRouter picks the gateway for an instrument by its type, so cards go
+// to the card gateway and bank accounts to the bank-transfer gateway.
+type gatewayRouter struct {
+	gateways map[string]processor
+}
+
+func newGatewayRouter() *gatewayRouter {
+	return &gatewayRouter{gateways: make(map[string]processor)}
+}
+
+func (d *gatewayRouter) register(instrumentType string, gateway processor) {
+	fmt.Println("[GATEWAY] routing", instrumentType, "payments to", gateway.getName())
+	d.gateways[instrumentType] = gateway
+}
+
+func (d *gatewayRouter) route(instrumentType string) (processor, error) {
+	gateway, ok := d.gateways[instrumentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoGatewayForInstrument, instrumentType)
+	}
+	return gateway, nil
+}
+
+// named finds a gateway by name, for refunding a payment on the gateway that
+// originally charged it.
+func (d *gatewayRouter) named(name string) (processor, error) {
+	for _, gateway := range d.gateways {
+		if gateway.getName() == name {
+			return gateway, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errNoGatewayForInstrument, name)
+}
+
+// How the fake gateway answers a call. A late timeout does the work on the
+// gateway but the caller never hears back, as when a response is lost.
+const (
+	gatewaySucceed     = "SUCCEED"
+	gatewayDecline     = "DECLINE"
+	gatewayTimeout     = "TIMEOUT"
+	gatewayLateTimeout = "LATE_TIMEOUT"
+)
+
+// Kinds of money movement a gateway settles.
+const (
+	settlementCapture = "CAPTURE"
+	settlementRefund  = "REFUND"
+)
+
+// settlementLine is one movement of money the gateway settled with us.
+type settlementLine struct {
+	settledAt       time.Time
+	gateway         string
+	authorisationId string
+	reference       string
+	kind            string
+	amount          money
+}
+
+type gatewayAuthorisation struct {
+	authorisationId string
+	reference       string
+	currency        string
+	amount          int // in minor units of currency
+	captured        int
+	refunded        int
+}
+
+// fakeGateway is an in-process gateway for the demo and for exercising
+// failure paths. Each operation can be told separately to succeed, decline or
+// time out, so a capture can be made to fail after a successful authorise. It
+// handles one call at a time.
+type fakeGateway struct {
+	mu             sync.Mutex
+	name           string
+	onAuthorise    string
+	onCapture      string
+	onRefund       string
+	timeout        time.Duration // how long a timing out call hangs before giving up
+	authorisations map[string]*gatewayAuthorisation
+	settlements    []settlementLine
+	lastId         int
+}
+
+func newFakeGateway(name, behaviour string) *fakeGateway {
+	return &fakeGateway{
+		name:           name,
+		onAuthorise:    behaviour,
+		onCapture:      behaviour,
+		onRefund:       behaviour,
+		timeout:        50 * time.Millisecond,
+		authorisations: make(map[string]*gatewayAuthorisation),
+	}
+}
+
+// setBehaviour changes how every operation answers from now on.
+func (d *fakeGateway) setBehaviour(behaviour string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onAuthorise = behaviour
+	d.onCapture = behaviour
+	d.onRefund = behaviour
+}
+
+func (d *fakeGateway) getName() string {
+	return d.name
+}
+
+func (d *fakeGateway) authorise(amount money, reference string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if amount.minor <= 0 {
+		return "", errInvalidGatewayAmount
+	}
+	if err := d.answer("authorise", d.onAuthorise, reference); err != nil {
+		return "", err
+	}
+	d.lastId++
+	auth := &gatewayAuthorisation{
+		authorisationId: fmt.Sprintf("%s-AUTH%04d", d.name, d.lastId),
+		reference:       reference,
+		currency:        amount.currency,
+		amount:          amount.minor,
+	}
+	d.authorisations[auth.authorisationId] = auth
+	fmt.Println("[GATEWAY]", d.name, "authorised", amount, "for", reference, "as", auth.authorisationId)
+	return auth.authorisationId, nil
+}
+
+func (d *fakeGateway) capture(authorisationId string, amount money) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	auth, ok := d.authorisations[authorisationId]
+	if !ok {
+		return fmt.Errorf("%w: %s", errAuthorisationNotFound, authorisationId)
+	}
+	if amount.minor <= 0 || amount.currency != auth.currency {
+		return fmt.Errorf("%w: %s on a %s authorisation", errInvalidGatewayAmount, amount, auth.currency)
+	}
+	if auth.captured+amount.minor > auth.amount {
+		return fmt.Errorf("%w: %s captured of %s, asked for %s more", errCaptureExceedsAuth, newMoney(auth.captured, auth.currency), newMoney(auth.amount, auth.currency), amount)
+	}
+	if err := d.answer("capture", d.onCapture, auth.reference); err != nil {
+		return err
+	}
+	auth.captured += amount.minor
+	d.settle(auth, settlementCapture, amount)
+	fmt.Println("[GATEWAY]", d.name, "captured", amount, "on", authorisationId)
+	return d.lateAnswer("capture", d.onCapture, auth.reference)
+}
+
+func (d *fakeGateway) refund(authorisationId string, amount money) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	auth, ok := d.authorisations[authorisationId]
+	if !ok {
+		return fmt.Errorf("%w: %s", errAuthorisationNotFound, authorisationId)
+	}
+	if amount.minor <= 0 || amount.currency != auth.currency {
+		return fmt.Errorf("%w: %s on a %s authorisation", errInvalidGatewayAmount, amount, auth.currency)
+	}
+	if auth.refunded+amount.minor > auth.captured {
+		return fmt.Errorf("%w: %s refunded of %s captured, asked for %s more", errRefundExceedsCapture, newMoney(auth.refunded, auth.currency), newMoney(auth.captured, auth.currency), amount)
+	}
+	if err := d.answer("refund", d.onRefund, auth.reference); err != nil {
+		return err
+	}
+	auth.refunded += amount.minor
+	d.settle(auth, settlementRefund, amount)
+	fmt.Println("[GATEWAY]", d.name, "refunded", amount, "on", authorisationId)
+	return d.lateAnswer("refund", d.onRefund, auth.reference)
+}
+
+func (d *fakeGateway) answer(operation, behaviour, reference string) error {
+	switch behaviour {
+	case gatewayDecline:
+		fmt.Println("[GATEWAY]", d.name, "declined", operation, "for", reference)
+		return fmt.Errorf("%w: %s %s", errGatewayDeclined, d.name, operation)
+	case gatewayTimeout:
+		time.Sleep(d.timeout)
+		fmt.Println("[GATEWAY]", d.name, operation, "for", reference, "timed out after", d.timeout)
+		return fmt.Errorf("%w: %s %s after %s", errGatewayTimeout, d.name, operation, d.timeout)
+	}
+	return nil
+}
+
+// lateAnswer loses the response to an operation the gateway has already done.
+func (d *fakeGateway) lateAnswer(operation, behaviour, reference string) error {
+	if behaviour != gatewayLateTimeout {
+		return nil
+	}
+	time.Sleep(d.timeout)
+	fmt.Println("[GATEWAY]", d.name, operation, "for", reference, "went through but the response was lost")
+	return fmt.Errorf("%w: %s %s after %s", errGatewayTimeout, d.name, operation, d.timeout)
+}
+
+func (d *fakeGateway) settle(auth *gatewayAuthorisation, kind string, amount money) {
+	d.settlements = append(d.settlements, settlementLine{
+		settledAt:       time.Now(),
+		gateway:         d.name,
+		authorisationId: auth.authorisationId,
+		reference:       auth.reference,
+		kind:            kind,
+		amount:          amount,
+	})
+}
+
+// writeSettlementFile writes the day's settled captures and refunds as CSV,
+// the way a processor hands over its settlement report.
+func (d *fakeGateway) writeSettlementFile(path string, day time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write(settlementHeader)
+	start, end := dayBounds(day)
+	for _, l := range d.settlements {
+		if l.settledAt.Before(start) || !l.settledAt.Before(end) {
+			continue
+		}
+		w.Write([]string{l.settledAt.Format(time.RFC3339), l.gateway, l.authorisationId, l.reference, l.kind, strconv.Itoa(l.amount.minor), l.amount.currency})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUnknownInstrumentType = errors.New("unknown instrument type")
+	errInstrumentNotFound    = errors.New("instrument not found")
+	errInstrumentRemoved     = errors.New("instrument has been removed")
+	errInvalidCardNumber     = errors.New("invalid card number")
+	errInvalidExpiry         = errors.New("invalid card expiry")
+	errCardExpired           = errors.New("card has expired")
+	errInvalidAccountNumber  = errors.New("invalid bank account number")
+	errInvalidIFSC           = errors.New("invalid IFSC code")
+	errInvalidVPA            = errors.New("invalid UPI id")
+	errInvalidWallet         = errors.New("invalid wallet details")
+	errNotVerified           = errors.New("bank account is not verified")
+	errVerificationFailed    = errors.New("micro-deposit amounts do not match")
+	errVerificationLocked    = errors.New("too many failed verification attempts")
+	errNoDefaultInstrument   = errors.New("no default instrument set")
+)
+
+// Instrument types. "wallet" is an external wallet such as a phone wallet,
+// not the user's balance here, which is paid from with payFromWallet.
+const (
+	instrumentCard   = "card"
+	instrumentBank   = "bank"
+	instrumentUPI    = "upi"
+	instrumentWallet = "wallet"
+)
+
+// Instrument statuses. Bank accounts start out pending until the micro-deposit
+// amounts are confirmed.
+const (
+	instrumentActive              = "ACTIVE"
+	instrumentPendingVerification = "PENDING_VERIFICATION"
+	instrumentVerificationLocked  = "VERIFICATION_LOCKED"
+	instrumentRemoved             = "REMOVED"
+)
+
+// maxVerificationAttempts is how many wrong micro-deposit guesses lock a bank
+// account out of verification.
+const maxVerificationAttempts = 3
+
+type instrument interface {
+	getId() int
+	getUserId() int
+	getType() string
+	getStatus() string
+	// usable reports why the instrument cannot be charged right now, if it
+	// cannot.
+	usable(now time.Time) error
+	remove()
+	printDetail()
+}
+
+type paymentInstrument struct {
+	id     int
+	userId int
+	name   string
+	status string
+}
+
+func (d *paymentInstrument) getId() int {
+	return d.id
+}
+
+func (d *paymentInstrument) getUserId() int {
+	return d.userId
+}
+
+func (d *paymentInstrument) getStatus() string {
+	return d.status
+}
+
+func (d *paymentInstrument) remove() {
+	d.status = instrumentRemoved
+}
+
+func (d *paymentInstrument) usable(now time.Time) error {
+	if d.status == instrumentRemoved {
+		return fmt.Errorf("%w: instrumentId %d", errInstrumentRemoved, d.id)
+	}
+	return nil
+}
+
+// card keeps only the masked number; the full PAN is never stored.
+type card struct {
+	paymentInstrument
+	maskedPan   string
+	expiryMonth int
+	expiryYear  int
+}
+
+func (d *card) getType() string {
+	return instrumentCard
+}
+
+func (d *card) usable(now time.Time) error {
+	if err := d.paymentInstrument.usable(now); err != nil {
+		return err
+	}
+	// a card is good until the end of its expiry month
+	if !now.Before(time.Date(d.expiryYear, time.Month(d.expiryMonth)+1, 1, 0, 0, 0, 0, now.Location())) {
+		return fmt.Errorf("%w: instrumentId %d expired %02d/%d", errCardExpired, d.id, d.expiryMonth, d.expiryYear)
+	}
+	return nil
+}
+
+func (d *card) printDetail() {
+	fmt.Println("[InstrumentDetail] instrument id:", d.id, "instrumentName:", d.name, "card:", d.maskedPan, "expiry:", fmt.Sprintf("%02d/%d", d.expiryMonth, d.expiryYear), "status:", d.status)
+}
+
+type bank struct {
+	paymentInstrument
+	maskedAccount       string
+	ifsc                string
+	microDeposits       [2]int
+	failedVerifications int
+}
+
+func (d *bank) getType() string {
+	return instrumentBank
+}
+
+func (d *bank) usable(now time.Time) error {
+	if err := d.paymentInstrument.usable(now); err != nil {
+		return err
+	}
+	if d.status != instrumentActive {
+		return fmt.Errorf("%w: instrumentId %d is %s", errNotVerified, d.id, d.status)
+	}
+	return nil
+}
+
+func (d *bank) printDetail() {
+	fmt.Println("[InstrumentDetail] instrument id:", d.id, "instrumentName:", d.name, "account:", d.maskedAccount, "ifsc:", d.ifsc, "status:", d.status)
+}
+
+type upi struct {
+	paymentInstrument
+	vpa string
+}
+
+func (d *upi) getType() string {
+	return instrumentUPI
+}
+
+func (d *upi) printDetail() {
+	fmt.Println("[InstrumentDetail] instrument id:", d.id, "instrumentName:", d.name, "upi:", d.vpa, "status:", d.status)
+}
+
+type externalWallet struct {
+	paymentInstrument
+	provider string
+	phone    string
+}
+
+func (d *externalWallet) getType() string {
+	return instrumentWallet
+}
+
+func (d *externalWallet) printDetail() {
+	fmt.Println("[InstrumentDetail] instrument id:", d.id, "instrumentName:", d.name, "wallet:", d.provider, d.phone, "status:", d.status)
+}
+
+// instrumentDetails carries what is needed to add an instrument of any type.
+// Only the fields for the chosen type are read.
+type instrumentDetails struct {
+	Name          string
+	CardNumber    string
+	ExpiryMonth   int
+	ExpiryYear    int
+	AccountNumber string
+	IFSC          string
+	VPA           string
+	Provider      string
+	Phone         string
+}
+
+var (
+	ifscPattern  = regexp.MustCompile(`^[A-Z]{4}0[A-Z0-9]{6}$`)
+	vpaPattern   = regexp.MustCompile(`^[a-zA-Z0-9.\-_]{2,256}@[a-zA-Z]{2,64}$`)
+	phonePattern = regexp.MustCompile(`^[0-9]{10}$`)
+)
+
+// instrumentManager guards every instrument's status with its lock, so
+// instruments only change through its methods.
+type instrumentManager struct {
+	mu                   sync.RWMutex
+	users                *userManager
+	userToInstrumentsMap map[int][]instrument
+	byId                 map[int]instrument
+	defaults             map[int]int // user id to their default instrument id
+	lastId               int
+	random               *rand.Rand
+}
+
+func newInstrumentManager(users *userManager) *instrumentManager {
+	return &instrumentManager{
+		users:                users,
+		userToInstrumentsMap: make(map[int][]instrument),
+		byId:                 make(map[int]instrument),
+		defaults:             make(map[int]int),
+		random:               rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// addInstrument validates the details and stores a new instrument. Instrument
+// ids are unique across all users. The first usable instrument a user adds
+// becomes their default.
+func (d *instrumentManager) addInstrument(userId int, instrumentType string, details instrumentDetails) (instrument, error) {
+	if !d.users.checkIfUserExists(userId) {
+		return nil, fmt.Errorf("%w: %d", errUserNotFound, userId)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	base := paymentInstrument{id: d.lastId + 1, userId: userId, name: details.Name, status: instrumentActive}
+	var added instrument
+	switch instrumentType {
+	case instrumentCard:
+		c, err := newCard(base, details, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		added = c
+	case instrumentBank:
+		b, err := newBank(base, details)
+		if err != nil {
+			return nil, err
+		}
+		b.status = instrumentPendingVerification
+		b.microDeposits = [2]int{1 + d.random.Intn(99), 1 + d.random.Intn(99)}
+		added = b
+	case instrumentUPI:
+		if !vpaPattern.MatchString(details.VPA) {
+			return nil, fmt.Errorf("%w: %q", errInvalidVPA, details.VPA)
+		}
+		added = &upi{paymentInstrument: base, vpa: strings.ToLower(details.VPA)}
+	case instrumentWallet:
+		if details.Provider == "" || !phonePattern.MatchString(details.Phone) {
+			return nil, fmt.Errorf("%w: provider %q phone %q", errInvalidWallet, details.Provider, details.Phone)
+		}
+		added = &externalWallet{paymentInstrument: base, provider: details.Provider, phone: details.Phone}
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownInstrumentType, instrumentType)
+	}
+
+	d.lastId++
+	d.userToInstrumentsMap[userId] = append(d.userToInstrumentsMap[userId], added)
+	d.byId[added.getId()] = added
+	fmt.Println("Adding", details.Name, "which is a", instrumentType, "for user", userId, "as instrumentId", added.getId())
+	if b, ok := added.(*bank); ok {
+		// stands in for the two small credits showing up on the bank statement
+		fmt.Println("[INSTRUMENT] micro-deposits sent to", b.maskedAccount, ":", b.microDeposits[0], "and", b.microDeposits[1])
+	}
+	if _, ok := d.defaults[userId]; !ok && added.usable(time.Now()) == nil {
+		d.defaults[userId] = added.getId()
+	}
+	return added, nil
+}
+
+func newCard(base paymentInstrument, details instrumentDetails, now time.Time) (*card, error) {
+	pan := strings.ReplaceAll(strings.ReplaceAll(details.CardNumber, " ", ""), "-", "")
+	if len(pan) < 12 || len(pan) > 19 || !luhnValid(pan) {
+		return nil, fmt.Errorf("%w: ending %s", errInvalidCardNumber, lastFour(pan))
+	}
+	if details.ExpiryMonth < 1 || details.ExpiryMonth > 12 || details.ExpiryYear < 2000 {
+		return nil, fmt.Errorf("%w: %02d/%d", errInvalidExpiry, details.ExpiryMonth, details.ExpiryYear)
+	}
+	c := &card{
+		paymentInstrument: base,
+		maskedPan:         strings.Repeat("*", len(pan)-4) + lastFour(pan),
+		expiryMonth:       details.ExpiryMonth,
+		expiryYear:        details.ExpiryYear,
+	}
+	if err := c.usable(now); errors.Is(err, errCardExpired) {
+		return nil, fmt.Errorf("%w: %02d/%d", errCardExpired, c.expiryMonth, c.expiryYear)
+	}
+	return c, nil
+}
+
+func newBank(base paymentInstrument, details instrumentDetails) (*bank, error) {
+	account := details.AccountNumber
+	if len(account) < 9 || len(account) > 18 || strings.Trim(account, "0123456789") != "" {
+		return nil, fmt.Errorf("%w: ending %s", errInvalidAccountNumber, lastFour(account))
+	}
+	if !ifscPattern.MatchString(details.IFSC) {
+		return nil, fmt.Errorf("%w: %q", errInvalidIFSC, details.IFSC)
+	}
+	return &bank{
+		paymentInstrument: base,
+		maskedAccount:     strings.Repeat("*", len(account)-4) + lastFour(account),
+		ifsc:              details.IFSC,
+	}, nil
+}
+
+func lastFour(number string) string {
+	if len(number) <= 4 {
+		return number
+	}
+	return number[len(number)-4:]
+}
+
+// luhnValid runs the Luhn checksum every card number carries.
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		digit := int(number[i] - '0')
+		if digit < 0 || digit > 9 {
+			return false
+		}
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// verifyBankAccount checks the two micro-deposit amounts the user read off
+// their statement, in either order.
+func (d *instrumentManager) verifyBankAccount(userId, instrumentId, first, second int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i, err := d.find(userId, instrumentId)
+	if err != nil {
+		return err
+	}
+	b, ok := i.(*bank)
+	if !ok {
+		return fmt.Errorf("%w: instrumentId %d is a %s, not a bank account", errUnknownInstrumentType, instrumentId, i.getType())
+	}
+	switch b.status {
+	case instrumentActive:
+		return nil
+	case instrumentVerificationLocked:
+		return fmt.Errorf("%w: instrumentId %d", errVerificationLocked, instrumentId)
+	case instrumentRemoved:
+		return fmt.Errorf("%w: instrumentId %d", errInstrumentRemoved, instrumentId)
+	}
+
+	matches := (first == b.microDeposits[0] && second == b.microDeposits[1]) ||
+		(first == b.microDeposits[1] && second == b.microDeposits[0])
+	if !matches {
+		b.failedVerifications++
+		if b.failedVerifications >= maxVerificationAttempts {
+			b.status = instrumentVerificationLocked
+			fmt.Println("[INSTRUMENT] instrumentId:", instrumentId, "locked after", b.failedVerifications, "failed verifications")
+			return fmt.Errorf("%w: instrumentId %d", errVerificationLocked, instrumentId)
+		}
+		return fmt.Errorf("%w: %d attempts left", errVerificationFailed, maxVerificationAttempts-b.failedVerifications)
+	}
+	b.status = instrumentActive
+	fmt.Println("[INSTRUMENT] instrumentId:", instrumentId, "verified for userId:", userId)
+	if _, ok := d.defaults[userId]; !ok {
+		d.defaults[userId] = instrumentId
+	}
+	return nil
+}
+
+// removeInstrument stops the instrument being charged. It is kept so earlier
+// payments made with it can still be refunded.
+func (d *instrumentManager) removeInstrument(userId, instrumentId int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i, err := d.find(userId, instrumentId)
+	if err != nil {
+		return err
+	}
+	if i.getStatus() == instrumentRemoved {
+		return fmt.Errorf("%w: instrumentId %d", errInstrumentRemoved, instrumentId)
+	}
+	i.remove()
+	if d.defaults[userId] == instrumentId {
+		delete(d.defaults, userId)
+	}
+	fmt.Println("[INSTRUMENT] removed instrumentId:", instrumentId, "for userId:", userId)
+	return nil
+}
+
+func (d *instrumentManager) setDefault(userId, instrumentId int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i, err := d.find(userId, instrumentId)
+	if err != nil {
+		return err
+	}
+	if err := i.usable(time.Now()); err != nil {
+		return err
+	}
+	d.defaults[userId] = instrumentId
+	fmt.Println("[INSTRUMENT] instrumentId:", instrumentId, "is now the default for userId:", userId)
+	return nil
+}
+
+func (d *instrumentManager) getDefault(userId int) (instrument, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	instrumentId, ok := d.defaults[userId]
+	if !ok {
+		return nil, fmt.Errorf("%w: userId %d", errNoDefaultInstrument, userId)
+	}
+	return d.find(userId, instrumentId)
+}
+
+// find looks the instrument up by id and checks who owns it. The caller holds
+// the lock.
+func (d *instrumentManager) find(userId, instrumentId int) (instrument, error) {
+	i, ok := d.byId[instrumentId]
+	if !ok || i.getUserId() != userId {
+		return nil, fmt.Errorf("%w: instrumentId %d for userId %d", errInstrumentNotFound, instrumentId, userId)
+	}
+	return i, nil
+}
+
+// instrumentsFor lists the user's instruments in the order they were added.
+func (d *instrumentManager) instrumentsFor(userId int) []instrument {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]instrument(nil), d.userToInstrumentsMap[userId]...)
+}
+
+// selectInstrument returns the instrument even if it was removed, so refunds
+// can still find where a payment came from.
+func (d *instrumentManager) selectInstrument(userId, instrumentId int) (instrument, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.find(userId, instrumentId)
+}
+
+// validatePayment says why the user cannot pay with the instrument, if they
+// cannot.
+func (d *instrumentManager) validatePayment(userId, instrumentId int) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	i, err := d.find(userId, instrumentId)
+	if err != nil {
+		return err
+	}
+	return i.usable(time.Now())
+}
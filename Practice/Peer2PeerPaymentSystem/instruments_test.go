@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLuhn(t *testing.T) {
+	tests := []struct {
+		number string
+		valid  bool
+	}{
+		{"4111111111111111", true},
+		{"5500000000000004", true},
+		{"4012888888881881", true},
+		{"4111111111111112", false},
+		{"5500000000000005", false},
+		{"41111111111111a1", false},
+	}
+	for _, tt := range tests {
+		if got := luhnValid(tt.number); got != tt.valid {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.valid)
+		}
+	}
+}
+
+func TestAddCard(t *testing.T) {
+	payments := newTestPayments(t, 1, majorUnits(1, "INR"))
+	tests := []struct {
+		name    string
+		details instrumentDetails
+		want    error
+	}{
+		{"valid", instrumentDetails{CardNumber: "4111 1111 1111 1111", ExpiryMonth: 12, ExpiryYear: 2099}, nil},
+		{"dashes", instrumentDetails{CardNumber: "5500-0000-0000-0004", ExpiryMonth: 1, ExpiryYear: 2099}, nil},
+		{"bad checksum", instrumentDetails{CardNumber: "4111 1111 1111 1112", ExpiryMonth: 12, ExpiryYear: 2099}, errInvalidCardNumber},
+		{"too short", instrumentDetails{CardNumber: "4111 1111 18", ExpiryMonth: 12, ExpiryYear: 2099}, errInvalidCardNumber},
+		{"bad month", instrumentDetails{CardNumber: "4111 1111 1111 1111", ExpiryMonth: 13, ExpiryYear: 2099}, errInvalidExpiry},
+		{"expired", instrumentDetails{CardNumber: "4111 1111 1111 1111", ExpiryMonth: 3, ExpiryYear: 2021}, errCardExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, err := payments.instrumentManager.addInstrument(1, instrumentCard, tt.details)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && !strings.HasSuffix(tt.details.CardNumber, lastFour(added.(*card).maskedPan)) {
+				t.Fatalf("masked number %s does not keep the last four digits", added.(*card).maskedPan)
+			}
+		})
+	}
+}
+
+func TestAddInstrumentRejectsUnknownUsers(t *testing.T) {
+	payments := newTestPayments(t, 1, majorUnits(1, "INR"))
+	_, err := payments.instrumentManager.addInstrument(99, instrumentUPI, instrumentDetails{Name: "upi", VPA: "nobody@okaxis"})
+	if !errors.Is(err, errUserNotFound) {
+		t.Fatalf("got %v, want %v", err, errUserNotFound)
+	}
+}
+
+func TestSelectInstrument(t *testing.T) {
+	payments, _, cardId := newCardPayments(t, 2, majorUnits(1, "INR"))
+	if _, err := payments.instrumentManager.selectInstrument(1, cardId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := payments.instrumentManager.selectInstrument(2, cardId); !errors.Is(err, errInstrumentNotFound) {
+		t.Fatalf("another user's card: got %v, want %v", err, errInstrumentNotFound)
+	}
+	if _, err := payments.instrumentManager.selectInstrument(1, 99); !errors.Is(err, errInstrumentNotFound) {
+		t.Fatalf("unknown card: got %v, want %v", err, errInstrumentNotFound)
+	}
+}
+
+func addBank(t *testing.T, instruments *instrumentManager, userId int) *bank {
+	t.Helper()
+	added, err := instruments.addInstrument(userId, instrumentBank, instrumentDetails{Name: "bank", AccountNumber: "917010012345678", IFSC: "UTIB0000123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := added.(*bank)
+	if b.status != instrumentPendingVerification {
+		t.Fatalf("new bank account is %s, want %s", b.status, instrumentPendingVerification)
+	}
+	return b
+}
+
+func TestMicroDepositVerification(t *testing.T) {
+	payments := newTestPayments(t, 1, majorUnits(1, "INR"))
+	instruments := payments.instrumentManager
+	b := addBank(t, instruments, 1)
+	if _, err := instruments.getDefault(1); !errors.Is(err, errNoDefaultInstrument) {
+		t.Fatalf("an unverified account became the default: %v", err)
+	}
+	if err := b.usable(time.Now()); !errors.Is(err, errNotVerified) {
+		t.Fatalf("got %v, want %v", err, errNotVerified)
+	}
+
+	if err := instruments.verifyBankAccount(1, b.id, 0, 0); !errors.Is(err, errVerificationFailed) {
+		t.Fatalf("got %v, want %v", err, errVerificationFailed)
+	}
+	// the amounts may be given in either order
+	if err := instruments.verifyBankAccount(1, b.id, b.microDeposits[1], b.microDeposits[0]); err != nil {
+		t.Fatal(err)
+	}
+	if b.status != instrumentActive {
+		t.Fatalf("verified account is %s, want %s", b.status, instrumentActive)
+	}
+	if i, err := instruments.getDefault(1); err != nil || i.getId() != b.id {
+		t.Fatalf("verified account is not the default: %v", err)
+	}
+}
+
+func TestMicroDepositVerificationLocks(t *testing.T) {
+	payments := newTestPayments(t, 1, majorUnits(1, "INR"))
+	instruments := payments.instrumentManager
+	b := addBank(t, instruments, 1)
+
+	for attempt := 1; attempt < maxVerificationAttempts; attempt++ {
+		if err := instruments.verifyBankAccount(1, b.id, 0, 0); !errors.Is(err, errVerificationFailed) {
+			t.Fatalf("attempt %d: got %v, want %v", attempt, err, errVerificationFailed)
+		}
+	}
+	if err := instruments.verifyBankAccount(1, b.id, 0, 0); !errors.Is(err, errVerificationLocked) {
+		t.Fatalf("last attempt: got %v, want %v", err, errVerificationLocked)
+	}
+	// once locked, even the right amounts are refused
+	if err := instruments.verifyBankAccount(1, b.id, b.microDeposits[0], b.microDeposits[1]); !errors.Is(err, errVerificationLocked) {
+		t.Fatalf("got %v, want %v", err, errVerificationLocked)
+	}
+	if b.status != instrumentVerificationLocked {
+		t.Fatalf("account is %s, want %s", b.status, instrumentVerificationLocked)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUnbalancedPosting = errors.New("posting debits and credits do not balance")
+	errInsufficientFunds = errors.New("insufficient funds")
+	errWalletNotFound    = errors.New("wallet not found")
+)
+
+// ledgerEntry is one line of a posting. Exactly one of debit and credit is set,
+// in minor units of currency.
+type ledgerEntry struct {
+	entryId   int
+	postingId int
+	accountId string
+	currency  string
+	debit     int
+	credit    int
+	reference string
+	createdAt time.Time
+}
+
+type postingLine struct {
+	accountId string
+	currency  string
+	debit     int
+	credit    int
+}
+
+func debitLine(accountId string, amount money) postingLine {
+	return postingLine{accountId: accountId, currency: amount.currency, debit: amount.minor}
+}
+
+func creditLine(accountId string, amount money) postingLine {
+	return postingLine{accountId: accountId, currency: amount.currency, credit: amount.minor}
+}
+
+// ledger is the append-only book of record. Money only moves through
+// postings whose debits and credits sum to the same amount in every currency,
+// so the ledger as a whole always nets to zero per currency and any balance
+// can be rebuilt from it. Every account holds a single currency.
+type ledger struct {
+	entries       []ledgerEntry
+	nextPostingId int
+	currencies    map[string]string // account id to the currency it holds
+}
+
+func (d *ledger) post(reference string, lines ...postingLine) (int, error) {
+	net := make(map[string]int)
+	// accounts new to the ledger take the currency of their first line, so two
+	// lines for one new account must agree too
+	currencies := make(map[string]string)
+	for _, l := range lines {
+		if l.debit < 0 || l.credit < 0 || (l.debit == 0) == (l.credit == 0) {
+			return 0, fmt.Errorf("%w: line for %s must have exactly one positive side", errUnbalancedPosting, l.accountId)
+		}
+		currency, ok := d.currencies[l.accountId]
+		if !ok {
+			currency, ok = currencies[l.accountId]
+		}
+		if ok && currency != l.currency {
+			return 0, fmt.Errorf("%w: %s holds %s, line is in %s", errCurrencyMismatch, l.accountId, currency, l.currency)
+		}
+		currencies[l.accountId] = l.currency
+		net[l.currency] += l.debit - l.credit
+	}
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("%w: a posting needs at least two lines", errUnbalancedPosting)
+	}
+	for currency, difference := range net {
+		if difference != 0 {
+			return 0, fmt.Errorf("%w: %s debits exceed credits by %d", errUnbalancedPosting, currency, difference)
+		}
+	}
+
+	if d.currencies == nil {
+		d.currencies = make(map[string]string)
+	}
+	for accountId, currency := range currencies {
+		d.currencies[accountId] = currency
+	}
+	d.nextPostingId++
+	now := time.Now()
+	for _, l := range lines {
+		d.entries = append(d.entries, ledgerEntry{
+			entryId:   len(d.entries) + 1,
+			postingId: d.nextPostingId,
+			accountId: l.accountId,
+			currency:  l.currency,
+			debit:     l.debit,
+			credit:    l.credit,
+			reference: reference,
+			createdAt: now,
+		})
+	}
+	return d.nextPostingId, nil
+}
+
+// balance replays the ledger for one account. Balances are credit-normal:
+// money held in a wallet is a positive balance, while the clearing accounts
+// that money enters through go negative.
+func (d *ledger) balance(accountId string) int {
+	balance := 0
+	for _, e := range d.entries {
+		if e.accountId == accountId {
+			balance += e.credit - e.debit
+		}
+	}
+	return balance
+}
+
+func (d *ledger) accountIds() []string {
+	seen := make(map[string]bool)
+	var accountIds []string
+	for _, e := range d.entries {
+		if !seen[e.accountId] {
+			seen[e.accountId] = true
+			accountIds = append(accountIds, e.accountId)
+		}
+	}
+	sort.Strings(accountIds)
+	return accountIds
+}
+
+func walletAccount(userId int) string {
+	return "wallet:" + strconv.Itoa(userId)
+}
+
+// clearingAccount is where money from an external payment rail enters the
+// system, one account per instrument type and currency.
+func clearingAccount(instrumentType, currency string) string {
+	return "clearing:" + instrumentType + ":" + currency
+}
+
+// fxAccount is the position the business holds in a currency from converting
+// payments; feeAccount collects the fees charged for conversion.
+func fxAccount(currency string) string {
+	return "fx:" + currency
+}
+
+func feeAccount(currency string) string {
+	return "fees:" + currency
+}
+
+// walletManager keeps a running balance per wallet alongside the ledger so
+// balance checks do not replay every entry; audit compares the two. Each
+// wallet holds one currency, fixed when it is opened. Its lock also guards
+// the ledger, so the overdraft check and the posting happen as one step.
+type walletManager struct {
+	mu         sync.RWMutex
+	ledger     *ledger
+	balances   map[string]int    // wallet account id to balance in minor units
+	currencies map[string]string // wallet account id to currency
+}
+
+func newWalletManager() *walletManager {
+	return &walletManager{ledger: &ledger{}, balances: make(map[string]int), currencies: make(map[string]string)}
+}
+
+func (d *walletManager) openWallet(userId int, currency string) error {
+	if err := validCurrency(currency); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.balances[walletAccount(userId)]; ok {
+		return nil
+	}
+	fmt.Println("[WALLET] Opening", currency, "wallet for userId:", userId)
+	d.balances[walletAccount(userId)] = 0
+	d.currencies[walletAccount(userId)] = currency
+	return nil
+}
+
+func (d *walletManager) getBalance(userId int) (money, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	balance, ok := d.balances[walletAccount(userId)]
+	if !ok {
+		return money{}, fmt.Errorf("%w: userId %d", errWalletNotFound, userId)
+	}
+	return newMoney(balance, d.currencies[walletAccount(userId)]), nil
+}
+
+func (d *walletManager) currencyOf(userId int) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	currency, ok := d.currencies[walletAccount(userId)]
+	if !ok {
+		return "", fmt.Errorf("%w: userId %d", errWalletNotFound, userId)
+	}
+	return currency, nil
+}
+
+// addMoney loads a wallet from an external instrument.
+func (d *walletManager) addMoney(userId int, instrumentType string, amount money, reference string) (int, error) {
+	return d.move(reference, clearingAccount(instrumentType, amount.currency), walletAccount(userId), amount)
+}
+
+// transfer moves money from one account to another, converting it when the
+// two hold different currencies. debit plus fee leaves fromAccount and credit
+// reaches toAccount; across currencies the fx accounts take the other side of
+// each leg and the fee goes to the fee account.
+func (d *walletManager) transfer(reference, fromAccount, toAccount string, debit, fee, credit money) (int, error) {
+	if debit.currency == credit.currency && fee.minor == 0 {
+		return d.move(reference, fromAccount, toAccount, debit)
+	}
+	lines := []postingLine{debitLine(fromAccount, debit.plus(fee))}
+	if debit.currency == credit.currency {
+		lines = append(lines, creditLine(toAccount, credit))
+	} else {
+		lines = append(lines, creditLine(fxAccount(debit.currency), debit), debitLine(fxAccount(credit.currency), credit), creditLine(toAccount, credit))
+	}
+	if fee.minor > 0 {
+		lines = append(lines, creditLine(feeAccount(fee.currency), fee))
+	}
+	return d.postLines(reference, lines...)
+}
+
+// reversePosting posts the mirror image of an earlier posting, putting the
+// money back where it came from.
+func (d *walletManager) reversePosting(postingId int, reference string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var lines []postingLine
+	for _, e := range d.ledger.entries {
+		if e.postingId == postingId {
+			lines = append(lines, postingLine{accountId: e.accountId, currency: e.currency, debit: e.credit, credit: e.debit})
+		}
+	}
+	if len(lines) == 0 {
+		return 0, fmt.Errorf("posting %d not found", postingId)
+	}
+	return d.post(reference, lines...)
+}
+
+// move debits one account and credits another in the same currency.
+func (d *walletManager) move(reference, fromAccount, toAccount string, amount money) (int, error) {
+	return d.postLines(reference, debitLine(fromAccount, amount), creditLine(toAccount, amount))
+}
+
+// postLines posts to the ledger and keeps wallet balances in step. Wallets
+// cannot be overdrawn; clearing accounts can, since they mirror money held
+// outside the system.
+func (d *walletManager) postLines(reference string, lines ...postingLine) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.post(reference, lines...)
+}
+
+// post does the work of postLines. The caller holds the lock.
+func (d *walletManager) post(reference string, lines ...postingLine) (int, error) {
+	outgoing := make(map[string]int)
+	for _, l := range lines {
+		if !isWalletAccount(l.accountId) {
+			continue
+		}
+		currency, ok := d.currencies[l.accountId]
+		if !ok {
+			return 0, fmt.Errorf("%w: %s", errWalletNotFound, l.accountId)
+		}
+		if currency != l.currency {
+			return 0, fmt.Errorf("%w: %s holds %s, not %s", errCurrencyMismatch, l.accountId, currency, l.currency)
+		}
+		outgoing[l.accountId] += l.debit - l.credit
+	}
+	for accountId, amount := range outgoing {
+		if amount > d.balances[accountId] {
+			return 0, fmt.Errorf("%w: %s has %s, needs %s", errInsufficientFunds, accountId, newMoney(d.balances[accountId], d.currencies[accountId]), newMoney(amount, d.currencies[accountId]))
+		}
+	}
+	postingId, err := d.ledger.post(reference, lines...)
+	if err != nil {
+		return 0, err
+	}
+	for accountId, amount := range outgoing {
+		d.balances[accountId] -= amount
+	}
+	return postingId, nil
+}
+
+func isWalletAccount(accountId string) bool {
+	return strings.HasPrefix(accountId, "wallet:")
+}
+
+// audit rebuilds every wallet balance from the ledger and reports the wallets
+// whose running balance disagrees, plus any currency the ledger does not net
+// to zero in.
+func (d *walletManager) audit() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var problems []string
+	totals := make(map[string]int)
+	for _, e := range d.ledger.entries {
+		totals[e.currency] += e.credit - e.debit
+	}
+	for currency, total := range totals {
+		if total != 0 {
+			problems = append(problems, fmt.Sprintf("ledger does not net to zero in %s: %d", currency, total))
+		}
+	}
+
+	var accountIds []string
+	for accountId := range d.balances {
+		accountIds = append(accountIds, accountId)
+	}
+	sort.Strings(accountIds)
+	for _, accountId := range accountIds {
+		if recomputed := d.ledger.balance(accountId); recomputed != d.balances[accountId] {
+			problems = append(problems, fmt.Sprintf("%s: balance %d, ledger says %d", accountId, d.balances[accountId], recomputed))
+		}
+	}
+	return problems
+}
+
+// entries returns a copy of the ledger to report from.
+func (d *walletManager) entries() []ledgerEntry {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]ledgerEntry(nil), d.ledger.entries...)
+}
+
+// accountBalance is the ledger balance of any account, wallet or not.
+func (d *walletManager) accountBalance(accountId string) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.ledger.balance(accountId)
+}
+
+// totalWalletBalance adds up every wallet holding currency.
+func (d *walletManager) totalWalletBalance(currency string) money {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	total := newMoney(0, currency)
+	for accountId, balance := range d.balances {
+		if d.currencies[accountId] == currency {
+			total.minor += balance
+		}
+	}
+	return total
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestPostingChecksCurrenciesBeforeWriting posts to an account new to the
+// ledger in two currencies at once; nothing may be written, and the account
+// must be free to take either currency afterwards.
+func TestPostingChecksCurrenciesBeforeWriting(t *testing.T) {
+	l := &ledger{}
+	_, err := l.post("mixed",
+		creditLine("wallet:1", newMoney(100, "INR")),
+		debitLine("clearing:card:INR", newMoney(100, "INR")),
+		debitLine("wallet:1", newMoney(100, "USD")),
+		creditLine("clearing:card:USD", newMoney(100, "USD")),
+	)
+	if !errors.Is(err, errCurrencyMismatch) {
+		t.Fatalf("got %v, want %v", err, errCurrencyMismatch)
+	}
+	if len(l.entries) != 0 || len(l.currencies) != 0 {
+		t.Fatalf("a rejected posting left %d entries and %v behind", len(l.entries), l.currencies)
+	}
+	if _, err := l.post("usd", creditLine("wallet:1", newMoney(100, "USD")), debitLine("clearing:card:USD", newMoney(100, "USD"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.post("inr", creditLine("wallet:1", newMoney(100, "INR")), debitLine("clearing:card:INR", newMoney(100, "INR"))); !errors.Is(err, errCurrencyMismatch) {
+		t.Fatalf("got %v, want %v", err, errCurrencyMismatch)
+	}
+}
+
+func TestPaymentsMustBePositive(t *testing.T) {
+	payments := newTestPayments(t, 2, majorUnits(1000, "INR"))
+	for _, amount := range []money{newMoney(0, "INR"), newMoney(-500, "INR"), newMoney(500, "XYZ")} {
+		payment := *payments
+		payment.amount = amount
+		if _, err := payment.doTransaction("bad-"+amount.String(), 1, 2, payFromWallet); !errors.Is(err, errInvalidPaymentAmount) {
+			t.Errorf("paying %s: got %v, want %v", amount, err, errInvalidPaymentAmount)
+		}
+	}
+	if history := payments.store.historyForUser(1); len(history) != 0 {
+		t.Fatalf("rejected payments left %d records", len(history))
+	}
+	checkMoneyConserved(t, payments, 2, majorUnits(1000, "INR"))
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type user interface {
 	getId() int
+	getName() string
+	getEmail() string
+	getPhone() string
 	printDetail()
 }
 
@@ -14,12 +23,25 @@ type appUser struct {
 	id    int
 	name  string
 	email string
+	phone string
 }
 
 func (d *appUser) getId() int {
 	return d.id
 }
 
+func (d *appUser) getName() string {
+	return d.name
+}
+
+func (d *appUser) getEmail() string {
+	return d.email
+}
+
+func (d *appUser) getPhone() string {
+	return d.phone
+}
+
 func (d *appUser) printDetail() {
 	fmt.Println("[UserDetail] userId:", d.id, "UserName:", d.name, "email:", d.email)
 }
@@ -32,242 +54,945 @@ func addUser(id int, name, email string) user {
 	return d
 }
 
-type instrument interface {
-	getId() int
-	printDetail()
-}
-
-type paymentInstrument struct {
-	id   int
-	name string
-}
-
-type card struct {
-	paymentInstrument
+type transaction interface {
+	doTransaction()
 }
 
-func (d *card) getId() int {
-	return d.id
-}
+// payFromWallet is passed as the instrument id to pay out of the sender's
+// wallet balance instead of charging one of their instruments, and
+// payWithDefault to charge the sender's default instrument.
+const (
+	payFromWallet  = 0
+	payWithDefault = -1
+)
 
-func (d *card) printDetail() {
-	fmt.Println("[InstrumentDetail] instrument id:", d.id, "instrumentName:", d.name)
-}
+// paymentTransaction pays amount, in the sender's currency. When the receiver's
+// wallet holds another currency the payment is converted through fx, at the
+// rate locked by quoteId if one is set or by a fresh quote otherwise.
+type paymentTransaction struct {
+	amount            money
+	quoteId           string
+	fx                *fxService
+	userManager       *userManager
+	instrumentManager *instrumentManager
+	walletManager     *walletManager
+	store             *transactionStore
+	disputes          *disputeStore
+	gateways          *gatewayRouter
+	risk              *riskEngine
+	notifier          *notificationService
+}
+
+// doTransaction pays amount from one user to another and returns the payment
+// record. Retrying with the same idempotency key returns the original payment
+// and its outcome rather than paying again.
+func (d *paymentTransaction) doTransaction(idempotencyKey string, fromSendId, toSendId, instrumentId int) (transferRecord, error) {
+	if d.amount.minor <= 0 || validCurrency(d.amount.currency) != nil {
+		err := fmt.Errorf("%w: %s", errInvalidPaymentAmount, d.amount)
+		fmt.Println("[TRANSACTION_IN_PROGRESS] payment rejected:", err)
+		return transferRecord{}, err
+	}
+	if instrumentId == payWithDefault {
+		instrument, err := d.instrumentManager.getDefault(fromSendId)
+		if err != nil {
+			fmt.Println("[TRANSACTION_IN_PROGRESS] payment rejected:", err)
+			return transferRecord{}, err
+		}
+		instrumentId = instrument.getId()
+	}
+	record, created, err := d.store.create(idempotencyKey, fromSendId, toSendId, instrumentId, d.amount)
+	if err != nil {
+		fmt.Println("[TRANSACTION_IN_PROGRESS] payment rejected:", err)
+		return transferRecord{}, err
+	}
+	if !created {
+		fmt.Println("[TRANSACTION_IN_PROGRESS] idempotency key", idempotencyKey, "already used by", record.transactionId, "with status", record.status, ". Not paying again")
+		return record, record.outcome()
+	}
+	transactionId := record.transactionId
+	unlock, _ := d.store.lock(transactionId)
+	defer unlock()
+	fmt.Println("[TRANSACTION_IN_PROGRESS] created", transactionId, "for", d.amount, "from userId:", fromSendId, "to userId:", toSendId)
 
-func setCardInstrument(id int, name string) instrument {
-	return &card{
-		paymentInstrument{
-			id:   id,
-			name: name,
-		},
+	// check if toSend exists
+	if !d.userManager.checkIfUserExists(toSendId) {
+		return d.failTransaction(transactionId, fmt.Errorf("userId %d does not exist", toSendId))
 	}
-}
+	fmt.Println("[TRANSACTION_IN_PROGRESS] userId:", toSendId, "exists. Proceeding with payment")
 
-type bank struct {
-	paymentInstrument
-}
+	// the sender's wallet only pays out in its own currency
+	if instrumentId == payFromWallet {
+		if currency, err := d.walletManager.currencyOf(fromSendId); err != nil {
+			return d.failTransaction(transactionId, err)
+		} else if currency != d.amount.currency {
+			return d.failTransaction(transactionId, fmt.Errorf("%w: wallet holds %s, payment is in %s", errCurrencyMismatch, currency, d.amount.currency))
+		}
+	}
+	// convert into the receiver's currency
+	receiveCurrency, err := d.walletManager.currencyOf(toSendId)
+	if err != nil {
+		return d.failTransaction(transactionId, err)
+	}
+	if receiveCurrency != d.amount.currency {
+		quote, err := d.lockRate(fromSendId, receiveCurrency)
+		if err != nil {
+			return d.failTransaction(transactionId, err)
+		}
+		d.store.setConversion(transactionId, quote)
+		record, _ = d.store.getTransaction(transactionId)
+		fmt.Println("[TRANSACTION_IN_PROGRESS]", transactionId, "converts", quote.send, "to", quote.receive, "at", formatRate(quote.rate), "with fee", quote.fee)
+	}
 
-func (d *bank) getId() int {
-	return d.id
-}
+	// validate payment
+	if instrumentId != payFromWallet {
+		if err := d.instrumentManager.validatePayment(fromSendId, instrumentId); err != nil {
+			return d.failTransaction(transactionId, err)
+		}
+		fmt.Println("[TRANSACTION_IN_PROGRESS] instrumentId:", instrumentId, "exists for userId: ", fromSendId, ". Proceeding with payment")
+	}
 
-func (d *bank) printDetail() {
-	fmt.Println("[InstrumentDetail] instrument id:", d.id, "instrumentName:", d.name)
+	// run the risk rules before any money moves
+	if d.risk != nil {
+		assessment := d.risk.assess(record)
+		switch assessment.decision {
+		case decisionDeny:
+			return d.failTransaction(transactionId, fmt.Errorf("%w: %s", errRiskDenied, strings.Join(assessment.reasons, "; ")))
+		case decisionReview:
+			d.store.transition(transactionId, statusInReview, strings.Join(assessment.reasons, "; "))
+			d.notifier.notify(fromSendId, eventHeldForReview, messageData{Amount: record.charged(), TransactionId: transactionId})
+			record, _ := d.store.getTransaction(transactionId)
+			return record, fmt.Errorf("%w: %s", errHeldForReview, strings.Join(assessment.reasons, "; "))
+		}
+	}
+	return d.processTransaction(transactionId)
 }
 
-func setBankInstrument(id int, name string) instrument {
-	return &bank{
-		paymentInstrument{
-			id:   id,
-			name: name,
-		},
+// lockRate returns the quote the payment converts at: the one the sender
+// locked in advance, or a fresh one.
+func (d *paymentTransaction) lockRate(fromSendId int, receiveCurrency string) (fxQuote, error) {
+	if d.fx == nil {
+		return fxQuote{}, fmt.Errorf("%w: %s to %s", errNoFXProvider, d.amount.currency, receiveCurrency)
+	}
+	if d.quoteId == "" {
+		return d.fx.quote(fromSendId, d.amount, receiveCurrency)
+	}
+	quote, err := d.fx.getQuote(d.quoteId)
+	if err != nil {
+		return fxQuote{}, err
 	}
+	if quote.userId != fromSendId {
+		return fxQuote{}, fmt.Errorf("%w: %s belongs to userId %d, not %d", errQuoteNotOwned, quote.quoteId, quote.userId, fromSendId)
+	}
+	if quote.send != d.amount || quote.receive.currency != receiveCurrency {
+		return fxQuote{}, fmt.Errorf("%w: %s quotes %s to %s, payment is %s to %s", errQuoteMismatch, quote.quoteId, quote.send, quote.receive.currency, d.amount, receiveCurrency)
+	}
+	return quote, nil
 }
 
-type transaction interface {
-	doTransaction()
+// approveReview lets an operator release a payment the risk rules held back.
+func (d *paymentTransaction) approveReview(transactionId, note string) (transferRecord, error) {
+	unlock, err := d.store.lock(transactionId)
+	if err != nil {
+		return transferRecord{}, err
+	}
+	defer unlock()
+	record, err := d.store.getTransaction(transactionId)
+	if err != nil {
+		return transferRecord{}, err
+	}
+	if record.status != statusInReview {
+		return record, fmt.Errorf("%w: %s is %s, not in review", errInvalidTransition, transactionId, record.status)
+	}
+	fmt.Println("[RISK]", transactionId, "approved in review:", note)
+	return d.processTransaction(transactionId)
 }
 
-type paymentTransaction struct {
-	amount            int
-	userManager       *userManager
-	instrumentManager *instrumentManager
-	processor         processor
-	notification      notification
+func (d *paymentTransaction) rejectReview(transactionId, note string) (transferRecord, error) {
+	unlock, err := d.store.lock(transactionId)
+	if err != nil {
+		return transferRecord{}, err
+	}
+	defer unlock()
+	record, err := d.store.getTransaction(transactionId)
+	if err != nil {
+		return transferRecord{}, err
+	}
+	if record.status != statusInReview {
+		return record, fmt.Errorf("%w: %s is %s, not in review", errInvalidTransition, transactionId, record.status)
+	}
+	fmt.Println("[RISK]", transactionId, "rejected in review:", note)
+	return d.failTransaction(transactionId, fmt.Errorf("%w: %s", errRiskDenied, note))
 }
 
-func (d *paymentTransaction) doTransaction(fromSendId, toSendId, instrumentId int) bool {
-	// check if toSend exists
-	if !d.userManager.checkIfUserExists(toSendId) {
-		fmt.Println("[TRANSACTION_IN_PROGRESS] userId:", toSendId, "donot exists. Aborting with payment")
-		return false
+// processTransaction moves the money for a payment that passed validation and
+// the risk rules. The caller holds the payment's lock.
+func (d *paymentTransaction) processTransaction(transactionId string) (transferRecord, error) {
+	record, err := d.store.getTransaction(transactionId)
+	if err != nil {
+		return transferRecord{}, err
 	}
-	fmt.Println("[TRANSACTION_IN_PROGRESS] userId:", toSendId, "exists. Proceeding with payment")
+	fromSendId, toSendId, charged := record.fromUserId, record.toUserId, record.charged()
 
-	// validate payment
-	if !d.instrumentManager.validatePayment(fromSendId, instrumentId) {
-		fmt.Println("[TRANSACTION_IN_PROGRESS] instrumentId:", instrumentId, "donot exists for userId: ", fromSendId, ". Aborting payment")
-		return false
+	// the locked rate is spent as the money moves, and only while it holds;
+	// failTransaction gives it back if the money does not move after all
+	if record.quoteId != "" {
+		if d.fx == nil {
+			return d.failTransaction(transactionId, fmt.Errorf("%w: %s", errNoFXProvider, record.quoteId))
+		}
+		if _, err := d.fx.use(record.quoteId, transactionId, time.Now()); err != nil {
+			return d.failTransaction(transactionId, err)
+		}
 	}
-	fmt.Println("[TRANSACTION_IN_PROGRESS] instrumentId:", instrumentId, "exists for userId: ", fromSendId, ". Proceeding with payment")
 
-	// process payment
-	d.processor.processPayment()
+	if record.instrumentId == payFromWallet {
+		// move money between the wallets
+		balance, err := d.walletManager.getBalance(fromSendId)
+		if err != nil {
+			return d.failTransaction(transactionId, err)
+		}
+		if balance.minor < charged.minor {
+			return d.failTransaction(transactionId, fmt.Errorf("%w: wallet balance %s, needs %s", errInsufficientFunds, balance, charged))
+		}
+		d.store.transition(transactionId, statusAuthorised, "wallet balance covers the amount")
+		postingId, err := d.walletManager.transfer(transactionId, walletAccount(fromSendId), walletAccount(toSendId), record.amount, record.fee, record.credited)
+		if err != nil {
+			return d.failTransaction(transactionId, err)
+		}
+		d.store.addPosting(transactionId, postingId)
+	} else {
+		// the instrument may have been removed or expired while in review
+		if err := d.instrumentManager.validatePayment(fromSendId, record.instrumentId); err != nil {
+			return d.failTransaction(transactionId, err)
+		}
+		// charge the instrument through its gateway
+		instrument, err := d.instrumentManager.selectInstrument(fromSendId, record.instrumentId)
+		if err != nil {
+			return d.failTransaction(transactionId, err)
+		}
+		err = d.chargeInstrument(transactionId, instrument, charged, func() (int, error) {
+			return d.walletManager.transfer(transactionId, clearingAccount(instrument.getType(), charged.currency), walletAccount(toSendId), record.amount, record.fee, record.credited)
+		})
+		if err != nil {
+			return d.failTransaction(transactionId, err)
+		}
+	}
+	d.store.transition(transactionId, statusCaptured, "")
 
 	// notify users
-	notification1 := getNotificationObj(1, fromSendId, "Amount Debited:"+strconv.Itoa(d.amount))
-	notification1.notifyUser()
-	notification2 := getNotificationObj(2, toSendId, "Amount Credited:"+strconv.Itoa(d.amount))
-	notification2.notifyUser()
-	return true
+	d.notifier.notify(fromSendId, eventDebited, messageData{Amount: charged, TransactionId: transactionId})
+	d.notifier.notify(toSendId, eventCredited, messageData{Amount: record.credited, TransactionId: transactionId})
+	return d.store.getTransaction(transactionId)
 
 }
 
-type processor interface {
-	processPayment()
-}
+// addMoney loads the user's wallet with the transaction amount, charged to
+// one of their instruments. It is recorded as a payment to themselves.
+func (d *paymentTransaction) addMoney(idempotencyKey string, userId, instrumentId int) (transferRecord, error) {
+	record, created, err := d.store.create(idempotencyKey, userId, userId, instrumentId, d.amount)
+	if err != nil {
+		fmt.Println("[ADD_MONEY] rejected:", err)
+		return transferRecord{}, err
+	}
+	if !created {
+		fmt.Println("[ADD_MONEY] idempotency key", idempotencyKey, "already used by", record.transactionId, "with status", record.status)
+		return record, record.outcome()
+	}
+	transactionId := record.transactionId
+	unlock, _ := d.store.lock(transactionId)
+	defer unlock()
+
+	if currency, err := d.walletManager.currencyOf(userId); err != nil {
+		return d.failTransaction(transactionId, err)
+	} else if currency != d.amount.currency {
+		return d.failTransaction(transactionId, fmt.Errorf("%w: wallet holds %s, top-up is in %s", errCurrencyMismatch, currency, d.amount.currency))
+	}
+	if err := d.instrumentManager.validatePayment(userId, instrumentId); err != nil {
+		return d.failTransaction(transactionId, err)
+	}
+	instrument, err := d.instrumentManager.selectInstrument(userId, instrumentId)
+	if err != nil {
+		return d.failTransaction(transactionId, err)
+	}
+	err = d.chargeInstrument(transactionId, instrument, d.amount, func() (int, error) {
+		return d.walletManager.addMoney(userId, instrument.getType(), d.amount, transactionId)
+	})
+	if err != nil {
+		return d.failTransaction(transactionId, err)
+	}
+	d.store.transition(transactionId, statusCaptured, "")
 
-type paymentProcessor struct {
-	id int
+	d.notifier.notify(userId, eventWalletTopUp, messageData{Amount: d.amount, TransactionId: transactionId})
+	return d.store.getTransaction(transactionId)
 }
 
-func (d *paymentProcessor) processPayment() {
-	fmt.Println("[PAYMENT-PROCESSOR] Processing payment with processorId:", d.id)
+// reverseTransaction undoes a captured payment by posting the mirror image of
+// each of its ledger postings, then refunds any instrument charge.
+func (d *paymentTransaction) reverseTransaction(transactionId, reason string) (transferRecord, error) {
+	unlock, err := d.store.lock(transactionId)
+	if err != nil {
+		return transferRecord{}, err
+	}
+	defer unlock()
+	record, err := d.store.getTransaction(transactionId)
+	if err != nil {
+		return transferRecord{}, err
+	}
+	if record.status != statusCaptured {
+		return record, fmt.Errorf("%w: %s is %s, only captured payments can be reversed", errInvalidTransition, transactionId, record.status)
+	}
+	// the ledger goes first: it fails if the receiver has spent the money, and
+	// then the card must not have been refunded
+	reference := transactionId + ":reversal"
+	reversalIds, err := d.reversePostings(transactionId, record.postingIds, reference)
+	if err != nil {
+		fmt.Println("[REVERSAL]", transactionId, "could not be reversed:", err)
+		return record, err
+	}
+	if err := d.refundCharge(transactionId, record.charged()); err != nil {
+		// the gateway kept the money, so the ledger must too
+		if _, undoErr := d.reversePostings(transactionId, reversalIds, reference+":undo"); undoErr != nil {
+			return record, fmt.Errorf("%v, and the ledger reversal could not be undone: %w", err, undoErr)
+		}
+		return record, err
+	}
+	d.store.transition(transactionId, statusReversed, reason)
+	fmt.Println("[REVERSAL]", transactionId, "reversed:", reason)
+
+	d.notifyParties(record, eventReversed, messageData{Amount: record.charged(), TransactionId: transactionId, Detail: reason})
+	return d.store.getTransaction(transactionId)
+}
+
+// reversePostings posts the mirror image of each posting, last first, and
+// records them on the payment. If one fails, those already posted are undone
+// so the ledger is left as it was.
+func (d *paymentTransaction) reversePostings(transactionId string, postingIds []int, reference string) ([]int, error) {
+	var reversalIds []int
+	for i := len(postingIds) - 1; i >= 0; i-- {
+		reversalId, err := d.walletManager.reversePosting(postingIds[i], reference)
+		if err != nil {
+			for j := len(reversalIds) - 1; j >= 0; j-- {
+				if undoId, undoErr := d.walletManager.reversePosting(reversalIds[j], reference+":undo"); undoErr == nil {
+					d.store.addPosting(transactionId, undoId)
+				}
+			}
+			return nil, err
+		}
+		d.store.addPosting(transactionId, reversalId)
+		reversalIds = append(reversalIds, reversalId)
+	}
+	return reversalIds, nil
 }
 
-type notification interface {
-	notifyUser()
-}
+// chargeInstrument authorises the payment amount on the gateway the
+// instrument routes to, posts the payment to the ledger and then captures it.
+// If the capture fails after the ledger was debited the posting is reversed
+// straight away, so no money moves without the gateway taking it.
+func (d *paymentTransaction) chargeInstrument(transactionId string, instrument instrument, amount money, post func() (int, error)) error {
+	gateway, err := d.gateways.route(instrument.getType())
+	if err != nil {
+		return err
+	}
+	authorisation, err := gateway.authorise(amount, transactionId)
+	if err != nil {
+		return err
+	}
+	d.store.setAuthorisation(transactionId, gateway.getName(), authorisation)
+	d.store.transition(transactionId, statusAuthorised, "authorised by "+gateway.getName()+" as "+authorisation)
 
-type paymentNotification struct {
-	notificationId int
-	userId         int
-	message        string
-}
+	// an uncaptured authorisation is left to lapse on the gateway
+	postingId, err := post()
+	if err != nil {
+		return err
+	}
+	d.store.addPosting(transactionId, postingId)
 
-func (d *paymentNotification) notifyUser() {
-	fmt.Println("[NOTIFICATION] Notification sent to UserId:", d.userId, "msg:", d.message, "notificationId:", d.notificationId)
+	if err := gateway.capture(authorisation, amount); err != nil {
+		reversalId, reversalErr := d.walletManager.reversePosting(postingId, transactionId+":reversal")
+		if reversalErr != nil {
+			return fmt.Errorf("capture failed: %v, and the ledger could not be reversed: %w", err, reversalErr)
+		}
+		d.store.addPosting(transactionId, reversalId)
+		d.store.transition(transactionId, statusReversed, "capture failed: "+err.Error())
+		fmt.Println("[REVERSAL]", transactionId, "reversed automatically after the capture failed")
+		return err
+	}
+	return nil
 }
 
-func getNotificationObj(notificationId, userId int, message string) notification {
-	return &paymentNotification{
-		notificationId: notificationId,
-		userId:         userId,
-		message:        message,
+// refundCharge gives money back on the gateway that charged the payment.
+// Payments out of a wallet have no gateway charge and need no refund.
+func (d *paymentTransaction) refundCharge(transactionId string, amount money) error {
+	record, err := d.store.getTransaction(transactionId)
+	if err != nil {
+		return err
 	}
+	if record.authorisation == "" {
+		return nil
+	}
+	gateway, err := d.gateways.named(record.gatewayName)
+	if err != nil {
+		return err
+	}
+	if err := gateway.refund(record.authorisation, amount); err != nil {
+		fmt.Println("[TRANSACTION_IN_PROGRESS]", transactionId, "could not be refunded on", record.gatewayName, ":", err)
+		return err
+	}
+	return nil
 }
 
-type userManager struct {
-	users []user
+func (d *paymentTransaction) failTransaction(transactionId string, err error) (transferRecord, error) {
+	fmt.Println("[TRANSACTION_IN_PROGRESS]", transactionId, "failed:", err, ". Aborting payment")
+	record, _ := d.store.getTransaction(transactionId)
+	// a payment reversed after a failed capture keeps its REVERSED status
+	if record.status != statusReversed {
+		d.store.transition(transactionId, statusFailed, err.Error())
+	}
+	d.store.setFailure(transactionId, err)
+	// the payment did not go through, so a quote it spent can pay again
+	if record.quoteId != "" && d.fx != nil {
+		d.fx.release(record.quoteId, transactionId)
+	}
+	record, _ = d.store.getTransaction(transactionId)
+	return record, err
 }
 
-func (d *userManager) addUser(id int, name, email string) {
-	fmt.Println("Adding user with ID:", id, "name:", name, "email", email)
-	u := addUser(id, name, email)
-	d.users = append(d.users, u)
-
-}
+var (
+	errUserExists   = errors.New("user id already registered")
+	errEmailTaken   = errors.New("email already registered")
+	errInvalidEmail = errors.New("invalid email")
+	errUserNotFound = errors.New("user not found")
+)
 
-func (d *userManager) getUserDetails(userId int) user {
-	for _, u := range d.users {
-		if u.getId() == userId {
-			return u
-		}
-	}
-	fmt.Println("user not found")
-	return nil
+// userManager indexes users by id and by email. Users are never changed in
+// place: setPhone swaps in an updated copy, so a user handed out earlier can
+// be read without holding the lock.
+type userManager struct {
+	mu      sync.RWMutex
+	users   map[int]user
+	byEmail map[string]int // normalised email to user id
 }
 
-func (d *userManager) checkIfUserExists(id int) bool {
-	for _, u := range d.users {
-		if u.getId() == id {
-			return true
-		}
-	}
-	return false
+func newUserManager() *userManager {
+	return &userManager{users: make(map[int]user), byEmail: make(map[string]int)}
 }
 
-type instrumentManager struct {
-	userToInstrumentsMap map[int][]instrument
+// normaliseEmail makes emails that differ only in case or surrounding space
+// count as the same address.
+func normaliseEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
-func (d *instrumentManager) addInstrument(userId int, instrumentID string, instrumentType string) {
-	fmt.Println("Adding", instrumentID, "which is a", instrumentType, "for user", userId)
-	if len(d.userToInstrumentsMap) == 0 {
-		d.userToInstrumentsMap = make(map[int][]instrument)
-	}
-	if instruments, ok := d.userToInstrumentsMap[userId]; ok {
-		lastID := len(instruments)
-		switch instrumentType {
-		case "card":
-			instruments = append(instruments, setCardInstrument(lastID+1, instrumentID))
-		case "bank":
-			instruments = append(instruments, setBankInstrument(lastID+1, instrumentID))
-		}
-		d.userToInstrumentsMap[userId] = instruments
-	} else {
-		switch instrumentType {
-		case "card":
-			instruments = append(instruments, setCardInstrument(1, instrumentID))
-		case "bank":
-			instruments = append(instruments, setBankInstrument(1, instrumentID))
-		}
-		d.userToInstrumentsMap[userId] = instruments
+func (d *userManager) addUser(id int, name, email string) error {
+	key := normaliseEmail(email)
+	if at := strings.Index(key, "@"); at <= 0 || at == len(key)-1 {
+		return fmt.Errorf("%w: %q", errInvalidEmail, email)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.users[id]; ok {
+		return fmt.Errorf("%w: %d", errUserExists, id)
 	}
+	if owner, ok := d.byEmail[key]; ok {
+		return fmt.Errorf("%w: %s belongs to userId %d", errEmailTaken, key, owner)
+	}
+	fmt.Println("Adding user with ID:", id, "name:", name, "email", email)
+	d.users[id] = addUser(id, name, email)
+	d.byEmail[key] = id
+	return nil
 }
 
-func (d *instrumentManager) selectInstrument(userId, instrumentId int) instrument {
-	if instrument, ok := d.userToInstrumentsMap[userId]; ok {
-		for _, i := range instrument {
-			if i.getId() == instrumentId {
-				return i
-			}
-		}
+func (d *userManager) setPhone(userId int, phone string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u, ok := d.users[userId]
+	if !ok {
+		return fmt.Errorf("%w: %d", errUserNotFound, userId)
 	}
-	fmt.Println("card not found")
+	updated := *u.(*appUser)
+	updated.phone = phone
+	d.users[userId] = &updated
 	return nil
 }
 
-func (d *instrumentManager) validatePayment(userId, paymentId int) bool {
-	if payments, ok := d.userToInstrumentsMap[userId]; ok {
-		for _, p := range payments {
-			if p.getId() == paymentId {
-				return true
-			}
-		}
+func (d *userManager) getUserDetails(userId int) user {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	u, ok := d.users[userId]
+	if !ok {
+		fmt.Println("user not found")
+		return nil
 	}
-	return false
+	return u
+}
+
+func (d *userManager) checkIfUserExists(id int) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.users[id]
+	return ok
 }
 
 func main() {
-	userManager := &userManager{}
+	userManager := newUserManager()
 	userManager.addUser(1, "shashank", "shashank@gmail.com")
 	userManager.addUser(2, "prakash", "prakash@gmail.com")
+	userManager.addUser(3, "ravi", "ravi@gmail.com")
+	userManager.addUser(4, "mule", "mule@example.com")
+	userManager.addUser(5, "emily", "emily@example.com")
+	// emails are unique whatever their case
+	if err := userManager.addUser(6, "shashank again", " Shashank@Gmail.com"); err != nil {
+		fmt.Println("User rejected:", err)
+	}
+
+	walletManager := newWalletManager()
+	walletManager.openWallet(1, "INR")
+	walletManager.openWallet(2, "INR")
+	walletManager.openWallet(3, "INR")
+	walletManager.openWallet(4, "INR")
+	walletManager.openWallet(5, "USD")
+
+	instrumentManager := newInstrumentManager(userManager)
+	instrumentManager.addInstrument(1, instrumentCard, instrumentDetails{Name: "SBI_Card_1", CardNumber: "4111 1111 1111 1111", ExpiryMonth: 12, ExpiryYear: 2030})
+	hdfcCard, _ := instrumentManager.addInstrument(2, instrumentCard, instrumentDetails{Name: "HDFC_Card_1", CardNumber: "5500-0000-0000-0004", ExpiryMonth: 6, ExpiryYear: 2031})
+	axisBank, _ := instrumentManager.addInstrument(2, instrumentBank, instrumentDetails{Name: "AXIS_BANK", AccountNumber: "917010012345678", IFSC: "UTIB0000123"})
+
+	fmt.Println("----------------Instruments----------------")
+	// bad details are rejected with a reason
+	if _, err := instrumentManager.addInstrument(1, instrumentCard, instrumentDetails{Name: "typo", CardNumber: "4111 1111 1111 1112", ExpiryMonth: 1, ExpiryYear: 2030}); err != nil {
+		fmt.Println("Instrument rejected:", err)
+	}
+	if _, err := instrumentManager.addInstrument(1, instrumentCard, instrumentDetails{Name: "old card", CardNumber: "4012 8888 8888 1881", ExpiryMonth: 3, ExpiryYear: 2021}); err != nil {
+		fmt.Println("Instrument rejected:", err)
+	}
+	if _, err := instrumentManager.addInstrument(1, "cheque", instrumentDetails{Name: "cheque book"}); err != nil {
+		fmt.Println("Instrument rejected:", err)
+	}
+	instrumentManager.addInstrument(1, instrumentUPI, instrumentDetails{Name: "SBI_UPI", VPA: "shashank@sbi"})
+	instrumentManager.addInstrument(1, instrumentWallet, instrumentDetails{Name: "PhonePe", Provider: "phonepe", Phone: "9845000001"})
 
-	instrumentManager := &instrumentManager{}
-	instrumentManager.addInstrument(1, "SBI_Card_1", "card")
-	instrumentManager.addInstrument(2, "HDFC_Card_1", "card")
-	instrumentManager.addInstrument(2, "AXIS_BANK", "bank")
+	// the bank account cannot be charged until the micro-deposits are confirmed
+	if err := instrumentManager.validatePayment(2, axisBank.getId()); err != nil {
+		fmt.Println("Bank account not usable yet:", err)
+	}
+	// user 2 reads the two amounts off their statement, getting them wrong once
+	deposits := axisBank.(*bank).microDeposits
+	if err := instrumentManager.verifyBankAccount(2, axisBank.getId(), deposits[0]+1, deposits[1]); err != nil {
+		fmt.Println("Verification failed:", err)
+	}
+	instrumentManager.verifyBankAccount(2, axisBank.getId(), deposits[1], deposits[0])
+
+	// user 1 moves their default to UPI and drops the PhonePe wallet
+	if def, err := instrumentManager.getDefault(1); err == nil {
+		fmt.Println("Default for userId: 1 was instrumentId", def.getId())
+	}
+	instrumentManager.setDefault(1, 4)
+	instrumentManager.removeInstrument(1, 5)
+	if err := instrumentManager.setDefault(1, 5); err != nil {
+		fmt.Println("Cannot make it the default:", err)
+	}
+	for _, i := range instrumentManager.instrumentsFor(1) {
+		i.printDetail()
+	}
+
+	outboxDir := filepath.Join(os.TempDir(), "p2p-outbox")
+	channels, err := newOutboxChannels(outboxDir)
+	if err != nil {
+		fmt.Println("could not create the notification outbox:", err)
+		return
+	}
+	fmt.Println("[NOTIFICATION] writing email, sms and push messages to", outboxDir)
+	notifier := newNotificationService(userManager, channels...)
+	// user 2 wants texts as well as email; the SMS provider is flaky at first
+	userManager.setPhone(2, "+91-98450-00002")
+	notifier.setPreferences(2, channelEmail, channelSMS)
+	channels[1].(*smsChannel).failNext = 2
+	// user 1 wants push too, but the push service is down for the first message
+	notifier.setPreferences(1, channelEmail, channelPush)
+	channels[2].(*pushChannel).failNext = 3
+
+	store := newTransactionStore()
+	disputes := newDisputeStore()
+
+	cardGateway := newFakeGateway("card-gateway", gatewaySucceed)
+	bankGateway := newFakeGateway("bank-transfer-gateway", gatewaySucceed)
+	gateways := newGatewayRouter()
+	gateways.register("card", cardGateway)
+	gateways.register("bank", bankGateway)
+	upiGateway := newFakeGateway("upi-gateway", gatewaySucceed)
+	walletGateway := newFakeGateway("wallet-gateway", gatewaySucceed)
+	gateways.register(instrumentUPI, upiGateway)
+	gateways.register(instrumentWallet, walletGateway)
+
+	risk := newRiskEngine(store, riskConfig{
+		TransactionLimit: moneyLimits{"INR": 100000, "USD": 1200},
+		DailyLimit:       moneyLimits{"INR": 200000, "USD": 2400},
+		VelocityCount:    10,
+		VelocityWindow:   10 * time.Minute,
+		NewPayeeCoolDown: 24 * time.Hour,
+		NewPayeeLimit:    moneyLimits{"INR": 25000, "USD": 300},
+		StepUpThreshold:  moneyLimits{"INR": 50000, "USD": 600},
+		BlockedUsers:     map[int]string{4: "reported money mule"},
+	})
 
 	fmt.Println("----------------Running inference----------------")
 	sendFrom := userManager.getUserDetails(2)
 	sendTo := userManager.getUserDetails(1)
 
-	instrumentToSend := instrumentManager.selectInstrument(2, 2)
+	instrumentToSend, err := instrumentManager.selectInstrument(2, axisBank.getId())
+	if err != nil {
+		fmt.Println("failed to select instrument:", err)
+		return
+	}
 	instrumentToSend.printDetail()
 
 	transaction := &paymentTransaction{
-		amount:            100,
+		amount:            majorUnits(100, "INR"),
 		userManager:       userManager,
 		instrumentManager: instrumentManager,
-		processor:         &paymentProcessor{id: 1},
+		walletManager:     walletManager,
+		store:             store,
+		disputes:          disputes,
+		gateways:          gateways,
+		risk:              risk,
+		notifier:          notifier,
 	}
 
-	status := transaction.doTransaction(sendFrom.getId(), sendTo.getId(), instrumentToSend.getId())
-	if status {
+	record, err := transaction.doTransaction("order-42", sendFrom.getId(), sendTo.getId(), instrumentToSend.getId())
+	if err == nil {
+		fmt.Println("Transaction successful:", record.transactionId)
+	} else {
+		fmt.Println("Transaction failed:", err)
+	}
+	// the client timed out and retries with the same key: no second payment
+	retry, _ := transaction.doTransaction("order-42", sendFrom.getId(), sendTo.getId(), instrumentToSend.getId())
+	fmt.Println("Retry returned", retry.transactionId, "with status", retry.status)
+
+	// user 1 pays back out of the money they just received
+	payBack := &paymentTransaction{
+		amount:            majorUnits(60, "INR"),
+		userManager:       userManager,
+		instrumentManager: instrumentManager,
+		walletManager:     walletManager,
+		store:             store,
+		disputes:          disputes,
+		gateways:          gateways,
+		risk:              risk,
+		notifier:          notifier,
+	}
+	if _, err := payBack.doTransaction("payback-1", 1, 2, payFromWallet); err == nil {
 		fmt.Println("Transaction successful")
+	}
+	// only 40 left, so a second pay back is rejected
+	if _, err := payBack.doTransaction("payback-2", 1, 2, payFromWallet); err != nil {
+		fmt.Println("Transaction failed:", err)
+	}
+
+	topUp := &paymentTransaction{
+		amount:            majorUnits(500, "INR"),
+		userManager:       userManager,
+		instrumentManager: instrumentManager,
+		walletManager:     walletManager,
+		store:             store,
+		disputes:          disputes,
+		gateways:          gateways,
+		risk:              risk,
+		notifier:          notifier,
+	}
+	if record, err := topUp.addMoney("topup-1", 2, hdfcCard.getId()); err == nil {
+		// the top-up was a mistake: reverse it
+		topUp.reverseTransaction(record.transactionId, "requested by customer")
+	}
+
+	// the card issuer declines and then stops answering
+	cardGateway.setBehaviour(gatewayDecline)
+	if _, err := transaction.doTransaction("order-43", 2, 1, hdfcCard.getId()); err != nil {
+		fmt.Println("Transaction failed:", err)
+	}
+	cardGateway.setBehaviour(gatewayTimeout)
+	if _, err := transaction.doTransaction("order-44", 2, 1, hdfcCard.getId()); err != nil {
+		fmt.Println("Transaction failed:", err)
+	}
+	cardGateway.setBehaviour(gatewaySucceed)
+
+	// the bank accepts the transfer but the capture fails after the debit
+	bankGateway.onCapture = gatewayDecline
+	if record, err := transaction.doTransaction("order-45", 2, 1, axisBank.getId()); err != nil {
+		fmt.Println("Transaction failed:", err, "status:", record.status)
+	}
+	bankGateway.onCapture = gatewaySucceed
+
+	fmt.Println("----------------Refunds and disputes----------------")
+	purchase := &paymentTransaction{
+		amount:            majorUnits(200, "INR"),
+		userManager:       userManager,
+		instrumentManager: instrumentManager,
+		walletManager:     walletManager,
+		store:             store,
+		disputes:          disputes,
+		gateways:          gateways,
+		risk:              risk,
+		notifier:          notifier,
+	}
+	order46, _ := purchase.doTransaction("order-46", 2, 1, hdfcCard.getId())
+	purchase.refund(order46.transactionId, majorUnits(50, "INR"), "one item out of stock")
+	if _, err := purchase.refund(order46.transactionId, majorUnits(500, "INR"), "whole order"); err != nil {
+		fmt.Println("Refund failed:", err)
+	}
+	if ds, err := purchase.raiseDispute(order46.transactionId, 2, "rest of the order never arrived"); err == nil {
+		purchase.addEvidence(ds.disputeId, 2, "no delivery scan after dispatch")
+		purchase.addEvidence(ds.disputeId, 1, "signed proof of delivery")
+		ds, _ = purchase.resolveDispute(ds.disputeId, false, "delivery confirmed by courier")
+		ds.printDetail()
+	}
+	purchase.refund(order46.transactionId, majorUnits(150, "INR"), "customer returned the rest")
+
+	order47, _ := purchase.doTransaction("order-47", 2, 1, axisBank.getId())
+	if ds, err := purchase.raiseDispute(order47.transactionId, 2, "charged for a cancelled order"); err == nil {
+		purchase.addEvidence(ds.disputeId, 2, "cancellation email")
+		ds, _ = purchase.resolveDispute(ds.disputeId, true, "order was cancelled before dispatch")
+		ds.printDetail()
+	}
+
+	fmt.Println("----------------Payment requests----------------")
+	requests := newRequestManager(&paymentTransaction{
+		userManager:       userManager,
+		instrumentManager: instrumentManager,
+		walletManager:     walletManager,
+		store:             store,
+		disputes:          disputes,
+		gateways:          gateways,
+		risk:              risk,
+		notifier:          notifier,
+	})
+	// ravi asks shashank for his half of a cab
+	cab, _ := requests.requestMoney(3, []int{1}, majorUnits(30, "INR"), "cab share", 24*time.Hour)
+	for _, r := range requests.pendingFor(1) {
+		r.printDetail()
+	}
+	requests.accept(cab[0].requestId, 1, payFromWallet)
+	// accepting again returns the same transfer
+	if again, err := requests.accept(cab[0].requestId, 1, payFromWallet); err == nil {
+		fmt.Println("Request already paid by", again.transactionId)
+	}
+
+	// shashank collects for a team dinner: prakash pays, mule declines, ravi ignores it
+	dinner, _ := requests.createCollect(1, []int{2, 3, 4}, majorUnits(150, "INR"), "team dinner", 24*time.Hour)
+	for _, requestId := range dinner.requestIds {
+		r := requests.requests[requestId]
+		switch r.payerId {
+		case 2:
+			requests.accept(requestId, 2, hdfcCard.getId())
+		case 4:
+			requests.decline(requestId, 4, "I was not at the dinner")
+		}
+	}
+	if _, err := requests.requestMoney(1, []int{1}, majorUnits(10, "INR"), "myself", time.Hour); err != nil {
+		fmt.Println("Request rejected:", err)
+	}
+	// two days later the unanswered request has expired
+	requests.expireRequests(time.Now().Add(48 * time.Hour))
+	if summary, err := requests.collectStatus(dinner.collectId); err == nil {
+		summary.printDetail()
+	}
+
+	// statements below start from here
+	statementFrom := time.Now()
+
+	fmt.Println("----------------Cross-currency payments----------------")
+	rates := newStaticRateProvider(map[string]int64{"USD/INR": 83250000, "EUR/INR": 90100000})
+	fx := newFXService(rates, 2*time.Minute, 50, 25)
+	abroad := &paymentTransaction{
+		amount:            majorUnits(200, "INR"),
+		fx:                fx,
+		userManager:       userManager,
+		instrumentManager: instrumentManager,
+		walletManager:     walletManager,
+		store:             store,
+		disputes:          disputes,
+		gateways:          gateways,
+		risk:              risk,
+		notifier:          notifier,
+	}
+	// prakash pays emily, whose wallet is in dollars
+	order60, err := abroad.doTransaction("order-60", 2, 5, hdfcCard.getId())
+	if err == nil {
+		order60.printDetail()
+		// a quarter of it comes back, converted at the original rate
+		abroad.refund(order60.transactionId, majorUnits(50, "INR"), "partial cancellation")
+	}
+
+	// emily locks a rate before sending dollars back to shashank
+	quote, _ := fx.quote(5, majorUnits(1, "USD"), "INR")
+	quote.printDetail()
+	payHome := *abroad
+	payHome.amount, payHome.quoteId = quote.send, quote.quoteId
+	if record, err := payHome.doTransaction("gift-1", 5, 1, payFromWallet); err == nil {
+		fmt.Println("Transaction successful:", record.transactionId, "credited", record.credited)
+	}
+	// the same quote cannot pay twice
+	if _, err := payHome.doTransaction("gift-2", 5, 1, payFromWallet); err != nil {
+		fmt.Println("Transaction failed:", err)
+	}
+	// a rate locked for a moment has lapsed by the time she pays
+	fx.lockFor = time.Millisecond
+	lapsed, _ := fx.quote(5, newMoney(50, "USD"), "INR")
+	fx.lockFor = 2 * time.Minute
+	stale := *abroad
+	stale.amount, stale.quoteId = lapsed.send, lapsed.quoteId
+	time.Sleep(5 * time.Millisecond)
+	if _, err := stale.doTransaction("gift-3", 5, 1, payFromWallet); err != nil {
+		fmt.Println("Transaction failed:", err)
+	}
+	// without an FX service a payment cannot cross currencies
+	if _, err := purchase.doTransaction("order-61", 2, 5, hdfcCard.getId()); err != nil {
+		fmt.Println("Transaction failed:", err)
+	}
+
+	fmt.Println("----------------Risk rules----------------")
+	large := &paymentTransaction{
+		amount:            majorUnits(600, "INR"),
+		userManager:       userManager,
+		instrumentManager: instrumentManager,
+		walletManager:     walletManager,
+		store:             store,
+		disputes:          disputes,
+		gateways:          gateways,
+		risk:              risk,
+		notifier:          notifier,
+	}
+	if held, err := large.doTransaction("order-48", 2, 1, hdfcCard.getId()); err != nil {
+		fmt.Println("Transaction held:", err)
+		large.approveReview(held.transactionId, "customer confirmed with one-time password")
+	}
+	if _, err := large.doTransaction("order-49", 2, 3, hdfcCard.getId()); err != nil {
+		fmt.Println("Transaction held:", err)
+	}
+	if _, err := large.doTransaction("order-50", 2, 4, hdfcCard.getId()); err != nil {
+		fmt.Println("Transaction failed:", err)
+	}
+	huge := &paymentTransaction{
+		amount:            majorUnits(1500, "INR"),
+		userManager:       userManager,
+		instrumentManager: instrumentManager,
+		walletManager:     walletManager,
+		store:             store,
+		disputes:          disputes,
+		gateways:          gateways,
+		risk:              risk,
+		notifier:          notifier,
+	}
+	if _, err := huge.doTransaction("order-51", 2, 1, hdfcCard.getId()); err != nil {
+		fmt.Println("Transaction failed:", err)
+	}
+	// user 1 sends many small payments in quick succession
+	small := &paymentTransaction{
+		amount:            majorUnits(4, "INR"),
+		userManager:       userManager,
+		instrumentManager: instrumentManager,
+		walletManager:     walletManager,
+		store:             store,
+		disputes:          disputes,
+		gateways:          gateways,
+		risk:              risk,
+		notifier:          notifier,
+	}
+	// user 1 pays with whatever their default instrument is
+	if record, err := small.doTransaction("coffee", 1, 2, payWithDefault); err == nil {
+		fmt.Println("Paid with default instrumentId", record.instrumentId)
+	}
+
+	for i := 1; i <= 9; i++ {
+		if held, err := small.doTransaction("tip-"+strconv.Itoa(i), 1, 2, payFromWallet); err != nil {
+			fmt.Println("Transaction held:", err)
+			small.rejectReview(held.transactionId, "user did not answer the verification call")
+		}
+	}
+
+	fmt.Println("----------------Statements and reconciliation----------------")
+	// ravi's UPI app captures the payment but the response never reaches us,
+	// so the ledger reverses it while the money has in fact been taken
+	raviUPI, _ := instrumentManager.addInstrument(3, instrumentUPI, instrumentDetails{Name: "RAVI_UPI", VPA: "ravi@okaxis"})
+	upiGateway.onCapture = gatewayLateTimeout
+	if record, err := transaction.doTransaction("order-62", 3, 1, raviUPI.getId()); err != nil {
+		fmt.Println("Transaction failed:", err, "status:", record.status)
+	}
+	upiGateway.onCapture = gatewaySucceed
+
+	reportDir := filepath.Join(os.TempDir(), "p2p-reports")
+	if err := os.MkdirAll(reportDir, 0o755); err != nil {
+		fmt.Println("could not create the report directory:", err)
 		return
 	}
-	fmt.Println("Transaction failed")
+	for _, userId := range []int{1, 5} {
+		s, err := transaction.statement(userId, statementFrom, time.Now().Add(time.Minute))
+		if err != nil {
+			fmt.Println("Statement failed:", err)
+			continue
+		}
+		s.writeText(os.Stdout)
+		path := filepath.Join(reportDir, fmt.Sprintf("statement-%d.csv", userId))
+		if f, err := os.Create(path); err == nil {
+			s.writeCSV(f)
+			f.Close()
+			fmt.Println("[STATEMENT] userId:", userId, "exported to", path)
+		}
+	}
+	if _, err := transaction.statement(1, time.Now(), statementFrom); err != nil {
+		fmt.Println("Statement failed:", err)
+	}
 
+	// the processors drop their settlement files for the day; the card
+	// processor's file has a row for a payment we never made
+	today := time.Now()
+	for _, gateway := range []*fakeGateway{cardGateway, bankGateway, upiGateway, walletGateway} {
+		gateway.writeSettlementFile(filepath.Join(reportDir, settlementFileName(gateway.getName(), today)), today)
+	}
+	if f, err := os.OpenFile(filepath.Join(reportDir, settlementFileName(cardGateway.getName(), today)), os.O_APPEND|os.O_WRONLY, 0o644); err == nil {
+		fmt.Fprintf(f, "%s,card-gateway,card-gateway-AUTH9999,EXT-778,CAPTURE,4999,INR\n", today.Format(time.RFC3339))
+		fmt.Fprintf(f, "%s,card-gateway,card-gateway-AUTH9999,EXT-778,CHARGEBACK,4999,INR\n", today.Format(time.RFC3339))
+		f.Close()
+	}
+	if report, err := transaction.reconcile(today, reportDir); err == nil {
+		report.printDetail()
+		path := filepath.Join(reportDir, "reconciliation-"+today.Format("2006-01-02")+".txt")
+		if f, err := os.Create(path); err == nil {
+			report.writeText(f)
+			f.Close()
+			fmt.Println("[RECONCILIATION] report written to", path)
+		}
+	} else {
+		fmt.Println("Reconciliation failed:", err)
+	}
+
+	fmt.Println("----------------Transaction history----------------")
+	if status, err := store.getTransaction(record.transactionId); err == nil {
+		status.printDetail()
+	}
+	for _, r := range store.historyForUser(2) {
+		fmt.Println("[HISTORY] userId: 2", r.transactionId, r.status, "from:", r.fromUserId, "to:", r.toUserId, "amount:", r.amount, r.failureReason())
+	}
+
+	sent, failed := 0, 0
+	for _, r := range notifier.deliveryLog() {
+		if r.status == deliverySent {
+			sent++
+		} else {
+			failed++
+			fmt.Println("[NOTIFICATION] undelivered:", r.notificationId, "userId:", r.userId, r.event, "via", r.channel, "after", r.attempts, "attempts")
+		}
+	}
+	fmt.Println("[NOTIFICATION]", sent, "deliveries sent,", failed, "failed")
+
+	for _, userId := range []int{1, 2, 5} {
+		balance, _ := walletManager.getBalance(userId)
+		fmt.Println("[WALLET] userId:", userId, "balance:", balance)
+	}
+	for _, accountId := range []string{fxAccount("INR"), fxAccount("USD"), feeAccount("INR"), feeAccount("USD")} {
+		fmt.Println("[LEDGER]", accountId, "balance:", walletManager.accountBalance(accountId))
+	}
+	if problems := walletManager.audit(); len(problems) > 0 {
+		fmt.Println("[AUDIT] ledger mismatches:", problems)
+	} else {
+		fmt.Println("[AUDIT] all wallet balances match the ledger")
+	}
 }
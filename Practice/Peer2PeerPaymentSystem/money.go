@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errCurrencyMismatch = errors.New("currency mismatch")
+	errUnknownCurrency  = errors.New("unknown currency")
+)
+
+// currencyExponents is the number of minor-unit digits for each supported
+// currency: 100 paise to the rupee, no minor unit for the yen.
+var currencyExponents = map[string]int{
+	"INR": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+}
+
+// money is an amount in the minor units of its currency, so 12.50 USD is
+// money{minor: 1250, currency: "USD"}. Amounts never go through floats.
+type money struct {
+	minor    int
+	currency string
+}
+
+func newMoney(minor int, currency string) money {
+	return money{minor: minor, currency: currency}
+}
+
+// majorUnits builds an amount from whole units, 100 rupees being 10000 paise.
+func majorUnits(major int, currency string) money {
+	return money{minor: major * pow10(currencyExponents[currency]), currency: currency}
+}
+
+func validCurrency(currency string) error {
+	if _, ok := currencyExponents[currency]; !ok {
+		return fmt.Errorf("%w: %q", errUnknownCurrency, currency)
+	}
+	return nil
+}
+
+func (d money) plus(other money) money {
+	return money{minor: d.minor + other.minor, currency: d.currency}
+}
+
+func (d money) String() string {
+	return d.currency + " " + d.decimal()
+}
+
+// decimal writes the amount in major units without the currency, as in
+// "-12.50".
+func (d money) decimal() string {
+	exponent := currencyExponents[d.currency]
+	sign, minor := "", d.minor
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	if exponent == 0 {
+		return fmt.Sprintf("%s%d", sign, minor)
+	}
+	unit := pow10(exponent)
+	fraction := fmt.Sprintf("%d", minor%unit)
+	return fmt.Sprintf("%s%d.%s", sign, minor/unit, strings.Repeat("0", exponent-len(fraction))+fraction)
+}
+
+func pow10(n int) int {
+	p := 1
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	errChannelUnavailable = errors.New("notification channel unavailable")
+	errNoContact          = errors.New("user has no contact for channel")
+	errUnknownChannel     = errors.New("unknown notification channel")
+	errUnknownEvent       = errors.New("no template for notification event")
+)
+
+// Channels a user can be notified on.
+const (
+	channelEmail = "email"
+	channelSMS   = "sms"
+	channelPush  = "push"
+)
+
+// Events that send a notification. Each one has a template.
+const (
+	eventDebited          = "DEBITED"
+	eventCredited         = "CREDITED"
+	eventWalletTopUp      = "WALLET_TOP_UP"
+	eventReversed         = "REVERSED"
+	eventRefunded         = "REFUNDED"
+	eventHeldForReview    = "HELD_FOR_REVIEW"
+	eventDisputeRaised    = "DISPUTE_RAISED"
+	eventDisputeResolved  = "DISPUTE_RESOLVED"
+	eventPaymentRequested = "PAYMENT_REQUESTED"
+	eventRequestDeclined  = "REQUEST_DECLINED"
+	eventRequestExpired   = "REQUEST_EXPIRED"
+)
+
+// messageData fills in a template. Name is set by the notification service.
+type messageData struct {
+	Name          string
+	Amount        money
+	TransactionId string
+	RequestId     string
+	Counterparty  string
+	Detail        string
+}
+
+type messageTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func mustTemplate(event, subject, body string) messageTemplate {
+	return messageTemplate{
+		subject: template.Must(template.New(event + "-subject").Parse(subject)),
+		body:    template.Must(template.New(event + "-body").Parse(body)),
+	}
+}
+
+var defaultTemplates = map[string]messageTemplate{
+	eventDebited:          mustTemplate(eventDebited, "Money sent", "Hi {{.Name}}, {{.Amount}} was debited for payment {{.TransactionId}}."),
+	eventCredited:         mustTemplate(eventCredited, "Money received", "Hi {{.Name}}, {{.Amount}} was credited to your wallet by payment {{.TransactionId}}."),
+	eventWalletTopUp:      mustTemplate(eventWalletTopUp, "Wallet topped up", "Hi {{.Name}}, {{.Amount}} was added to your wallet ({{.TransactionId}})."),
+	eventReversed:         mustTemplate(eventReversed, "Payment reversed", "Hi {{.Name}}, payment {{.TransactionId}} of {{.Amount}} was reversed: {{.Detail}}."),
+	eventRefunded:         mustTemplate(eventRefunded, "Payment refunded", "Hi {{.Name}}, {{.Amount}} of payment {{.TransactionId}} was refunded: {{.Detail}}."),
+	eventHeldForReview:    mustTemplate(eventHeldForReview, "Payment on hold", "Hi {{.Name}}, payment {{.TransactionId}} of {{.Amount}} is on hold while we check it."),
+	eventDisputeRaised:    mustTemplate(eventDisputeRaised, "Payment disputed", "Hi {{.Name}}, payment {{.TransactionId}} of {{.Amount}} is disputed: {{.Detail}}."),
+	eventDisputeResolved:  mustTemplate(eventDisputeResolved, "Dispute resolved", "Hi {{.Name}}, the dispute on payment {{.TransactionId}} is resolved: {{.Detail}}."),
+	eventPaymentRequested: mustTemplate(eventPaymentRequested, "Payment request", "Hi {{.Name}}, {{.Counterparty}} requested {{.Amount}} from you for {{.Detail}} ({{.RequestId}})."),
+	eventRequestDeclined:  mustTemplate(eventRequestDeclined, "Request declined", "Hi {{.Name}}, {{.Counterparty}} declined your request {{.RequestId}} for {{.Amount}}: {{.Detail}}."),
+	eventRequestExpired:   mustTemplate(eventRequestExpired, "Request expired", "Hi {{.Name}}, your request {{.RequestId}} to {{.Counterparty}} for {{.Amount}} expired unpaid."),
+}
+
+// channel delivers one rendered message to a user.
+type channel interface {
+	getName() string
+	send(to user, notificationId, subject, body string) error
+}
+
+// outbox stands in for a real provider by appending every message to a file.
+// failNext makes the next few sends fail, to exercise retries.
+type outbox struct {
+	mu       sync.Mutex
+	path     string
+	failNext int
+}
+
+func (d *outbox) write(notificationId, address, text string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failNext > 0 {
+		d.failNext--
+		return fmt.Errorf("%w: %s", errChannelUnavailable, filepath.Base(d.path))
+	}
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errChannelUnavailable, err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s to:%s %s\n", time.Now().Format(time.RFC3339), notificationId, address, text)
+	return err
+}
+
+type emailChannel struct {
+	outbox
+}
+
+func (d *emailChannel) getName() string {
+	return channelEmail
+}
+
+func (d *emailChannel) send(to user, notificationId, subject, body string) error {
+	if to.getEmail() == "" {
+		return fmt.Errorf("%w: %s", errNoContact, channelEmail)
+	}
+	return d.write(notificationId, to.getEmail(), "subject:"+subject+" | "+body)
+}
+
+type smsChannel struct {
+	outbox
+}
+
+func (d *smsChannel) getName() string {
+	return channelSMS
+}
+
+// send keeps to a single 160 character text.
+func (d *smsChannel) send(to user, notificationId, subject, body string) error {
+	if to.getPhone() == "" {
+		return fmt.Errorf("%w: %s", errNoContact, channelSMS)
+	}
+	return d.write(notificationId, to.getPhone(), truncate(body, 160))
+}
+
+// truncate shortens text to at most limit characters, ending in "..." when
+// anything was cut. It counts and cuts whole characters, so a rupee sign or a
+// name is never split.
+func truncate(text string, limit int) string {
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:limit-3]) + "..."
+}
+
+type pushChannel struct {
+	outbox
+}
+
+func (d *pushChannel) getName() string {
+	return channelPush
+}
+
+func (d *pushChannel) send(to user, notificationId, subject, body string) error {
+	return d.write(notificationId, fmt.Sprintf("device-of-user-%d", to.getId()), subject+": "+body)
+}
+
+// newOutboxChannels writes email, SMS and push messages to files in dir.
+func newOutboxChannels(dir string) ([]channel, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return []channel{
+		&emailChannel{outbox{path: filepath.Join(dir, "email.log")}},
+		&smsChannel{outbox{path: filepath.Join(dir, "sms.log")}},
+		&pushChannel{outbox{path: filepath.Join(dir, "push.log")}},
+	}, nil
+}
+
+// Delivery statuses.
+const (
+	deliverySent   = "SENT"
+	deliveryFailed = "FAILED"
+)
+
+type deliveryRecord struct {
+	notificationId string
+	userId         int
+	event          string
+	channel        string
+	status         string
+	attempts       int
+	lastError      string
+}
+
+// notificationService renders templates and delivers them on each of the
+// user's preferred channels, retrying a failing channel with exponential
+// backoff. Users without preferences get email when they have an address and
+// push otherwise.
+type notificationService struct {
+	mu          sync.Mutex // guards preferences, deliveries and lastId
+	userManager *userManager
+	channels    map[string]channel
+	preferences map[int][]string
+	templates   map[string]messageTemplate
+	maxAttempts int
+	backoff     time.Duration // wait before the first retry, doubled on each one after
+	deliveries  []deliveryRecord
+	lastId      int
+}
+
+func newNotificationService(userManager *userManager, channels ...channel) *notificationService {
+	d := &notificationService{
+		userManager: userManager,
+		channels:    make(map[string]channel),
+		preferences: make(map[int][]string),
+		templates:   defaultTemplates,
+		maxAttempts: 3,
+		backoff:     10 * time.Millisecond,
+	}
+	for _, c := range channels {
+		d.channels[c.getName()] = c
+	}
+	return d
+}
+
+func (d *notificationService) setPreferences(userId int, channels ...string) error {
+	for _, c := range channels {
+		if _, ok := d.channels[c]; !ok {
+			return fmt.Errorf("%w: %s", errUnknownChannel, c)
+		}
+	}
+	fmt.Println("[NOTIFICATION] userId:", userId, "prefers", strings.Join(channels, ", "))
+	d.mu.Lock()
+	d.preferences[userId] = channels
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *notificationService) channelsFor(u user) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if channels, ok := d.preferences[u.getId()]; ok {
+		return channels
+	}
+	if u.getEmail() != "" {
+		return []string{channelEmail}
+	}
+	return []string{channelPush}
+}
+
+// newNotification gives the message a unique id. Nothing is sent until
+// notifyUser is called.
+func (d *notificationService) newNotification(userId int, event string, data messageData) notification {
+	d.mu.Lock()
+	d.lastId++
+	notificationId := fmt.Sprintf("NTF%06d", d.lastId)
+	d.mu.Unlock()
+	return &paymentNotification{
+		notificationId: notificationId,
+		userId:         userId,
+		event:          event,
+		data:           data,
+		service:        d,
+	}
+}
+
+func (d *notificationService) notify(userId int, event string, data messageData) {
+	d.newNotification(userId, event, data).notifyUser()
+}
+
+func (d *notificationService) deliver(n *paymentNotification) error {
+	u := d.userManager.getUserDetails(n.userId)
+	if u == nil {
+		return fmt.Errorf("userId %d does not exist", n.userId)
+	}
+	tmpl, ok := d.templates[n.event]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownEvent, n.event)
+	}
+	data := n.data
+	data.Name = u.getName()
+	var subject, body bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := tmpl.body.Execute(&body, data); err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, name := range d.channelsFor(u) {
+		record := deliveryRecord{notificationId: n.notificationId, userId: n.userId, event: n.event, channel: name}
+		wait := d.backoff
+		for record.attempts < d.maxAttempts {
+			record.attempts++
+			err := d.channels[name].send(u, n.notificationId, subject.String(), body.String())
+			if err == nil {
+				record.status = deliverySent
+				break
+			}
+			record.lastError = err.Error()
+			if errors.Is(err, errNoContact) || record.attempts == d.maxAttempts {
+				record.status = deliveryFailed
+				break
+			}
+			fmt.Println("[NOTIFICATION]", n.notificationId, name, "attempt", record.attempts, "failed:", err, ". Retrying in", wait)
+			time.Sleep(wait)
+			wait *= 2
+		}
+		d.mu.Lock()
+		d.deliveries = append(d.deliveries, record)
+		d.mu.Unlock()
+		if record.status == deliverySent {
+			fmt.Println("[NOTIFICATION]", n.notificationId, "sent to UserId:", n.userId, "via", name, "msg:", body.String())
+		} else {
+			fmt.Println("[NOTIFICATION]", n.notificationId, "to UserId:", n.userId, "via", name, "gave up after", record.attempts, "attempts:", record.lastError)
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %s", errChannelUnavailable, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (d *notificationService) deliveryLog() []deliveryRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]deliveryRecord(nil), d.deliveries...)
+}
+
+type notification interface {
+	notifyUser()
+}
+
+type paymentNotification struct {
+	notificationId string
+	userId         int
+	event          string
+	data           messageData
+	service        *notificationService
+}
+
+func (d *paymentNotification) notifyUser() {
+	d.service.deliver(d)
+}
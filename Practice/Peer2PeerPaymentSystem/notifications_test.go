@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSMSCutsWholeCharacters(t *testing.T) {
+	sms := &smsChannel{outbox{path: filepath.Join(t.TempDir(), "sms.log")}}
+	to := &appUser{id: 1, name: "ravi", phone: "9845000001"}
+	body := strings.Repeat("₹", 200)
+	if err := sms.send(to, "N1", "", body); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(sms.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSpace(string(written))
+	sent := line[strings.Index(line, "to:9845000001 ")+len("to:9845000001 "):]
+	if !utf8.ValidString(sent) {
+		t.Fatalf("sent invalid UTF-8: %q", sent)
+	}
+	if want := strings.Repeat("₹", 157) + "..."; sent != want {
+		t.Fatalf("sent %d characters %q, want 157 rupee signs and an ellipsis", utf8.RuneCountInString(sent), sent)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"short", 160, "short"},
+		{"exactly", 7, "exactly"},
+		{"one too long", 11, "one too ..."},
+		{"Müller paid ₹100", 10, "Müller ..."},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.text, tt.limit); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+		}
+	}
+}
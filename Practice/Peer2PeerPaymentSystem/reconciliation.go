@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var errBadSettlementRow = errors.New("unreadable settlement row")
+
+// settlementHeader is the first row of every settlement file.
+var settlementHeader = []string{"settled_at", "gateway", "authorisation_id", "reference", "type", "amount_minor", "currency"}
+
+// Reconciliation findings. Everything else on the day matched.
+const (
+	mismatchMissingInSettlement = "MISSING_IN_SETTLEMENT"
+	mismatchMissingInLedger     = "MISSING_IN_LEDGER"
+	mismatchAmount              = "AMOUNT_MISMATCH"
+	mismatchNoFile              = "NO_SETTLEMENT_FILE"
+	mismatchBadRow              = "UNREADABLE_ROW"
+)
+
+type reconciliationItem struct {
+	gateway       string
+	transactionId string
+	finding       string
+	ledger        money // net taken through the gateway according to our ledger
+	settled       money // net the gateway says it settled
+	detail        string
+}
+
+type reconciliationReport struct {
+	day        time.Time
+	matched    int
+	mismatches []reconciliationItem
+}
+
+func dayBounds(day time.Time) (time.Time, time.Time) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	return start, start.AddDate(0, 0, 1)
+}
+
+// settlementFileName is where a gateway's settlement file for the day is
+// expected, as in "card-gateway-2024-05-01.csv".
+func settlementFileName(gateway string, day time.Time) string {
+	return gateway + "-" + day.Format("2006-01-02") + ".csv"
+}
+
+// reconcile is the daily job. For every gateway it compares the net amount
+// our ledger moved through the gateway's clearing account for each payment
+// that day against the net the gateway settled for it in its file in dir,
+// and reports every payment that does not agree.
+func (d *paymentTransaction) reconcile(day time.Time, dir string) (reconciliationReport, error) {
+	report := reconciliationReport{day: day}
+	expected := d.gatewayMovements(day)
+
+	var gatewayNames []string
+	for _, gateway := range d.gateways.gateways {
+		gatewayNames = append(gatewayNames, gateway.getName())
+	}
+	sort.Strings(gatewayNames)
+	for i, name := range gatewayNames {
+		if i > 0 && name == gatewayNames[i-1] {
+			continue
+		}
+		settled, badRows, err := readSettlementFile(filepath.Join(dir, settlementFileName(name, day)))
+		if errors.Is(err, os.ErrNotExist) {
+			if len(expected[name]) > 0 {
+				report.mismatches = append(report.mismatches, reconciliationItem{gateway: name, finding: mismatchNoFile, detail: settlementFileName(name, day)})
+			}
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		for _, detail := range badRows {
+			report.mismatches = append(report.mismatches, reconciliationItem{gateway: name, finding: mismatchBadRow, detail: detail})
+		}
+		report.compare(name, expected[name], settled)
+	}
+	return report, nil
+}
+
+// gatewayMovements adds up, per gateway and payment, what the ledger took in
+// through clearing accounts on the day, net of refunds and reversals.
+func (d *paymentTransaction) gatewayMovements(day time.Time) map[string]map[string]money {
+	start, end := dayBounds(day)
+	payments := d.store.byPosting()
+	movements := make(map[string]map[string]money)
+	for _, e := range d.walletManager.entries() {
+		if !strings.HasPrefix(e.accountId, "clearing:") || e.createdAt.Before(start) || !e.createdAt.Before(end) {
+			continue
+		}
+		record, ok := payments[e.postingId]
+		if !ok || record.gatewayName == "" {
+			continue
+		}
+		if movements[record.gatewayName] == nil {
+			movements[record.gatewayName] = make(map[string]money)
+		}
+		net, ok := movements[record.gatewayName][record.transactionId]
+		if !ok {
+			net = newMoney(0, e.currency)
+		}
+		movements[record.gatewayName][record.transactionId] = net.plus(newMoney(e.debit-e.credit, e.currency))
+	}
+	return movements
+}
+
+// readSettlementFile nets the file's captures and refunds per payment
+// reference. Rows it cannot read are returned with the reason.
+func readSettlementFile(path string) (map[string]money, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+
+	settled := make(map[string]money)
+	var badRows []string
+	for i, row := range rows {
+		if i == 0 && len(row) > 0 && row[0] == settlementHeader[0] {
+			continue
+		}
+		line, err := parseSettlementRow(row)
+		if err != nil {
+			badRows = append(badRows, fmt.Sprintf("%s line %d: %v", filepath.Base(path), i+1, err))
+			continue
+		}
+		if line.kind == settlementRefund {
+			line.amount.minor = -line.amount.minor
+		}
+		net, ok := settled[line.reference]
+		if !ok {
+			net = newMoney(0, line.amount.currency)
+		}
+		if net.currency != line.amount.currency {
+			badRows = append(badRows, fmt.Sprintf("%s line %d: %v: %s settled in %s and %s", filepath.Base(path), i+1, errCurrencyMismatch, line.reference, net.currency, line.amount.currency))
+			continue
+		}
+		settled[line.reference] = net.plus(line.amount)
+	}
+	return settled, badRows, nil
+}
+
+func parseSettlementRow(row []string) (settlementLine, error) {
+	if len(row) != len(settlementHeader) {
+		return settlementLine{}, fmt.Errorf("%w: %d columns, want %d", errBadSettlementRow, len(row), len(settlementHeader))
+	}
+	settledAt, err := time.Parse(time.RFC3339, row[0])
+	if err != nil {
+		return settlementLine{}, fmt.Errorf("%w: settled_at %q", errBadSettlementRow, row[0])
+	}
+	if row[4] != settlementCapture && row[4] != settlementRefund {
+		return settlementLine{}, fmt.Errorf("%w: type %q", errBadSettlementRow, row[4])
+	}
+	minor, err := strconv.Atoi(row[5])
+	if err != nil || minor <= 0 {
+		return settlementLine{}, fmt.Errorf("%w: amount %q", errBadSettlementRow, row[5])
+	}
+	if err := validCurrency(row[6]); err != nil {
+		return settlementLine{}, fmt.Errorf("%w: %v", errBadSettlementRow, err)
+	}
+	return settlementLine{settledAt: settledAt, gateway: row[1], authorisationId: row[2], reference: row[3], kind: row[4], amount: newMoney(minor, row[6])}, nil
+}
+
+// compare matches one gateway's ledger movements against its settlement.
+// A payment whose ledger postings cancel out, such as one reversed after a
+// failed capture, matches a settlement that has nothing for it.
+func (d *reconciliationReport) compare(gateway string, ledger, settled map[string]money) {
+	var transactionIds []string
+	for transactionId := range ledger {
+		transactionIds = append(transactionIds, transactionId)
+	}
+	for transactionId := range settled {
+		if _, ok := ledger[transactionId]; !ok {
+			transactionIds = append(transactionIds, transactionId)
+		}
+	}
+	sort.Strings(transactionIds)
+
+	for _, transactionId := range transactionIds {
+		ours, inLedger := ledger[transactionId]
+		theirs, inSettlement := settled[transactionId]
+		item := reconciliationItem{gateway: gateway, transactionId: transactionId, ledger: ours, settled: theirs}
+		switch {
+		case !inSettlement && ours.minor == 0, inLedger && inSettlement && ours == theirs:
+			d.matched++
+			continue
+		case !inSettlement:
+			item.finding = mismatchMissingInSettlement
+		case !inLedger:
+			item.finding = mismatchMissingInLedger
+		default:
+			item.finding = mismatchAmount
+		}
+		d.mismatches = append(d.mismatches, item)
+	}
+}
+
+func (d reconciliationReport) printDetail() {
+	fmt.Println("[RECONCILIATION]", d.day.Format("2006-01-02"), d.matched, "payments matched,", len(d.mismatches), "mismatches")
+	for _, m := range d.mismatches {
+		fmt.Println("    ", m.finding, m.gateway, m.transactionId, "ledger:", blankIfUnset(m.ledger), "settled:", blankIfUnset(m.settled), m.detail)
+	}
+}
+
+// writeText writes the report for whoever chases the mismatches.
+func (d reconciliationReport) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "Reconciliation for %s: %d matched, %d mismatches\n\n", d.day.Format("2006-01-02"), d.matched, len(d.mismatches))
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(t, "Finding\tGateway\tTransaction\tLedger\tSettled\tDetail")
+	for _, m := range d.mismatches {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%s\n", m.finding, m.gateway, m.transactionId, blankIfUnset(m.ledger), blankIfUnset(m.settled), m.detail)
+	}
+	return t.Flush()
+}
+
+func blankIfUnset(amount money) string {
+	if amount.currency == "" {
+		return ""
+	}
+	return amount.String()
+}
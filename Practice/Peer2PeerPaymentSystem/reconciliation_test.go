@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSettlement(t *testing.T, gateway *fakeGateway, dir string, day time.Time, extraRows ...string) {
+	t.Helper()
+	path := filepath.Join(dir, settlementFileName(gateway.getName(), day))
+	if err := gateway.writeSettlementFile(path, day); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, row := range extraRows {
+		fmt.Fprintln(f, row)
+	}
+}
+
+func TestReconcileMatches(t *testing.T) {
+	payments, cardGateway, cardId := newCardPayments(t, 2, majorUnits(1, "INR"))
+	refunded := pay(t, payments, "refunded", 1, 2, cardId, majorUnits(100, "INR"))
+	if _, err := payments.refund(refunded.transactionId, majorUnits(40, "INR"), "returned"); err != nil {
+		t.Fatal(err)
+	}
+	pay(t, payments, "kept", 1, 2, cardId, majorUnits(25, "INR"))
+	// a payment that failed before capture moves nothing either side
+	cardGateway.setBehaviour(gatewayDecline)
+	payment := *payments
+	payment.amount = majorUnits(10, "INR")
+	payment.doTransaction("declined", 1, 2, cardId)
+
+	dir := t.TempDir()
+	today := time.Now()
+	writeSettlement(t, cardGateway, dir, today)
+	report, err := payments.reconcile(today, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.matched != 2 || len(report.mismatches) != 0 {
+		t.Fatalf("%d matched with mismatches %v, want 2 matched and none", report.matched, report.mismatches)
+	}
+}
+
+func TestReconcileMismatches(t *testing.T) {
+	payments, cardGateway, cardId := newCardPayments(t, 2, majorUnits(1, "INR"))
+	matched := pay(t, payments, "matched", 1, 2, cardId, majorUnits(100, "INR"))
+
+	// the capture goes through but its response is lost, so the ledger
+	// reverses a payment the gateway settled
+	cardGateway.onCapture = gatewayLateTimeout
+	payment := *payments
+	payment.amount = majorUnits(30, "INR")
+	lost, _ := payment.doTransaction("lost", 1, 2, cardId)
+	cardGateway.onCapture = gatewaySucceed
+
+	dir := t.TempDir()
+	today := time.Now()
+	writeSettlement(t, cardGateway, dir, today,
+		today.Format(time.RFC3339)+",card-gateway,card-gateway-AUTH9999,EXT-1,CAPTURE,4999,INR",
+		today.Format(time.RFC3339)+",card-gateway,card-gateway-AUTH9999,EXT-1,CHARGEBACK,4999,INR",
+	)
+	// paid after the gateway wrote its file
+	late := pay(t, payments, "late", 1, 2, cardId, majorUnits(20, "INR"))
+
+	report, err := payments.reconcile(today, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.matched != 1 {
+		t.Fatalf("%d matched, want only %s", report.matched, matched.transactionId)
+	}
+	want := map[string]string{
+		mismatchBadRow:              "",
+		mismatchMissingInLedger:     "EXT-1",
+		mismatchAmount:              lost.transactionId,
+		mismatchMissingInSettlement: late.transactionId,
+	}
+	if len(report.mismatches) != len(want) {
+		t.Fatalf("got mismatches %v, want %v", report.mismatches, want)
+	}
+	for _, m := range report.mismatches {
+		if transactionId, ok := want[m.finding]; !ok || transactionId != m.transactionId {
+			t.Errorf("unexpected %s for %q", m.finding, m.transactionId)
+		}
+	}
+}
+
+func TestReconcileMissingFile(t *testing.T) {
+	payments, cardGateway, cardId := newCardPayments(t, 2, majorUnits(1, "INR"))
+	pay(t, payments, "paid", 1, 2, cardId, majorUnits(100, "INR"))
+	payments.gateways.register(instrumentBank, newFakeGateway("bank-gateway", gatewaySucceed))
+
+	dir := t.TempDir()
+	today := time.Now()
+	report, err := payments.reconcile(today, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bank gateway moved nothing, so its file is not missed
+	if len(report.mismatches) != 1 || report.mismatches[0].finding != mismatchNoFile || report.mismatches[0].gateway != cardGateway.getName() {
+		t.Fatalf("got mismatches %v, want only the card gateway's file missing", report.mismatches)
+	}
+}
+
+func TestStatementListsInstrumentPayments(t *testing.T) {
+	payments, _, cardId := newCardPayments(t, 2, majorUnits(50, "INR"))
+	from := time.Now()
+	paid := pay(t, payments, "card", 1, 2, cardId, majorUnits(100, "INR"))
+	if _, err := payments.refund(paid.transactionId, majorUnits(40, "INR"), "returned"); err != nil {
+		t.Fatal(err)
+	}
+	pay(t, payments, "wallet", 1, 2, payFromWallet, majorUnits(10, "INR"))
+
+	s, err := payments.statement(1, from, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.lines) != 1 || s.lines[0].debit != majorUnits(10, "INR") || s.closing != majorUnits(40, "INR") {
+		t.Fatalf("wallet lines %v closing at %s, want only the INR 10.00 wallet payment", s.lines, s.closing)
+	}
+	if len(s.charged) != 2 {
+		t.Fatalf("charged %v, want the card payment and its refund", s.charged)
+	}
+	if charge := s.charged[0]; charge.transactionId != paid.transactionId || charge.debit != majorUnits(100, "INR") || charge.description != "payment to user2 by card" {
+		t.Fatalf("got charge %+v", charge)
+	}
+	if refund := s.charged[1]; refund.credit != majorUnits(40, "INR") || refund.description != "refund from user2 by card" {
+		t.Fatalf("got refund %+v", refund)
+	}
+
+	// the receiver sees the card payment in their wallet, not as a charge
+	received, err := payments.statement(2, from, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received.charged) != 0 || len(received.lines) != 3 {
+		t.Fatalf("receiver has lines %v and charges %v", received.lines, received.charged)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidRefundAmount  = errors.New("refund amount must be positive")
+	errRefundExceedsPayment = errors.New("refund exceeds what is left of the payment")
+	errNotRefundable        = errors.New("payment cannot be refunded")
+	errDisputeNotFound      = errors.New("dispute not found")
+	errDisputeAlreadyOpen   = errors.New("payment already has an open dispute")
+	errDisputeClosed        = errors.New("dispute is already resolved")
+	errNotDisputeParty      = errors.New("user is not a party to the payment")
+)
+
+// Dispute statuses.
+const (
+	disputeOpen                = "OPEN"
+	disputeResolvedForSender   = "RESOLVED_FOR_SENDER"
+	disputeResolvedForReceiver = "RESOLVED_FOR_RECEIVER"
+)
+
+type disputeEvidence struct {
+	submittedBy int
+	note        string
+	at          time.Time
+}
+
+// dispute is raised by the sender of a captured payment. While it is open the
+// disputed amount is held in an account of its own, out of the receiver's
+// wallet, until it is resolved in favour of one side.
+type dispute struct {
+	disputeId     string
+	transactionId string
+	raisedBy      int
+	reason        string
+	amount        money // what the sender gets back if they win
+	held          money // taken out of the receiver's wallet, in its currency
+	status        string
+	statusBefore  string // payment status to go back to if the receiver wins
+	evidence      []disputeEvidence
+	resolution    string
+	raisedAt      time.Time
+	resolvedAt    time.Time
+}
+
+func (d dispute) printDetail() {
+	fmt.Println("[DisputeDetail] disputeId:", d.disputeId, "transactionId:", d.transactionId, "amount:", d.amount, "held:", d.held, "status:", d.status, "reason:", d.reason)
+	for _, e := range d.evidence {
+		fmt.Println("    ", e.at.Format(time.RFC3339), "userId:", e.submittedBy, e.note)
+	}
+	if d.resolution != "" {
+		fmt.Println("     resolution:", d.resolution)
+	}
+}
+
+func disputeAccount(disputeId string) string {
+	return "dispute:" + disputeId
+}
+
+// disputeStore's lock guards dispute state. Money for a dispute only moves
+// under its payment's lock, which is always taken first.
+type disputeStore struct {
+	mu                sync.Mutex
+	disputes          map[string]*dispute
+	openByTransaction map[string]string
+	lastId            int
+}
+
+func newDisputeStore() *disputeStore {
+	return &disputeStore{
+		disputes:          make(map[string]*dispute),
+		openByTransaction: make(map[string]string),
+	}
+}
+
+func (d *disputeStore) getDispute(disputeId string) (dispute, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.snapshot(disputeId)
+}
+
+// snapshot copies a dispute. The caller holds the lock.
+func (d *disputeStore) snapshot(disputeId string) (dispute, error) {
+	ds, ok := d.disputes[disputeId]
+	if !ok {
+		return dispute{}, fmt.Errorf("%w: %s", errDisputeNotFound, disputeId)
+	}
+	r := *ds
+	r.evidence = append([]disputeEvidence(nil), ds.evidence...)
+	return r, nil
+}
+
+// fundingAccount is where money for the payment came from and where refunds
+// go back to: the sender's wallet, or the clearing account of the instrument
+// that was charged.
+func (d *paymentTransaction) fundingAccount(record transferRecord) (string, error) {
+	if record.instrumentId == payFromWallet {
+		return walletAccount(record.fromUserId), nil
+	}
+	instrument, err := d.instrumentManager.selectInstrument(record.fromUserId, record.instrumentId)
+	if err != nil {
+		return "", err
+	}
+	return clearingAccount(instrument.getType(), record.amount.currency), nil
+}
+
+// refund gives some or all of a captured payment back to the sender. The
+// receiver's wallet has to cover their share of it; a converted payment is
+// converted back at the rate it was made at, and its FX fee is kept.
+func (d *paymentTransaction) refund(transactionId string, amount money, reason string) (transferRecord, error) {
+	unlock, err := d.store.lock(transactionId)
+	if err != nil {
+		return transferRecord{}, err
+	}
+	defer unlock()
+	record, err := d.store.getTransaction(transactionId)
+	if err != nil {
+		return transferRecord{}, err
+	}
+	if record.status != statusCaptured && record.status != statusPartiallyRefunded {
+		return record, fmt.Errorf("%w: %s is %s", errNotRefundable, transactionId, record.status)
+	}
+	if amount.minor <= 0 {
+		return record, errInvalidRefundAmount
+	}
+	if amount.currency != record.amount.currency {
+		return record, fmt.Errorf("%w: %s paid in %s, refund is in %s", errCurrencyMismatch, transactionId, record.amount.currency, amount.currency)
+	}
+	if remaining := record.amount.minor - record.refunded.minor; amount.minor > remaining {
+		return record, fmt.Errorf("%w: %s left on %s, asked for %s", errRefundExceedsPayment, newMoney(remaining, amount.currency), transactionId, amount)
+	}
+
+	reference := transactionId + ":refund"
+	reclaimed := record.receiverShare(amount)
+	funding, err := d.fundingAccount(record)
+	if err != nil {
+		return record, err
+	}
+	postingId, err := d.walletManager.transfer(reference, walletAccount(record.toUserId), funding, reclaimed, newMoney(0, reclaimed.currency), amount)
+	if err != nil {
+		fmt.Println("[REFUND]", transactionId, "could not be refunded:", err)
+		return record, err
+	}
+	if err := d.refundCharge(transactionId, amount); err != nil {
+		// the gateway kept the money, so the ledger must too
+		d.store.addPosting(transactionId, postingId)
+		if reversalId, reversalErr := d.walletManager.reversePosting(postingId, reference+":reversal"); reversalErr == nil {
+			d.store.addPosting(transactionId, reversalId)
+		}
+		return record, err
+	}
+	d.store.addPosting(transactionId, postingId)
+	d.store.addRefund(transactionId, amount, reclaimed)
+
+	status := statusPartiallyRefunded
+	if record.refunded.minor+amount.minor == record.amount.minor {
+		status = statusRefunded
+	}
+	d.store.transition(transactionId, status, "refunded "+amount.String()+": "+reason)
+	fmt.Println("[REFUND]", transactionId, "refunded", amount, "of", record.amount, ":", reason)
+
+	d.notifyParties(record, eventRefunded, messageData{Amount: amount, TransactionId: transactionId, Detail: reason})
+	return d.store.getTransaction(transactionId)
+}
+
+// raiseDispute lets the sender contest a captured payment. Whatever has not
+// been refunded yet is taken out of the receiver's wallet and held until the
+// dispute is resolved.
+func (d *paymentTransaction) raiseDispute(transactionId string, raisedBy int, reason string) (dispute, error) {
+	unlock, err := d.store.lock(transactionId)
+	if err != nil {
+		return dispute{}, err
+	}
+	defer unlock()
+	d.disputes.mu.Lock()
+	defer d.disputes.mu.Unlock()
+	record, err := d.store.getTransaction(transactionId)
+	if err != nil {
+		return dispute{}, err
+	}
+	if raisedBy != record.fromUserId {
+		return dispute{}, fmt.Errorf("%w: only the sender, userId %d, can dispute %s", errNotDisputeParty, record.fromUserId, transactionId)
+	}
+	if disputeId, ok := d.disputes.openByTransaction[transactionId]; ok {
+		return dispute{}, fmt.Errorf("%w: %s", errDisputeAlreadyOpen, disputeId)
+	}
+	if record.status != statusCaptured && record.status != statusPartiallyRefunded {
+		return dispute{}, fmt.Errorf("%w: %s is %s", errNotRefundable, transactionId, record.status)
+	}
+
+	d.disputes.lastId++
+	ds := &dispute{
+		disputeId:     fmt.Sprintf("DSP%06d", d.disputes.lastId),
+		transactionId: transactionId,
+		raisedBy:      raisedBy,
+		reason:        reason,
+		amount:        newMoney(record.amount.minor-record.refunded.minor, record.amount.currency),
+		held:          newMoney(record.credited.minor-record.reclaimed.minor, record.credited.currency),
+		status:        disputeOpen,
+		statusBefore:  record.status,
+		raisedAt:      time.Now(),
+	}
+	postingId, err := d.walletManager.move(ds.disputeId+":hold", walletAccount(record.toUserId), disputeAccount(ds.disputeId), ds.held)
+	if err != nil {
+		d.disputes.lastId--
+		fmt.Println("[DISPUTE] could not hold", ds.held, "for", transactionId, ":", err)
+		return dispute{}, err
+	}
+	d.disputes.disputes[ds.disputeId] = ds
+	d.disputes.openByTransaction[transactionId] = ds.disputeId
+	d.store.addPosting(transactionId, postingId)
+	d.store.transition(transactionId, statusDisputed, ds.disputeId+": "+reason)
+	fmt.Println("[DISPUTE]", ds.disputeId, "raised by userId:", raisedBy, "on", transactionId, "holding", ds.held)
+
+	d.notifyParties(record, eventDisputeRaised, messageData{Amount: ds.amount, TransactionId: transactionId, Detail: ds.disputeId + ", " + reason})
+	return d.disputes.snapshot(ds.disputeId)
+}
+
+func (d *paymentTransaction) addEvidence(disputeId string, userId int, note string) error {
+	d.disputes.mu.Lock()
+	defer d.disputes.mu.Unlock()
+	ds, ok := d.disputes.disputes[disputeId]
+	if !ok {
+		return fmt.Errorf("%w: %s", errDisputeNotFound, disputeId)
+	}
+	if ds.status != disputeOpen {
+		return fmt.Errorf("%w: %s", errDisputeClosed, disputeId)
+	}
+	record, err := d.store.getTransaction(ds.transactionId)
+	if err != nil {
+		return err
+	}
+	if userId != record.fromUserId && userId != record.toUserId {
+		return fmt.Errorf("%w: userId %d on %s", errNotDisputeParty, userId, ds.transactionId)
+	}
+	ds.evidence = append(ds.evidence, disputeEvidence{submittedBy: userId, note: note, at: time.Now()})
+	fmt.Println("[DISPUTE]", disputeId, "evidence from userId:", userId, ":", note)
+	return nil
+}
+
+// resolveDispute releases the held money. In favour of the sender it goes back
+// where the payment was funded from and the payment counts as refunded; in
+// favour of the receiver it returns to their wallet.
+func (d *paymentTransaction) resolveDispute(disputeId string, inFavourOfSender bool, resolution string) (dispute, error) {
+	d.disputes.mu.Lock()
+	ds, ok := d.disputes.disputes[disputeId]
+	d.disputes.mu.Unlock()
+	if !ok {
+		return dispute{}, fmt.Errorf("%w: %s", errDisputeNotFound, disputeId)
+	}
+	unlock, err := d.store.lock(ds.transactionId)
+	if err != nil {
+		return dispute{}, err
+	}
+	defer unlock()
+	d.disputes.mu.Lock()
+	defer d.disputes.mu.Unlock()
+	if ds.status != disputeOpen {
+		return dispute{}, fmt.Errorf("%w: %s", errDisputeClosed, disputeId)
+	}
+	record, err := d.store.getTransaction(ds.transactionId)
+	if err != nil {
+		return dispute{}, err
+	}
+
+	reference := disputeId + ":resolution"
+	if inFavourOfSender {
+		funding, err := d.fundingAccount(record)
+		if err != nil {
+			return dispute{}, err
+		}
+		if err := d.refundCharge(ds.transactionId, ds.amount); err != nil {
+			return dispute{}, err
+		}
+		postingId, err := d.walletManager.transfer(reference, disputeAccount(disputeId), funding, ds.held, newMoney(0, ds.held.currency), ds.amount)
+		if err != nil {
+			return dispute{}, err
+		}
+		d.store.addPosting(ds.transactionId, postingId)
+		d.store.addRefund(ds.transactionId, ds.amount, ds.held)
+		d.store.transition(ds.transactionId, statusRefunded, disputeId+" resolved for the sender")
+		ds.status = disputeResolvedForSender
+	} else {
+		postingId, err := d.walletManager.move(reference, disputeAccount(disputeId), walletAccount(record.toUserId), ds.held)
+		if err != nil {
+			return dispute{}, err
+		}
+		d.store.addPosting(ds.transactionId, postingId)
+		d.store.transition(ds.transactionId, ds.statusBefore, disputeId+" resolved for the receiver")
+		ds.status = disputeResolvedForReceiver
+	}
+	ds.resolution = resolution
+	ds.resolvedAt = time.Now()
+	delete(d.disputes.openByTransaction, ds.transactionId)
+	fmt.Println("[DISPUTE]", disputeId, ds.status, ":", resolution)
+
+	d.notifyParties(record, eventDisputeResolved, messageData{Amount: ds.amount, TransactionId: ds.transactionId, Detail: ds.status + ", " + resolution})
+	return d.disputes.snapshot(disputeId)
+}
+
+func (d *paymentTransaction) notifyParties(record transferRecord, event string, data messageData) {
+	d.notifier.notify(record.fromUserId, event, data)
+	if record.toUserId != record.fromUserId {
+		d.notifier.notify(record.toUserId, event, data)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// newCardPayments is newTestPayments with a card for user 1 charged through a
+// fake card gateway.
+func newCardPayments(t *testing.T, users int, startingBalance money) (*paymentTransaction, *fakeGateway, int) {
+	t.Helper()
+	payments := newTestPayments(t, users, startingBalance)
+	cardGateway := newFakeGateway("card-gateway", gatewaySucceed)
+	payments.gateways.register(instrumentCard, cardGateway)
+	c, err := payments.instrumentManager.addInstrument(1, instrumentCard, instrumentDetails{Name: "card", CardNumber: "4111 1111 1111 1111", ExpiryMonth: 12, ExpiryYear: 2099})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payments, cardGateway, c.getId()
+}
+
+func pay(t *testing.T, payments *paymentTransaction, key string, from, to, instrumentId int, amount money) transferRecord {
+	t.Helper()
+	payment := *payments
+	payment.amount = amount
+	record, err := payment.doTransaction(key, from, to, instrumentId)
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	return record
+}
+
+func checkAudit(t *testing.T, payments *paymentTransaction) {
+	t.Helper()
+	if problems := payments.walletManager.audit(); len(problems) != 0 {
+		t.Fatalf("audit: %v", problems)
+	}
+}
+
+func TestReversalLeavesTheCardAloneWhenTheReceiverSpentIt(t *testing.T) {
+	payments, cardGateway, cardId := newCardPayments(t, 3, majorUnits(1, "INR"))
+	record := pay(t, payments, "card", 1, 2, cardId, majorUnits(100, "INR"))
+	pay(t, payments, "spent", 2, 3, payFromWallet, majorUnits(101, "INR"))
+
+	if _, err := payments.reverseTransaction(record.transactionId, "chargeback"); !errors.Is(err, errInsufficientFunds) {
+		t.Fatalf("got %v, want %v", err, errInsufficientFunds)
+	}
+	if refunded := cardGateway.authorisations[record.authorisation].refunded; refunded != 0 {
+		t.Fatalf("the card was refunded %d though the ledger was not reversed", refunded)
+	}
+	if after, _ := payments.store.getTransaction(record.transactionId); after.status != statusCaptured {
+		t.Fatalf("payment is %s, want %s", after.status, statusCaptured)
+	}
+	checkAudit(t, payments)
+}
+
+func TestReversalUndoesTheLedgerWhenTheCardRefundFails(t *testing.T) {
+	payments, cardGateway, cardId := newCardPayments(t, 2, majorUnits(1, "INR"))
+	record := pay(t, payments, "card", 1, 2, cardId, majorUnits(100, "INR"))
+	cardGateway.setBehaviour(gatewayDecline)
+
+	if _, err := payments.reverseTransaction(record.transactionId, "chargeback"); !errors.Is(err, errGatewayDeclined) {
+		t.Fatalf("got %v, want %v", err, errGatewayDeclined)
+	}
+	if balance, _ := payments.walletManager.getBalance(2); balance != majorUnits(101, "INR") {
+		t.Fatalf("receiver has %s after a failed reversal, want INR 101.00", balance)
+	}
+	checkAudit(t, payments)
+
+	cardGateway.setBehaviour(gatewaySucceed)
+	if after, err := payments.reverseTransaction(record.transactionId, "chargeback"); err != nil || after.status != statusReversed {
+		t.Fatalf("retrying the reversal got %s and %v", after.status, err)
+	}
+	if refunded := cardGateway.authorisations[record.authorisation].refunded; refunded != 10000 {
+		t.Fatalf("card refunded %d, want 10000", refunded)
+	}
+	if balance, _ := payments.walletManager.getBalance(2); balance != majorUnits(1, "INR") {
+		t.Fatalf("receiver has %s after the reversal, want INR 1.00", balance)
+	}
+	checkAudit(t, payments)
+}
+
+func TestRefundsStopAtThePaymentAmount(t *testing.T) {
+	payments := newTestPayments(t, 2, majorUnits(1000, "INR"))
+	record := pay(t, payments, "wallet", 1, 2, payFromWallet, majorUnits(100, "INR"))
+
+	steps := []struct {
+		amount money
+		status string
+		want   error
+	}{
+		{majorUnits(30, "INR"), statusPartiallyRefunded, nil},
+		{majorUnits(80, "INR"), statusPartiallyRefunded, errRefundExceedsPayment},
+		{newMoney(0, "INR"), statusPartiallyRefunded, errInvalidRefundAmount},
+		{majorUnits(10, "USD"), statusPartiallyRefunded, errCurrencyMismatch},
+		{majorUnits(70, "INR"), statusRefunded, nil},
+		{majorUnits(1, "INR"), statusRefunded, errNotRefundable},
+	}
+	for _, step := range steps {
+		_, err := payments.refund(record.transactionId, step.amount, "test")
+		if !errors.Is(err, step.want) || (step.want == nil && err != nil) {
+			t.Fatalf("refunding %s: got %v, want %v", step.amount, err, step.want)
+		}
+		if after, _ := payments.store.getTransaction(record.transactionId); after.status != step.status {
+			t.Fatalf("after refunding %s the payment is %s, want %s", step.amount, after.status, step.status)
+		}
+	}
+	checkMoneyConserved(t, payments, 2, majorUnits(1000, "INR"))
+}
+
+func TestCardRefundsGoBackThroughTheGateway(t *testing.T) {
+	payments, cardGateway, cardId := newCardPayments(t, 2, majorUnits(1, "INR"))
+	record := pay(t, payments, "card", 1, 2, cardId, majorUnits(100, "INR"))
+	if _, err := payments.refund(record.transactionId, majorUnits(100, "INR"), "returned"); err != nil {
+		t.Fatal(err)
+	}
+	if refunded := cardGateway.authorisations[record.authorisation].refunded; refunded != 10000 {
+		t.Fatalf("card refunded %d, want 10000", refunded)
+	}
+	// the gateway will not refund more than it captured either
+	if err := cardGateway.refund(record.authorisation, newMoney(1, "INR")); !errors.Is(err, errRefundExceedsCapture) {
+		t.Fatalf("got %v, want %v", err, errRefundExceedsCapture)
+	}
+	checkAudit(t, payments)
+}
+
+func TestDisputeTransitions(t *testing.T) {
+	tests := []struct {
+		name             string
+		inFavourOfSender bool
+		partRefunded     money
+		wantPayment      string
+		wantDispute      string
+		wantSender       money
+	}{
+		{"sender wins", true, newMoney(0, "INR"), statusRefunded, disputeResolvedForSender, majorUnits(1000, "INR")},
+		{"receiver wins", false, newMoney(0, "INR"), statusCaptured, disputeResolvedForReceiver, majorUnits(900, "INR")},
+		{"sender wins the rest", true, majorUnits(40, "INR"), statusRefunded, disputeResolvedForSender, majorUnits(1000, "INR")},
+		{"receiver keeps the rest", false, majorUnits(40, "INR"), statusPartiallyRefunded, disputeResolvedForReceiver, majorUnits(940, "INR")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payments := newTestPayments(t, 3, majorUnits(1000, "INR"))
+			record := pay(t, payments, "disputed", 1, 2, payFromWallet, majorUnits(100, "INR"))
+			if tt.partRefunded.minor > 0 {
+				if _, err := payments.refund(record.transactionId, tt.partRefunded, "part"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := payments.raiseDispute(record.transactionId, 2, "not me"); !errors.Is(err, errNotDisputeParty) {
+				t.Fatalf("receiver raising a dispute: got %v, want %v", err, errNotDisputeParty)
+			}
+			ds, err := payments.raiseDispute(record.transactionId, 1, "never arrived")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := payments.raiseDispute(record.transactionId, 1, "again"); !errors.Is(err, errDisputeAlreadyOpen) {
+				t.Fatalf("second dispute: got %v, want %v", err, errDisputeAlreadyOpen)
+			}
+			if _, err := payments.refund(record.transactionId, majorUnits(1, "INR"), "during dispute"); !errors.Is(err, errNotRefundable) {
+				t.Fatalf("refund while disputed: got %v, want %v", err, errNotRefundable)
+			}
+			if err := payments.addEvidence(ds.disputeId, 3, "hearsay"); !errors.Is(err, errNotDisputeParty) {
+				t.Fatalf("evidence from an outsider: got %v, want %v", err, errNotDisputeParty)
+			}
+			if err := payments.addEvidence(ds.disputeId, 2, "tracking number"); err != nil {
+				t.Fatal(err)
+			}
+
+			resolved, err := payments.resolveDispute(ds.disputeId, tt.inFavourOfSender, "decided")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolved.status != tt.wantDispute {
+				t.Fatalf("dispute is %s, want %s", resolved.status, tt.wantDispute)
+			}
+			if after, _ := payments.store.getTransaction(record.transactionId); after.status != tt.wantPayment {
+				t.Fatalf("payment is %s, want %s", after.status, tt.wantPayment)
+			}
+			if balance, _ := payments.walletManager.getBalance(1); balance != tt.wantSender {
+				t.Fatalf("sender has %s, want %s", balance, tt.wantSender)
+			}
+			if _, err := payments.resolveDispute(ds.disputeId, !tt.inFavourOfSender, "changed my mind"); !errors.Is(err, errDisputeClosed) {
+				t.Fatalf("resolving twice: got %v, want %v", err, errDisputeClosed)
+			}
+			checkMoneyConserved(t, payments, 3, majorUnits(1000, "INR"))
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errRequestNotFound  = errors.New("payment request not found")
+	errCollectNotFound  = errors.New("collect not found")
+	errRequestClosed    = errors.New("payment request is no longer pending")
+	errRequestExpired   = errors.New("payment request has expired")
+	errNotRequestPayer  = errors.New("user is not the payer of the request")
+	errInvalidRequest   = errors.New("invalid payment request")
+	errRequestingMyself = errors.New("cannot request money from yourself")
+)
+
+// Payment request statuses. A payer who does nothing leaves the request
+// pending until it expires.
+const (
+	requestPending  = "PENDING"
+	requestAccepted = "ACCEPTED"
+	requestDeclined = "DECLINED"
+	requestExpired  = "EXPIRED"
+)
+
+// paymentRequest asks one user to pay another. Accepting it makes a normal
+// transfer from the payer to the requester.
+type paymentRequest struct {
+	requestId     string
+	collectId     string // set when the request is part of a group collect
+	requesterId   int
+	payerId       int
+	amount        money
+	note          string
+	status        string
+	reason        string // why it was declined
+	transactionId string // the transfer made when it was accepted
+	attempts      int    // accept attempts whose transfer failed
+	createdAt     time.Time
+	expiresAt     time.Time
+}
+
+func (d paymentRequest) printDetail() {
+	fmt.Println("[RequestDetail] requestId:", d.requestId, "from userId:", d.payerId, "to userId:", d.requesterId, "amount:", d.amount, "note:", d.note, "status:", d.status, d.transactionId, d.reason)
+}
+
+// collect gathers money from a group, one request per member.
+type collect struct {
+	collectId   string
+	requesterId int
+	note        string
+	currency    string
+	requestIds  []string
+}
+
+type collectSummary struct {
+	collectId string
+	requested money
+	collected money
+	paid      []int
+	pending   []int
+	declined  []int
+	expired   []int
+}
+
+// queuedNotification is a notification waiting for requestManager's lock to
+// be released.
+type queuedNotification struct {
+	userId int
+	event  string
+	data   messageData
+}
+
+// requestManager's lock guards the requests and collects. It is not held
+// while a request is being paid or a notification sent.
+type requestManager struct {
+	mu            sync.Mutex
+	payments      *paymentTransaction
+	requests      map[string]*paymentRequest
+	collects      map[string]*collect
+	byPayer       map[int][]string
+	outbox        []queuedNotification
+	lastRequestId int
+	lastCollectId int
+}
+
+func newRequestManager(payments *paymentTransaction) *requestManager {
+	return &requestManager{
+		payments: payments,
+		requests: make(map[string]*paymentRequest),
+		collects: make(map[string]*collect),
+		byPayer:  make(map[int][]string),
+	}
+}
+
+// requestMoney sends a request for amount to each payer.
+func (d *requestManager) requestMoney(requesterId int, payerIds []int, amount money, note string, expiresIn time.Duration) ([]paymentRequest, error) {
+	if err := d.validate(requesterId, payerIds, amount, expiresIn); err != nil {
+		return nil, err
+	}
+	var created []paymentRequest
+	for _, payerId := range payerIds {
+		created = append(created, d.create(requesterId, payerId, amount, note, expiresIn, ""))
+	}
+	return created, nil
+}
+
+// createCollect requests amountEach from every member of the group and tracks
+// them together.
+func (d *requestManager) createCollect(requesterId int, payerIds []int, amountEach money, note string, expiresIn time.Duration) (collect, error) {
+	if err := d.validate(requesterId, payerIds, amountEach, expiresIn); err != nil {
+		return collect{}, err
+	}
+	d.mu.Lock()
+	d.lastCollectId++
+	collectId := fmt.Sprintf("COL%06d", d.lastCollectId)
+	d.mu.Unlock()
+	c := &collect{collectId: collectId, requesterId: requesterId, note: note, currency: amountEach.currency}
+	for _, payerId := range payerIds {
+		r := d.create(requesterId, payerId, amountEach, note, expiresIn, c.collectId)
+		c.requestIds = append(c.requestIds, r.requestId)
+	}
+	d.mu.Lock()
+	d.collects[c.collectId] = c
+	d.mu.Unlock()
+	fmt.Println("[REQUEST]", c.collectId, "collecting", amountEach, "each from", len(payerIds), "users for", note)
+	return *c, nil
+}
+
+func (d *requestManager) validate(requesterId int, payerIds []int, amount money, expiresIn time.Duration) error {
+	if amount.minor <= 0 || validCurrency(amount.currency) != nil || expiresIn <= 0 || len(payerIds) == 0 {
+		return fmt.Errorf("%w: amount %s, expiry %s, %d payers", errInvalidRequest, amount, expiresIn, len(payerIds))
+	}
+	if !d.payments.userManager.checkIfUserExists(requesterId) {
+		return fmt.Errorf("%w: userId %d does not exist", errInvalidRequest, requesterId)
+	}
+	for _, payerId := range payerIds {
+		if payerId == requesterId {
+			return errRequestingMyself
+		}
+		if !d.payments.userManager.checkIfUserExists(payerId) {
+			return fmt.Errorf("%w: userId %d does not exist", errInvalidRequest, payerId)
+		}
+	}
+	return nil
+}
+
+func (d *requestManager) create(requesterId, payerId int, amount money, note string, expiresIn time.Duration, collectId string) paymentRequest {
+	d.mu.Lock()
+	d.lastRequestId++
+	now := time.Now()
+	r := &paymentRequest{
+		requestId:   fmt.Sprintf("REQ%06d", d.lastRequestId),
+		collectId:   collectId,
+		requesterId: requesterId,
+		payerId:     payerId,
+		amount:      amount,
+		note:        note,
+		status:      requestPending,
+		createdAt:   now,
+		expiresAt:   now.Add(expiresIn),
+	}
+	d.requests[r.requestId] = r
+	d.byPayer[payerId] = append(d.byPayer[payerId], r.requestId)
+	created := *r
+	d.mu.Unlock()
+	fmt.Println("[REQUEST]", created.requestId, "userId:", requesterId, "requests", amount, "from userId:", payerId, "for", note)
+
+	d.payments.notifier.notify(payerId, eventPaymentRequested, messageData{Amount: amount, RequestId: created.requestId, Counterparty: d.userName(requesterId), Detail: note})
+	return created
+}
+
+// accept pays the request with the given instrument, or payFromWallet. The
+// transfer goes through doTransaction like any other payment, keyed on the
+// request so accepting twice never pays twice. The request is accepted once
+// the transfer is captured, or held for review; if review then rejects it the
+// request is pending again. If the transfer fails the request stays pending
+// and can be accepted again. Two accepts racing each other use the same key,
+// so the second gets the first one's transfer back, or errPaymentInProgress
+// while it is still being made.
+func (d *requestManager) accept(requestId string, payerId, instrumentId int) (transferRecord, error) {
+	d.mu.Lock()
+	r, err := d.pendingRequest(requestId, payerId)
+	if err != nil {
+		transactionId := ""
+		if r != nil && r.status == requestAccepted {
+			transactionId = r.transactionId
+		}
+		d.unlockAndNotify()
+		if transactionId != "" {
+			record, err := d.payments.store.getTransaction(transactionId)
+			if err != nil {
+				return record, err
+			}
+			return record, record.outcome()
+		}
+		return transferRecord{}, err
+	}
+	payment := *d.payments
+	payment.amount = r.amount
+	attempt := r.attempts
+	idempotencyKey := "request:" + r.requestId + ":" + strconv.Itoa(attempt)
+	requesterId := r.requesterId
+	d.mu.Unlock()
+
+	record, err := payment.doTransaction(idempotencyKey, payerId, requesterId, instrumentId)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	held := errors.Is(err, errHeldForReview)
+	if err != nil && !held {
+		if errors.Is(err, errPaymentInProgress) {
+			// the accept racing this one will finish the request
+			return record, err
+		}
+		if r.attempts == attempt {
+			r.attempts++
+		}
+		fmt.Println("[REQUEST]", requestId, "could not be paid:", err)
+		return record, err
+	}
+	if r.status == requestAccepted && r.transactionId == record.transactionId {
+		return record, err
+	}
+	r.status = requestAccepted
+	r.transactionId = record.transactionId
+	fmt.Println("[REQUEST]", requestId, "accepted by userId:", payerId, "as", record.transactionId)
+	if held {
+		d.payments.store.onFailure(record.transactionId, func(failed transferRecord) {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.reopen(r, failed.transactionId)
+		})
+		// review may have rejected it before the hook was in place
+		if latest, _ := d.payments.store.getTransaction(record.transactionId); latest.status == statusFailed {
+			d.reopen(r, record.transactionId)
+		}
+	}
+	return record, err
+}
+
+// reopen puts a request back to pending when the transfer that accepted it
+// failed after all, so the payer can accept it again. The caller holds the
+// lock.
+func (d *requestManager) reopen(r *paymentRequest, transactionId string) {
+	if r.status != requestAccepted || r.transactionId != transactionId {
+		return
+	}
+	r.status = requestPending
+	r.transactionId = ""
+	r.attempts++
+	fmt.Println("[REQUEST]", r.requestId, "is pending again,", transactionId, "was rejected in review")
+}
+
+func (d *requestManager) decline(requestId string, payerId int, reason string) error {
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	r, err := d.pendingRequest(requestId, payerId)
+	if err != nil {
+		return err
+	}
+	r.status = requestDeclined
+	r.reason = reason
+	fmt.Println("[REQUEST]", requestId, "declined by userId:", payerId, ":", reason)
+	d.queueNotification(r.requesterId, eventRequestDeclined, messageData{Amount: r.amount, RequestId: r.requestId, Counterparty: d.userName(payerId), Detail: reason})
+	return nil
+}
+
+// expireRequests closes every pending request past its expiry at now and
+// tells the requester. Requests nobody answered end up here.
+func (d *requestManager) expireRequests(now time.Time) []paymentRequest {
+	d.mu.Lock()
+	defer d.unlockAndNotify()
+	var expired []paymentRequest
+	for id := 1; id <= d.lastRequestId; id++ {
+		r := d.requests[fmt.Sprintf("REQ%06d", id)]
+		if r.status != requestPending || now.Before(r.expiresAt) {
+			continue
+		}
+		d.expire(r)
+		expired = append(expired, *r)
+	}
+	return expired
+}
+
+// expire closes the request and queues the requester's notification. The
+// caller holds the lock.
+func (d *requestManager) expire(r *paymentRequest) {
+	r.status = requestExpired
+	fmt.Println("[REQUEST]", r.requestId, "expired unanswered by userId:", r.payerId)
+	d.queueNotification(r.requesterId, eventRequestExpired, messageData{Amount: r.amount, RequestId: r.requestId, Counterparty: d.userName(r.payerId)})
+}
+
+// queueNotification holds a notification until the lock is released, so a
+// slow channel never blocks other requests. The caller holds the lock.
+func (d *requestManager) queueNotification(userId int, event string, data messageData) {
+	d.outbox = append(d.outbox, queuedNotification{userId: userId, event: event, data: data})
+}
+
+// unlockAndNotify releases the lock and then sends what was queued under it.
+func (d *requestManager) unlockAndNotify() {
+	outbox := d.outbox
+	d.outbox = nil
+	d.mu.Unlock()
+	for _, n := range outbox {
+		d.payments.notifier.notify(n.userId, n.event, n.data)
+	}
+}
+
+// pendingRequest finds the payer's request, expiring it if its time is up. The
+// caller holds the lock.
+func (d *requestManager) pendingRequest(requestId string, payerId int) (*paymentRequest, error) {
+	r, ok := d.requests[requestId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errRequestNotFound, requestId)
+	}
+	if r.payerId != payerId {
+		return nil, fmt.Errorf("%w: userId %d on %s", errNotRequestPayer, payerId, requestId)
+	}
+	if r.status == requestPending && !time.Now().Before(r.expiresAt) {
+		d.expire(r)
+	}
+	switch r.status {
+	case requestPending:
+		return r, nil
+	case requestExpired:
+		return r, fmt.Errorf("%w: %s", errRequestExpired, requestId)
+	}
+	return r, fmt.Errorf("%w: %s is %s", errRequestClosed, requestId, r.status)
+}
+
+// pendingFor lists the requests waiting on the payer, oldest first.
+func (d *requestManager) pendingFor(payerId int) []paymentRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var pending []paymentRequest
+	for _, requestId := range d.byPayer[payerId] {
+		if r := d.requests[requestId]; r.status == requestPending {
+			pending = append(pending, *r)
+		}
+	}
+	return pending
+}
+
+// collectStatus reports who in the group has paid. A member counts as paid
+// once their transfer is captured; a transfer still in review is pending.
+func (d *requestManager) collectStatus(collectId string) (collectSummary, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.collects[collectId]
+	if !ok {
+		return collectSummary{}, fmt.Errorf("%w: %s", errCollectNotFound, collectId)
+	}
+	summary := collectSummary{collectId: collectId, requested: newMoney(0, c.currency), collected: newMoney(0, c.currency)}
+	for _, requestId := range c.requestIds {
+		r := d.requests[requestId]
+		summary.requested = summary.requested.plus(r.amount)
+		switch r.status {
+		case requestDeclined:
+			summary.declined = append(summary.declined, r.payerId)
+		case requestExpired:
+			summary.expired = append(summary.expired, r.payerId)
+		case requestAccepted:
+			record, err := d.payments.store.getTransaction(r.transactionId)
+			if err == nil && record.status == statusCaptured {
+				summary.collected = summary.collected.plus(r.amount)
+				summary.paid = append(summary.paid, r.payerId)
+			} else {
+				summary.pending = append(summary.pending, r.payerId)
+			}
+		default:
+			summary.pending = append(summary.pending, r.payerId)
+		}
+	}
+	return summary, nil
+}
+
+func (d collectSummary) printDetail() {
+	fmt.Println("[CollectDetail] collectId:", d.collectId, "collected", d.collected, "of", d.requested, "paid:", d.paid, "pending:", d.pending, "declined:", d.declined, "expired:", d.expired)
+}
+
+func (d *requestManager) userName(userId int) string {
+	return d.payments.userName(userId)
+}
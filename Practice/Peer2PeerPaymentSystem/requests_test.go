@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// lockCheckingChannel records each message's subject and whether the request
+// manager's lock was free when it was sent.
+type lockCheckingChannel struct {
+	requests *requestManager
+	sent     []string
+	locked   []string
+}
+
+func (d *lockCheckingChannel) getName() string {
+	return channelEmail
+}
+
+func (d *lockCheckingChannel) send(to user, notificationId, subject, body string) error {
+	d.sent = append(d.sent, subject)
+	if d.requests.mu.TryLock() {
+		d.requests.mu.Unlock()
+	} else {
+		d.locked = append(d.locked, subject)
+	}
+	return nil
+}
+
+func newTestRequests(t *testing.T) (*requestManager, *lockCheckingChannel) {
+	t.Helper()
+	payments := newTestPayments(t, 2, majorUnits(1000, "INR"))
+	channel := &lockCheckingChannel{}
+	payments.notifier = newNotificationService(payments.userManager, channel)
+	requests := newRequestManager(payments)
+	channel.requests = requests
+	return requests, channel
+}
+
+func requestFrom(t *testing.T, requests *requestManager, amount money) paymentRequest {
+	t.Helper()
+	created, err := requests.requestMoney(2, []int{1}, amount, "lunch", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created[0]
+}
+
+func checkRequestStatus(t *testing.T, requests *requestManager, requestId, want string) {
+	t.Helper()
+	requests.mu.Lock()
+	defer requests.mu.Unlock()
+	if got := requests.requests[requestId].status; got != want {
+		t.Fatalf("request is %s, want %s", got, want)
+	}
+}
+
+func TestAcceptPaysOnce(t *testing.T) {
+	requests, _ := newTestRequests(t)
+	r := requestFrom(t, requests, majorUnits(100, "INR"))
+
+	if _, err := requests.accept(r.requestId, 2, payFromWallet); !errors.Is(err, errNotRequestPayer) {
+		t.Fatalf("requester accepting: got %v, want %v", err, errNotRequestPayer)
+	}
+	record, err := requests.accept(r.requestId, 1, payFromWallet)
+	if err != nil || record.status != statusCaptured {
+		t.Fatalf("got %s and %v", record.status, err)
+	}
+	checkRequestStatus(t, requests, r.requestId, requestAccepted)
+	again, err := requests.accept(r.requestId, 1, payFromWallet)
+	if err != nil || again.transactionId != record.transactionId {
+		t.Fatalf("accepting again got %s and %v, want %s", again.transactionId, err, record.transactionId)
+	}
+	if balance, _ := requests.payments.walletManager.getBalance(2); balance != majorUnits(1100, "INR") {
+		t.Fatalf("requester has %s, want INR 1100.00", balance)
+	}
+}
+
+func TestFailedAcceptLeavesTheRequestPending(t *testing.T) {
+	requests, _ := newTestRequests(t)
+	r := requestFrom(t, requests, majorUnits(2000, "INR"))
+
+	if _, err := requests.accept(r.requestId, 1, payFromWallet); !errors.Is(err, errInsufficientFunds) {
+		t.Fatalf("got %v, want %v", err, errInsufficientFunds)
+	}
+	checkRequestStatus(t, requests, r.requestId, requestPending)
+	requests.payments.walletManager.addMoney(1, instrumentCard, majorUnits(1000, "INR"), "top-up")
+	if record, err := requests.accept(r.requestId, 1, payFromWallet); err != nil || record.status != statusCaptured {
+		t.Fatalf("second accept got %s and %v", record.status, err)
+	}
+	checkRequestStatus(t, requests, r.requestId, requestAccepted)
+}
+
+// TestAcceptRacingAnInFlightTransfer is an accept that finds the transfer of
+// an accept racing it still being made.
+func TestAcceptRacingAnInFlightTransfer(t *testing.T) {
+	requests, _ := newTestRequests(t)
+	r := requestFrom(t, requests, majorUnits(100, "INR"))
+	// the racing accept has created its transfer but not yet moved the money
+	requests.payments.store.create("request:"+r.requestId+":0", 1, 2, payFromWallet, r.amount)
+
+	if _, err := requests.accept(r.requestId, 1, payFromWallet); !errors.Is(err, errPaymentInProgress) {
+		t.Fatalf("got %v, want %v", err, errPaymentInProgress)
+	}
+	checkRequestStatus(t, requests, r.requestId, requestPending)
+	if requests.requests[r.requestId].attempts != 0 {
+		t.Fatal("an in-flight transfer moved the request on to a new idempotency key")
+	}
+}
+
+func TestAcceptHeldForReview(t *testing.T) {
+	tests := []struct {
+		name    string
+		approve bool
+		want    string
+	}{
+		{"approved", true, requestAccepted},
+		{"rejected", false, requestPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, _ := newTestRequests(t)
+			requests.payments.risk = newRiskEngine(requests.payments.store, riskConfig{StepUpThreshold: moneyLimits{"INR": 10000}})
+			r := requestFrom(t, requests, majorUnits(200, "INR"))
+
+			held, err := requests.accept(r.requestId, 1, payFromWallet)
+			if !errors.Is(err, errHeldForReview) {
+				t.Fatalf("got %v, want %v", err, errHeldForReview)
+			}
+			checkRequestStatus(t, requests, r.requestId, requestAccepted)
+			if tt.approve {
+				_, err = requests.payments.approveReview(held.transactionId, "confirmed")
+			} else {
+				_, err = requests.payments.rejectReview(held.transactionId, "not confirmed")
+			}
+			if err != nil && tt.approve {
+				t.Fatal(err)
+			}
+			checkRequestStatus(t, requests, r.requestId, tt.want)
+			if tt.approve {
+				return
+			}
+
+			// the payer can try again, and the new transfer is held in turn
+			again, err := requests.accept(r.requestId, 1, payFromWallet)
+			if !errors.Is(err, errHeldForReview) || again.transactionId == held.transactionId {
+				t.Fatalf("accepting again got %s and %v", again.transactionId, err)
+			}
+			checkRequestStatus(t, requests, r.requestId, requestAccepted)
+		})
+	}
+}
+
+func TestDecline(t *testing.T) {
+	requests, channel := newTestRequests(t)
+	r := requestFrom(t, requests, majorUnits(100, "INR"))
+
+	if err := requests.decline(r.requestId, 1, "already paid in cash"); err != nil {
+		t.Fatal(err)
+	}
+	checkRequestStatus(t, requests, r.requestId, requestDeclined)
+	if _, err := requests.accept(r.requestId, 1, payFromWallet); !errors.Is(err, errRequestClosed) {
+		t.Fatalf("accepting a declined request: got %v, want %v", err, errRequestClosed)
+	}
+	if err := requests.decline(r.requestId, 1, "again"); !errors.Is(err, errRequestClosed) {
+		t.Fatalf("declining twice: got %v, want %v", err, errRequestClosed)
+	}
+	if len(channel.sent) != 2 || channel.sent[1] != "Request declined" {
+		t.Fatalf("sent %q, want the request and the decline", channel.sent)
+	}
+	if len(channel.locked) != 0 {
+		t.Fatalf("sent %q while holding the lock", channel.locked)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	requests, channel := newTestRequests(t)
+	stale := requestFrom(t, requests, majorUnits(100, "INR"))
+	fresh, _ := requests.requestMoney(2, []int{1}, majorUnits(100, "INR"), "dinner", 3*time.Hour)
+
+	expired := requests.expireRequests(time.Now().Add(2 * time.Hour))
+	if len(expired) != 1 || expired[0].requestId != stale.requestId {
+		t.Fatalf("expired %v, want only %s", expired, stale.requestId)
+	}
+	checkRequestStatus(t, requests, fresh[0].requestId, requestPending)
+	if _, err := requests.accept(stale.requestId, 1, payFromWallet); !errors.Is(err, errRequestExpired) {
+		t.Fatalf("got %v, want %v", err, errRequestExpired)
+	}
+
+	// a request found past its expiry when answered is expired then
+	requests.mu.Lock()
+	requests.requests[fresh[0].requestId].expiresAt = time.Now()
+	requests.mu.Unlock()
+	if err := requests.decline(fresh[0].requestId, 1, "late"); !errors.Is(err, errRequestExpired) {
+		t.Fatalf("got %v, want %v", err, errRequestExpired)
+	}
+	if len(channel.sent) != 4 || channel.sent[2] != "Request expired" || channel.sent[3] != "Request expired" {
+		t.Fatalf("sent %q, want two requests and two expiries", channel.sent)
+	}
+	if len(channel.locked) != 0 {
+		t.Fatalf("sent %q while holding the lock", channel.locked)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errRiskDenied    = errors.New("payment denied by risk rules")
+	errHeldForReview = errors.New("payment held for review")
+)
+
+// Risk decisions, from least to most severe. The engine's decision for a
+// payment is the most severe one any rule returns.
+const (
+	decisionAllow  = "ALLOW"
+	decisionReview = "REVIEW"
+	decisionDeny   = "DENY"
+)
+
+var decisionSeverity = map[string]int{
+	decisionAllow:  0,
+	decisionReview: 1,
+	decisionDeny:   2,
+}
+
+// riskRule looks at a new payment together with the sender's earlier
+// payments. reason explains any decision other than allow.
+type riskRule interface {
+	getName() string
+	evaluate(payment transferRecord, sent []transferRecord, now time.Time) (decision, reason string)
+}
+
+type riskAssessment struct {
+	transactionId string
+	decision      string
+	reasons       []string
+	at            time.Time
+}
+
+// riskConfig switches the built-in rules on. A zero value leaves that rule out.
+type riskConfig struct {
+	TransactionLimit moneyLimits // largest single payment
+	DailyLimit       moneyLimits // most a user can send in a calendar day
+	VelocityCount    int         // payments allowed in VelocityWindow before review
+	VelocityWindow   time.Duration
+	NewPayeeCoolDown time.Duration // how long a payee counts as new after the first payment to them
+	NewPayeeLimit    moneyLimits   // largest payment to a new payee
+	StepUpThreshold  moneyLimits   // payments at or above this need a review
+	BlockedUsers     map[int]string
+}
+
+// moneyLimits sets a limit per currency, in minor units of that currency, so
+// a limit means the same amount of money whatever the payment is made in. A
+// rule does not check payments in a currency it has no limit for.
+type moneyLimits map[string]int
+
+func (d moneyLimits) limitFor(currency string) (money, bool) {
+	limit, ok := d[currency]
+	return newMoney(limit, currency), ok
+}
+
+// riskEngine runs every rule before a payment is processed and keeps a log of
+// what it decided and why.
+type riskEngine struct {
+	rules       []riskRule
+	store       *transactionStore
+	mu          sync.Mutex // guards log, allowed and senderLocks
+	log         []riskAssessment
+	allowed     map[string]bool // payments let through, which count against limits before their money moves
+	senderLocks map[int]*sync.Mutex
+}
+
+func newRiskEngine(store *transactionStore, cfg riskConfig) *riskEngine {
+	d := &riskEngine{store: store, allowed: make(map[string]bool), senderLocks: make(map[int]*sync.Mutex)}
+	if len(cfg.BlockedUsers) > 0 {
+		d.addRule(&blocklistRule{blockedUsers: cfg.BlockedUsers})
+	}
+	if len(cfg.TransactionLimit) > 0 {
+		d.addRule(&transactionLimitRule{limits: cfg.TransactionLimit})
+	}
+	if len(cfg.DailyLimit) > 0 {
+		d.addRule(&dailyLimitRule{limits: cfg.DailyLimit})
+	}
+	if cfg.VelocityCount > 0 && cfg.VelocityWindow > 0 {
+		d.addRule(&velocityRule{count: cfg.VelocityCount, window: cfg.VelocityWindow})
+	}
+	if cfg.NewPayeeCoolDown > 0 {
+		d.addRule(&newPayeeRule{coolDown: cfg.NewPayeeCoolDown, limits: cfg.NewPayeeLimit})
+	}
+	if len(cfg.StepUpThreshold) > 0 {
+		d.addRule(&stepUpRule{thresholds: cfg.StepUpThreshold})
+	}
+	return d
+}
+
+func (d *riskEngine) addRule(rule riskRule) {
+	d.rules = append(d.rules, rule)
+}
+
+func (d *riskEngine) lockSender(userId int) func() {
+	d.mu.Lock()
+	l, ok := d.senderLocks[userId]
+	if !ok {
+		l = &sync.Mutex{}
+		d.senderLocks[userId] = l
+	}
+	d.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// assess decides whether a payment may go ahead. A sender's payments are
+// assessed one at a time, and a payment counts against the sender's limits
+// from the moment it is let through, so payments racing each other cannot all
+// fit under the same daily limit.
+func (d *riskEngine) assess(payment transferRecord) riskAssessment {
+	unlock := d.lockSender(payment.fromUserId)
+	defer unlock()
+	now := time.Now()
+	history := d.store.historyForUser(payment.fromUserId)
+	var sent []transferRecord
+	d.mu.Lock()
+	for _, r := range history {
+		// top-ups, the payment being assessed and payments not assessed yet do not count
+		if r.fromUserId == payment.fromUserId && r.toUserId != r.fromUserId && r.transactionId != payment.transactionId &&
+			(r.status != statusCreated || d.allowed[r.transactionId]) {
+			sent = append(sent, r)
+		}
+	}
+	d.mu.Unlock()
+
+	assessment := riskAssessment{transactionId: payment.transactionId, decision: decisionAllow, at: now}
+	for _, rule := range d.rules {
+		decision, reason := rule.evaluate(payment, sent, now)
+		if decision == decisionAllow {
+			continue
+		}
+		assessment.reasons = append(assessment.reasons, rule.getName()+": "+reason)
+		if decisionSeverity[decision] > decisionSeverity[assessment.decision] {
+			assessment.decision = decision
+		}
+	}
+	d.mu.Lock()
+	d.log = append(d.log, assessment)
+	if assessment.decision != decisionDeny {
+		d.allowed[payment.transactionId] = true
+	}
+	d.mu.Unlock()
+	if len(assessment.reasons) == 0 {
+		fmt.Println("[RISK]", payment.transactionId, assessment.decision)
+	} else {
+		fmt.Println("[RISK]", payment.transactionId, assessment.decision, "-", strings.Join(assessment.reasons, "; "))
+	}
+	return assessment
+}
+
+// committedAmount is what a payment still takes from the sender: nothing if it
+// failed or was reversed, less any refunds otherwise.
+func committedAmount(r transferRecord) int {
+	if r.status == statusFailed || r.status == statusReversed {
+		return 0
+	}
+	return r.charged().minor - r.refunded.minor
+}
+
+type blocklistRule struct {
+	blockedUsers map[int]string // user id to why they are blocked
+}
+
+func (d *blocklistRule) getName() string {
+	return "blocklist"
+}
+
+func (d *blocklistRule) evaluate(payment transferRecord, sent []transferRecord, now time.Time) (string, string) {
+	if why, ok := d.blockedUsers[payment.fromUserId]; ok {
+		return decisionDeny, "sender userId " + strconv.Itoa(payment.fromUserId) + " is blocked (" + why + ")"
+	}
+	if why, ok := d.blockedUsers[payment.toUserId]; ok {
+		return decisionDeny, "receiver userId " + strconv.Itoa(payment.toUserId) + " is blocked (" + why + ")"
+	}
+	return decisionAllow, ""
+}
+
+type transactionLimitRule struct {
+	limits moneyLimits
+}
+
+func (d *transactionLimitRule) getName() string {
+	return "transaction-limit"
+}
+
+func (d *transactionLimitRule) evaluate(payment transferRecord, sent []transferRecord, now time.Time) (string, string) {
+	limit, ok := d.limits.limitFor(payment.amount.currency)
+	if ok && payment.charged().minor > limit.minor {
+		return decisionDeny, fmt.Sprintf("%s is over the per-payment limit of %s", payment.charged(), limit)
+	}
+	return decisionAllow, ""
+}
+
+type dailyLimitRule struct {
+	limits moneyLimits
+}
+
+func (d *dailyLimitRule) getName() string {
+	return "daily-limit"
+}
+
+func (d *dailyLimitRule) evaluate(payment transferRecord, sent []transferRecord, now time.Time) (string, string) {
+	limit, ok := d.limits.limitFor(payment.amount.currency)
+	if !ok {
+		return decisionAllow, ""
+	}
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	total := payment.charged().minor
+	for _, r := range sent {
+		if !r.createdAt.Before(startOfDay) && r.amount.currency == payment.amount.currency {
+			total += committedAmount(r)
+		}
+	}
+	if total > limit.minor {
+		return decisionDeny, fmt.Sprintf("%s sent today with this payment, over the daily limit of %s", newMoney(total, limit.currency), limit)
+	}
+	return decisionAllow, ""
+}
+
+// velocityRule sends a payment to review when the sender already made count
+// payments, successful or not, within the window.
+type velocityRule struct {
+	count  int
+	window time.Duration
+}
+
+func (d *velocityRule) getName() string {
+	return "velocity"
+}
+
+func (d *velocityRule) evaluate(payment transferRecord, sent []transferRecord, now time.Time) (string, string) {
+	recent := 0
+	for _, r := range sent {
+		if now.Sub(r.createdAt) <= d.window {
+			recent++
+		}
+	}
+	if recent >= d.count {
+		return decisionReview, fmt.Sprintf("%d payments in the last %s, limit is %d", recent, d.window, d.count)
+	}
+	return decisionAllow, ""
+}
+
+// newPayeeRule sends payments over limit to review until coolDown has passed
+// since the sender first paid the payee successfully.
+type newPayeeRule struct {
+	coolDown time.Duration
+	limits   moneyLimits
+}
+
+func (d *newPayeeRule) getName() string {
+	return "new-payee"
+}
+
+func (d *newPayeeRule) evaluate(payment transferRecord, sent []transferRecord, now time.Time) (string, string) {
+	var firstPaid time.Time
+	for _, r := range sent {
+		if r.toUserId == payment.toUserId && committedAmount(r) > 0 {
+			firstPaid = r.createdAt
+			break
+		}
+	}
+	if !firstPaid.IsZero() && now.Sub(firstPaid) >= d.coolDown {
+		return decisionAllow, ""
+	}
+	if limit, ok := d.limits.limitFor(payment.amount.currency); ok && payment.charged().minor > limit.minor {
+		return decisionReview, fmt.Sprintf("userId %d is a new payee, payments over %s are checked for %s", payment.toUserId, limit, d.coolDown)
+	}
+	return decisionAllow, ""
+}
+
+// stepUpRule asks for extra verification on large payments.
+type stepUpRule struct {
+	thresholds moneyLimits
+}
+
+func (d *stepUpRule) getName() string {
+	return "step-up"
+}
+
+func (d *stepUpRule) evaluate(payment transferRecord, sent []transferRecord, now time.Time) (string, string) {
+	if threshold, ok := d.thresholds.limitFor(payment.amount.currency); ok && payment.charged().minor >= threshold.minor {
+		return decisionReview, fmt.Sprintf("%s needs step-up verification at or above %s", payment.charged(), threshold)
+	}
+	return decisionAllow, ""
+}
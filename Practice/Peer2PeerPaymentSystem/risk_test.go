@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sentRecord(to int, amount money, status string, at time.Time) transferRecord {
+	return transferRecord{
+		transactionId: "earlier",
+		fromUserId:    1,
+		toUserId:      to,
+		amount:        amount,
+		fee:           newMoney(0, amount.currency),
+		refunded:      newMoney(0, amount.currency),
+		status:        status,
+		createdAt:     at,
+	}
+}
+
+func TestRiskRules(t *testing.T) {
+	now := time.Date(2024, time.March, 10, 15, 0, 0, 0, time.UTC)
+	limits := moneyLimits{"INR": 100000, "USD": 1200}
+	tests := []struct {
+		name    string
+		rule    riskRule
+		payment transferRecord
+		sent    []transferRecord
+		want    string
+	}{
+		{"blocked sender", &blocklistRule{blockedUsers: map[int]string{1: "mule"}}, sentRecord(2, majorUnits(1, "INR"), statusCreated, now), nil, decisionDeny},
+		{"blocked receiver", &blocklistRule{blockedUsers: map[int]string{2: "mule"}}, sentRecord(2, majorUnits(1, "INR"), statusCreated, now), nil, decisionDeny},
+		{"nobody blocked", &blocklistRule{blockedUsers: map[int]string{3: "mule"}}, sentRecord(2, majorUnits(1, "INR"), statusCreated, now), nil, decisionAllow},
+
+		{"at the payment limit", &transactionLimitRule{limits: limits}, sentRecord(2, majorUnits(1000, "INR"), statusCreated, now), nil, decisionAllow},
+		{"over the payment limit", &transactionLimitRule{limits: limits}, sentRecord(2, newMoney(100001, "INR"), statusCreated, now), nil, decisionDeny},
+		{"payment limit is per currency", &transactionLimitRule{limits: limits}, sentRecord(2, majorUnits(1000, "USD"), statusCreated, now), nil, decisionDeny},
+		{"no limit for the currency", &transactionLimitRule{limits: limits}, sentRecord(2, majorUnits(1000000, "JPY"), statusCreated, now), nil, decisionAllow},
+
+		{"under the daily limit", &dailyLimitRule{limits: limits}, sentRecord(2, majorUnits(400, "INR"), statusCreated, now),
+			[]transferRecord{sentRecord(3, majorUnits(600, "INR"), statusCaptured, now.Add(-time.Hour))}, decisionAllow},
+		{"over the daily limit", &dailyLimitRule{limits: limits}, sentRecord(2, majorUnits(401, "INR"), statusCreated, now),
+			[]transferRecord{sentRecord(3, majorUnits(600, "INR"), statusCaptured, now.Add(-time.Hour))}, decisionDeny},
+		{"failed and yesterday's payments do not count", &dailyLimitRule{limits: limits}, sentRecord(2, majorUnits(900, "INR"), statusCreated, now),
+			[]transferRecord{sentRecord(3, majorUnits(600, "INR"), statusFailed, now.Add(-time.Hour)), sentRecord(3, majorUnits(600, "INR"), statusCaptured, now.Add(-24*time.Hour))}, decisionAllow},
+		{"other currencies have their own daily limit", &dailyLimitRule{limits: limits}, sentRecord(2, majorUnits(10, "USD"), statusCreated, now),
+			[]transferRecord{sentRecord(3, majorUnits(900, "INR"), statusCaptured, now.Add(-time.Hour))}, decisionAllow},
+
+		{"slow sender", &velocityRule{count: 2, window: time.Hour}, sentRecord(2, majorUnits(1, "INR"), statusCreated, now),
+			[]transferRecord{sentRecord(2, majorUnits(1, "INR"), statusCaptured, now.Add(-30*time.Minute)), sentRecord(2, majorUnits(1, "INR"), statusFailed, now.Add(-2*time.Hour))}, decisionAllow},
+		{"fast sender", &velocityRule{count: 2, window: time.Hour}, sentRecord(2, majorUnits(1, "INR"), statusCreated, now),
+			[]transferRecord{sentRecord(2, majorUnits(1, "INR"), statusCaptured, now.Add(-30*time.Minute)), sentRecord(2, majorUnits(1, "INR"), statusFailed, now.Add(-10*time.Minute))}, decisionReview},
+
+		{"small payment to a new payee", &newPayeeRule{coolDown: 24 * time.Hour, limits: limits}, sentRecord(2, majorUnits(1000, "INR"), statusCreated, now), nil, decisionAllow},
+		{"large payment to a new payee", &newPayeeRule{coolDown: 24 * time.Hour, limits: limits}, sentRecord(2, majorUnits(1001, "INR"), statusCreated, now), nil, decisionReview},
+		{"payee paid too recently", &newPayeeRule{coolDown: 24 * time.Hour, limits: limits}, sentRecord(2, majorUnits(1001, "INR"), statusCreated, now),
+			[]transferRecord{sentRecord(2, majorUnits(1, "INR"), statusCaptured, now.Add(-time.Hour))}, decisionReview},
+		{"known payee", &newPayeeRule{coolDown: 24 * time.Hour, limits: limits}, sentRecord(2, majorUnits(1001, "INR"), statusCreated, now),
+			[]transferRecord{sentRecord(2, majorUnits(1, "INR"), statusCaptured, now.Add(-48*time.Hour))}, decisionAllow},
+		{"payee only ever failed", &newPayeeRule{coolDown: 24 * time.Hour, limits: limits}, sentRecord(2, majorUnits(1001, "INR"), statusCreated, now),
+			[]transferRecord{sentRecord(2, majorUnits(1, "INR"), statusFailed, now.Add(-48*time.Hour))}, decisionReview},
+
+		{"under the step-up threshold", &stepUpRule{thresholds: limits}, sentRecord(2, newMoney(99999, "INR"), statusCreated, now), nil, decisionAllow},
+		{"at the step-up threshold", &stepUpRule{thresholds: limits}, sentRecord(2, majorUnits(1000, "INR"), statusCreated, now), nil, decisionReview},
+		{"step-up threshold is per currency", &stepUpRule{thresholds: limits}, sentRecord(2, majorUnits(12, "USD"), statusCreated, now), nil, decisionReview},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.payment.transactionId = "new"
+			decision, reason := tt.rule.evaluate(tt.payment, tt.sent, now)
+			if decision != tt.want {
+				t.Fatalf("%s decided %s (%s), want %s", tt.rule.getName(), decision, reason, tt.want)
+			}
+			if (decision == decisionAllow) != (reason == "") {
+				t.Fatalf("%s decided %s with reason %q", tt.rule.getName(), decision, reason)
+			}
+		})
+	}
+}
+
+func TestRiskEngineTakesTheMostSevereDecision(t *testing.T) {
+	payments := newTestPayments(t, 2, majorUnits(1000, "INR"))
+	payments.risk = newRiskEngine(payments.store, riskConfig{
+		TransactionLimit: moneyLimits{"INR": 50000},
+		StepUpThreshold:  moneyLimits{"INR": 10000},
+	})
+	payment := *payments
+	payment.amount = majorUnits(200, "INR")
+	if _, err := payment.doTransaction("held", 1, 2, payFromWallet); !errors.Is(err, errHeldForReview) {
+		t.Fatalf("got %v, want %v", err, errHeldForReview)
+	}
+	payment.amount = majorUnits(600, "INR")
+	if _, err := payment.doTransaction("denied", 1, 2, payFromWallet); !errors.Is(err, errRiskDenied) {
+		t.Fatalf("got %v, want %v", err, errRiskDenied)
+	}
+}
+
+// TestDailyLimitHoldsUnderConcurrentPayments races payments from one sender
+// that together go well over the daily limit; exactly as many as fit may go
+// through.
+func TestDailyLimitHoldsUnderConcurrentPayments(t *testing.T) {
+	payments := newTestPayments(t, 2, majorUnits(1000, "INR"))
+	payments.risk = newRiskEngine(payments.store, riskConfig{DailyLimit: moneyLimits{"INR": 10000}})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	paid := 0
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payment := *payments
+			payment.amount = majorUnits(10, "INR")
+			if _, err := payment.doTransaction("daily-"+string(rune('a'+i)), 1, 2, payFromWallet); err == nil {
+				mu.Lock()
+				paid++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if paid != 10 {
+		t.Fatalf("%d payments of INR 10.00 went through under an INR 100.00 daily limit, want 10", paid)
+	}
+}
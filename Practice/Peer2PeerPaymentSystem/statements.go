@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var errInvalidStatementRange = errors.New("statement range must end after it starts")
+
+// statementLine is one ledger entry on a user's wallet. Exactly one of debit
+// and credit is non-zero; balance is the wallet balance after the entry.
+type statementLine struct {
+	at            time.Time
+	transactionId string
+	description   string
+	debit         money
+	credit        money
+	balance       money
+}
+
+// statement covers the user's wallet from from up to, but not including, to.
+// Payments the user charged straight to a card or bank account never touch
+// the wallet, so they are listed apart in charged, without a balance.
+type statement struct {
+	userId   int
+	name     string
+	from     time.Time
+	to       time.Time
+	opening  money
+	closing  money
+	totalIn  money
+	totalOut money
+	lines    []statementLine
+	charged  []statementLine
+}
+
+// statement replays the ledger for the user's wallet: entries before from
+// make up the opening balance and the ones in the range are listed in order.
+// The clearing entries of payments the user sent from an instrument are
+// listed as charged: debits are charges, credits are refunds to the
+// instrument.
+func (d *paymentTransaction) statement(userId int, from, to time.Time) (statement, error) {
+	if !to.After(from) {
+		return statement{}, fmt.Errorf("%w: %s to %s", errInvalidStatementRange, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	currency, err := d.walletManager.currencyOf(userId)
+	if err != nil {
+		return statement{}, err
+	}
+	s := statement{
+		userId:   userId,
+		name:     d.userName(userId),
+		from:     from,
+		to:       to,
+		opening:  newMoney(0, currency),
+		totalIn:  newMoney(0, currency),
+		totalOut: newMoney(0, currency),
+	}
+
+	payments := d.store.byPosting()
+	balance := 0
+	accountId := walletAccount(userId)
+	for _, e := range d.walletManager.entries() {
+		if !e.createdAt.Before(to) {
+			continue
+		}
+		if e.accountId != accountId {
+			if record, ok := payments[e.postingId]; ok && !e.createdAt.Before(from) && d.chargedTo(record, e, userId) {
+				s.charged = append(s.charged, statementLine{
+					at:            e.createdAt,
+					transactionId: record.transactionId,
+					description:   d.describe(record, e, userId) + d.paidWith(record),
+					debit:         newMoney(e.debit, e.currency),
+					credit:        newMoney(e.credit, e.currency),
+				})
+			}
+			continue
+		}
+		balance += e.credit - e.debit
+		if e.createdAt.Before(from) {
+			s.opening = newMoney(balance, currency)
+			continue
+		}
+		line := statementLine{
+			at:      e.createdAt,
+			debit:   newMoney(e.debit, currency),
+			credit:  newMoney(e.credit, currency),
+			balance: newMoney(balance, currency),
+		}
+		if record, ok := payments[e.postingId]; ok {
+			line.transactionId = record.transactionId
+			line.description = d.describe(record, e, userId)
+		} else {
+			line.description = e.reference
+		}
+		s.totalIn = s.totalIn.plus(line.credit)
+		s.totalOut = s.totalOut.plus(line.debit)
+		s.lines = append(s.lines, line)
+	}
+	s.closing = newMoney(balance, currency)
+	return s, nil
+}
+
+// chargedTo reports whether the entry is money the user's own instrument paid
+// or got back: the clearing side of a payment they sent from it.
+func (d *paymentTransaction) chargedTo(record transferRecord, e ledgerEntry, userId int) bool {
+	return record.fromUserId == userId && record.toUserId != userId &&
+		record.instrumentId != payFromWallet && strings.HasPrefix(e.accountId, "clearing:")
+}
+
+// paidWith names the instrument a payment was charged to, as in " by card".
+func (d *paymentTransaction) paidWith(record transferRecord) string {
+	i, err := d.instrumentManager.selectInstrument(record.fromUserId, record.instrumentId)
+	if err != nil {
+		return ""
+	}
+	return " by " + i.getType()
+}
+
+// describe says what a wallet entry was from the user's side, as in "refund
+// to prakash".
+func (d *paymentTransaction) describe(record transferRecord, e ledgerEntry, userId int) string {
+	kind := "payment"
+	switch {
+	case strings.HasSuffix(e.reference, ":reversal"):
+		kind = "reversal"
+	case strings.HasSuffix(e.reference, ":refund"):
+		kind = "refund"
+	case strings.HasSuffix(e.reference, ":hold"):
+		kind = "dispute hold"
+	case strings.HasSuffix(e.reference, ":resolution"):
+		kind = "dispute release"
+	}
+	if record.fromUserId == record.toUserId {
+		return "wallet top-up " + kind
+	}
+	counterparty := record.fromUserId
+	if userId == record.fromUserId {
+		counterparty = record.toUserId
+	}
+	direction := "to "
+	if e.credit > 0 {
+		direction = "from "
+	}
+	description := kind + " " + direction + d.userName(counterparty)
+	if record.quoteId != "" {
+		description += fmt.Sprintf(" (%s at %s)", record.amount, formatRate(record.rate))
+	}
+	return description
+}
+
+func (d *paymentTransaction) userName(userId int) string {
+	if u := d.userManager.getUserDetails(userId); u != nil {
+		return u.getName()
+	}
+	return fmt.Sprintf("userId %d", userId)
+}
+
+// writeCSV exports the statement with amounts in major units. The opening and
+// closing balances come first and last among the wallet rows; charges to
+// instruments follow them with no balance.
+func (d statement) writeCSV(w io.Writer) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"date", "transaction_id", "description", "debit", "credit", "balance", "currency"})
+	currency := d.opening.currency
+	c.Write([]string{d.from.Format(time.RFC3339), "", "opening balance", "", "", d.opening.decimal(), currency})
+	for _, l := range d.lines {
+		c.Write([]string{l.at.Format(time.RFC3339), l.transactionId, l.description, blankIfZero(l.debit), blankIfZero(l.credit), l.balance.decimal(), currency})
+	}
+	c.Write([]string{d.to.Format(time.RFC3339), "", "closing balance", d.totalOut.decimal(), d.totalIn.decimal(), d.closing.decimal(), currency})
+	for _, l := range d.charged {
+		c.Write([]string{l.at.Format(time.RFC3339), l.transactionId, l.description, blankIfZero(l.debit), blankIfZero(l.credit), "", l.debit.currency})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// writeText lays the statement out in columns for reading.
+func (d statement) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "Statement for %s (userId %d), %s wallet\n", d.name, d.userId, d.opening.currency)
+	fmt.Fprintf(w, "%s to %s\n\n", d.from.Format(time.RFC3339), d.to.Format(time.RFC3339))
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(t, "Date\tTransaction\tDescription\tDebit\tCredit\tBalance\t")
+	fmt.Fprintf(t, "\t\tOpening balance\t\t\t%s\t\n", d.opening.decimal())
+	for _, l := range d.lines {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%s\t\n", l.at.Format("2006-01-02 15:04:05"), l.transactionId, l.description, blankIfZero(l.debit), blankIfZero(l.credit), l.balance.decimal())
+	}
+	fmt.Fprintf(t, "\t\tClosing balance\t%s\t%s\t%s\t\n", d.totalOut.decimal(), d.totalIn.decimal(), d.closing.decimal())
+	if len(d.charged) > 0 {
+		fmt.Fprintln(t, "\t\tCharged to cards and accounts\t\t\t\t")
+	}
+	for _, l := range d.charged {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t\t\n", l.at.Format("2006-01-02 15:04:05"), l.transactionId, l.description, blankIfZero(l.debit), blankIfZero(l.credit))
+	}
+	return t.Flush()
+}
+
+func blankIfZero(amount money) string {
+	if amount.minor == 0 {
+		return ""
+	}
+	return amount.decimal()
+}
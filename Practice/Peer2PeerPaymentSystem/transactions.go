@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	errTransactionNotFound    = errors.New("transaction not found")
+	errIdempotencyKeyMissing  = errors.New("idempotency key is required")
+	errIdempotencyKeyConflict = errors.New("idempotency key already used for a different payment")
+	errInvalidTransition      = errors.New("invalid status transition")
+	errInvalidPaymentAmount   = errors.New("payment amount must be positive and in a known currency")
+	errPaymentInProgress      = errors.New("payment is still in progress")
+)
+
+// Transaction statuses. A payment is created, held in review if the risk rules
+// ask for it, authorised once the sender and funds check out and captured once
+// the money has moved in the ledger. A captured payment can later be reversed,
+// refunded in one or more parts, or disputed by the sender.
+const (
+	statusCreated           = "CREATED"
+	statusInReview          = "IN_REVIEW"
+	statusAuthorised        = "AUTHORISED"
+	statusCaptured          = "CAPTURED"
+	statusFailed            = "FAILED"
+	statusReversed          = "REVERSED"
+	statusPartiallyRefunded = "PARTIALLY_REFUNDED"
+	statusRefunded          = "REFUNDED"
+	statusDisputed          = "DISPUTED"
+)
+
+var allowedTransitions = map[string][]string{
+	statusCreated:           {statusInReview, statusAuthorised, statusFailed},
+	statusInReview:          {statusAuthorised, statusFailed},
+	statusAuthorised:        {statusCaptured, statusFailed, statusReversed},
+	statusCaptured:          {statusReversed, statusPartiallyRefunded, statusRefunded, statusDisputed},
+	statusPartiallyRefunded: {statusPartiallyRefunded, statusRefunded, statusDisputed},
+	statusDisputed:          {statusCaptured, statusPartiallyRefunded, statusRefunded},
+}
+
+type statusChange struct {
+	status string
+	reason string
+	at     time.Time
+}
+
+type transferRecord struct {
+	transactionId  string
+	idempotencyKey string
+	fromUserId     int
+	toUserId       int
+	instrumentId   int
+	amount         money  // what the sender pays, before any FX fee
+	fee            money  // FX fee charged to the sender on top of amount
+	credited       money  // what the receiver gets, in their wallet's currency
+	rate           int64  // FX rate locked for the payment, scaled by rateScale
+	quoteId        string // the FX quote used, for cross-currency payments
+	status         string
+	gatewayName    string // set for payments charged to an instrument
+	authorisation  string // the gateway's authorisation id
+	refunded       money  // total refunded so far, out of amount
+	reclaimed      money  // what the refunds took back from the receiver
+	postingIds     []int  // ledger postings made for this payment, in order
+	failure        error  // why the payment failed, handed to retries
+	history        []statusChange
+	createdAt      time.Time
+}
+
+func (d transferRecord) failureReason() string {
+	if d.status != statusFailed {
+		return ""
+	}
+	return d.history[len(d.history)-1].reason
+}
+
+// outcome is what a retry with the payment's idempotency key gets back: the
+// original failure, an error while the payment is still pending, or nil once
+// it was captured, whatever happened to it afterwards.
+func (d transferRecord) outcome() error {
+	if d.failure != nil {
+		return d.failure
+	}
+	switch d.status {
+	case statusCreated, statusAuthorised:
+		return fmt.Errorf("%w: %s is %s", errPaymentInProgress, d.transactionId, d.status)
+	case statusInReview:
+		return fmt.Errorf("%w: %s", errHeldForReview, d.transactionId)
+	}
+	return nil
+}
+
+// charged is everything taken from the sender, fee included.
+func (d transferRecord) charged() money {
+	return d.amount.plus(d.fee)
+}
+
+// receiverShare is what refunding amount takes back from the receiver: the
+// same fraction of what they were credited, with the last refund taking
+// whatever is left so rounding never strands a minor unit.
+func (d transferRecord) receiverShare(amount money) money {
+	if d.refunded.minor+amount.minor == d.amount.minor {
+		return newMoney(d.credited.minor-d.reclaimed.minor, d.credited.currency)
+	}
+	return newMoney(d.credited.minor*amount.minor/d.amount.minor, d.credited.currency)
+}
+
+func (d transferRecord) printDetail() {
+	fmt.Println("[TransactionDetail] transactionId:", d.transactionId, "from:", d.fromUserId, "to:", d.toUserId, "amount:", d.amount, "refunded:", d.refunded, "status:", d.status)
+	if d.quoteId != "" {
+		fmt.Println("     converted at", formatRate(d.rate), "with", d.quoteId, "fee:", d.fee, "credited:", d.credited)
+	}
+	for _, h := range d.history {
+		fmt.Println("    ", h.at.Format(time.RFC3339), h.status, h.reason)
+	}
+}
+
+// transactionStore keeps every payment together with all of its status
+// changes. Idempotency keys are scoped to the sender, so a client retrying
+// with the same key gets the original payment back instead of paying twice.
+// Records are only handed out as snapshots.
+type transactionStore struct {
+	mu               sync.RWMutex
+	paymentLocks     map[string]*sync.Mutex // held while a payment's money moves
+	transactions     map[string]*transferRecord
+	idempotencyIndex map[string]string // "<fromUserId>:<key>" to transaction id
+	userIndex        map[int][]string  // user id to the ids of payments they sent or received
+	failureHooks     map[string][]func(transferRecord)
+	lastId           int
+}
+
+func newTransactionStore() *transactionStore {
+	return &transactionStore{
+		paymentLocks:     make(map[string]*sync.Mutex),
+		transactions:     make(map[string]*transferRecord),
+		idempotencyIndex: make(map[string]string),
+		userIndex:        make(map[int][]string),
+		failureHooks:     make(map[string][]func(transferRecord)),
+	}
+}
+
+// create records a new payment, or returns the existing one when the key was
+// already used by the sender. created is false for such replays, which pass
+// on the original payment's outcome.
+func (d *transactionStore) create(idempotencyKey string, fromUserId, toUserId, instrumentId int, amount money) (record transferRecord, created bool, err error) {
+	if idempotencyKey == "" {
+		return transferRecord{}, false, errIdempotencyKeyMissing
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	scopedKey := fmt.Sprintf("%d:%s", fromUserId, idempotencyKey)
+	if transactionId, ok := d.idempotencyIndex[scopedKey]; ok {
+		existing := d.transactions[transactionId]
+		if existing.toUserId != toUserId || existing.instrumentId != instrumentId || existing.amount != amount {
+			return transferRecord{}, false, fmt.Errorf("%w: %s", errIdempotencyKeyConflict, transactionId)
+		}
+		return existing.snapshot(), false, nil
+	}
+
+	d.lastId++
+	now := time.Now()
+	r := &transferRecord{
+		transactionId:  fmt.Sprintf("TXN%06d", d.lastId),
+		idempotencyKey: idempotencyKey,
+		fromUserId:     fromUserId,
+		toUserId:       toUserId,
+		instrumentId:   instrumentId,
+		amount:         amount,
+		fee:            newMoney(0, amount.currency),
+		credited:       amount,
+		rate:           rateScale,
+		refunded:       newMoney(0, amount.currency),
+		reclaimed:      newMoney(0, amount.currency),
+		status:         statusCreated,
+		history:        []statusChange{{status: statusCreated, at: now}},
+		createdAt:      now,
+	}
+	d.transactions[r.transactionId] = r
+	d.paymentLocks[r.transactionId] = &sync.Mutex{}
+	d.idempotencyIndex[scopedKey] = r.transactionId
+	d.userIndex[fromUserId] = append(d.userIndex[fromUserId], r.transactionId)
+	if toUserId != fromUserId {
+		d.userIndex[toUserId] = append(d.userIndex[toUserId], r.transactionId)
+	}
+	return r.snapshot(), true, nil
+}
+
+// lock serialises everything that moves money for one payment, such as two
+// refunds racing each other, and returns the unlock function.
+func (d *transactionStore) lock(transactionId string) (func(), error) {
+	d.mu.RLock()
+	l, ok := d.paymentLocks[transactionId]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errTransactionNotFound, transactionId)
+	}
+	l.Lock()
+	return l.Unlock, nil
+}
+
+// transition moves the payment to status. Hooks waiting on the payment
+// failing run after the store's lock is released.
+func (d *transactionStore) transition(transactionId, status, reason string) error {
+	d.mu.Lock()
+	r, ok := d.transactions[transactionId]
+	if !ok {
+		d.mu.Unlock()
+		return fmt.Errorf("%w: %s", errTransactionNotFound, transactionId)
+	}
+	allowed := false
+	for _, next := range allowedTransitions[r.status] {
+		if next == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		d.mu.Unlock()
+		return fmt.Errorf("%w: %s cannot go from %s to %s", errInvalidTransition, transactionId, r.status, status)
+	}
+	r.status = status
+	r.history = append(r.history, statusChange{status: status, reason: reason, at: time.Now()})
+	var hooks []func(transferRecord)
+	if status == statusFailed {
+		hooks = d.failureHooks[transactionId]
+		delete(d.failureHooks, transactionId)
+	}
+	record := r.snapshot()
+	d.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(record)
+	}
+	return nil
+}
+
+// onFailure runs hook if the payment later fails, such as a payment held for
+// review being rejected. It is not run for a payment that already failed.
+func (d *transactionStore) onFailure(transactionId string, hook func(transferRecord)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.transactions[transactionId]; ok && r.status != statusFailed {
+		d.failureHooks[transactionId] = append(d.failureHooks[transactionId], hook)
+	}
+}
+
+func (d *transactionStore) setFailure(transactionId string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.transactions[transactionId]; ok {
+		r.failure = err
+	}
+}
+
+func (d *transactionStore) setAuthorisation(transactionId, gatewayName, authorisation string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.transactions[transactionId]; ok {
+		r.gatewayName = gatewayName
+		r.authorisation = authorisation
+	}
+}
+
+// setConversion records the FX quote a cross-currency payment is made at.
+func (d *transactionStore) setConversion(transactionId string, quote fxQuote) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.transactions[transactionId]; ok {
+		r.quoteId = quote.quoteId
+		r.fee = quote.fee
+		r.credited = quote.receive
+		r.rate = quote.rate
+		r.reclaimed = newMoney(0, quote.receive.currency)
+	}
+}
+
+func (d *transactionStore) addPosting(transactionId string, postingId int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.transactions[transactionId]; ok {
+		r.postingIds = append(r.postingIds, postingId)
+	}
+}
+
+func (d *transactionStore) addRefund(transactionId string, amount, reclaimed money) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.transactions[transactionId]; ok {
+		r.refunded = r.refunded.plus(amount)
+		r.reclaimed = r.reclaimed.plus(reclaimed)
+	}
+}
+
+func (d *transactionStore) getTransaction(transactionId string) (transferRecord, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	r, ok := d.transactions[transactionId]
+	if !ok {
+		return transferRecord{}, fmt.Errorf("%w: %s", errTransactionNotFound, transactionId)
+	}
+	return r.snapshot(), nil
+}
+
+// historyForUser lists the payments a user sent or received, oldest first.
+func (d *transactionStore) historyForUser(userId int) []transferRecord {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var records []transferRecord
+	for _, transactionId := range d.userIndex[userId] {
+		records = append(records, d.transactions[transactionId].snapshot())
+	}
+	return records
+}
+
+// byPosting maps each ledger posting to the payment it was made for.
+func (d *transactionStore) byPosting() map[int]transferRecord {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	payments := make(map[int]transferRecord)
+	for _, r := range d.transactions {
+		for _, postingId := range r.postingIds {
+			payments[postingId] = r.snapshot()
+		}
+	}
+	return payments
+}
+
+func (d *transferRecord) snapshot() transferRecord {
+	r := *d
+	r.postingIds = append([]int(nil), d.postingIds...)
+	r.history = append([]statusChange(nil), d.history...)
+	return r
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRetryGetsTheOriginalOutcome(t *testing.T) {
+	payments := newTestPayments(t, 2, majorUnits(100, "INR"))
+
+	tooMuch := *payments
+	tooMuch.amount = majorUnits(500, "INR")
+	if _, err := tooMuch.doTransaction("too-much", 1, 2, payFromWallet); !errors.Is(err, errInsufficientFunds) {
+		t.Fatalf("got %v, want %v", err, errInsufficientFunds)
+	}
+	if record, err := tooMuch.doTransaction("too-much", 1, 2, payFromWallet); !errors.Is(err, errInsufficientFunds) || record.status != statusFailed {
+		t.Fatalf("retrying a failed payment got %s and %v, want %s and %v", record.status, err, statusFailed, errInsufficientFunds)
+	}
+
+	paid := *payments
+	paid.amount = majorUnits(10, "INR")
+	first, err := paid.doTransaction("paid", 1, 2, payFromWallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := paid.doTransaction("paid", 1, 2, payFromWallet); err != nil || again.transactionId != first.transactionId {
+		t.Fatalf("retrying a captured payment got %s and %v", again.transactionId, err)
+	}
+
+	// a first attempt that has not finished yet
+	if _, _, err := payments.store.create("pending", 1, 2, payFromWallet, paid.amount); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := paid.doTransaction("pending", 1, 2, payFromWallet); !errors.Is(err, errPaymentInProgress) {
+		t.Fatalf("got %v, want %v", err, errPaymentInProgress)
+	}
+	if balance, _ := payments.walletManager.getBalance(1); balance != majorUnits(90, "INR") {
+		t.Fatalf("sender has %s after paying 10 once, want INR 90.00", balance)
+	}
+}
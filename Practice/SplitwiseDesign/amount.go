@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidAmount   = errors.New("invalid amount")
+	errUnknownCurrency = errors.New("unknown currency")
+)
+
+// Amounts are held in minor units of their currency (paise for INR) so shares
+// always add back up to the expense.
+
+// defaultCurrency is what amounts are in unless an expense or group says
+// otherwise. Its amounts print without a currency code, as the problem's
+// sample output does.
+const defaultCurrency = "INR"
+
+// currencyExponents is the number of minor-unit digits per currency.
+var currencyExponents = map[string]int{
+	"INR": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"THB": 2,
+	"JPY": 0,
+}
+
+func validCurrency(currency string) error {
+	if _, ok := currencyExponents[currency]; !ok {
+		return fmt.Errorf("%w: %q", errUnknownCurrency, currency)
+	}
+	return nil
+}
+
+// parseAmount reads "1250" or "1250.5" as paise.
+func parseAmount(s string) (int, error) {
+	return parseAmountIn(s, defaultCurrency)
+}
+
+// parseAmountIn reads an amount in the currency's minor units. More decimal
+// places than the currency has is an error rather than silently rounded.
+func parseAmountIn(s, currency string) (int, error) {
+	exponent := currencyExponents[currency]
+	whole, fraction, hasFraction := strings.Cut(s, ".")
+	if hasFraction && (len(fraction) == 0 || len(fraction) > exponent) {
+		return 0, fmt.Errorf("%w: %q", errInvalidAmount, s)
+	}
+	major, err := strconv.Atoi(whole)
+	if err != nil || major < 0 || strings.HasPrefix(whole, "+") {
+		return 0, fmt.Errorf("%w: %q", errInvalidAmount, s)
+	}
+	minor := 0
+	if hasFraction {
+		if minor, err = strconv.Atoi(fraction); err != nil || minor < 0 || strings.HasPrefix(fraction, "+") {
+			return 0, fmt.Errorf("%w: %q", errInvalidAmount, s)
+		}
+		for i := len(fraction); i < exponent; i++ {
+			minor *= 10
+		}
+	}
+	return major*pow10(exponent) + minor, nil
+}
+
+// formatAmount prints whole amounts without decimals, as the problem's sample
+// output does, and anything else to the paisa.
+func formatAmount(paise int) string {
+	return formatAmountIn(paise, defaultCurrency)
+}
+
+func formatAmountIn(minor int, currency string) string {
+	exponent := currencyExponents[currency]
+	sign := ""
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	unit := pow10(exponent)
+	if minor%unit == 0 {
+		return sign + strconv.Itoa(minor/unit)
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/unit, exponent, minor%unit)
+}
+
+// formatMoney is formatAmountIn with the currency code in front, left off for
+// the default currency.
+func formatMoney(minor int, currency string) string {
+	if currency == defaultCurrency || currency == "" {
+		return formatAmountIn(minor, defaultCurrency)
+	}
+	return currency + " " + formatAmountIn(minor, currency)
+}
+
+func pow10(n int) int {
+	p := 1
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errSaveFailed    = errors.New("could not save")
+	errRestoreFailed = errors.New("could not rebuild the saved state")
+)
+
+// server is the local REST API. Every change is made on a copy of the last
+// state that was saved, and the copy only replaces the tracker once it has
+// been saved too, so a change that fails part way leaves nothing behind.
+type server struct {
+	mu      sync.Mutex
+	tracker *expenseTracker
+	store   storage
+	saved   snapshot
+}
+
+func newServer(store storage) (*server, error) {
+	s, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	tracker, err := restoreTracker(s)
+	if err != nil {
+		return nil, err
+	}
+	return &server{tracker: tracker, store: store, saved: s}, nil
+}
+
+// change runs fn against a copy of the tracker rebuilt from the saved state,
+// saves the copy and only then swaps it in. Rebuilding replays every
+// transaction, which is cheap at the sizes a local API sees.
+func (d *server) change(fn func(*expenseTracker) error) error {
+	working, err := restoreTracker(d.saved)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRestoreFailed, err)
+	}
+	// the clock, notifier and rates are not part of the saved state
+	working.clock, working.notifier, working.rates = d.tracker.clock, d.tracker.notifier, d.tracker.rates
+	if err := fn(working); err != nil {
+		return err
+	}
+	s, err := working.snapshot()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSaveFailed, err)
+	}
+	if err := d.store.save(s); err != nil {
+		return fmt.Errorf("%w: %v", errSaveFailed, err)
+	}
+	d.tracker, d.saved = working, s
+	return nil
+}
+
+func (d *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", d.handleUsers)
+	mux.HandleFunc("/groups", d.handleGroups)
+	mux.HandleFunc("/groups/", d.handleGroupMembers)
+	mux.HandleFunc("/expenses", d.handleExpenses)
+	mux.HandleFunc("/expenses/", d.handleExpense)
+	mux.HandleFunc("/settlements", d.handleSettlements)
+	mux.HandleFunc("/balances", d.handleBalances)
+	mux.HandleFunc("/recurring", d.handleRecurring)
+	mux.HandleFunc("/recurring/", d.handleStopRecurring)
+	mux.HandleFunc("/reminders", d.handleReminders)
+	return mux
+}
+
+// runSchedule adds due recurring expenses and sends reminders straight away
+// and then every interval, saving after each run.
+func (d *server) runSchedule(every time.Duration) {
+	for {
+		d.mu.Lock()
+		err := d.change(func(t *expenseTracker) error {
+			t.runScheduled()
+			return nil
+		})
+		d.mu.Unlock()
+		if err != nil {
+			log.Println("[runSchedule]", err)
+		}
+		time.Sleep(every)
+	}
+}
+
+type userJSON struct {
+	UserId       string `json:"userId"`
+	Name         string `json:"name"`
+	Email        string `json:"email,omitempty"`
+	MobileNumber string `json:"mobileNumber,omitempty"`
+}
+
+type groupJSON struct {
+	GroupId string   `json:"groupId"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// expenseJSON carries amounts as decimal strings in Currency, as in
+// "1250.50". Without a currency an expense is in its group's base currency.
+type expenseJSON struct {
+	Id        string            `json:"id,omitempty"`
+	Type      string            `json:"type"`
+	PaidBy    string            `json:"paidBy"`
+	Amount    string            `json:"amount"`
+	Currency  string            `json:"currency,omitempty"`
+	UserIds   []string          `json:"userIds"`
+	SplitArgs []string          `json:"splitArgs,omitempty"`
+	GroupId   string            `json:"groupId,omitempty"`
+	Shares    map[string]string `json:"shares,omitempty"`
+	// EditedBy is who is making a PUT.
+	EditedBy string `json:"editedBy,omitempty"`
+}
+
+type settlementJSON struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Amount   string `json:"amount"`
+	Currency string `json:"currency,omitempty"`
+	GroupId  string `json:"groupId,omitempty"`
+}
+
+type recurringJSON struct {
+	Id          string      `json:"id,omitempty"`
+	Frequency   string      `json:"frequency"`
+	Expense     expenseJSON `json:"expense"`
+	Next        string      `json:"next,omitempty"`
+	Occurrences int         `json:"occurrences"`
+	Stopped     bool        `json:"stopped"`
+}
+
+// remindersJSON turns reminders off when everyDays is 0.
+type remindersJSON struct {
+	Threshold  string `json:"threshold"`
+	MaxAgeDays int    `json:"maxAgeDays"`
+	EveryDays  int    `json:"everyDays"`
+}
+
+type balanceJSON struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (d *server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		users := []userJSON{}
+		for _, u := range d.tracker.users {
+			users = append(users, userJSON{UserId: u.userId, Name: u.name, Email: u.email, MobileNumber: u.mobileNumber})
+		}
+		writeJSON(w, http.StatusOK, users)
+	case http.MethodPost:
+		var body userJSON
+		if !readJSON(w, r, &body) {
+			return
+		}
+		if body.UserId == "" || body.Name == "" {
+			writeError(w, fmt.Errorf("%w: userId and name are required", errBadCommand))
+			return
+		}
+		err := d.change(func(t *expenseTracker) error {
+			return t.addUser(newUser(body.UserId, body.Name, body.Email, body.MobileNumber))
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		groups := []groupJSON{}
+		for _, g := range d.tracker.groups {
+			groups = append(groups, groupJSON{GroupId: g.groupId, Name: g.name, Members: g.members})
+		}
+		writeJSON(w, http.StatusOK, groups)
+	case http.MethodPost:
+		var body groupJSON
+		if !readJSON(w, r, &body) {
+			return
+		}
+		err := d.change(func(t *expenseTracker) error {
+			_, err := t.createGroup(body.GroupId, body.Name, body.Members)
+			return err
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleGroupMembers handles POST /groups/{groupId}/members with
+// {"userIds": [...]}.
+func (d *server) handleGroupMembers(w http.ResponseWriter, r *http.Request) {
+	groupId, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/groups/"), "/")
+	if rest != "members" || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	var body struct {
+		UserIds []string `json:"userIds"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.change(func(t *expenseTracker) error { return t.addMembers(groupId, body.UserIds) }); err != nil {
+		writeError(w, err)
+		return
+	}
+	g, _ := d.tracker.getGroup(groupId)
+	writeJSON(w, http.StatusOK, groupJSON{GroupId: g.groupId, Name: g.name, Members: g.members})
+}
+
+func (d *server) handleExpenses(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		expenses := []expenseJSON{}
+		for _, t := range d.tracker.transactions {
+			expense, err := toExpenseJSON(t)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			expenses = append(expenses, expense)
+		}
+		writeJSON(w, http.StatusOK, expenses)
+	case http.MethodPost:
+		var body expenseJSON
+		if !readJSON(w, r, &body) {
+			return
+		}
+		var created transaction
+		err := d.change(func(t *expenseTracker) error {
+			var err error
+			if created, err = t.parseExpense(body.command()); err != nil {
+				return err
+			}
+			t.addTransaction(created)
+			return nil
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeExpense(w, http.StatusCreated, created)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleExpense handles GET, PUT and DELETE /expenses/{id}. DELETE names who
+// is deleting with ?by=<userId>.
+func (d *server) handleExpense(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/expenses/")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		_, t, err := d.tracker.getTransaction(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeExpense(w, http.StatusOK, t)
+	case http.MethodPut:
+		var body expenseJSON
+		if !readJSON(w, r, &body) {
+			return
+		}
+		if err := d.change(func(t *expenseTracker) error { return t.editExpense(id, body.EditedBy, body.command()) }); err != nil {
+			writeError(w, err)
+			return
+		}
+		_, t, _ := d.tracker.getTransaction(id)
+		writeExpense(w, http.StatusOK, t)
+	case http.MethodDelete:
+		if err := d.change(func(t *expenseTracker) error { return t.deleteExpense(id, r.URL.Query().Get("by")) }); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *server) handleSettlements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body settlementJSON
+	if !readJSON(w, r, &body) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.change(func(t *expenseTracker) error {
+		currency := body.Currency
+		if currency == "" {
+			currency = t.baseCurrencyOf(body.GroupId)
+		}
+		if err := validCurrency(currency); err != nil {
+			return err
+		}
+		amount, err := parseAmountIn(body.Amount, currency)
+		if err != nil {
+			return err
+		}
+		return t.settle(body.From, body.To, amount, currency, body.GroupId)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	t := d.tracker.transactions[len(d.tracker.transactions)-1]
+	writeExpense(w, http.StatusCreated, t)
+}
+
+// handleBalances handles GET /balances with optional ?group= and ?user=, and
+// ?base=true to convert everything into the base currency.
+func (d *server) handleBalances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	query := r.URL.Query()
+	lines, err := d.tracker.balancesFor(query.Get("group"), query.Get("user"), query.Get("base") == "true")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	balances := []balanceJSON{}
+	for _, t := range lines {
+		balances = append(balances, balanceJSON{From: t.from, To: t.to, Amount: formatAmountIn(t.amount, t.currency), Currency: t.currency})
+	}
+	writeJSON(w, http.StatusOK, balances)
+}
+
+// command turns the body into the words of an EXPENSE command so the API
+// and the command line validate expenses the same way.
+func (d expenseJSON) command() []string {
+	cmd := []string{"EXPENSE", d.PaidBy, d.Amount, strconv.Itoa(len(d.UserIds))}
+	cmd = append(cmd, d.UserIds...)
+	cmd = append(cmd, d.Type)
+	cmd = append(cmd, d.SplitArgs...)
+	if d.Currency != "" {
+		cmd = append(cmd, "CURRENCY", d.Currency)
+	}
+	if d.GroupId != "" {
+		cmd = append(cmd, "GROUP", d.GroupId)
+	}
+	return cmd
+}
+
+func toExpenseJSON(t transaction) (expenseJSON, error) {
+	base, splitArgs, err := baseOf(t)
+	if err != nil {
+		return expenseJSON{}, err
+	}
+	shares := make(map[string]string)
+	for userId, share := range t.getUserToSplitAmount() {
+		shares[userId] = formatAmountIn(share, base.currency)
+	}
+	return expenseJSON{
+		Id:        base.id,
+		Type:      base.transactionType,
+		PaidBy:    base.whoPaid,
+		Amount:    formatAmountIn(base.amount, base.currency),
+		Currency:  base.currency,
+		UserIds:   base.userIds,
+		SplitArgs: splitArgs,
+		GroupId:   base.groupId,
+		Shares:    shares,
+	}, nil
+}
+
+func writeExpense(w http.ResponseWriter, status int, t transaction) {
+	expense, err := toExpenseJSON(t)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status, expense)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errBadCommand, err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError maps the tracker's errors onto status codes.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, errUserNotFound), errors.Is(err, errGroupNotFound), errors.Is(err, errTransactionNotFound), errors.Is(err, errRecurringNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errUserExists), errors.Is(err, errGroupExists):
+		status = http.StatusConflict
+	case errors.Is(err, errNotAllowed):
+		status = http.StatusForbidden
+	case errors.Is(err, errSaveFailed), errors.Is(err, errRestoreFailed), errors.Is(err, errUnknownTransaction):
+		status = http.StatusInternalServerError
+	}
+	log.Println("[api]", status, err)
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// handleRecurring lists schedules on GET and starts one from now on POST.
+func (d *server) handleRecurring(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		schedules := []recurringJSON{}
+		for _, rec := range d.tracker.recurring {
+			schedules = append(schedules, toRecurringJSON(rec))
+		}
+		writeJSON(w, http.StatusOK, schedules)
+	case http.MethodPost:
+		var body recurringJSON
+		if !readJSON(w, r, &body) {
+			return
+		}
+		var created *recurringExpense
+		err := d.change(func(t *expenseTracker) error {
+			var err error
+			created, err = t.addRecurring(body.Frequency, t.clock.now(), body.Expense.command())
+			return err
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, toRecurringJSON(created))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleStopRecurring stops a schedule on DELETE /recurring/{id}. The
+// expenses it already added stay.
+func (d *server) handleStopRecurring(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/recurring/")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.change(func(t *expenseTracker) error { return t.stopRecurring(id) }); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *server) handleReminders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body remindersJSON
+	if !readJSON(w, r, &body) {
+		return
+	}
+	cmd := []string{"REMIND", "off"}
+	if body.EveryDays != 0 {
+		cmd = []string{"REMIND", body.Threshold, strconv.Itoa(body.MaxAgeDays), strconv.Itoa(body.EveryDays)}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.change(func(t *expenseTracker) error { return t.runRemind(cmd) }); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// toRecurringJSON reads the expense back out of the schedule's command.
+func toRecurringJSON(r *recurringExpense) recurringJSON {
+	cmd, options := splitOptions(r.cmd)
+	expense := expenseJSON{GroupId: options["GROUP"], Currency: options["CURRENCY"]}
+	if len(cmd) >= 5 {
+		expense.PaidBy, expense.Amount = cmd[1], cmd[2]
+		if count, err := strconv.Atoi(cmd[3]); err == nil && len(cmd) >= count+5 {
+			expense.UserIds = cmd[4 : 4+count]
+			expense.Type = cmd[4+count]
+			expense.SplitArgs = cmd[5+count:]
+		}
+	}
+	rec := recurringJSON{Id: r.id, Frequency: r.frequency, Expense: expense, Occurrences: r.occurrences, Stopped: r.stopped}
+	if !r.stopped {
+		rec.Next = r.occurrence(r.occurrences).Format(time.RFC3339)
+	}
+	return rec
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// flakyStorage keeps the snapshot in memory and fails every save while fail
+// is set.
+type flakyStorage struct {
+	saved snapshot
+	fail  bool
+}
+
+func (d *flakyStorage) load() (snapshot, error) {
+	return d.saved, nil
+}
+
+func (d *flakyStorage) save(s snapshot) error {
+	if d.fail {
+		return errors.New("disk full")
+	}
+	d.saved = s
+	return nil
+}
+
+func serve(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+// TestAPIChangesSurviveRestart drives the API against a file holding the
+// demo, and checks a fresh server started on the same file still has what the
+// first one was sent.
+func TestAPIChangesSurviveRestart(t *testing.T) {
+	store := newFileStorage(filepath.Join(t.TempDir(), "splitwise.json"))
+	original := runDemo(t)
+	if err := store.save(mustSnapshot(t, original)); err != nil {
+		t.Fatal(err)
+	}
+	api, err := newServer(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := api.handler()
+
+	added := "/expenses/E" + strconv.Itoa(original.lastId+1)
+	steps := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/users", `{"userId":"u5","name":"meera"}`, http.StatusCreated},
+		{"POST", "/users", `{"userId":"u5","name":"meera"}`, http.StatusConflict},
+		{"POST", "/groups/goa/members", `{"userIds":["u5"]}`, http.StatusOK},
+		{"POST", "/expenses", `{"paidBy":"u5","amount":"300","userIds":["u1","u5"],"type":"EQUAL","groupId":"goa"}`, http.StatusCreated},
+		{"POST", "/expenses", `{"paidBy":"u5","amount":"300","userIds":["u1","u4"],"type":"EQUAL","groupId":"goa"}`, http.StatusBadRequest},
+		{"PUT", added, `{"editedBy":"u1","paidBy":"u5","amount":"400","userIds":["u1","u5"],"type":"EXACT","splitArgs":["300","100"]}`, http.StatusOK},
+		{"POST", "/settlements", `{"from":"u1","to":"u5","amount":"100","groupId":"goa"}`, http.StatusCreated},
+		{"DELETE", "/expenses/E1?by=u4", "", http.StatusNoContent},
+		{"DELETE", "/expenses/E2?by=u5", "", http.StatusForbidden},
+		{"GET", "/expenses/E1", "", http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if recorder := serve(t, h, step.method, step.path, step.body); recorder.Code != step.status {
+			t.Fatalf("%s %s: got %d, want %d: %s", step.method, step.path, recorder.Code, step.status, recorder.Body.String())
+		}
+	}
+
+	var balances []balanceJSON
+	if err := json.Unmarshal(serve(t, h, "GET", "/balances?group=goa&user=u5", "").Body.Bytes(), &balances); err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 1 || balances[0] != (balanceJSON{From: "u1", To: "u5", Amount: "200", Currency: "INR"}) {
+		t.Fatalf("u5's goa balances are %+v, want u1 owing 200", balances)
+	}
+
+	restarted, err := newServer(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameTracker(t, api.tracker, restarted.tracker)
+}
+
+func TestAPIFailedSaveChangesNothing(t *testing.T) {
+	store := &flakyStorage{}
+	api, err := newServer(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := api.handler()
+	for _, u := range []string{"u1", "u2"} {
+		if recorder := serve(t, h, "POST", "/users", `{"userId":"`+u+`","name":"`+u+`"}`); recorder.Code != http.StatusCreated {
+			t.Fatalf("adding %s: %d %s", u, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	store.fail = true
+	expense := `{"paidBy":"u1","amount":"300","userIds":["u1","u2"],"type":"EQUAL"}`
+	if recorder := serve(t, h, "POST", "/expenses", expense); recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, want %d: %s", recorder.Code, http.StatusInternalServerError, recorder.Body.String())
+	}
+	if recorder := serve(t, h, "GET", "/expenses", ""); recorder.Body.String() != "[]\n" {
+		t.Fatalf("expenses after a failed save: %s", recorder.Body.String())
+	}
+
+	store.fail = false
+	if recorder := serve(t, h, "POST", "/expenses", expense); recorder.Code != http.StatusCreated {
+		t.Fatalf("got %d after the store recovered: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestAPIFailedChangeLeavesNothingBehind(t *testing.T) {
+	api, err := newServer(&flakyStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errHalfway := errors.New("failed half way")
+	err = api.change(func(t *expenseTracker) error {
+		if err := t.addUser(newUser("u1", "u1", "", "")); err != nil {
+			return err
+		}
+		return errHalfway
+	})
+	if !errors.Is(err, errHalfway) {
+		t.Fatalf("got %v, want %v", err, errHalfway)
+	}
+	if len(api.tracker.users) != 0 {
+		t.Fatalf("a failed change left %d users behind", len(api.tracker.users))
+	}
+}
+
+func TestAPIRejectsACorruptSavedState(t *testing.T) {
+	store := &flakyStorage{saved: snapshot{Transactions: []storedTransaction{{Id: "E1", Type: EQUAL, PaidBy: "u1", Amount: 100}}}}
+	if _, err := newServer(store); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("got %v, want %v", err, errUserNotFound)
+	}
+}
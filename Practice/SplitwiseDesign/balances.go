@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// balanceSheet holds, for every pair of users, what the first owes the second
+// in paise after netting every expense between them, so sheet[b][a] is always
+// the negation of sheet[a][b].
+type balanceSheet map[string]map[string]int
+
+// currencyBalances keeps a balance sheet per currency, so what was spent in
+// dollars is owed in dollars.
+type currencyBalances map[string]balanceSheet
+
+func (d currencyBalances) sheet(currency string) balanceSheet {
+	if d[currency] == nil {
+		d[currency] = make(balanceSheet)
+	}
+	return d[currency]
+}
+
+// currencies lists the currencies with a sheet, the default currency first.
+func (d currencyBalances) currencies() []string {
+	var currencies []string
+	for currency := range d {
+		currencies = append(currencies, currency)
+	}
+	sort.Slice(currencies, func(i, j int) bool {
+		if (currencies[i] == defaultCurrency) != (currencies[j] == defaultCurrency) {
+			return currencies[i] == defaultCurrency
+		}
+		return currencies[i] < currencies[j]
+	})
+	return currencies
+}
+
+// recordOwed moves amount of debt from debtor to creditor.
+func (d balanceSheet) recordOwed(debtor, creditor string, amount int) {
+	if debtor == creditor || amount == 0 {
+		return
+	}
+	if d[debtor] == nil {
+		d[debtor] = make(map[string]int)
+	}
+	if d[creditor] == nil {
+		d[creditor] = make(map[string]int)
+	}
+	d[debtor][creditor] += amount
+	d[creditor][debtor] -= amount
+}
+
+// owes is the net amount debtor owes creditor, zero if the debt runs the
+// other way.
+func (d balanceSheet) owes(debtor, creditor string) int {
+	if amount := d[debtor][creditor]; amount > 0 {
+		return amount
+	}
+	return 0
+}
+
+// netPositions is what each of userIds is owed overall by the others in
+// userIds. Debtors are negative and the positions sum to zero.
+func (d balanceSheet) netPositions(userIds []string) map[string]int {
+	net := make(map[string]int)
+	for _, u := range userIds {
+		net[u] = 0
+	}
+	for _, debtor := range userIds {
+		for _, creditor := range userIds {
+			if debtor < creditor {
+				owed := d[debtor][creditor]
+				net[debtor] -= owed
+				net[creditor] += owed
+			}
+		}
+	}
+	return net
+}
+
+// simplifyDebts settles the debts among userIds with as few transfers as the
+// greedy approach finds: the largest debtor repeatedly pays the largest
+// creditor until one of them is square. That takes at most len(userIds)-1
+// transfers and leaves everyone's net position where it was.
+func (d balanceSheet) simplifyDebts(userIds []string) []transfer {
+	return simplifyNet(d.netPositions(userIds))
+}
+
+// balanceLines lists the sheet's non-zero balances among userIds, or the
+// transfers that settle them when simplify is set. With onlyUserId it lists
+// just the lines involving that user, in either direction.
+func (d balanceSheet) balanceLines(userIds []string, simplify bool, onlyUserId string) []transfer {
+	var lines []transfer
+	if simplify {
+		lines = d.simplifyDebts(userIds)
+	} else {
+		for _, debtor := range userIds {
+			for _, creditor := range userIds {
+				if amount := d.owes(debtor, creditor); amount > 0 {
+					lines = append(lines, transfer{from: debtor, to: creditor, amount: amount})
+				}
+			}
+		}
+	}
+	if onlyUserId == "" {
+		return lines
+	}
+	var involving []transfer
+	for _, t := range lines {
+		if t.from == onlyUserId || t.to == onlyUserId {
+			involving = append(involving, t)
+		}
+	}
+	return involving
+}
+
+// balancesFor lists the balances SHOW would print: the group's when groupId
+// is set, everyone's otherwise, narrowed to userId when that is set. The
+// balances are listed per currency, or all converted into the base currency
+// at the rates each expense was recorded at when inBase is set.
+func (d *expenseTracker) balancesFor(groupId, userId string, inBase bool) ([]transfer, error) {
+	if userId != "" {
+		if _, err := d.getUser(userId); err != nil {
+			return nil, err
+		}
+	}
+	balances, base, baseCurrency, userIds, simplify := d.balances, d.baseBalances, defaultCurrency, d.userIds(), d.simplify
+	if groupId != "" {
+		g, err := d.getGroup(groupId)
+		if err != nil {
+			return nil, err
+		}
+		if userId != "" {
+			if err := g.checkMembers(userId); err != nil {
+				return nil, err
+			}
+		}
+		balances, base, baseCurrency, userIds, simplify = g.balances, g.baseBalances, g.baseCurrency, g.members, g.simplify
+	}
+
+	if inBase {
+		return withCurrency(base.balanceLines(userIds, simplify, userId), baseCurrency), nil
+	}
+	var lines []transfer
+	for _, currency := range balances.currencies() {
+		lines = append(lines, withCurrency(balances[currency].balanceLines(userIds, simplify, userId), currency)...)
+	}
+	return lines, nil
+}
+
+func withCurrency(lines []transfer, currency string) []transfer {
+	for i := range lines {
+		lines[i].currency = currency
+	}
+	return lines
+}
+
+func (d *expenseTracker) printBalances(lines []transfer) {
+	for _, t := range lines {
+		fmt.Println(d.userName(t.from), "owes", d.userName(t.to)+":", formatMoney(t.amount, t.currency))
+	}
+	if len(lines) == 0 {
+		fmt.Println("No balances")
+	}
+}
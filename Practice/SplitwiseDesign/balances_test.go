@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureOutput runs f and returns what it printed and what it logged.
+func captureOutput(t *testing.T, f func()) (string, string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer func() {
+		os.Stdout = stdout
+		log.SetOutput(os.Stderr)
+	}()
+
+	printed := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		printed <- string(out)
+	}()
+	f()
+	w.Close()
+	return <-printed, logged.String()
+}
+
+// newSampleTracker has the four users of the problem statement.
+func newSampleTracker(t *testing.T) *expenseTracker {
+	t.Helper()
+	tracker := newExpenseTracker()
+	for i, name := range []string{"User1", "User2", "User3", "User4"} {
+		if err := tracker.addUser(newUser("u"+string(rune('1'+i)), name, "", "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tracker
+}
+
+func TestShow(t *testing.T) {
+	tracker := newSampleTracker(t)
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"SHOW", "No balances\n"},
+		{"SHOW u4", "No balances\n"},
+		{"EXPENSE u1 1000 4 u1 u2 u3 u4 EQUAL", ""},
+		// u4 never paid for anything but still sees what they owe
+		{"SHOW u4", "User4 owes User1: 250\n"},
+		{"SHOW u1", "User2 owes User1: 250\nUser3 owes User1: 250\nUser4 owes User1: 250\n"},
+		{"EXPENSE u4 1250 2 u2 u3 EXACT 370 880", ""},
+		{"SHOW u4", "User2 owes User4: 370\nUser3 owes User4: 880\nUser4 owes User1: 250\n"},
+		{"SHOW", "User2 owes User1: 250\nUser2 owes User4: 370\nUser3 owes User1: 250\nUser3 owes User4: 880\nUser4 owes User1: 250\n"},
+	}
+	for _, tt := range tests {
+		printed, logged := captureOutput(t, func() { tracker.runCommand(tt.cmd) })
+		if printed != tt.want {
+			t.Errorf("%s printed\n%s\nwant\n%s", tt.cmd, printed, tt.want)
+		}
+		if strings.Contains(logged, "failed") {
+			t.Errorf("%s logged %s", tt.cmd, logged)
+		}
+	}
+}
+
+func TestShowUnknownUserIsLogged(t *testing.T) {
+	tracker := newSampleTracker(t)
+	printed, logged := captureOutput(t, func() { tracker.runCommand("SHOW u9") })
+	if printed != "" {
+		t.Errorf("printed %q for an unknown user", printed)
+	}
+	if !strings.Contains(logged, "failed showing user: user not found: u9") {
+		t.Errorf("logged %q, want the failure", logged)
+	}
+}
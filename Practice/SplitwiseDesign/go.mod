@@ -0,0 +1,3 @@
+module system_design_lld_real_world_examples
+
+go 1.19
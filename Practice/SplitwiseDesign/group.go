@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+var (
+	errGroupNotFound = errors.New("group not found")
+	errGroupExists   = errors.New("group already exists")
+	errNotAMember    = errors.New("user is not a member of the group")
+	errGroupInUse    = errors.New("the base currency cannot change once the group has expenses")
+)
+
+// group is a set of people who share costs, such as a trip or a flat. Its
+// expenses count towards the members' overall balances as well as the
+// group's own.
+type group struct {
+	groupId  string
+	name     string
+	members  []string
+	balances currencyBalances
+	// baseCurrency is what the group views and settles its balances in;
+	// baseBalances holds every expense converted into it.
+	baseCurrency string
+	baseBalances balanceSheet
+	// simplify makes SHOW GROUP print the fewest transfers that settle the
+	// group, whatever the tracker-wide setting.
+	simplify bool
+}
+
+func (d *group) isMember(userId string) bool {
+	for _, member := range d.members {
+		if member == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *expenseTracker) getGroup(groupId string) (*group, error) {
+	for _, g := range d.groups {
+		if g.groupId == groupId {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errGroupNotFound, groupId)
+}
+
+func (d *expenseTracker) createGroup(groupId, name string, members []string) (*group, error) {
+	if _, err := d.getGroup(groupId); err == nil {
+		return nil, fmt.Errorf("%w: %s", errGroupExists, groupId)
+	}
+	for _, userId := range members {
+		if _, err := d.getUser(userId); err != nil {
+			return nil, err
+		}
+	}
+	g := &group{groupId: groupId, name: name, balances: make(currencyBalances), baseCurrency: defaultCurrency, baseBalances: make(balanceSheet)}
+	d.groups = append(d.groups, g)
+	log.Println("[createGroup] created group", groupId, name)
+	return g, d.addMembers(groupId, members)
+}
+
+// addMembers adds users to the group, skipping anyone already in it.
+func (d *expenseTracker) addMembers(groupId string, userIds []string) error {
+	g, err := d.getGroup(groupId)
+	if err != nil {
+		return err
+	}
+	for _, userId := range userIds {
+		if _, err := d.getUser(userId); err != nil {
+			return err
+		}
+	}
+	for _, userId := range userIds {
+		if !g.isMember(userId) {
+			g.members = append(g.members, userId)
+			log.Println("[addMembers] added", userId, "to group", groupId)
+		}
+	}
+	return nil
+}
+
+// checkMembers makes sure everyone on a group expense is in the group.
+func (d *group) checkMembers(userIds ...string) error {
+	for _, userId := range userIds {
+		if !d.isMember(userId) {
+			return fmt.Errorf("%w: %s is not in %s", errNotAMember, userId, d.groupId)
+		}
+	}
+	return nil
+}
+
+func (d *expenseTracker) showGroupBalance(groupId, userId string, inBase bool) error {
+	lines, err := d.balancesFor(groupId, userId, inBase)
+	if err != nil {
+		return err
+	}
+	d.printBalances(lines)
+	return nil
+}
+
+// baseCurrencyOf is the currency the group settles in, or the default
+// currency outside any group or for a group that does not exist.
+func (d *expenseTracker) baseCurrencyOf(groupId string) string {
+	if g, err := d.getGroup(groupId); err == nil {
+		return g.baseCurrency
+	}
+	return defaultCurrency
+}
+
+// setBaseCurrency changes what the group views and settles in. Expenses keep
+// the rate to the base currency they were recorded at, so it can only change
+// before the first one.
+func (d *expenseTracker) setBaseCurrency(groupId, currency string) error {
+	g, err := d.getGroup(groupId)
+	if err != nil {
+		return err
+	}
+	if err := validCurrency(currency); err != nil {
+		return err
+	}
+	for _, t := range d.transactions {
+		if t.getGroupId() == groupId {
+			return fmt.Errorf("%w: %s", errGroupInUse, groupId)
+		}
+	}
+	g.baseCurrency = currency
+	log.Println("[setBaseCurrency]", groupId, "now settles in", currency)
+	return nil
+}
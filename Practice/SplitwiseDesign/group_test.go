@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newTripGroup has u1, u2 and u3 in group trip; u4 stays out of it.
+func newTripGroup(t *testing.T) *expenseTracker {
+	t.Helper()
+	tracker := newSampleTracker(t)
+	if err := tracker.runGroup(strings.Fields("GROUP create trip goa u1 u2 u3")); err != nil {
+		t.Fatal(err)
+	}
+	return tracker
+}
+
+func TestGroupExpensesNeedMembers(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  string
+		want error
+	}{
+		{"payer outside", "EXPENSE u4 300 3 u1 u2 u3 EQUAL GROUP trip", errNotAMember},
+		{"participant outside", "EXPENSE u1 300 3 u1 u2 u4 EQUAL GROUP trip", errNotAMember},
+		{"unknown group", "EXPENSE u1 300 3 u1 u2 u3 EQUAL GROUP flat", errGroupNotFound},
+		{"unknown user", "EXPENSE u1 300 2 u1 u9 EQUAL GROUP trip", errUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newTripGroup(t)
+			if err := tracker.runExpense(strings.Fields(tt.cmd)); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if len(tracker.transactions) != 0 {
+				t.Fatalf("a rejected expense was recorded: %v", tracker.transactions)
+			}
+			checkOwed(t, tracker)
+			if got := owed(t, tracker, "trip"); len(got) != 0 {
+				t.Fatalf("group balances %q, want none", got)
+			}
+		})
+	}
+}
+
+func TestGroupExpensesCountOverallAndInTheGroup(t *testing.T) {
+	tracker := newTripGroup(t)
+	if err := tracker.runExpense(strings.Fields("EXPENSE u1 300 3 u1 u2 u3 EQUAL GROUP trip")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.runExpense(strings.Fields("EXPENSE u4 100 2 u1 u4 EQUAL")); err != nil {
+		t.Fatal(err)
+	}
+	checkOwed(t, tracker, "u1->u4 50", "u2->u1 100", "u3->u1 100")
+	if got := owed(t, tracker, "trip"); strings.Join(got, ",") != "u2->u1 100,u3->u1 100" {
+		t.Fatalf("group balances %q leave out the expense outside the group", got)
+	}
+	if _, err := tracker.balancesFor("trip", "u4", false); !errors.Is(err, errNotAMember) {
+		t.Fatalf("showing a non-member: got %v, want %v", err, errNotAMember)
+	}
+	if err := tracker.settle("u4", "u1", 100, "", "trip"); !errors.Is(err, errNotAMember) {
+		t.Fatalf("settling with a non-member: got %v, want %v", err, errNotAMember)
+	}
+
+	// once added, u4 can share the group's expenses
+	if err := tracker.runGroup(strings.Fields("GROUP add trip u4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.runExpense(strings.Fields("EXPENSE u4 100 2 u1 u4 EQUAL GROUP trip")); err != nil {
+		t.Fatal(err)
+	}
+	if got := owed(t, tracker, "trip"); strings.Join(got, ",") != "u1->u4 50,u2->u1 100,u3->u1 100" {
+		t.Fatalf("got group balances %q", got)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errTransactionNotFound = errors.New("transaction not found")
+	errNotAllowed          = errors.New("only the payer or a participant can change an expense")
+	errNotAnExpense        = errors.New("settlements cannot be edited, delete and settle again")
+	errOverpayment         = errors.New("settlement is more than is owed")
+)
+
+// Audit actions.
+const (
+	actionCreate = "CREATE"
+	actionEdit   = "EDIT"
+	actionDelete = "DELETE"
+	actionSettle = "SETTLE"
+	// actionRecurring follows the CREATE of an expense a schedule added.
+	actionRecurring = "RECURRING"
+)
+
+// auditEntry records who did what to a transaction. Entries are never
+// removed, so a deleted expense keeps its history.
+type auditEntry struct {
+	at            time.Time
+	transactionId string
+	userId        string
+	action        string
+	detail        string
+}
+
+func (d *expenseTracker) record(transactionId, userId, action, detail string) {
+	d.audit = append(d.audit, auditEntry{at: d.clock.now(), transactionId: transactionId, userId: userId, action: action, detail: detail})
+}
+
+// describe sums a transaction up for the audit trail, as in
+// "shashank paid 300 EXACT: prakash 100, sharma 200 in goa", with the rate
+// to the default currency for anything spent in another.
+func (d *expenseTracker) describe(transaction transaction) string {
+	shares := transaction.getUserToSplitAmount()
+	userIds := make([]string, 0, len(shares))
+	for userId := range shares {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	var parts []string
+	for _, userId := range userIds {
+		parts = append(parts, d.userName(userId)+" "+formatMoney(shares[userId], transaction.getCurrency()))
+	}
+	detail := fmt.Sprintf("%s paid %s %s: %s", d.userName(transaction.getWhoPaid()), formatMoney(transaction.getAmount(), transaction.getCurrency()), transaction.getTransactionType(), strings.Join(parts, ", "))
+	if transaction.getGroupId() != "" {
+		detail += " in " + transaction.getGroupId()
+	}
+	if currency := transaction.getCurrency(); currency != defaultCurrency {
+		detail += fmt.Sprintf(" at %s %s", formatRate(transaction.rateTo(defaultCurrency)), defaultCurrency)
+	}
+	return detail
+}
+
+func (d *expenseTracker) getTransaction(transactionId string) (int, transaction, error) {
+	for i, t := range d.transactions {
+		if t.getId() == transactionId {
+			return i, t, nil
+		}
+	}
+	return -1, nil, fmt.Errorf("%w: %s", errTransactionNotFound, transactionId)
+}
+
+func canChange(transaction transaction, userId string) error {
+	if transaction.getWhoPaid() == userId {
+		return nil
+	}
+	if _, ok := transaction.getUserToSplitAmount()[userId]; ok {
+		return nil
+	}
+	return fmt.Errorf("%w: %s on %s", errNotAllowed, userId, transaction.getId())
+}
+
+// editExpense replaces an expense with the one cmdSplit describes, keeping
+// its id. An edit without a GROUP or CURRENCY keeps the original expense's,
+// and an edit in the same currency keeps the rates it was recorded at.
+func (d *expenseTracker) editExpense(transactionId, editedBy string, cmdSplit []string) error {
+	i, old, err := d.getTransaction(transactionId)
+	if err != nil {
+		return err
+	}
+	if old.getTransactionType() == SETTLEMENT {
+		return fmt.Errorf("%w: %s", errNotAnExpense, transactionId)
+	}
+	if err := canChange(old, editedBy); err != nil {
+		return err
+	}
+	_, options := splitOptions(cmdSplit)
+	if _, ok := options["GROUP"]; !ok && old.getGroupId() != "" {
+		cmdSplit = append(cmdSplit, "GROUP", old.getGroupId())
+	}
+	if _, ok := options["CURRENCY"]; !ok {
+		cmdSplit = append(cmdSplit, "CURRENCY", old.getCurrency())
+	}
+	edited, err := d.parseExpense(cmdSplit)
+	if err != nil {
+		return err
+	}
+	if edited.getCurrency() == old.getCurrency() {
+		for _, target := range []string{defaultCurrency, d.baseCurrencyOf(edited.getGroupId())} {
+			if rate := old.rateTo(target); rate != 0 && target != edited.getCurrency() {
+				edited.setRate(target, rate)
+			}
+		}
+	}
+	d.applyShares(old, -1)
+	edited.setId(transactionId)
+	edited.setCreatedAt(old.getCreatedAt())
+	d.transactions[i] = edited
+	d.applyShares(edited, 1)
+	d.record(transactionId, editedBy, actionEdit, d.describe(old)+" -> "+d.describe(edited))
+	log.Println("[editExpense]", editedBy, "edited", transactionId)
+	return nil
+}
+
+// deleteExpense takes an expense or settlement off the balances. Its audit
+// trail stays.
+func (d *expenseTracker) deleteExpense(transactionId, deletedBy string) error {
+	i, old, err := d.getTransaction(transactionId)
+	if err != nil {
+		return err
+	}
+	if err := canChange(old, deletedBy); err != nil {
+		return err
+	}
+	d.applyShares(old, -1)
+	d.transactions = append(d.transactions[:i], d.transactions[i+1:]...)
+	d.record(transactionId, deletedBy, actionDelete, d.describe(old))
+	log.Println("[deleteExpense]", deletedBy, "deleted", transactionId)
+	return nil
+}
+
+// settle records that from paid to back. It can be no more than from owes
+// to in the scope, which is the simplified transfer when the scope shows
+// simplified debts, since from may be told to pay someone they never owed
+// directly. A settlement in the scope's base currency pays off debts in any
+// currency; one in another currency only pays off debts in that currency.
+func (d *expenseTracker) settle(from, to string, amount int, currency, groupId string) error {
+	if _, err := d.getUser(from); err != nil {
+		return err
+	}
+	if _, err := d.getUser(to); err != nil {
+		return err
+	}
+	balances, base, baseCurrency, userIds, simplify := d.balances, d.baseBalances, defaultCurrency, d.userIds(), d.simplify
+	if groupId != "" {
+		g, err := d.getGroup(groupId)
+		if err != nil {
+			return err
+		}
+		if err := g.checkMembers(from, to); err != nil {
+			return err
+		}
+		balances, base, baseCurrency, userIds, simplify = g.balances, g.baseBalances, g.baseCurrency, g.members, g.simplify
+	}
+	if currency == "" {
+		currency = baseCurrency
+	}
+	if err := validCurrency(currency); err != nil {
+		return err
+	}
+	if err := validateParticipants([]string{to}, amount, currency); err != nil {
+		return err
+	}
+	sheet := base
+	if currency != baseCurrency {
+		sheet = balances.sheet(currency)
+	}
+
+	owed := sheet.owes(from, to)
+	if simplify {
+		owed = 0
+		for _, t := range sheet.simplifyDebts(userIds) {
+			if t.from == from && t.to == to {
+				owed = t.amount
+			}
+		}
+	}
+	if amount > owed {
+		return fmt.Errorf("%w: %s owes %s %s", errOverpayment, from, to, formatMoney(owed, currency))
+	}
+
+	settlement := &settlementTransaction{}
+	settlement.amount = amount
+	settlement.whoPaid = from
+	settlement.transactionType = SETTLEMENT
+	settlement.groupId = groupId
+	settlement.currency = currency
+	settlement.addUserIds([]string{to})
+	settlement.addSplits([]int{amount})
+	settlement.updateSplit()
+	if err := d.captureRates(settlement); err != nil {
+		return err
+	}
+	d.addTransaction(settlement)
+	return nil
+}
+
+type settlementTransaction struct {
+	baseTransaction
+}
+
+// runSettle handles "SETTLE <from> <to> <amount> [CURRENCY <code>]
+// [GROUP <groupId>]". Without a currency it settles in the scope's base
+// currency.
+func (d *expenseTracker) runSettle(cmdSplit []string) error {
+	args, options := splitOptions(cmdSplit)
+	if len(args) != 4 {
+		return fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
+	}
+	groupId, currency := options["GROUP"], options["CURRENCY"]
+	if currency == "" {
+		currency = d.baseCurrencyOf(groupId)
+	}
+	if err := validCurrency(currency); err != nil {
+		return err
+	}
+	amount, err := parseAmountIn(args[3], currency)
+	if err != nil {
+		return err
+	}
+	return d.settle(args[1], args[2], amount, currency, groupId)
+}
+
+// showHistory prints the audit trail, for one transaction or for all.
+func (d *expenseTracker) showHistory(transactionId string) {
+	found := false
+	for _, e := range d.audit {
+		if transactionId != "" && e.transactionId != transactionId {
+			continue
+		}
+		fmt.Println(e.at.Format("2006-01-02 15:04:05"), e.transactionId, e.action, "by", d.userName(e.userId)+":", e.detail)
+		found = true
+	}
+	if !found {
+		fmt.Println("No history")
+	}
+}
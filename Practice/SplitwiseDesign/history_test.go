@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func mustRun(t *testing.T, tracker *expenseTracker, cmd string) {
+	t.Helper()
+	if err := tracker.runExpense(strings.Fields(cmd)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// auditTrail lists the audit entries as "transactionId action by" lines.
+func auditTrail(tracker *expenseTracker) []string {
+	var trail []string
+	for _, e := range tracker.audit {
+		trail = append(trail, e.transactionId+" "+e.action+" "+e.userId)
+	}
+	return trail
+}
+
+func TestSettleCannotOverpay(t *testing.T) {
+	tracker := newSampleTracker(t)
+	mustRun(t, tracker, "EXPENSE u1 300 3 u1 u2 u3 EQUAL")
+
+	tests := []struct {
+		from, to string
+		amount   int
+		want     error
+	}{
+		{"u2", "u1", 15000, errOverpayment},
+		// u1 owes u2 nothing
+		{"u1", "u2", 100, errOverpayment},
+		{"u2", "u1", 0, errInvalidAmount},
+		{"u2", "u9", 100, errUserNotFound},
+		{"u2", "u1", 6000, nil},
+		{"u2", "u1", 4001, errOverpayment},
+		{"u2", "u1", 4000, nil},
+		{"u2", "u1", 1, errOverpayment},
+	}
+	for _, tt := range tests {
+		if err := tracker.settle(tt.from, tt.to, tt.amount, "", ""); !errors.Is(err, tt.want) {
+			t.Fatalf("%s paying %s %s: got %v, want %v", tt.from, tt.to, formatAmount(tt.amount), err, tt.want)
+		}
+	}
+	checkOwed(t, tracker, "u3->u1 100")
+	if got, want := strings.Join(auditTrail(tracker), ","), "E1 CREATE u1,S2 SETTLE u2,S3 SETTLE u2"; got != want {
+		t.Fatalf("got audit trail %s, want %s", got, want)
+	}
+}
+
+func TestSettleSimplifiedDebts(t *testing.T) {
+	tracker := newSampleTracker(t)
+	mustRun(t, tracker, "EXPENSE u1 100 1 u2 EXACT 100")
+	mustRun(t, tracker, "EXPENSE u2 100 1 u3 EXACT 100")
+	tracker.runCommand("SIMPLIFY ON")
+
+	// simplified, u3 pays u1 and owes u2 nothing
+	checkOwed(t, tracker, "u3->u1 100")
+	if err := tracker.settle("u3", "u2", 10000, "", ""); !errors.Is(err, errOverpayment) {
+		t.Fatalf("got %v, want %v", err, errOverpayment)
+	}
+	if err := tracker.settle("u3", "u1", 10000, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkOwed(t, tracker)
+}
+
+func TestEditAndDeleteReverseBalances(t *testing.T) {
+	tracker := newSampleTracker(t)
+	mustRun(t, tracker, "EXPENSE u1 300 3 u1 u2 u3 EQUAL")
+	mustRun(t, tracker, "EXPENSE u4 100 2 u1 u4 EQUAL")
+	checkOwed(t, tracker, "u1->u4 50", "u2->u1 100", "u3->u1 100")
+
+	if err := tracker.editExpense("E1", "u4", strings.Fields("EXPENSE u1 300 2 u2 u3 EQUAL")); !errors.Is(err, errNotAllowed) {
+		t.Fatalf("editing by an outsider: got %v, want %v", err, errNotAllowed)
+	}
+	// a participant may edit, and the old shares come off before the new go on
+	if err := tracker.editExpense("E1", "u2", strings.Fields("EXPENSE u1 300 2 u2 u3 EXACT 100 200")); err != nil {
+		t.Fatal(err)
+	}
+	checkOwed(t, tracker, "u1->u4 50", "u2->u1 100", "u3->u1 200")
+	// a rejected edit leaves the expense as it was
+	if err := tracker.editExpense("E1", "u2", strings.Fields("EXPENSE u1 300 2 u2 u3 EXACT 100 100")); !errors.Is(err, errExactTotal) {
+		t.Fatalf("got %v, want %v", err, errExactTotal)
+	}
+	checkOwed(t, tracker, "u1->u4 50", "u2->u1 100", "u3->u1 200")
+
+	if err := tracker.deleteExpense("E1", "u3"); err != nil {
+		t.Fatal(err)
+	}
+	checkOwed(t, tracker, "u1->u4 50")
+	if err := tracker.deleteExpense("E1", "u3"); !errors.Is(err, errTransactionNotFound) {
+		t.Fatalf("deleting twice: got %v, want %v", err, errTransactionNotFound)
+	}
+	if err := tracker.editExpense("E1", "u1", strings.Fields("EXPENSE u1 300 2 u2 u3 EQUAL")); !errors.Is(err, errTransactionNotFound) {
+		t.Fatalf("editing a deleted expense: got %v, want %v", err, errTransactionNotFound)
+	}
+
+	// settlements can be deleted but not edited
+	if err := tracker.settle("u1", "u4", 5000, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.editExpense("S3", "u1", strings.Fields("EXPENSE u1 50 1 u4 EQUAL")); !errors.Is(err, errNotAnExpense) {
+		t.Fatalf("got %v, want %v", err, errNotAnExpense)
+	}
+	if err := tracker.deleteExpense("S3", "u4"); err != nil {
+		t.Fatal(err)
+	}
+	checkOwed(t, tracker, "u1->u4 50")
+
+	// the deleted expense keeps its history
+	want := "E1 CREATE u1,E2 CREATE u4,E1 EDIT u2,E1 DELETE u3,S3 SETTLE u1,S3 DELETE u4"
+	if got := strings.Join(auditTrail(tracker), ","); got != want {
+		t.Fatalf("got audit trail %s, want %s", got, want)
+	}
+	printed, _ := captureOutput(t, func() { tracker.showHistory("E1") })
+	if lines := strings.Split(strings.TrimSpace(printed), "\n"); len(lines) != 3 ||
+		!strings.Contains(lines[1], "E1 EDIT by User2: User1 paid 300 EQUAL: User1 100, User2 100, User3 100 -> User1 paid 300 EXACT: User2 100, User3 200") {
+		t.Fatalf("HISTORY E1 printed\n%s", printed)
+	}
+}
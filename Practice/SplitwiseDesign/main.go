@@ -3,7 +3,10 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +16,13 @@ var (
 	EQUAL   = "EQUAL"
 	EXACT   = "EXACT"
 	PERCENT = "PERCENT"
+	// SHARE, ADJUSTMENT and ITEMISED are described on their strategies.
+	SHARE      = "SHARE"
+	ADJUSTMENT = "ADJUSTMENT"
+	ITEMISED   = "ITEMISED"
+	// SETTLEMENT is a repayment: the payer's whole amount is the receiver's
+	// share, so it cancels what the payer owed.
+	SETTLEMENT = "SETTLEMENT"
 )
 
 type user struct {
@@ -20,7 +30,6 @@ type user struct {
 	name         string
 	email        string
 	mobileNumber string
-	transactions []transaction
 }
 
 func newUser(userId, name, email, mobileNumber string) *user {
@@ -32,103 +41,94 @@ func newUser(userId, name, email, mobileNumber string) *user {
 	}
 }
 
-func (d *user) addTransaction(transactionType string, userIDs []string, amount float64, exactShare []float64, percentageShare []int) (transaction, error) {
-	var transaction transaction
-	var err error
-	var splits []float64
-	switch transactionType {
-	case EQUAL:
-		log.Println("[addTransaction] Recording an equal expense")
-		transaction, err = createEqualShareTransaction(d.userId, userIDs, amount)
-		split := amount / float64(len(userIDs))
-		for _, _ = range userIDs {
-			splits = append(splits, split)
-		}
-		break
-	case PERCENT:
-		log.Println("[addTransaction] Recording a percentage expense")
-		transaction, err = createPercentageShareTransaction(d.userId, userIDs, amount)
-		for _, p := range percentageShare {
-			splits = append(splits, (float64(p) * amount * 0.01))
-		}
-		break
-	case EXACT:
-		log.Println("[addTransaction] Recording a percentage expense")
-		transaction, err = createExactShareTransactionTransaction(d.userId, userIDs, amount)
-		for _, e := range exactShare {
-			splits = append(splits, e)
-		}
-		break
+// addTransaction creates an expense the user paid for, split the way the
+// transactionType's strategy splits it. amount is in minor units of currency.
+// The expense is the user's once the tracker records it.
+func (d *user) addTransaction(transactionType string, userIDs []string, amount int, currency string, splitArgs []string) (transaction, error) {
+	strategy, ok := splitStrategies[transactionType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownSplitType, transactionType)
 	}
-
-	// common logic
-	if err == nil {
-		transaction.addUserIds(userIDs)
-		transaction.addSplits(splits)
-		transaction.updateSplit()
-		d.transactions = append(d.transactions, transaction)
-		return transaction, nil
+	if err := validateParticipants(userIDs, amount, currency); err != nil {
+		return nil, err
 	}
-
-	log.Println("failed to add transaction")
-	return nil, errors.New("failed to add transaction")
-}
-
-func (d *user) showBalance() {
-	totalHeOwes := 0.0
-	totalOwedToHim := 0.0
-
-	if len(d.transactions) == 0 {
-		log.Println("No balances for user:", d.userId)
+	log.Println("[addTransaction] Recording a", transactionType, "expense")
+	splits, err := strategy.split(amount, currency, userIDs, splitArgs)
+	if err != nil {
+		return nil, err
 	}
+	transaction := createExpenseTransaction(d.userId, transactionType, userIDs, amount, splitArgs)
+	transaction.currency = currency
 
-	for _, t := range d.transactions {
-		if t.getWhoPaid() == d.userId {
-			for k, v := range t.getUserToSplitAmount() {
-				if k != d.userId {
-					log.Println(k, "owes", d.userId, ":", v)
-					totalOwedToHim = totalOwedToHim + v
-				}
-			}
-		} else {
-			for k, v := range t.getUserToSplitAmount() {
-				if k == d.userId {
-					log.Println(d.userId, "owes", k, ":", v)
-					totalHeOwes = totalHeOwes + v
-				}
-			}
-		}
-	}
+	// common logic
+	transaction.addUserIds(userIDs)
+	transaction.addSplits(splits)
+	transaction.updateSplit()
+	return transaction, nil
 }
 
 type transaction interface {
+	getId() string
+	setId(string)
+	getTransactionType() string
+	getAmount() int
 	getWhoPaid() string
-	getUserToSplitAmount() map[string]float64
+	getUserToSplitAmount() map[string]int
 	updateSplit()
 	addUserIds([]string)
-	addSplits([]float64)
+	addSplits([]int)
+	getGroupId() string
+	setGroupId(string)
+	getCreatedAt() time.Time
+	setCreatedAt(time.Time)
+	getCurrency() string
+	rateTo(currency string) int64
+	setRate(currency string, rate int64)
 }
 
 type baseTransaction struct {
 	transactionType   string
-	amount            float64
-	userToAmountSplit map[string]float64
+	amount            int // paise
+	userToAmountSplit map[string]int
 	id                string
 	whoPaid           string // userid of who paid
 	userIds           []string
-	splits            []float64
+	splits            []int
+	groupId           string // empty for expenses outside any group
+	createdAt         time.Time
+	currency          string
+	// rates are what one unit of currency was worth in each base currency
+	// the transaction counts towards when it was recorded, scaled by
+	// rateScale.
+	rates map[string]int64
+}
+
+func (d *baseTransaction) getId() string {
+	return d.id
+}
+
+func (d *baseTransaction) setId(id string) {
+	d.id = id
+}
+
+func (d *baseTransaction) getTransactionType() string {
+	return d.transactionType
+}
+
+func (d *baseTransaction) getAmount() int {
+	return d.amount
 }
 
 func (d *baseTransaction) getWhoPaid() string {
 	return d.whoPaid
 }
 
-func (d *baseTransaction) getUserToSplitAmount() map[string]float64 {
+func (d *baseTransaction) getUserToSplitAmount() map[string]int {
 	return d.userToAmountSplit
 }
 
 func (d *baseTransaction) updateSplit() {
-	userToAmountSplit := make(map[string]float64)
+	userToAmountSplit := make(map[string]int)
 	for index, u := range d.userIds {
 		userToAmountSplit[u] = d.splits[index]
 	}
@@ -139,65 +139,131 @@ func (d *baseTransaction) addUserIds(userIds []string) {
 	d.userIds = userIds
 }
 
-func (d *baseTransaction) addSplits(splits []float64) {
+func (d *baseTransaction) addSplits(splits []int) {
 	d.splits = splits
 }
 
-type equalShareTransaction struct {
-	baseTransaction
+func (d *baseTransaction) getGroupId() string {
+	return d.groupId
 }
 
-func createEqualShareTransaction(paidByUserId string, userIDs []string, amount float64) (transaction, error) {
-	transaction := &equalShareTransaction{}
-	baseTransaction := baseTransaction{}
-	baseTransaction.amount = amount
-	baseTransaction.id = time.Now().String()
-	baseTransaction.whoPaid = paidByUserId
-	baseTransaction.transactionType = EQUAL
-	transaction.baseTransaction = baseTransaction
-	log.Println("[createEqualShareTransaction] splitting", amount, "among", len(userIDs), "users equally")
-	return transaction, nil
+func (d *baseTransaction) setGroupId(groupId string) {
+	d.groupId = groupId
 }
 
-type percentageShareTransaction struct {
-	baseTransaction
+func (d *baseTransaction) getCreatedAt() time.Time {
+	return d.createdAt
 }
 
-func createPercentageShareTransaction(paidByUserId string, userIDs []string, amount float64) (transaction, error) {
-	transaction := &percentageShareTransaction{}
-	baseTransaction := baseTransaction{}
-	baseTransaction.amount = amount
-	baseTransaction.id = time.Now().String()
-	baseTransaction.whoPaid = paidByUserId
-	baseTransaction.transactionType = PERCENT
-	transaction.baseTransaction = baseTransaction
-	log.Println("[createPercentageShareTransaction] splitting", amount, "among", len(userIDs), "users by percentage")
-	return transaction, nil
+func (d *baseTransaction) setCreatedAt(at time.Time) {
+	d.createdAt = at
+}
+
+func (d *baseTransaction) getCurrency() string {
+	return d.currency
+}
+
+func (d *baseTransaction) rateTo(currency string) int64 {
+	if currency == d.currency {
+		return rateScale
+	}
+	return d.rates[currency]
 }
 
-type exactShareTransaction struct {
+func (d *baseTransaction) setRate(currency string, rate int64) {
+	if d.rates == nil {
+		d.rates = make(map[string]int64)
+	}
+	d.rates[currency] = rate
+}
+
+// expenseTransaction is an expense of any split type. splitArgs are kept as
+// entered so the expense can be described and re-split later.
+type expenseTransaction struct {
 	baseTransaction
+	splitArgs []string
 }
 
-func createExactShareTransactionTransaction(paidByUserId string, userIDs []string, amount float64) (transaction, error) {
-	transaction := &exactShareTransaction{}
-	baseTransaction := baseTransaction{}
-	baseTransaction.amount = amount
-	baseTransaction.id = time.Now().String()
-	baseTransaction.whoPaid = paidByUserId
-	baseTransaction.transactionType = EXACT
-	transaction.baseTransaction = baseTransaction
-	log.Println("[createPercentageShareTransaction] splitting", amount, "among", len(userIDs), "users exactly")
-	return transaction, nil
+func createExpenseTransaction(paidByUserId, transactionType string, userIDs []string, amount int, splitArgs []string) *expenseTransaction {
+	transaction := &expenseTransaction{splitArgs: splitArgs}
+	transaction.amount = amount
+	transaction.whoPaid = paidByUserId
+	transaction.transactionType = transactionType
+	log.Println("[createExpenseTransaction] splitting", formatAmount(amount), "among", len(userIDs), "users by", transactionType)
+	return transaction
 }
 
 type expenseTracker struct {
 	users        []*user
+	groups       []*group
 	transactions []transaction
+	// balances nets every expense, in a group or not, between each pair of
+	// users in the currency it was spent in; baseBalances nets them all in
+	// the default currency at the rates they were recorded at.
+	balances     currencyBalances
+	baseBalances balanceSheet
+	rates        rateProvider
+	// simplify makes SHOW print the fewest transfers that settle everyone
+	// instead of the balance between every pair.
+	simplify bool
+	// lastId numbers transactions in the order they are recorded.
+	lastId int
+	audit  []auditEntry
+
+	clock     clock
+	recurring []*recurringExpense
+	// owingSince is when each debt in baseBalances last went from nothing to
+	// something, which is how old reminders say it is.
+	owingSince   map[debt]time.Time
+	reminders    *reminderPolicy
+	lastReminded map[debt]time.Time
+	notifier     notifier
+}
+
+func newExpenseTracker() *expenseTracker {
+	return &expenseTracker{
+		balances:     make(currencyBalances),
+		baseBalances: make(balanceSheet),
+		rates:        newStaticRateProvider(),
+		clock:        realClock{},
+		owingSince:   make(map[debt]time.Time),
+		lastReminded: make(map[debt]time.Time),
+		notifier:     stdoutNotifier{},
+	}
+}
+
+// showBalance prints every non-zero balance between any two users.
+func (d *expenseTracker) showBalance(inBase bool) {
+	lines, _ := d.balancesFor("", "", inBase)
+	d.printBalances(lines)
+}
+
+// showUserBalance prints what the user owes others and what others owe the
+// user, whether or not the user paid for anything.
+func (d *expenseTracker) showUserBalance(userId string, inBase bool) error {
+	lines, err := d.balancesFor("", userId, inBase)
+	if err != nil {
+		return err
+	}
+	d.printBalances(lines)
+	return nil
 }
 
-func (d *expenseTracker) showBalance() {
+func (d *expenseTracker) userIds() []string {
+	var userIds []string
+	for _, u := range d.users {
+		userIds = append(userIds, u.userId)
+	}
+	return userIds
+}
 
+func (d *expenseTracker) userName(userId string) string {
+	for _, u := range d.users {
+		if u.userId == userId {
+			return u.name
+		}
+	}
+	return userId
 }
 
 func (d *expenseTracker) getUser(userId string) (*user, error) {
@@ -207,89 +273,381 @@ func (d *expenseTracker) getUser(userId string) (*user, error) {
 		}
 	}
 	log.Println("user with userId:", userId, "not found")
-	return nil, errors.New("user not found")
+	return nil, fmt.Errorf("%w: %s", errUserNotFound, userId)
+}
+
+func (d *expenseTracker) addUser(u *user) error {
+	for _, existing := range d.users {
+		if existing.userId == u.userId {
+			return fmt.Errorf("%w: %s", errUserExists, u.userId)
+		}
+	}
+	d.users = append(d.users, u)
+	return nil
 }
 
+// addTransaction gives the transaction the next id and records it against the
+// balances and the audit trail.
 func (d *expenseTracker) addTransaction(transaction transaction) {
-	log.Println("Added transaction to ledger")
+	d.lastId++
+	prefix, action := "E", actionCreate
+	if transaction.getTransactionType() == SETTLEMENT {
+		prefix, action = "S", actionSettle
+	}
+	transaction.setId(prefix + strconv.Itoa(d.lastId))
+	if transaction.getCreatedAt().IsZero() {
+		transaction.setCreatedAt(d.clock.now())
+	}
 	d.transactions = append(d.transactions, transaction)
+	d.applyShares(transaction, 1)
+	d.record(transaction.getId(), transaction.getWhoPaid(), action, d.describe(transaction))
+	log.Println("Added transaction", transaction.getId(), "to ledger")
+}
+
+// applyShares adds the transaction's shares to the balances, or takes them
+// off again when sign is -1. Each share is converted into the base
+// currencies on its own, at the rate the transaction was recorded at.
+func (d *expenseTracker) applyShares(transaction transaction, sign int) {
+	g, _ := d.getGroup(transaction.getGroupId())
+	currency, payer := transaction.getCurrency(), transaction.getWhoPaid()
+	for userId, share := range transaction.getUserToSplitAmount() {
+		d.balances.sheet(currency).recordOwed(userId, payer, sign*share)
+		d.baseBalances.recordOwed(userId, payer, sign*convert(share, currency, defaultCurrency, transaction.rateTo(defaultCurrency)))
+		if g != nil {
+			g.balances.sheet(currency).recordOwed(userId, payer, sign*share)
+			g.baseBalances.recordOwed(userId, payer, sign*convert(share, currency, g.baseCurrency, transaction.rateTo(g.baseCurrency)))
+		}
+		d.trackOwing(userId, payer, transaction.getCreatedAt())
+	}
+}
+
+// captureRates records today's rates from the transaction's currency into
+// every base currency it counts towards.
+func (d *expenseTracker) captureRates(transaction transaction) error {
+	targets := []string{defaultCurrency}
+	if g, err := d.getGroup(transaction.getGroupId()); err == nil {
+		targets = append(targets, g.baseCurrency)
+	}
+	for _, target := range targets {
+		if target == transaction.getCurrency() {
+			continue
+		}
+		rate, err := d.rates.rate(transaction.getCurrency(), target)
+		if err != nil {
+			return err
+		}
+		transaction.setRate(target, rate)
+	}
+	return nil
 }
 
 func main() {
-	expenseTracker := &expenseTracker{}
-	expenseTracker.users = append(expenseTracker.users, newUser("u1", "shashank", "shashank@gmail.com", "9340212623"))
-	expenseTracker.users = append(expenseTracker.users, newUser("u2", "prakash", "prakash@gmail.com", "8828232123"))
-	expenseTracker.users = append(expenseTracker.users, newUser("u3", "sharma", "sharma@gmail.com", "9340212623"))
-	expenseTracker.users = append(expenseTracker.users, newUser("u4", "golu", "golu@gmail.com", "8240212623"))
-
-	cmds := []string{
-		"EXPENSE u1 1000 4 u1 u2 u3 u4 EQUAL",
-		"EXPENSE u4 1200 4 u1 u2 u3 u4 PERCENT 40 20 20 20",
-		"EXPENSE u1 1250 2 u2 u3 EXACT 370 880",
-		"SHOW u4",
-		"SHOW u1",
-		"SHOW u3",
-	}
-
-	for _, cmd := range cmds {
-		log.Println("executing:", cmd)
-		cmdSplit := strings.Fields(cmd)
-		// cmd := "SHOW"
-		switch cmdSplit[0] {
-		case "SHOW":
-			if len(cmdSplit) == 1 {
-				expenseTracker.showBalance()
-				continue
-			}
-			if len(cmdSplit) > 1 {
-				user, err := expenseTracker.getUser(cmdSplit[1])
-				if err == nil {
-					user.showBalance()
-				}
-				expenseTracker.showBalance()
-				continue
+	serve := flag.String("serve", "", "serve the REST API on this address, such as localhost:8080, instead of running the demo")
+	data := flag.String("data", "splitwise.json", "file the REST API keeps its state in")
+	schedule := flag.Duration("schedule", time.Minute, "how often the REST API adds due recurring expenses and sends reminders")
+	flag.Parse()
+	if *serve != "" {
+		s, err := newServer(newFileStorage(*data))
+		if err != nil {
+			log.Fatalln("loading", *data+":", err)
+		}
+		go s.runSchedule(*schedule)
+		log.Println("serving the API on", *serve, "with state in", *data)
+		log.Fatal(http.ListenAndServe(*serve, s.handler()))
+	}
+
+	expenseTracker := newDemoTracker()
+	for _, cmd := range demoCommands {
+		expenseTracker.runCommand(cmd)
+	}
+}
+
+// newDemoTracker runs on a virtual clock so ADVANCE can move the schedule on.
+func newDemoTracker() *expenseTracker {
+	expenseTracker := newExpenseTracker()
+	expenseTracker.clock = &virtualClock{at: time.Date(2024, time.January, 31, 9, 0, 0, 0, time.UTC)}
+	expenseTracker.addUser(newUser("u1", "shashank", "shashank@gmail.com", "9340212623"))
+	expenseTracker.addUser(newUser("u2", "prakash", "prakash@gmail.com", "8828232123"))
+	expenseTracker.addUser(newUser("u3", "sharma", "sharma@gmail.com", "9340212623"))
+	expenseTracker.addUser(newUser("u4", "golu", "golu@gmail.com", "8240212623"))
+	return expenseTracker
+}
+
+var demoCommands = []string{
+	"EXPENSE u1 1000 4 u1 u2 u3 u4 EQUAL",
+	"EXPENSE u4 1200 4 u1 u2 u3 u4 PERCENT 40 20 20 20",
+	"EXPENSE u1 1250 2 u2 u3 EXACT 370 880",
+	"SHOW u4",
+	"SHOW u1",
+	"SHOW u3",
+	"SHOW",
+	"SIMPLIFY ON",
+	"SHOW",
+	"SHOW u3",
+	"SIMPLIFY OFF",
+	"EXPENSE u2 100 3 u1 u2 u3 EQUAL",
+	"EXPENSE u3 10.01 3 u1 u2 u4 PERCENT 50 25 25",
+	"EXPENSE u1 500 2 u2 u3 EXACT 200 200",
+	"EXPENSE u1 500 2 u2 u3 PERCENT 60 30",
+	"SHOW u2",
+	"GROUP create goa goa-trip u1 u2",
+	"GROUP add goa u3",
+	"EXPENSE u3 900 3 u1 u2 u3 EQUAL GROUP goa",
+	"EXPENSE u1 300 2 u2 u3 EXACT 100 200 GROUP goa",
+	"EXPENSE u4 100 2 u1 u4 EQUAL GROUP goa",
+	"SHOW GROUP goa",
+	"SHOW GROUP goa u2",
+	"SIMPLIFY ON goa",
+	"SHOW GROUP goa",
+	"SHOW u3",
+	"SIMPLIFY OFF goa",
+	"SETTLE u2 u3 250 GROUP goa",
+	"SETTLE u2 u3 500 GROUP goa",
+	"SHOW GROUP goa",
+	"EDIT E7 u2 u1 300 2 u2 u3 EXACT 150 150",
+	"EDIT E7 u4 u1 300 2 u2 u3 EQUAL",
+	"SHOW GROUP goa",
+	"DELETE E4 u2",
+	"DELETE E4 u2",
+	"SHOW u2",
+	"HISTORY E7",
+	"HISTORY",
+	"EXPENSE u1 1000 3 u1 u2 u3 SHARE 2 1 1",
+	"EXPENSE u2 950 3 u1 u2 u3 ADJUSTMENT 0 0 350",
+	"EXPENSE u3 1180 3 u1 u2 u3 ITEMISED pizza=600:u1,u2 beer=400:u2,u3 tax=80 tip=100",
+	"EXPENSE u3 1180 3 u1 u2 u3 ITEMISED pizza=600:u1,u2 beer=400:u4 tax=180",
+	"EXPENSE u1 100 2 u2 u3 SHARE 1",
+	"HISTORY E9",
+	"HISTORY E10",
+	"HISTORY E11",
+	"GROUP create flat flat-42 u1 u2 u3",
+	"REMIND 5000 45 30",
+	"RECURRING monthly EXPENSE u1 24000 3 u1 u2 u3 EQUAL GROUP flat",
+	"RECURRING weekly EXPENSE u4 199 2 u3 u4 EQUAL",
+	"RECURRING fortnightly EXPENSE u4 199 2 u3 u4 EQUAL",
+	"ADVANCE 31",
+	"RECURRING stop R2",
+	"ADVANCE 40",
+	"SHOW GROUP flat",
+	"SHOW u4",
+	"GROUP create bkk bangkok u1 u2 u3",
+	"GROUP currency bkk USD",
+	"EXPENSE u2 60 3 u1 u2 u3 EQUAL GROUP bkk",
+	"EXPENSE u3 1500 3 u1 u2 u3 EQUAL CURRENCY THB GROUP bkk",
+	"EXPENSE u1 4150 2 u1 u3 EQUAL CURRENCY INR GROUP bkk",
+	"SHOW GROUP bkk",
+	"SHOW GROUP bkk BASE",
+	"SETTLE u1 u2 20 GROUP bkk",
+	"SETTLE u2 u3 500 CURRENCY THB GROUP bkk",
+	"SHOW GROUP bkk u2 BASE",
+	"HISTORY E21",
+	"GROUP currency bkk EUR",
+}
+
+// runCommand runs one line of the problem's command language and logs
+// anything that fails.
+func (d *expenseTracker) runCommand(cmd string) {
+	log.Println("executing:", cmd)
+	cmdSplit := strings.Fields(cmd)
+	if len(cmdSplit) == 0 {
+		return
+	}
+	switch cmdSplit[0] {
+	case "SHOW":
+		// a trailing BASE shows everything converted into the base currency
+		inBase := cmdSplit[len(cmdSplit)-1] == "BASE"
+		if inBase {
+			cmdSplit = cmdSplit[:len(cmdSplit)-1]
+		}
+		if len(cmdSplit) == 1 {
+			d.showBalance(inBase)
+			return
+		}
+		if cmdSplit[1] == "GROUP" && len(cmdSplit) > 2 {
+			userId := ""
+			if len(cmdSplit) > 3 {
+				userId = cmdSplit[3]
 			}
-		case "EXPENSE":
-			amountStr := cmdSplit[2]
-			amount, _ := strconv.ParseFloat(amountStr, 64)
-			totalUsersStr := cmdSplit[3]
-			totalUsers, _ := strconv.Atoi(totalUsersStr)
-			var users []string
-			for i := 0; i < totalUsers; i++ {
-				users = append(users, cmdSplit[4+i])
+			if err := d.showGroupBalance(cmdSplit[2], userId, inBase); err != nil {
+				log.Println("failed showing group:", err)
 			}
-			user, err := expenseTracker.getUser(cmdSplit[1])
-			if err == nil {
-				transactionType := cmdSplit[totalUsers+4]
-				var transaction transaction
-				var err error
-				switch transactionType {
-				case EQUAL:
-					transaction, err = user.addTransaction(transactionType, users, amount, []float64{}, []int{})
-					break
-				case PERCENT:
-					var percentageShare []int
-					for i := 0; i < totalUsers; i++ {
-						s, _ := strconv.Atoi(cmdSplit[totalUsers+5+i])
-						percentageShare = append(percentageShare, s)
-					}
-					transaction, err = user.addTransaction(transactionType, users, amount, []float64{}, percentageShare)
-					break
-				case EXACT:
-					var exactShare []float64
-					for i := 0; i < totalUsers; i++ {
-						s, _ := strconv.ParseFloat(cmdSplit[totalUsers+5+i], 64)
-						exactShare = append(exactShare, s)
-					}
-					transaction, err = user.addTransaction(transactionType, users, amount, exactShare, []int{})
-					break
-				}
-				if err == nil {
-					expenseTracker.addTransaction(transaction)
-				}
+			return
+		}
+		if err := d.showUserBalance(cmdSplit[1], inBase); err != nil {
+			log.Println("failed showing user:", err)
+		}
+	case "SIMPLIFY":
+		on := len(cmdSplit) > 1 && cmdSplit[1] == "ON"
+		if len(cmdSplit) < 3 {
+			d.simplify = on
+			return
+		}
+		g, err := d.getGroup(cmdSplit[2])
+		if err != nil {
+			log.Println("failed simplifying:", err)
+			return
+		}
+		g.simplify = on
+	case "GROUP":
+		if err := d.runGroup(cmdSplit); err != nil {
+			log.Println("failed group command:", err)
+		}
+	case "EXPENSE":
+		if err := d.runExpense(cmdSplit); err != nil {
+			log.Println("failed adding expense:", err)
+		}
+	case "SETTLE":
+		if err := d.runSettle(cmdSplit); err != nil {
+			log.Println("failed settling:", err)
+		}
+	case "EDIT":
+		if len(cmdSplit) < 3 {
+			log.Println("failed editing:", errBadCommand)
+			return
+		}
+		if err := d.editExpense(cmdSplit[1], cmdSplit[2], append([]string{"EXPENSE"}, cmdSplit[3:]...)); err != nil {
+			log.Println("failed editing:", err)
+		}
+	case "DELETE":
+		if len(cmdSplit) < 3 {
+			log.Println("failed deleting:", errBadCommand)
+			return
+		}
+		if err := d.deleteExpense(cmdSplit[1], cmdSplit[2]); err != nil {
+			log.Println("failed deleting:", err)
+		}
+	case "RECURRING":
+		if err := d.runRecurring(cmdSplit); err != nil {
+			log.Println("failed scheduling:", err)
+		}
+	case "REMIND":
+		if err := d.runRemind(cmdSplit); err != nil {
+			log.Println("failed setting reminders:", err)
+		}
+	case "ADVANCE":
+		if err := d.runAdvance(cmdSplit); err != nil {
+			log.Println("failed advancing:", err)
+		}
+	case "HISTORY":
+		d.showHistory(strings.Join(cmdSplit[1:], ""))
+	}
+}
 
-			}
-			log.Println("failed adding expense")
+var (
+	errBadCommand   = errors.New("malformed command")
+	errUserNotFound = errors.New("user not found")
+	errUserExists   = errors.New("user already exists")
+)
+
+// runExpense parses "EXPENSE <paidBy> <amount> <n> <user>... <type> [<share>...]
+// [CURRENCY <code>] [GROUP <groupId>]" and records it. An expense without a
+// currency is in its group's base currency, or the default one.
+func (d *expenseTracker) runExpense(cmdSplit []string) error {
+	transaction, err := d.parseExpense(cmdSplit)
+	if err != nil {
+		return err
+	}
+	d.addTransaction(transaction)
+	return nil
+}
+
+// parseExpense builds the transaction an EXPENSE command describes, with
+// today's rates, without recording it.
+func (d *expenseTracker) parseExpense(cmdSplit []string) (transaction, error) {
+	cmdSplit, options := splitOptions(cmdSplit)
+	var g *group
+	currency := defaultCurrency
+	if groupId, ok := options["GROUP"]; ok {
+		var err error
+		if g, err = d.getGroup(groupId); err != nil {
+			return nil, err
+		}
+		currency = g.baseCurrency
+	}
+	if code, ok := options["CURRENCY"]; ok {
+		if err := validCurrency(code); err != nil {
+			return nil, err
+		}
+		currency = code
+	}
+	if len(cmdSplit) < 5 {
+		return nil, fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
+	}
+	user, err := d.getUser(cmdSplit[1])
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAmountIn(cmdSplit[2], currency)
+	if err != nil {
+		return nil, err
+	}
+	totalUsers, err := strconv.Atoi(cmdSplit[3])
+	if err != nil || totalUsers < 0 || len(cmdSplit) < totalUsers+5 {
+		return nil, fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
+	}
+	users := cmdSplit[4 : 4+totalUsers]
+	for _, userId := range users {
+		if _, err := d.getUser(userId); err != nil {
+			return nil, err
+		}
+	}
+	if g != nil {
+		if err := g.checkMembers(append([]string{user.userId}, users...)...); err != nil {
+			return nil, err
+		}
+	}
+	transactionType := cmdSplit[totalUsers+4]
+	transaction, err := user.addTransaction(transactionType, users, amount, currency, cmdSplit[totalUsers+5:])
+	if err != nil {
+		return nil, err
+	}
+	if g != nil {
+		transaction.setGroupId(g.groupId)
+	}
+	if err := d.captureRates(transaction); err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// splitOptions takes the trailing "GROUP <groupId>" and "CURRENCY <code>"
+// pairs, in either order, off the end of a command.
+func splitOptions(cmdSplit []string) ([]string, map[string]string) {
+	options := make(map[string]string)
+	for n := len(cmdSplit); n > 2; n = len(cmdSplit) {
+		keyword := cmdSplit[n-2]
+		if keyword != "GROUP" && keyword != "CURRENCY" {
+			break
+		}
+		if _, seen := options[keyword]; seen {
+			break
+		}
+		options[keyword] = cmdSplit[n-1]
+		cmdSplit = cmdSplit[:n-2]
+	}
+	return cmdSplit, options
+}
+
+// runGroup handles "GROUP create <groupId> <name> [<userId>...]",
+// "GROUP add <groupId> <userId>..." and "GROUP currency <groupId> <code>".
+func (d *expenseTracker) runGroup(cmdSplit []string) error {
+	if len(cmdSplit) < 3 {
+		return fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
+	}
+	switch cmdSplit[1] {
+	case "create":
+		if len(cmdSplit) < 4 {
+			return fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
+		}
+		_, err := d.createGroup(cmdSplit[2], cmdSplit[3], cmdSplit[4:])
+		return err
+	case "add":
+		return d.addMembers(cmdSplit[2], cmdSplit[3:])
+	case "currency":
+		if len(cmdSplit) != 4 {
+			return fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
 		}
+		return d.setBaseCurrency(cmdSplit[2], cmdSplit[3])
 	}
+	return fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
 }
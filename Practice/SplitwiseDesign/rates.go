@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+var errNoRate = errors.New("no exchange rate")
+
+// rateScale is the fixed-point scale rates are held at: a rate of 83120000
+// means one unit of the source currency buys 83.12 of the target.
+const rateScale = 1000000
+
+// rateProvider gives the rate from one currency to another. An expense keeps
+// the rates it was recorded at, so later changes to the table never move old
+// balances.
+type rateProvider interface {
+	rate(from, to string) (int64, error)
+}
+
+// staticRateProvider is a fixed table standing in for a live rates feed.
+// inrPerUnit is what one unit of each currency is worth in rupees, scaled by
+// rateScale.
+type staticRateProvider struct {
+	inrPerUnit map[string]int64
+}
+
+func newStaticRateProvider() *staticRateProvider {
+	return &staticRateProvider{inrPerUnit: map[string]int64{
+		"INR": 1000000,
+		"USD": 83120000,
+		"EUR": 90450000,
+		"GBP": 105300000,
+		"THB": 2310000,
+		"JPY": 556000,
+	}}
+}
+
+func (d *staticRateProvider) rate(from, to string) (int64, error) {
+	fromInr, ok := d.inrPerUnit[from]
+	toInr, ok2 := d.inrPerUnit[to]
+	if !ok || !ok2 {
+		return 0, fmt.Errorf("%w: %s to %s", errNoRate, from, to)
+	}
+	return fromInr * rateScale / toInr, nil
+}
+
+// convert changes minor units of from into minor units of to at rate,
+// rounding half up.
+func convert(minor int, from, to string, rate int64) int {
+	if from == to {
+		return minor
+	}
+	numerator := new(big.Int).Mul(big.NewInt(int64(minor)), big.NewInt(rate))
+	numerator.Mul(numerator, big.NewInt(int64(pow10(currencyExponents[to]))))
+	denominator := new(big.Int).Mul(big.NewInt(rateScale), big.NewInt(int64(pow10(currencyExponents[from]))))
+	negative := numerator.Sign() < 0
+	numerator.Abs(numerator)
+	numerator.Mul(numerator, big.NewInt(2))
+	numerator.Add(numerator, denominator)
+	denominator.Mul(denominator, big.NewInt(2))
+	result := int(numerator.Quo(numerator, denominator).Int64())
+	if negative {
+		return -result
+	}
+	return result
+}
+
+// formatRate prints a scaled rate as a decimal, as in "83.12".
+func formatRate(rate int64) string {
+	return strconv.FormatFloat(float64(rate)/rateScale, 'f', -1, 64)
+}
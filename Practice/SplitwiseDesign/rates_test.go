@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConvertRoundsHalfUp(t *testing.T) {
+	rates := newStaticRateProvider()
+	tests := []struct {
+		minor    int
+		from, to string
+		want     int
+	}{
+		{100, "USD", "INR", 8312},
+		{1000, "JPY", "INR", 55600},
+		{10000, "INR", "JPY", 180},
+		{-10000, "INR", "JPY", -180},
+		{1, "INR", "USD", 0},
+		{50000, "THB", "USD", 1390},
+		{12345, "INR", "INR", 12345},
+	}
+	for _, tt := range tests {
+		rate, err := rates.rate(tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := convert(tt.minor, tt.from, tt.to, rate); got != tt.want {
+			t.Errorf("%s in %s is %s, want %s", formatMoney(tt.minor, tt.from), tt.to, formatMoney(got, tt.to), formatMoney(tt.want, tt.to))
+		}
+	}
+}
+
+// newTripTracker has u1, u2 and u3 on a trip settled in USD, with expenses
+// in USD and THB and one outside the trip in JPY.
+func newTripTracker(t *testing.T) (*expenseTracker, *staticRateProvider) {
+	t.Helper()
+	rates := newStaticRateProvider()
+	tracker := newExpenseTracker()
+	tracker.rates = rates
+	for _, u := range []string{"u1", "u2", "u3"} {
+		tracker.addUser(newUser(u, u, "", ""))
+	}
+	for _, cmd := range []string{
+		"GROUP create trip trip u1 u2 u3",
+		"GROUP currency trip USD",
+		"EXPENSE u1 90 3 u1 u2 u3 EQUAL GROUP trip",
+		"EXPENSE u2 3000 3 u1 u2 u3 EQUAL CURRENCY THB GROUP trip",
+		"EXPENSE u3 1000 2 u1 u3 EQUAL CURRENCY JPY",
+	} {
+		if err := runCurrencyCommand(tracker, cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	return tracker, rates
+}
+
+func runCurrencyCommand(tracker *expenseTracker, cmd string) error {
+	cmdSplit := strings.Fields(cmd)
+	switch cmdSplit[0] {
+	case "GROUP":
+		return tracker.runGroup(cmdSplit)
+	case "SETTLE":
+		return tracker.runSettle(cmdSplit)
+	}
+	return tracker.runExpense(cmdSplit)
+}
+
+func TestCurrencyCommandsAreChecked(t *testing.T) {
+	tracker, _ := newTripTracker(t)
+	for _, bad := range []string{
+		"EXPENSE u1 10 2 u1 u2 EQUAL CURRENCY XYZ",
+		"EXPENSE u1 10.5 2 u1 u2 EQUAL CURRENCY JPY",
+		"SETTLE u2 u1 1 CURRENCY EUR GROUP trip",
+		"GROUP currency trip EUR",
+	} {
+		if err := runCurrencyCommand(tracker, bad); err == nil {
+			t.Errorf("%s was accepted", bad)
+		}
+	}
+}
+
+func TestExpensesKeepTheirRates(t *testing.T) {
+	tracker, rates := newTripTracker(t)
+	before, _ := tracker.balancesFor("trip", "", true)
+	rates.inrPerUnit["THB"] *= 2
+	if after, _ := tracker.balancesFor("trip", "", true); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Fatalf("changing the THB rate moved trip balances from %v to %v", before, after)
+	}
+	reloaded, err := restoreTracker(mustSnapshot(t, tracker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameTracker(t, tracker, reloaded)
+}
+
+// u2 owes u1 USD 30 less the THB 1000 u1 owes back, and is owed THB 1000 by
+// u3; settling what the base view shows clears u2 in dollars.
+func TestSettlingInTheBaseCurrency(t *testing.T) {
+	tracker, _ := newTripTracker(t)
+	owed, _ := tracker.balancesFor("trip", "u2", true)
+	if len(owed) == 0 {
+		t.Fatal("u2 has no balances in trip")
+	}
+	for _, tr := range owed {
+		if err := tracker.settle(tr.from, tr.to, tr.amount, "", "trip"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if left, _ := tracker.balancesFor("trip", "u2", true); len(left) != 0 {
+		t.Fatalf("u2 still has %v in trip after settling %v", left, owed)
+	}
+	if left, _ := tracker.balancesFor("trip", "u2", false); len(left) == 0 {
+		t.Fatal("settling in USD cleared the THB balances too")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errBadFrequency      = errors.New("frequency must be daily, weekly or monthly")
+	errRecurringNotFound = errors.New("recurring expense not found")
+)
+
+// clock lets the schedule run on real time when serving and on a virtual
+// clock the demo and tests move forward by hand.
+type clock interface {
+	now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) now() time.Time {
+	return time.Now()
+}
+
+type virtualClock struct {
+	at time.Time
+}
+
+func (d *virtualClock) now() time.Time {
+	return d.at
+}
+
+func (d *virtualClock) advance(by time.Duration) {
+	d.at = d.at.Add(by)
+}
+
+// recurringExpense adds the same expense on a schedule, such as rent monthly
+// or a subscription weekly. cmd holds the words of its EXPENSE command.
+type recurringExpense struct {
+	id        string
+	cmd       []string
+	frequency string
+	start     time.Time
+	// occurrences is how many expenses have been added so far, and the next
+	// is due at occurrence(occurrences).
+	occurrences int
+	stopped     bool
+}
+
+// occurrence is when the nth expense is due. Monthly expenses keep the start
+// day, or the month's last day when the month is shorter, so rent on the 31st
+// is due on the 28th in February and back on the 31st in March.
+func (d *recurringExpense) occurrence(n int) time.Time {
+	switch d.frequency {
+	case "daily":
+		return d.start.AddDate(0, 0, n)
+	case "weekly":
+		return d.start.AddDate(0, 0, 7*n)
+	}
+	year, month, day := d.start.Date()
+	firstOfMonth := time.Date(year, month+time.Month(n), 1, d.start.Hour(), d.start.Minute(), d.start.Second(), d.start.Nanosecond(), d.start.Location())
+	if last := firstOfMonth.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return firstOfMonth.AddDate(0, 0, day-1)
+}
+
+// addRecurring schedules the expense cmd describes from start. The expense
+// is checked now so a mistake is reported when it is set up rather than at
+// the first run.
+func (d *expenseTracker) addRecurring(frequency string, start time.Time, cmd []string) (*recurringExpense, error) {
+	if frequency != "daily" && frequency != "weekly" && frequency != "monthly" {
+		return nil, fmt.Errorf("%w: %q", errBadFrequency, frequency)
+	}
+	if _, err := d.parseExpense(cmd); err != nil {
+		return nil, err
+	}
+	r := &recurringExpense{id: "R" + strconv.Itoa(len(d.recurring)+1), cmd: cmd, frequency: frequency, start: start}
+	d.recurring = append(d.recurring, r)
+	log.Println("[addRecurring]", r.id, frequency, "from", start.Format("2006-01-02"), strings.Join(cmd, " "))
+	return r, nil
+}
+
+func (d *expenseTracker) stopRecurring(id string) error {
+	for _, r := range d.recurring {
+		if r.id == id {
+			r.stopped = true
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errRecurringNotFound, id)
+}
+
+// runDue adds every recurring expense that has fallen due, in the order
+// they fell due and each dated when it was due, so a server that was down
+// catches up on what it missed exactly as if it had run throughout. An
+// occurrence that no longer makes sense, say because the payer left the
+// group, is skipped and logged rather than retried for ever.
+func (d *expenseTracker) runDue() {
+	now := d.clock.now()
+	for {
+		var next *recurringExpense
+		for _, r := range d.recurring {
+			if !r.stopped && (next == nil || r.occurrence(r.occurrences).Before(next.occurrence(next.occurrences))) {
+				next = r
+			}
+		}
+		if next == nil || next.occurrence(next.occurrences).After(now) {
+			return
+		}
+		due := next.occurrence(next.occurrences)
+		next.occurrences++
+		t, err := d.parseExpense(next.cmd)
+		if err != nil {
+			log.Println("[runDue] skipped", next.id, "due", due.Format("2006-01-02")+":", err)
+			continue
+		}
+		t.setCreatedAt(due)
+		d.addTransaction(t)
+		d.record(t.getId(), t.getWhoPaid(), actionRecurring, next.id+" due "+due.Format("2006-01-02"))
+	}
+}
+
+// debt is one direction between two users on the overall balance sheet.
+type debt struct {
+	debtor   string
+	creditor string
+}
+
+// trackOwing keeps owingSince up to date after the balance between a and b
+// changed at at. A debt that grows keeps its original date.
+func (d *expenseTracker) trackOwing(a, b string, at time.Time) {
+	if a == b {
+		return
+	}
+	for _, pair := range []debt{{a, b}, {b, a}} {
+		if d.baseBalances.owes(pair.debtor, pair.creditor) == 0 {
+			delete(d.owingSince, pair)
+			delete(d.lastReminded, pair)
+		} else if _, ok := d.owingSince[pair]; !ok {
+			d.owingSince[pair] = at
+		}
+	}
+}
+
+// reminderPolicy says who is reminded: anyone who owes at least threshold,
+// or has owed anything for maxAge, no more than once every interval. A zero
+// threshold or maxAge turns that rule off.
+type reminderPolicy struct {
+	threshold int
+	maxAge    time.Duration
+	every     time.Duration
+}
+
+type notifier interface {
+	notify(userId, message string) error
+}
+
+type stdoutNotifier struct{}
+
+func (stdoutNotifier) notify(userId, message string) error {
+	fmt.Println("[REMINDER] to", userId+":", message)
+	return nil
+}
+
+// sendReminders reminds the users the policy picks out, one message per
+// debt, and returns how many went out.
+func (d *expenseTracker) sendReminders() int {
+	if d.reminders == nil {
+		return 0
+	}
+	now := d.clock.now()
+	sent := 0
+	for _, debtor := range d.users {
+		for _, creditor := range d.users {
+			pair := debt{debtor.userId, creditor.userId}
+			amount := d.baseBalances.owes(pair.debtor, pair.creditor)
+			if amount == 0 {
+				continue
+			}
+			since := d.owingSince[pair]
+			large := d.reminders.threshold > 0 && amount >= d.reminders.threshold
+			old := d.reminders.maxAge > 0 && now.Sub(since) >= d.reminders.maxAge
+			if !large && !old {
+				continue
+			}
+			if last, ok := d.lastReminded[pair]; ok && now.Sub(last) < d.reminders.every {
+				continue
+			}
+			message := fmt.Sprintf("%s, you owe %s %s since %s", debtor.name, creditor.name, formatAmount(amount), since.Format("2006-01-02"))
+			if err := d.notifier.notify(debtor.userId, message); err != nil {
+				log.Println("[sendReminders] could not remind", debtor.userId+":", err)
+				continue
+			}
+			d.lastReminded[pair] = now
+			sent++
+		}
+	}
+	return sent
+}
+
+// runScheduled is the periodic job: it adds the recurring expenses that are
+// due and then sends reminders.
+func (d *expenseTracker) runScheduled() {
+	d.runDue()
+	d.sendReminders()
+}
+
+const day = 24 * time.Hour
+
+// runRecurring handles "RECURRING <daily|weekly|monthly> EXPENSE ..." and
+// "RECURRING stop <id>". The schedule starts now.
+func (d *expenseTracker) runRecurring(cmdSplit []string) error {
+	if len(cmdSplit) == 3 && cmdSplit[1] == "stop" {
+		return d.stopRecurring(cmdSplit[2])
+	}
+	if len(cmdSplit) < 3 || cmdSplit[2] != "EXPENSE" {
+		return fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
+	}
+	_, err := d.addRecurring(cmdSplit[1], d.clock.now(), cmdSplit[2:])
+	return err
+}
+
+// runRemind handles "REMIND <threshold> <maxAgeDays> <everyDays>" and
+// "REMIND off".
+func (d *expenseTracker) runRemind(cmdSplit []string) error {
+	if len(cmdSplit) == 2 && cmdSplit[1] == "off" {
+		d.reminders = nil
+		return nil
+	}
+	if len(cmdSplit) != 4 {
+		return fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
+	}
+	threshold, err := parseAmount(cmdSplit[1])
+	if err != nil {
+		return err
+	}
+	maxAge, err1 := strconv.Atoi(cmdSplit[2])
+	every, err2 := strconv.Atoi(cmdSplit[3])
+	if err1 != nil || err2 != nil || maxAge < 0 || every < 1 {
+		return fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
+	}
+	d.reminders = &reminderPolicy{threshold: threshold, maxAge: time.Duration(maxAge) * day, every: time.Duration(every) * day}
+	return nil
+}
+
+// runAdvance handles "ADVANCE <days>", which moves a virtual clock on a day
+// at a time and runs the schedule after each day.
+func (d *expenseTracker) runAdvance(cmdSplit []string) error {
+	c, ok := d.clock.(*virtualClock)
+	if !ok {
+		return fmt.Errorf("%w: ADVANCE needs a virtual clock", errBadCommand)
+	}
+	days, err := strconv.Atoi(strings.Join(cmdSplit[1:], ""))
+	if err != nil || days < 0 {
+		return fmt.Errorf("%w: %s", errBadCommand, strings.Join(cmdSplit, " "))
+	}
+	for i := 0; i < days; i++ {
+		c.advance(day)
+		d.runScheduled()
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingNotifier struct {
+	clock    clock
+	messages []reminderSent
+}
+
+type reminderSent struct {
+	at      time.Time
+	userId  string
+	message string
+}
+
+func (d *recordingNotifier) notify(userId, message string) error {
+	d.messages = append(d.messages, reminderSent{d.clock.now(), userId, message})
+	return nil
+}
+
+var scheduleStart = time.Date(2024, time.January, 31, 9, 0, 0, 0, time.UTC)
+
+// scheduleDays is long enough to cover a 29-day February and a 30-day April.
+const scheduleDays = 95
+
+// newScheduledTracker has u1 paying rent monthly from the 31st and u3 a
+// subscription weekly, on a virtual clock at scheduleStart.
+func newScheduledTracker(t *testing.T) (*expenseTracker, *virtualClock, *recordingNotifier) {
+	t.Helper()
+	c := &virtualClock{at: scheduleStart}
+	tracker := newExpenseTracker()
+	tracker.clock = c
+	n := &recordingNotifier{clock: c}
+	tracker.notifier = n
+	for _, u := range []string{"u1", "u2", "u3"} {
+		tracker.addUser(newUser(u, u, "", ""))
+	}
+	tracker.reminders = &reminderPolicy{threshold: 1000000, maxAge: 20 * day, every: 14 * day}
+	if _, err := tracker.addRecurring("monthly", scheduleStart, strings.Fields("EXPENSE u1 24000 3 u1 u2 u3 EQUAL")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.addRecurring("weekly", scheduleStart, strings.Fields("EXPENSE u3 30 2 u2 u3 EQUAL")); err != nil {
+		t.Fatal(err)
+	}
+	return tracker, c, n
+}
+
+// runDays moves the clock on a day at a time, running the schedule after
+// each day.
+func runDays(tracker *expenseTracker, c *virtualClock, days int) {
+	for i := 0; i < days; i++ {
+		c.advance(day)
+		tracker.runScheduled()
+	}
+}
+
+// sameExpenses compares the expenses two trackers hold and what they add up
+// to, ignoring when the audit trail was written.
+func sameExpenses(t *testing.T, want, got *expenseTracker) {
+	t.Helper()
+	wantSnapshot, gotSnapshot := mustSnapshot(t, want), mustSnapshot(t, got)
+	wantJSON, _ := json.Marshal(wantSnapshot.Transactions)
+	gotJSON, _ := json.Marshal(gotSnapshot.Transactions)
+	if string(wantJSON) != string(gotJSON) {
+		t.Fatalf("%d expenses against %d, or they differ", len(gotSnapshot.Transactions), len(wantSnapshot.Transactions))
+	}
+	for _, inBase := range []bool{false, true} {
+		wantLines, _ := want.balancesFor("", "", inBase)
+		gotLines, _ := got.balancesFor("", "", inBase)
+		if fmt.Sprint(wantLines) != fmt.Sprint(gotLines) {
+			t.Fatalf("balances %v, want %v", gotLines, wantLines)
+		}
+	}
+}
+
+func TestMonthlyScheduleClampsToShortMonths(t *testing.T) {
+	tracker, c, _ := newScheduledTracker(t)
+	runDays(tracker, c, scheduleDays)
+	var rentDates []string
+	for _, tr := range tracker.transactions {
+		if tr.getWhoPaid() == "u1" {
+			rentDates = append(rentDates, tr.getCreatedAt().Format("2006-01-02"))
+		}
+	}
+	if want := "[2024-01-31 2024-02-29 2024-03-31 2024-04-30]"; fmt.Sprint(rentDates) != want {
+		t.Fatalf("rent was added on %v, want %s", rentDates, want)
+	}
+}
+
+func TestScheduleCatchesUpInOneJump(t *testing.T) {
+	daily, dailyClock, _ := newScheduledTracker(t)
+	runDays(daily, dailyClock, scheduleDays)
+
+	jumped, jumpedClock, _ := newScheduledTracker(t)
+	jumpedClock.advance(scheduleDays * day)
+	jumped.runScheduled()
+	sameExpenses(t, daily, jumped)
+}
+
+func TestScheduleSurvivesARestart(t *testing.T) {
+	daily, dailyClock, _ := newScheduledTracker(t)
+	runDays(daily, dailyClock, scheduleDays)
+
+	restarted, c, _ := newScheduledTracker(t)
+	runDays(restarted, c, scheduleDays/2)
+	restarted, err := restoreTracker(mustSnapshot(t, restarted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.clock = c
+	restarted.notifier = &recordingNotifier{clock: c}
+	runDays(restarted, c, scheduleDays-scheduleDays/2)
+	sameExpenses(t, daily, restarted)
+}
+
+// u2 owes u1 8000 a month and never reaches the threshold, so is only
+// reminded once the debt is 20 days old, then every 14 days.
+func TestRemindersFollowThePolicy(t *testing.T) {
+	tracker, c, notified := newScheduledTracker(t)
+	runDays(tracker, c, scheduleDays)
+	if len(notified.messages) == 0 {
+		t.Fatal("nobody was reminded")
+	}
+	last := make(map[string]time.Time)
+	for _, m := range notified.messages {
+		if m.userId == "u1" {
+			t.Errorf("u1 owes nobody but was reminded: %s", m.message)
+		}
+		if m.at.Sub(scheduleStart) < 20*day {
+			t.Errorf("%s was reminded on %s before any debt was 20 days old", m.userId, m.at.Format("2006-01-02"))
+		}
+		creditor := strings.Fields(m.message)[3]
+		if previous, ok := last[m.userId+" "+creditor]; ok && m.at.Sub(previous) < 14*day {
+			t.Errorf("%s was reminded about %s again after %v", m.userId, creditor, m.at.Sub(previous))
+		}
+		last[m.userId+" "+creditor] = m.at
+	}
+}
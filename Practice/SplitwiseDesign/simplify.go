@@ -0,0 +1,55 @@
+package main
+
+import "sort"
+
+// transfer is one payment that settles part of the simplified debts.
+type transfer struct {
+	from     string
+	to       string
+	amount   int // minor units of currency
+	currency string
+}
+
+func simplifyNet(net map[string]int) []transfer {
+	type position struct {
+		userId string
+		amount int
+	}
+	var debtors, creditors []*position
+	for userId, amount := range net {
+		if amount < 0 {
+			debtors = append(debtors, &position{userId, -amount})
+		} else if amount > 0 {
+			creditors = append(creditors, &position{userId, amount})
+		}
+	}
+	largestFirst := func(p []*position) {
+		sort.Slice(p, func(i, j int) bool {
+			if p[i].amount != p[j].amount {
+				return p[i].amount > p[j].amount
+			}
+			return p[i].userId < p[j].userId
+		})
+	}
+
+	var transfers []transfer
+	for len(debtors) > 0 && len(creditors) > 0 {
+		largestFirst(debtors)
+		largestFirst(creditors)
+		debtor, creditor := debtors[0], creditors[0]
+		amount := debtor.amount
+		if creditor.amount < amount {
+			amount = creditor.amount
+		}
+		transfers = append(transfers, transfer{from: debtor.userId, to: creditor.userId, amount: amount})
+		debtor.amount -= amount
+		creditor.amount -= amount
+		if debtor.amount == 0 {
+			debtors = debtors[1:]
+		}
+		if creditor.amount == 0 {
+			creditors = creditors[1:]
+		}
+	}
+	return transfers
+}
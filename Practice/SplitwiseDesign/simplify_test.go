@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// checkSimplified checks the transfers only have debtors paying creditors,
+// need no more than one fewer than there are users, and leave every user's
+// net position where it was.
+func checkSimplified(t *testing.T, userIds []string, net map[string]int, transfers []transfer) {
+	t.Helper()
+	if len(transfers) > len(userIds)-1 {
+		t.Errorf("%d transfers for %d users", len(transfers), len(userIds))
+	}
+	after := make(map[string]int)
+	for _, tr := range transfers {
+		if tr.amount <= 0 || net[tr.from] >= 0 || net[tr.to] <= 0 {
+			t.Errorf("%s pays %s %d", tr.from, tr.to, tr.amount)
+		}
+		after[tr.from] -= tr.amount
+		after[tr.to] += tr.amount
+	}
+	for _, userId := range userIds {
+		if after[userId] != net[userId] {
+			t.Errorf("%s nets %d after simplifying, %d before", userId, after[userId], net[userId])
+		}
+	}
+}
+
+func TestSimplifyDebtsKeepsNetPositions(t *testing.T) {
+	tests := []struct {
+		name      string
+		owed      []transfer
+		wantNet   map[string]int
+		transfers int
+	}{
+		{
+			name:      "cycle",
+			owed:      []transfer{{from: "a", to: "b", amount: 100}, {from: "b", to: "c", amount: 100}, {from: "c", to: "a", amount: 100}},
+			wantNet:   map[string]int{"a": 0, "b": 0, "c": 0},
+			transfers: 0,
+		},
+		{
+			name:      "uneven cycle",
+			owed:      []transfer{{from: "a", to: "b", amount: 300}, {from: "b", to: "c", amount: 200}, {from: "c", to: "a", amount: 100}},
+			wantNet:   map[string]int{"a": -200, "b": 100, "c": 100},
+			transfers: 2,
+		},
+		{
+			name:      "chain",
+			owed:      []transfer{{from: "a", to: "b", amount: 100}, {from: "b", to: "c", amount: 100}, {from: "c", to: "d", amount: 100}},
+			wantNet:   map[string]int{"a": -100, "b": 0, "c": 0, "d": 100},
+			transfers: 1,
+		},
+		{
+			name:      "tapering chain",
+			owed:      []transfer{{from: "a", to: "b", amount: 300}, {from: "b", to: "c", amount: 100}},
+			wantNet:   map[string]int{"a": -300, "b": 200, "c": 100},
+			transfers: 2,
+		},
+		{
+			name:      "zero-net group",
+			owed:      []transfer{{from: "a", to: "b", amount: 50}, {from: "b", to: "a", amount: 50}, {from: "c", to: "d", amount: 70}, {from: "d", to: "c", amount: 70}},
+			wantNet:   map[string]int{"a": 0, "b": 0, "c": 0, "d": 0},
+			transfers: 0,
+		},
+		{
+			name:      "star",
+			owed:      []transfer{{from: "a", to: "d", amount: 100}, {from: "b", to: "d", amount: 100}, {from: "c", to: "d", amount: 100}},
+			wantNet:   map[string]int{"a": -100, "b": -100, "c": -100, "d": 300},
+			transfers: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sheet := make(balanceSheet)
+			var userIds []string
+			for userId := range tt.wantNet {
+				userIds = append(userIds, userId)
+			}
+			for _, o := range tt.owed {
+				sheet.recordOwed(o.from, o.to, o.amount)
+			}
+			net := sheet.netPositions(userIds)
+			for _, userId := range userIds {
+				if net[userId] != tt.wantNet[userId] {
+					t.Errorf("%s nets %d before simplifying, want %d", userId, net[userId], tt.wantNet[userId])
+				}
+			}
+			transfers := sheet.simplifyDebts(userIds)
+			if len(transfers) != tt.transfers {
+				t.Errorf("got %d transfers %v, want %d", len(transfers), transfers, tt.transfers)
+			}
+			checkSimplified(t, userIds, tt.wantNet, transfers)
+		})
+	}
+}
+
+// TestSimplifyRandomLedgers records random expenses, checks their shares add
+// up to the amount to the paisa, and checks simplifying them keeps every
+// user's net position.
+func TestSimplifyRandomLedgers(t *testing.T) {
+	random := rand.New(rand.NewSource(42))
+	for round := 0; round < 200; round++ {
+		tracker := newExpenseTracker()
+		users := 2 + random.Intn(7)
+		for i := 1; i <= users; i++ {
+			tracker.users = append(tracker.users, newUser("u"+strconv.Itoa(i), "user"+strconv.Itoa(i), "", ""))
+		}
+		userIds := tracker.userIds()
+		for e := 0; e < 1+random.Intn(10); e++ {
+			payer := tracker.users[random.Intn(users)]
+			var splitWith []string
+			for _, userId := range userIds {
+				if random.Intn(2) == 0 {
+					splitWith = append(splitWith, userId)
+				}
+			}
+			if len(splitWith) == 0 {
+				splitWith = userIds[:1]
+			}
+			amount := 1 + random.Intn(500000)
+			var tr transaction
+			var err error
+			if random.Intn(2) == 0 {
+				tr, err = payer.addTransaction(EQUAL, splitWith, amount, defaultCurrency, nil)
+			} else {
+				var units []string
+				for range splitWith {
+					units = append(units, strconv.Itoa(1+random.Intn(5)))
+				}
+				tr, err = payer.addTransaction(SHARE, splitWith, amount, defaultCurrency, units)
+			}
+			if err != nil {
+				t.Fatalf("round %d: %v", round, err)
+			}
+			shared := 0
+			for _, share := range tr.getUserToSplitAmount() {
+				shared += share
+			}
+			if shared != amount {
+				t.Fatalf("round %d: shares add up to %s of %s", round, formatAmount(shared), formatAmount(amount))
+			}
+			tracker.addTransaction(tr)
+		}
+
+		net := tracker.baseBalances.netPositions(userIds)
+		checkSimplified(t, userIds, net, tracker.baseBalances.simplifyDebts(userIds))
+		if t.Failed() {
+			t.Fatalf("round %d failed", round)
+		}
+	}
+}
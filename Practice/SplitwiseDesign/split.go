@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errNoParticipants       = errors.New("an expense needs at least one participant")
+	errDuplicateParticipant = errors.New("participant listed twice")
+	errShareCount           = errors.New("one share is needed per participant")
+	errExactTotal           = errors.New("exact shares do not add up to the amount")
+	errPercentTotal         = errors.New("percentages do not add up to 100")
+	errUnknownSplitType     = errors.New("unknown split type")
+	errBadShare             = errors.New("invalid share")
+	errAdjustmentTotal      = errors.New("adjustments are more than the amount")
+	errItemisedTotal        = errors.New("items, tax and tip do not add up to the amount")
+	errBadItem              = errors.New("invalid item")
+)
+
+// splitStrategy works out each participant's share of an expense, in the
+// order of userIds and in minor units of currency. args are the words after the split type on the EXPENSE
+// line. A new split type only needs a strategy registered in splitStrategies.
+type splitStrategy interface {
+	split(amount int, currency string, userIds []string, args []string) ([]int, error)
+}
+
+var splitStrategies = map[string]splitStrategy{
+	EQUAL:      equalSplit{},
+	EXACT:      exactSplit{},
+	PERCENT:    percentSplit{},
+	SHARE:      shareSplit{},
+	ADJUSTMENT: adjustmentSplit{},
+	ITEMISED:   itemisedSplit{},
+}
+
+func validateParticipants(userIDs []string, amount int, currency string) error {
+	if amount <= 0 {
+		return fmt.Errorf("%w: %s", errInvalidAmount, formatAmountIn(amount, currency))
+	}
+	if len(userIDs) == 0 {
+		return errNoParticipants
+	}
+	seen := make(map[string]bool)
+	for _, userId := range userIDs {
+		if seen[userId] {
+			return fmt.Errorf("%w: %s", errDuplicateParticipant, userId)
+		}
+		seen[userId] = true
+	}
+	return nil
+}
+
+// allocate divides amount in proportion to weights. Every share is rounded
+// down and the paise left over go one each to the first participants with a
+// non-zero weight, so the shares always add up to amount.
+func allocate(amount int, weights []int) []int {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	shares := make([]int, len(weights))
+	if total == 0 {
+		return shares
+	}
+	remainder := amount
+	for i, w := range weights {
+		shares[i] = amount * w / total
+		remainder -= shares[i]
+	}
+	for i := 0; remainder > 0; i++ {
+		if weights[i] > 0 {
+			shares[i]++
+			remainder--
+		}
+	}
+	return shares
+}
+
+// parseShares reads one whole number per participant, such as percentages
+// or ratio units.
+func parseShares(args []string, participants int) ([]int, error) {
+	if len(args) != participants {
+		return nil, fmt.Errorf("%w: %d shares for %d participants", errShareCount, len(args), participants)
+	}
+	shares := make([]int, len(args))
+	for i, a := range args {
+		s, err := strconv.Atoi(a)
+		if err != nil || s < 0 {
+			return nil, fmt.Errorf("%w: %q", errBadShare, a)
+		}
+		shares[i] = s
+	}
+	return shares, nil
+}
+
+// parseAmounts reads one amount per participant.
+func parseAmounts(args []string, participants int, currency string) ([]int, error) {
+	if len(args) != participants {
+		return nil, fmt.Errorf("%w: %d shares for %d participants", errShareCount, len(args), participants)
+	}
+	amounts := make([]int, len(args))
+	for i, a := range args {
+		amount, err := parseAmountIn(a, currency)
+		if err != nil {
+			return nil, err
+		}
+		amounts[i] = amount
+	}
+	return amounts, nil
+}
+
+type equalSplit struct{}
+
+func (equalSplit) split(amount int, currency string, userIds []string, args []string) ([]int, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("%w: EQUAL takes no shares", errShareCount)
+	}
+	weights := make([]int, len(userIds))
+	for i := range weights {
+		weights[i] = 1
+	}
+	return allocate(amount, weights), nil
+}
+
+type exactSplit struct{}
+
+func (exactSplit) split(amount int, currency string, userIds []string, args []string) ([]int, error) {
+	shares, err := parseAmounts(args, len(userIds), currency)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, s := range shares {
+		total += s
+	}
+	if total != amount {
+		return nil, fmt.Errorf("%w: %s against %s", errExactTotal, formatAmountIn(total, currency), formatAmountIn(amount, currency))
+	}
+	return shares, nil
+}
+
+type percentSplit struct{}
+
+func (percentSplit) split(amount int, currency string, userIds []string, args []string) ([]int, error) {
+	percentages, err := parseShares(args, len(userIds))
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, p := range percentages {
+		total += p
+	}
+	if total != 100 {
+		return nil, fmt.Errorf("%w: got %d", errPercentTotal, total)
+	}
+	return allocate(amount, percentages), nil
+}
+
+// shareSplit divides by ratio units, so "SHARE 2 1 1" gives the first
+// participant half.
+type shareSplit struct{}
+
+func (shareSplit) split(amount int, currency string, userIds []string, args []string) ([]int, error) {
+	units, err := parseShares(args, len(userIds))
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, u := range units {
+		total += u
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%w: no units", errBadShare)
+	}
+	return allocate(amount, units), nil
+}
+
+// adjustmentSplit charges everyone their own extra, as in "ADJUSTMENT 0 150 0"
+// for someone who ordered an extra dish, and splits the rest equally.
+type adjustmentSplit struct{}
+
+func (adjustmentSplit) split(amount int, currency string, userIds []string, args []string) ([]int, error) {
+	extras, err := parseAmounts(args, len(userIds), currency)
+	if err != nil {
+		return nil, err
+	}
+	rest := amount
+	for _, e := range extras {
+		rest -= e
+	}
+	if rest < 0 {
+		return nil, fmt.Errorf("%w: %s over", errAdjustmentTotal, formatAmountIn(-rest, currency))
+	}
+	shares, _ := equalSplit{}.split(rest, currency, userIds, nil)
+	for i, e := range extras {
+		shares[i] += e
+	}
+	return shares, nil
+}
+
+// itemisedSplit splits a bill line by line. Each item is written
+// name=price:userId,userId and is split equally among the users listed;
+// "tax=<amount>" and "tip=<amount>" are shared in proportion to what each
+// participant's items came to.
+type itemisedSplit struct{}
+
+func (itemisedSplit) split(amount int, currency string, userIds []string, args []string) ([]int, error) {
+	index := make(map[string]int)
+	for i, userId := range userIds {
+		index[userId] = i
+	}
+	subtotals := make([]int, len(userIds))
+	total, extras := 0, 0
+	for _, a := range args {
+		name, rest, ok := strings.Cut(a, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%w: %q", errBadItem, a)
+		}
+		if name == "tax" || name == "tip" {
+			extra, err := parseAmountIn(rest, currency)
+			if err != nil {
+				return nil, err
+			}
+			extras += extra
+			total += extra
+			continue
+		}
+		priceStr, sharedBy, ok := strings.Cut(rest, ":")
+		if !ok || sharedBy == "" {
+			return nil, fmt.Errorf("%w: %q has nobody to share it", errBadItem, a)
+		}
+		price, err := parseAmountIn(priceStr, currency)
+		if err != nil {
+			return nil, err
+		}
+		var weights []int
+		var positions []int
+		for _, userId := range strings.Split(sharedBy, ",") {
+			i, ok := index[userId]
+			if !ok {
+				return nil, fmt.Errorf("%w: %q is shared by %s who is not on the expense", errBadItem, a, userId)
+			}
+			positions = append(positions, i)
+			weights = append(weights, 1)
+		}
+		if err := validateParticipants(strings.Split(sharedBy, ","), price, currency); err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", errBadItem, a, err)
+		}
+		for j, share := range allocate(price, weights) {
+			subtotals[positions[j]] += share
+		}
+		total += price
+	}
+	if total != amount {
+		return nil, fmt.Errorf("%w: %s against %s", errItemisedTotal, formatAmountIn(total, currency), formatAmountIn(amount, currency))
+	}
+	if extras > 0 && total == extras {
+		return nil, fmt.Errorf("%w: tax and tip with no items to share them by", errBadItem)
+	}
+	shares := allocate(extras, subtotals)
+	for i := range shares {
+		shares[i] += subtotals[i]
+	}
+	return shares, nil
+}
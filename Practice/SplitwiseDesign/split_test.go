@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// owed lists the balances, the group's when groupId is set, as
+// "debtor->creditor amount" lines.
+func owed(t *testing.T, tracker *expenseTracker, groupId string) []string {
+	t.Helper()
+	lines, err := tracker.balancesFor(groupId, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range lines {
+		got = append(got, l.from+"->"+l.to+" "+formatMoney(l.amount, l.currency))
+	}
+	return got
+}
+
+func checkOwed(t *testing.T, tracker *expenseTracker, want ...string) {
+	t.Helper()
+	if got := owed(t, tracker, ""); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got balances %q, want %q", got, want)
+	}
+}
+
+func TestSplitsMustAddUp(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want error
+	}{
+		{"EXPENSE u1 1000 2 u2 u3 EXACT 400 500", errExactTotal},
+		{"EXPENSE u1 1000 2 u2 u3 EXACT 600 500", errExactTotal},
+		{"EXPENSE u1 1000 2 u2 u3 EXACT 400", errShareCount},
+		{"EXPENSE u1 1000 3 u1 u2 u3 PERCENT 40 40 10", errPercentTotal},
+		{"EXPENSE u1 1000 3 u1 u2 u3 PERCENT 50 40 20", errPercentTotal},
+		{"EXPENSE u1 1000 2 u2 u2 EQUAL", errDuplicateParticipant},
+		{"EXPENSE u1 1000 0 EQUAL", errNoParticipants},
+		{"EXPENSE u1 0 2 u2 u3 EQUAL", errInvalidAmount},
+		{"EXPENSE u1 1000.005 2 u2 u3 EQUAL", errInvalidAmount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			tracker := newSampleTracker(t)
+			if err := tracker.runExpense(strings.Fields(tt.cmd)); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			// a rejected expense leaves no balances behind
+			checkOwed(t, tracker)
+		})
+	}
+}
+
+func TestSplitRemainderGoesToTheFirstParticipants(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"EXPENSE u4 100 3 u1 u2 u3 EQUAL", []string{"u1->u4 33.34", "u2->u4 33.33", "u3->u4 33.33"}},
+		{"EXPENSE u4 100 3 u3 u2 u1 EQUAL", []string{"u1->u4 33.33", "u2->u4 33.33", "u3->u4 33.34"}},
+		{"EXPENSE u4 0.02 3 u1 u2 u3 EQUAL", []string{"u1->u4 0.01", "u2->u4 0.01"}},
+		{"EXPENSE u4 100.01 2 u1 u2 PERCENT 50 50", []string{"u1->u4 50.01", "u2->u4 50"}},
+		{"EXPENSE u4 100 2 u1 u2 EXACT 66.67 33.33", []string{"u1->u4 66.67", "u2->u4 33.33"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			tracker := newSampleTracker(t)
+			if err := tracker.runExpense(strings.Fields(tt.cmd)); err != nil {
+				t.Fatal(err)
+			}
+			checkOwed(t, tracker, tt.want...)
+		})
+	}
+}
+
+func TestSplitStrategies(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"EXPENSE u4 1000 3 u1 u2 u3 SHARE 2 1 1", []string{"u1->u4 500", "u2->u4 250", "u3->u4 250"}},
+		{"EXPENSE u4 100 3 u1 u2 u3 SHARE 1 1 1", []string{"u1->u4 33.34", "u2->u4 33.33", "u3->u4 33.33"}},
+		// nobody owes for a zero share
+		{"EXPENSE u4 100 2 u1 u2 SHARE 0 3", []string{"u2->u4 100"}},
+		{"EXPENSE u4 950 3 u1 u2 u3 ADJUSTMENT 0 0 350", []string{"u1->u4 200", "u2->u4 200", "u3->u4 550"}},
+		{"EXPENSE u4 100 2 u1 u2 ADJUSTMENT 100 0", []string{"u1->u4 100"}},
+		// tax and tip are shared 300:500:200, as the items came to
+		{"EXPENSE u4 1180 3 u1 u2 u3 ITEMISED pizza=600:u1,u2 beer=400:u2,u3 tax=80 tip=100", []string{"u1->u4 354", "u2->u4 590", "u3->u4 236"}},
+		{"EXPENSE u4 100.01 2 u1 u2 ITEMISED tea=50:u1 coffee=50:u2 tax=0.01", []string{"u1->u4 50.01", "u2->u4 50"}},
+		{"EXPENSE u4 10 3 u1 u2 u3 ITEMISED cake=10:u1,u2,u3", []string{"u1->u4 3.34", "u2->u4 3.33", "u3->u4 3.33"}},
+		// u3 had nothing, so pays none of the tip
+		{"EXPENSE u4 110 3 u1 u2 u3 ITEMISED soup=100:u1,u2 tip=10", []string{"u1->u4 55", "u2->u4 55"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			tracker := newSampleTracker(t)
+			if err := tracker.runExpense(strings.Fields(tt.cmd)); err != nil {
+				t.Fatal(err)
+			}
+			checkOwed(t, tracker, tt.want...)
+		})
+	}
+}
+
+func TestSplitStrategyErrors(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want error
+	}{
+		{"EXPENSE u4 100 2 u1 u2 SHARE 1", errShareCount},
+		{"EXPENSE u4 100 2 u1 u2 SHARE 0 0", errBadShare},
+		{"EXPENSE u4 100 2 u1 u2 SHARE -1 2", errBadShare},
+		{"EXPENSE u4 100 2 u1 u2 SHARE 1.5 1", errBadShare},
+		{"EXPENSE u4 100 2 u1 u2 ADJUSTMENT 60 50", errAdjustmentTotal},
+		{"EXPENSE u4 100 2 u1 u2 ADJUSTMENT 10", errShareCount},
+		{"EXPENSE u4 100 2 u1 u2 ADJUSTMENT 10 x", errInvalidAmount},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=50:u1 coffee=40:u2", errItemisedTotal},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=50:u1 coffee=40:u2 tax=20", errItemisedTotal},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=50:u1 coffee=50", errBadItem},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=50:u1 coffee=50:", errBadItem},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=50:u1 =50:u2", errBadItem},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=50:u1 coffee", errBadItem},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=50:u1 coffee=50:u3", errBadItem},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=100:u1,u1", errBadItem},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=100:u1 coffee=0:u2", errBadItem},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=abc:u1", errInvalidAmount},
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tea=100:u1 tip=-5", errInvalidAmount},
+		// tax and tip alone have nothing to be shared by
+		{"EXPENSE u4 100 2 u1 u2 ITEMISED tax=60 tip=40", errBadItem},
+		{"EXPENSE u4 100 2 u1 u2 HALVES", errUnknownSplitType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			tracker := newSampleTracker(t)
+			if err := tracker.runExpense(strings.Fields(tt.cmd)); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			checkOwed(t, tracker)
+		})
+	}
+}
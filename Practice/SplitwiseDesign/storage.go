@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	errUnknownTransaction = errors.New("unknown transaction type")
+	errSplitTotal         = errors.New("shares do not add up to the amount")
+)
+
+// storage keeps the tracker across sessions. Balances are not stored; they
+// are rebuilt from the transactions on load.
+type storage interface {
+	load() (snapshot, error)
+	save(snapshot) error
+}
+
+type snapshot struct {
+	Users        []storedUser        `json:"users"`
+	Groups       []storedGroup       `json:"groups"`
+	Transactions []storedTransaction `json:"transactions"`
+	Audit        []storedAuditEntry  `json:"audit"`
+	LastId       int                 `json:"lastId"`
+	Simplify     bool                `json:"simplify"`
+	Recurring    []storedRecurring   `json:"recurring"`
+	Debts        []storedDebt        `json:"debts"`
+	Reminders    *storedReminders    `json:"reminders,omitempty"`
+}
+
+type storedRecurring struct {
+	Id          string    `json:"id"`
+	Cmd         []string  `json:"cmd"`
+	Frequency   string    `json:"frequency"`
+	Start       time.Time `json:"start"`
+	Occurrences int       `json:"occurrences"`
+	Stopped     bool      `json:"stopped"`
+}
+
+// storedDebt keeps how old a debt is and when its debtor was last reminded,
+// so a restart neither resets the age nor reminds again early.
+type storedDebt struct {
+	Debtor       string     `json:"debtor"`
+	Creditor     string     `json:"creditor"`
+	Since        time.Time  `json:"since"`
+	LastReminded *time.Time `json:"lastReminded,omitempty"`
+}
+
+type storedReminders struct {
+	Threshold int           `json:"threshold"`
+	MaxAge    time.Duration `json:"maxAge"`
+	Every     time.Duration `json:"every"`
+}
+
+type storedUser struct {
+	UserId       string `json:"userId"`
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	MobileNumber string `json:"mobileNumber"`
+}
+
+// storedGroup and storedTransaction leave out the currency in files saved
+// before there was more than one; those are in the default currency.
+type storedGroup struct {
+	GroupId      string   `json:"groupId"`
+	Name         string   `json:"name"`
+	Members      []string `json:"members"`
+	Simplify     bool     `json:"simplify"`
+	BaseCurrency string   `json:"baseCurrency,omitempty"`
+}
+
+// storedTransaction keeps the shares as well as the split arguments so
+// loading never depends on how a split type rounds today.
+type storedTransaction struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	PaidBy    string    `json:"paidBy"`
+	Amount    int       `json:"amount"`
+	UserIds   []string  `json:"userIds"`
+	Splits    []int     `json:"splits"`
+	SplitArgs []string  `json:"splitArgs,omitempty"`
+	GroupId   string    `json:"groupId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Currency  string    `json:"currency,omitempty"`
+	// Rates are the ones the transaction was recorded at.
+	Rates map[string]int64 `json:"rates,omitempty"`
+}
+
+type storedAuditEntry struct {
+	At            time.Time `json:"at"`
+	TransactionId string    `json:"transactionId"`
+	UserId        string    `json:"userId"`
+	Action        string    `json:"action"`
+	Detail        string    `json:"detail"`
+}
+
+// fileStorage keeps the tracker as one JSON file. A save writes a temporary
+// file and renames it over the old one, so a crash leaves either the old
+// state or the new, never half of each.
+type fileStorage struct {
+	path string
+}
+
+func newFileStorage(path string) *fileStorage {
+	return &fileStorage{path: path}
+}
+
+// load returns an empty snapshot if nothing has been saved yet.
+func (d *fileStorage) load() (snapshot, error) {
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot{}, nil
+	}
+	if err != nil {
+		return snapshot{}, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return snapshot{}, fmt.Errorf("%s: %w", d.path, err)
+	}
+	return s, nil
+}
+
+func (d *fileStorage) save(s snapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path)
+}
+
+func (d *expenseTracker) snapshot() (snapshot, error) {
+	s := snapshot{LastId: d.lastId, Simplify: d.simplify}
+	for _, u := range d.users {
+		s.Users = append(s.Users, storedUser{UserId: u.userId, Name: u.name, Email: u.email, MobileNumber: u.mobileNumber})
+	}
+	for _, g := range d.groups {
+		s.Groups = append(s.Groups, storedGroup{GroupId: g.groupId, Name: g.name, Members: g.members, Simplify: g.simplify, BaseCurrency: g.baseCurrency})
+	}
+	for _, t := range d.transactions {
+		base, splitArgs, err := baseOf(t)
+		if err != nil {
+			return snapshot{}, err
+		}
+		s.Transactions = append(s.Transactions, storedTransaction{
+			Id:        base.id,
+			Type:      base.transactionType,
+			PaidBy:    base.whoPaid,
+			Amount:    base.amount,
+			UserIds:   base.userIds,
+			Splits:    base.splits,
+			SplitArgs: splitArgs,
+			GroupId:   base.groupId,
+			CreatedAt: base.createdAt,
+			Currency:  base.currency,
+			Rates:     base.rates,
+		})
+	}
+	for _, e := range d.audit {
+		s.Audit = append(s.Audit, storedAuditEntry{At: e.at, TransactionId: e.transactionId, UserId: e.userId, Action: e.action, Detail: e.detail})
+	}
+	for _, r := range d.recurring {
+		s.Recurring = append(s.Recurring, storedRecurring{Id: r.id, Cmd: r.cmd, Frequency: r.frequency, Start: r.start, Occurrences: r.occurrences, Stopped: r.stopped})
+	}
+	for pair, since := range d.owingSince {
+		stored := storedDebt{Debtor: pair.debtor, Creditor: pair.creditor, Since: since}
+		if last, ok := d.lastReminded[pair]; ok {
+			stored.LastReminded = &last
+		}
+		s.Debts = append(s.Debts, stored)
+	}
+	sort.Slice(s.Debts, func(i, j int) bool {
+		if s.Debts[i].Debtor != s.Debts[j].Debtor {
+			return s.Debts[i].Debtor < s.Debts[j].Debtor
+		}
+		return s.Debts[i].Creditor < s.Debts[j].Creditor
+	})
+	if d.reminders != nil {
+		s.Reminders = &storedReminders{Threshold: d.reminders.threshold, MaxAge: d.reminders.maxAge, Every: d.reminders.every}
+	}
+	return s, nil
+}
+
+func baseOf(t transaction) (*baseTransaction, []string, error) {
+	switch t := t.(type) {
+	case *expenseTransaction:
+		return &t.baseTransaction, t.splitArgs, nil
+	case *settlementTransaction:
+		return &t.baseTransaction, nil, nil
+	}
+	return nil, nil, fmt.Errorf("%w: %T", errUnknownTransaction, t)
+}
+
+// restoreTracker rebuilds a tracker from a snapshot and replays its
+// transactions onto the balances. A transaction whose shares do not add up,
+// or that names someone who is not a user, means the file is corrupt and
+// nothing is loaded.
+func restoreTracker(s snapshot) (*expenseTracker, error) {
+	d := newExpenseTracker()
+	d.lastId, d.simplify = s.LastId, s.Simplify
+	for _, u := range s.Users {
+		if err := d.addUser(newUser(u.UserId, u.Name, u.Email, u.MobileNumber)); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range s.Groups {
+		if _, err := d.createGroup(g.GroupId, g.Name, g.Members); err != nil {
+			return nil, err
+		}
+		restored := d.groups[len(d.groups)-1]
+		restored.simplify = g.Simplify
+		if g.BaseCurrency != "" {
+			if err := validCurrency(g.BaseCurrency); err != nil {
+				return nil, fmt.Errorf("group %s: %w", g.GroupId, err)
+			}
+			restored.baseCurrency = g.BaseCurrency
+		}
+	}
+	for _, st := range s.Transactions {
+		if _, err := d.getUser(st.PaidBy); err != nil {
+			return nil, fmt.Errorf("transaction %s: %w", st.Id, err)
+		}
+		if st.GroupId != "" {
+			if _, err := d.getGroup(st.GroupId); err != nil {
+				return nil, fmt.Errorf("transaction %s: %w", st.Id, err)
+			}
+		}
+		if len(st.UserIds) != len(st.Splits) {
+			return nil, fmt.Errorf("transaction %s: %w", st.Id, errShareCount)
+		}
+		total := 0
+		for i, userId := range st.UserIds {
+			if _, err := d.getUser(userId); err != nil {
+				return nil, fmt.Errorf("transaction %s: %w", st.Id, err)
+			}
+			total += st.Splits[i]
+		}
+		if total != st.Amount {
+			return nil, fmt.Errorf("transaction %s: %w: %d of %d", st.Id, errSplitTotal, total, st.Amount)
+		}
+		currency := st.Currency
+		if currency == "" {
+			currency = defaultCurrency
+		}
+		if err := validCurrency(currency); err != nil {
+			return nil, fmt.Errorf("transaction %s: %w", st.Id, err)
+		}
+		var t transaction
+		var base *baseTransaction
+		if st.Type == SETTLEMENT {
+			settlement := &settlementTransaction{}
+			t, base = settlement, &settlement.baseTransaction
+		} else {
+			expense := &expenseTransaction{splitArgs: st.SplitArgs}
+			t, base = expense, &expense.baseTransaction
+		}
+		base.id, base.transactionType, base.whoPaid, base.amount, base.groupId, base.createdAt = st.Id, st.Type, st.PaidBy, st.Amount, st.GroupId, st.CreatedAt
+		base.currency, base.rates = currency, st.Rates
+		for _, target := range []string{defaultCurrency, d.baseCurrencyOf(st.GroupId)} {
+			if t.rateTo(target) == 0 {
+				return nil, fmt.Errorf("transaction %s: %w: %s to %s", st.Id, errNoRate, currency, target)
+			}
+		}
+		t.addUserIds(st.UserIds)
+		t.addSplits(st.Splits)
+		t.updateSplit()
+		d.transactions = append(d.transactions, t)
+		d.applyShares(t, 1)
+	}
+	for _, e := range s.Audit {
+		d.audit = append(d.audit, auditEntry{at: e.At, transactionId: e.TransactionId, userId: e.UserId, action: e.Action, detail: e.Detail})
+	}
+	for _, r := range s.Recurring {
+		d.recurring = append(d.recurring, &recurringExpense{id: r.Id, cmd: r.Cmd, frequency: r.Frequency, start: r.Start, occurrences: r.Occurrences, stopped: r.Stopped})
+	}
+	// the replay above dated the debts by transaction; the saved dates also
+	// allow for edits and deletes
+	d.owingSince = make(map[debt]time.Time)
+	for _, stored := range s.Debts {
+		pair := debt{stored.Debtor, stored.Creditor}
+		d.owingSince[pair] = stored.Since
+		if stored.LastReminded != nil {
+			d.lastReminded[pair] = *stored.LastReminded
+		}
+	}
+	if s.Reminders != nil {
+		d.reminders = &reminderPolicy{threshold: s.Reminders.Threshold, maxAge: s.Reminders.MaxAge, every: s.Reminders.Every}
+	}
+	return d, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runDemo returns a tracker that has run every demo command.
+func runDemo(t *testing.T) *expenseTracker {
+	t.Helper()
+	tracker := newDemoTracker()
+	for _, cmd := range demoCommands {
+		tracker.runCommand(cmd)
+	}
+	return tracker
+}
+
+func mustSnapshot(t *testing.T, tracker *expenseTracker) snapshot {
+	t.Helper()
+	s, err := tracker.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// sameTracker compares everything a user can see: the stored state and every
+// balance, overall and in each group.
+func sameTracker(t *testing.T, want, got *expenseTracker) {
+	t.Helper()
+	wantJSON, _ := json.Marshal(mustSnapshot(t, want))
+	gotJSON, _ := json.Marshal(mustSnapshot(t, got))
+	if string(wantJSON) != string(gotJSON) {
+		t.Fatal("snapshots differ")
+	}
+	scopes := []string{""}
+	for _, g := range want.groups {
+		scopes = append(scopes, g.groupId)
+	}
+	for _, groupId := range scopes {
+		for _, inBase := range []bool{false, true} {
+			wantLines, _ := want.balancesFor(groupId, "", inBase)
+			gotLines, _ := got.balancesFor(groupId, "", inBase)
+			if fmt.Sprint(wantLines) != fmt.Sprint(gotLines) {
+				t.Fatalf("balances in %q differ: %v and %v", groupId, wantLines, gotLines)
+			}
+		}
+	}
+}
+
+func TestFileStorageRoundTripsTheDemo(t *testing.T) {
+	store := newFileStorage(filepath.Join(t.TempDir(), "splitwise.json"))
+	original := runDemo(t)
+	if err := store.save(mustSnapshot(t, original)); err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := restoreTracker(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameTracker(t, original, reloaded)
+}
+
+func TestFileStorageStartsEmpty(t *testing.T) {
+	s, err := newFileStorage(filepath.Join(t.TempDir(), "missing.json")).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := restoreTracker(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracker.users) != 0 || len(tracker.transactions) != 0 {
+		t.Fatalf("loaded %d users and %d transactions from nothing", len(tracker.users), len(tracker.transactions))
+	}
+}
+
+func TestRestoreRejectsCorruptTransactions(t *testing.T) {
+	at := time.Date(2024, time.January, 31, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		transaction storedTransaction
+		want        error
+	}{
+		{
+			name:        "shares short of the amount",
+			transaction: storedTransaction{Id: "E1", Type: EQUAL, PaidBy: "u1", Amount: 1000, UserIds: []string{"u1", "u2"}, Splits: []int{500, 400}, CreatedAt: at},
+			want:        errSplitTotal,
+		},
+		{
+			name:        "shares over the amount",
+			transaction: storedTransaction{Id: "E1", Type: SETTLEMENT, PaidBy: "u1", Amount: 100, UserIds: []string{"u2"}, Splits: []int{200}, CreatedAt: at},
+			want:        errSplitTotal,
+		},
+		{
+			name:        "unknown participant",
+			transaction: storedTransaction{Id: "E1", Type: EQUAL, PaidBy: "u1", Amount: 1000, UserIds: []string{"u1", "u9"}, Splits: []int{500, 500}, CreatedAt: at},
+			want:        errUserNotFound,
+		},
+		{
+			name:        "unknown payer",
+			transaction: storedTransaction{Id: "E1", Type: EQUAL, PaidBy: "u9", Amount: 1000, UserIds: []string{"u1", "u2"}, Splits: []int{500, 500}, CreatedAt: at},
+			want:        errUserNotFound,
+		},
+		{
+			name:        "a share missing",
+			transaction: storedTransaction{Id: "E1", Type: EQUAL, PaidBy: "u1", Amount: 1000, UserIds: []string{"u1", "u2"}, Splits: []int{1000}, CreatedAt: at},
+			want:        errShareCount,
+		},
+		{
+			name:        "foreign currency without a rate",
+			transaction: storedTransaction{Id: "E1", Type: EQUAL, PaidBy: "u1", Amount: 1000, UserIds: []string{"u1", "u2"}, Splits: []int{500, 500}, CreatedAt: at, Currency: "USD"},
+			want:        errNoRate,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := snapshot{
+				Users:        []storedUser{{UserId: "u1", Name: "u1"}, {UserId: "u2", Name: "u2"}},
+				Transactions: []storedTransaction{tt.transaction},
+				LastId:       1,
+			}
+			if _, err := restoreTracker(s); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// giftTransaction is a transaction type storage does not know about.
+type giftTransaction struct {
+	baseTransaction
+}
+
+func TestSnapshotRejectsUnknownTransactions(t *testing.T) {
+	tracker := newExpenseTracker()
+	tracker.addUser(newUser("u1", "u1", "", ""))
+	gift := &giftTransaction{}
+	gift.whoPaid = "u1"
+	tracker.transactions = append(tracker.transactions, gift)
+	if _, err := tracker.snapshot(); !errors.Is(err, errUnknownTransaction) {
+		t.Fatalf("got %v, want %v", err, errUnknownTransaction)
+	}
+}